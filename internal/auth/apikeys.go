@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"strings"
+	"time"
+
+	"rekazdrive/internal/db"
+)
+
+// APIKeyPrefix starts every API key, so AuthMiddleware can tell them from JWTs
+// and secret scanners can find leaked ones
+const APIKeyPrefix = "rkz_"
+
+// the stored prefix, rkz_ and 8 random characters, enough to tell keys apart
+const apiKeyShownLen = len(APIKeyPrefix) + 8
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// NewAPIKey makes a key for the user, the key itself is returned once and
+// only its hash is kept. A zero expiresAt never expires.
+func NewAPIKey(userID, name string, scopes []string, expiresAt, now time.Time) (string, *db.APIKey, error) {
+	id, err := NewTokenID()
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	key := APIKeyPrefix + secret
+	return key, &db.APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Prefix:    key[:apiKeyShownLen],
+		Hash:      HashToken(key),
+		Scope:     strings.Join(scopes, " "),
+		CreatedAt: now.UTC(),
+		ExpiresAt: expiresAt,
+	}, nil
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public key as RFC 7517 has it, only the kinds Keyring signs with
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	N string `json:"n,omitempty"` // RSA
+	E string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"` // EC and OKP
+	X string `json:"x,omitempty"`
+	Y string `json:"y,omitempty"` // EC only
+}
+
+// JWKS is what /.well-known/jwks.json serves
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// NewJWK describes a public key for the JWKS
+func NewJWK(kid, alg string, pub crypto.PublicKey) (JWK, error) {
+	jwk := JWK{Kid: kid, Use: "sig", Alg: alg}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(pub.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = b64.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64.EncodeToString(pub)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return jwk, nil
+}
+
+// PublicKey is the key a JWK describes
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := func(name, v string) ([]byte, error) {
+		b, err := b64.DecodeString(v)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("key %s: invalid %s", j.Kid, name)
+		}
+		return b, nil
+	}
+
+	switch j.Kty {
+	case "RSA":
+		n, err := decode("n", j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", j.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %s: invalid e", j.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %s: unsupported curve %q", j.Kid, j.Crv)
+		}
+		x, err := decode("x", j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", j.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("key %s: point is not on the curve", j.Kid)
+		}
+		return pub, nil
+	case "OKP":
+		x, err := decode("x", j.X)
+		if err != nil {
+			return nil, err
+		}
+		if j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s: unsupported OKP key", j.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported key type %q", j.Kid, j.Kty)
+}
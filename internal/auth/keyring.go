@@ -0,0 +1,394 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"rekazdrive/internal/db"
+)
+
+// the algorithms access tokens can be signed with, JWT_ALGORITHM
+const (
+	AlgHS256 = "HS256" // JWT_SECRET, whoever verifies tokens can mint them too
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// an unknown kid reloads the keys at most this often, it may be a key another
+// replica just made or just garbage
+const keyReloadInterval = 10 * time.Second
+
+// Keyring signs access tokens and finds the key to verify them by kid. With
+// HS256 it is just JWT_SECRET. The other algorithms use key pairs kept in the
+// metadata store: each key signs for Rotation, then a new one takes over and
+// the old one keeps verifying for Overlap, until the last token it signed has
+// expired. The public keys are served as a JWKS.
+//
+// The private keys are sealed (AES-256-GCM) with the current master key
+// before they reach the store, bound to their kid and algorithm. Keys sealed
+// with an older master key, or from before sealing, are sealed again with the
+// current one on the next Rotate.
+type Keyring struct {
+	Algorithm string
+	Rotation time.Duration
+	Overlap time.Duration // at least the access token lifetime
+
+	secret []byte // HS256 only
+	store db.SigningKeyStore
+	masters map[string]cipher.AEAD
+	master string // master key new keys are sealed with
+
+	rotating sync.Mutex // one new key at a time from this process
+
+	mu sync.RWMutex
+	keys []*signingKey // newest first
+	loadedAt time.Time
+}
+
+type signingKey struct {
+	kid string
+	alg string
+	private crypto.Signer
+	retiresAt time.Time
+	masterKeyID string
+}
+
+// MinSecretLen is the shortest JWT_SECRET that's accepted, 256 bits as HS256 uses
+const MinSecretLen = 32
+
+// CheckSecret refuses an empty, short or well-known JWT_SECRET, whoever
+// guesses it can sign tokens for any user
+func CheckSecret(secret string) error {
+	switch {
+	case secret == "":
+		return fmt.Errorf("JWT_SECRET is not set")
+	case slices.Contains(knownPasswords, strings.ToLower(secret)):
+		return fmt.Errorf("JWT_SECRET is a well-known default")
+	case len(secret) < MinSecretLen:
+		return fmt.Errorf("JWT_SECRET is shorter than %d bytes", MinSecretLen)
+	}
+	return nil
+}
+
+func NewHMACKeyring(secret string) *Keyring {
+	return &Keyring{Algorithm: AlgHS256, secret: []byte(secret)}
+}
+
+// NewKeyring seals new keys with masters[current], the other master keys are
+// only used to open keys that weren't sealed again yet
+func NewKeyring(alg string, store db.SigningKeyStore, masters map[string][]byte, current string, rotation, overlap time.Duration) (*Keyring, error) {
+	if alg != AlgRS256 && alg != AlgES256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("algorithm must be one of %s, %s, %s or %s", AlgHS256, AlgRS256, AlgES256, AlgEdDSA)
+	}
+	if rotation <= 0 || overlap <= 0 {
+		return nil, fmt.Errorf("rotation and overlap must be positive")
+	}
+	if _, ok := masters[current]; !ok {
+		return nil, fmt.Errorf("master key %q is not configured", current)
+	}
+
+	k := &Keyring{Algorithm: alg, Rotation: rotation, Overlap: overlap, store: store, masters: map[string]cipher.AEAD{}, master: current}
+	for id, key := range masters {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 bytes, got %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.masters[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// sealKey encrypts the PKCS #8 DER of a key as nonce || ciphertext
+func (k *Keyring) sealKey(kid, alg string, der []byte) ([]byte, error) {
+	aead := k.masters[k.master]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, der, []byte(kid+" "+alg)), nil
+}
+
+// openKey returns the PKCS #8 DER of a stored key
+func (k *Keyring) openKey(row db.SigningKey) ([]byte, error) {
+	if row.MasterKeyID == "" {
+		return row.PrivateKey, nil // from before sealing
+	}
+	aead, ok := k.masters[row.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", row.MasterKeyID)
+	}
+	if len(row.PrivateKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed key is too short")
+	}
+	nonce, sealed := row.PrivateKey[:aead.NonceSize()], row.PrivateKey[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(row.KID+" "+row.Algorithm))
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	switch alg {
+	case AlgRS256:
+		return jwt.SigningMethodRS256
+	case AlgES256:
+		return jwt.SigningMethodES256
+	case AlgEdDSA:
+		return jwt.SigningMethodEdDSA
+	}
+	return nil
+}
+
+// Load reads the keys from the store, keys other replicas made show up with it
+func (k *Keyring) Load(now time.Time) error {
+	if k.store == nil {
+		return nil
+	}
+	rows, err := k.store.ListSigningKeys(now)
+	if err != nil {
+		return err
+	}
+
+	// a key that does not open (its master key was dropped from the config) is
+	// left out, tokens it signed stop verifying but the others keep working
+	keys := make([]*signingKey, 0, len(rows))
+	skipped := 0
+	for _, row := range rows {
+		key, err := k.parseKey(row)
+		if err != nil {
+			log.Printf("keyring: skipping signing key %s: %v", row.KID, err)
+			skipped++
+			continue
+		}
+		keys = append(keys, key)
+	}
+	// if none of the configured algorithm opened the master keys are most likely
+	// wrong, better to stop than to quietly sign with a new key. A retired one
+	// counts, Rotate replaces it.
+	if skipped > 0 && !slices.ContainsFunc(keys, func(key *signingKey) bool { return key.alg == k.Algorithm }) {
+		return fmt.Errorf("no usable signing key left, %d could not be opened", skipped)
+	}
+
+	k.mu.Lock()
+	k.keys, k.loadedAt = keys, time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *Keyring) parseKey(row db.SigningKey) (*signingKey, error) {
+	der, err := k.openKey(row)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok || signingMethod(row.Algorithm) == nil {
+		return nil, fmt.Errorf("unsupported %s key", row.Algorithm)
+	}
+	return &signingKey{kid: row.KID, alg: row.Algorithm, private: private, retiresAt: row.RetiresAt, masterKeyID: row.MasterKeyID}, nil
+}
+
+// Rotate makes a new key once the current one has retired, or when there is
+// none yet. main calls it on a schedule, Sign too when it finds no key.
+func (k *Keyring) Rotate(now time.Time) error {
+	if k.store == nil {
+		return nil
+	}
+	k.rotating.Lock()
+	defer k.rotating.Unlock()
+
+	if err := k.Load(now); err != nil {
+		return err
+	}
+	if err := k.reseal(); err != nil {
+		return err
+	}
+	if k.current(now) != nil {
+		return nil
+	}
+
+	private, err := generateKey(k.Algorithm)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	kid, err := NewTokenID()
+	if err != nil {
+		return err
+	}
+	sealed, err := k.sealKey(kid, k.Algorithm, der)
+	if err != nil {
+		return err
+	}
+	err = k.store.CreateSigningKey(&db.SigningKey{
+		KID:         kid,
+		Algorithm:   k.Algorithm,
+		PrivateKey:  sealed,
+		MasterKeyID: k.master,
+		CreatedAt:   now.UTC(),
+		RetiresAt:   now.Add(k.Rotation).UTC(),
+		ExpiresAt:   now.Add(k.Rotation + k.Overlap).UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return k.Load(now)
+}
+
+// reseal seals the loaded keys that aren't sealed with the current master key
+// yet. Until then they still open with the old one, so a replica that does it
+// first is as good as any.
+func (k *Keyring) reseal() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		if key.masterKeyID == k.master {
+			continue
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key.private)
+		if err != nil {
+			return err
+		}
+		sealed, err := k.sealKey(key.kid, key.alg, der)
+		if err != nil {
+			return err
+		}
+		if err := k.store.ResealSigningKey(key.kid, k.master, sealed); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("signing key %s: %v", key.kid, err)
+		}
+		key.masterKeyID = k.master
+	}
+	return nil
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case AlgRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+// current is the newest key of the algorithm that hasn't retired yet, if any.
+// After JWT_ALGORITHM changed, keys of the old one only verify.
+func (k *Keyring) current(now time.Time) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.alg == k.Algorithm && key.retiresAt.After(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) find(kid string) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// Sign signs the claims with the current key and puts its kid in the header
+func (k *Keyring) Sign(claims jwt.Claims, now time.Time) (string, error) {
+	if k.secret != nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+
+	key := k.current(now)
+	if key == nil {
+		if err := k.Rotate(now); err != nil {
+			return "", err
+		}
+		if key = k.current(now); key == nil {
+			return "", fmt.Errorf("no signing key")
+		}
+	}
+	token := jwt.NewWithClaims(signingMethod(key.alg), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Keyfunc picks the key to verify a token with, for jwt.Parse. The token's
+// alg must be the key's, so a public key is never taken for an HMAC secret.
+func (k *Keyring) Keyfunc(t *jwt.Token) (interface{}, error) {
+	if k.secret != nil {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return k.secret, nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	key := k.find(kid)
+	if key == nil && kid != "" && k.reloadDue() {
+		if err := k.Load(time.Now()); err != nil {
+			return nil, err
+		}
+		key = k.find(kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if t.Method.Alg() != key.alg {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.private.Public(), nil
+}
+
+func (k *Keyring) reloadDue() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return time.Since(k.loadedAt) >= keyReloadInterval
+}
+
+// JWKS lists the public keys that still verify, none for HS256
+func (k *Keyring) JWKS() (JWKS, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk, err := NewJWK(key.kid, key.alg, key.private.Public())
+		if err != nil {
+			return JWKS{}, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
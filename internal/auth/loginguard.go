@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"rekazdrive/internal/db"
+)
+
+// LoginPolicy says how many failed logins a username and an address get
+// before they are locked, and for how long. Every failure past the limit
+// doubles the lock, up to MaxDelay.
+type LoginPolicy struct {
+	UserAttempts int // failures of one username, from anywhere
+	IPAttempts int // failures from one address, for any usernames
+	BaseDelay time.Duration // the first lock
+	MaxDelay time.Duration
+	Window time.Duration // a key without failures for this long starts over
+}
+
+var DefaultLoginPolicy = LoginPolicy{
+	UserAttempts: 5,
+	IPAttempts:   20,
+	BaseDelay:    time.Second,
+	MaxDelay:     15 * time.Minute,
+	Window:       time.Hour,
+}
+
+// LoginGuard throttles password logins per username and per client address.
+// The counts are kept in the metadata store so every replica sees them.
+type LoginGuard struct {
+	Policy LoginPolicy
+	store db.LoginThrottleStore
+}
+
+func NewLoginGuard(store db.LoginThrottleStore, policy LoginPolicy) *LoginGuard {
+	return &LoginGuard{Policy: policy, store: store}
+}
+
+// UserThrottleKey and IPThrottleKey are the keys failures are counted under
+func UserThrottleKey(username string) string {
+	return "user:" + username
+}
+
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long until username may try to log in from ip, 0 if it may now
+func (g *LoginGuard) Check(username, ip string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range []string{UserThrottleKey(username), IPThrottleKey(ip)} {
+		f, err := g.store.GetLoginFailures(key)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, f.LockedUntil.Sub(now))
+	}
+	return wait, nil
+}
+
+// Failed counts a failed login and locks the username or the address once
+// they are past their attempts, every lock is recorded. It returns how long
+// the next try has to wait, 0 if it doesn't.
+func (g *LoginGuard) Failed(username, ip string, now time.Time) (time.Duration, error) {
+	limits := []struct {
+		key string
+		attempts int
+	}{
+		{UserThrottleKey(username), g.Policy.UserAttempts},
+		{IPThrottleKey(ip), g.Policy.IPAttempts},
+	}
+
+	var wait time.Duration
+	for _, l := range limits {
+		failures, err := g.store.AddLoginFailure(l.key, now, now.Add(-g.Policy.Window))
+		if err != nil {
+			return 0, err
+		}
+		if failures < l.attempts {
+			continue
+		}
+
+		delay := g.delay(failures - l.attempts)
+		id, err := NewTokenID()
+		if err != nil {
+			return 0, err
+		}
+		err = g.store.LockLogin(&db.Lockout{
+			ID:          id,
+			Key:         l.key,
+			Failures:    failures,
+			CreatedAt:   now,
+			LockedUntil: now.Add(delay),
+		})
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, delay)
+	}
+	return wait, nil
+}
+
+// delay is the lock after the n-th failure past the limit
+func (g *LoginGuard) delay(n int) time.Duration {
+	delay := g.Policy.BaseDelay
+	for i := 0; i < n && delay < g.Policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, g.Policy.MaxDelay)
+}
+
+// Reset forgets the failures of username and lifts its lock, after a login
+// or by an admin. Those of the address stay, one account of its own mustn't
+// let a client go on guessing the passwords of others.
+func (g *LoginGuard) Reset(username string) error {
+	return g.store.ClearLoginFailures(UserThrottleKey(username))
+}
+
+// Cleanup forgets the keys that start over anyway and aren't locked
+func (g *LoginGuard) Cleanup(now time.Time) (int, error) {
+	return g.store.DeleteStaleLoginFailures(now.Add(-g.Policy.Window), now)
+}
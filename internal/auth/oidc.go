@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCConfig is an external identity provider whose tokens AuthMiddleware
+// accepts next to its own
+type OIDCConfig struct {
+	Issuer string // must match the provider's iss exactly
+	Audience string // usually the client id
+	UsernameClaim string // becomes the local username, empty = email
+	GroupsClaim string // empty = groups
+	RoleGroups map[string]string // provider group -> role, the highest one wins
+	DefaultRole string // for users in none of RoleGroups, empty refuses them
+	ClockSkew time.Duration // leeway for exp, nbf and iat
+
+	// an unknown kid fetches the JWKS again, at most this often, empty = 10s
+	RefreshInterval time.Duration
+	Client *http.Client // empty = a client with a 10s timeout
+}
+
+// the JWKS is fetched again after this long even without an unknown kid, so
+// keys the provider dropped stop working
+const jwksMaxAge = time.Hour
+
+// the algorithms providers sign ID and access tokens with
+var oidcMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Identity is who a provider's token says the caller is
+type Identity struct {
+	Subject string
+	Username string // from UsernameClaim, normalised
+	Groups []string
+	Role string // from RoleGroups or DefaultRole
+}
+
+var ErrNoRole = errors.New("no role for this account")
+
+// OIDCProvider verifies tokens of one issuer with its published keys. The
+// discovery document and the JWKS are fetched on first use and cached.
+type OIDCProvider struct {
+	cfg OIDCConfig
+
+	mu sync.Mutex
+	jwksURI string
+	keys map[string]crypto.PublicKey // kid -> key
+	fetchedAt time.Time // of the last try, failed ones count too
+}
+
+func NewOIDCProvider(cfg OIDCConfig) (*OIDCProvider, error) {
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, fmt.Errorf("issuer and audience are required")
+	}
+	if cfg.DefaultRole != "" {
+		if err := ValidateRole(cfg.DefaultRole); err != nil {
+			return nil, err
+		}
+	}
+	for group, role := range cfg.RoleGroups {
+		if err := ValidateRole(role); err != nil {
+			return nil, fmt.Errorf("group %s: %v", group, err)
+		}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "email"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = 10 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OIDCProvider{cfg: cfg}, nil
+}
+
+// ParseRoleGroups reads "group:role,..." pairs, e.g. "drive-admins:admin,staff:reader"
+func ParseRoleGroups(v string) (map[string]string, error) {
+	groups := map[string]string{}
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not group:role", item)
+		}
+		if err := ValidateRole(item[i+1:]); err != nil {
+			return nil, fmt.Errorf("%q: %v", item, err)
+		}
+		groups[item[:i]] = item[i+1:]
+	}
+	return groups, nil
+}
+
+// Issuer is the iss the provider's tokens carry
+func (p *OIDCProvider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// Discover fetches the discovery document and the JWKS. Verify does it too if
+// it hasn't happened yet, calling it at startup only finds problems early.
+func (p *OIDCProvider) Discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discover(ctx)
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) error {
+	p.fetchedAt = time.Now()
+	var doc struct {
+		Issuer string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	url := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, url, &doc); err != nil {
+		return err
+	}
+	// a document for another issuer would let that issuer's keys in
+	if doc.Issuer != p.cfg.Issuer {
+		return fmt.Errorf("discovery document is for issuer %q, not %q", doc.Issuer, p.cfg.Issuer)
+	}
+	if doc.JWKSURI == "" {
+		return fmt.Errorf("discovery document has no jwks_uri")
+	}
+	p.jwksURI = doc.JWKSURI
+	return p.fetchKeys(ctx)
+}
+
+func (p *OIDCProvider) fetchKeys(ctx context.Context) error {
+	p.fetchedAt = time.Now()
+	var jwks JWKS
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// keys of a kind we don't know are skipped, the others still work
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = pub
+	}
+	p.keys = keys
+	return nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the key for kid, fetching the JWKS again when kid is unknown
+// or the cached one is old. A provider that is down is asked at most every
+// RefreshInterval, not on every request.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	age := time.Since(p.fetchedAt)
+	if p.jwksURI == "" {
+		if age < p.cfg.RefreshInterval {
+			return nil, fmt.Errorf("provider %s isn't reachable", p.cfg.Issuer)
+		}
+		if err := p.discover(ctx); err != nil {
+			return nil, err
+		}
+		age = 0
+	}
+	if _, ok := p.keys[kid]; (!ok && age >= p.cfg.RefreshInterval) || age >= jwksMaxAge {
+		if err := p.fetchKeys(ctx); err != nil {
+			return nil, err
+		}
+	}
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	return key, nil
+}
+
+// Verify checks a token of the provider and says who it belongs to
+func (p *OIDCProvider) Verify(ctx context.Context, tokenString string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods(oidcMethods),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(p.cfg.ClockSkew),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("token has no sub")
+	}
+	// an address the provider hasn't verified could be anyone's
+	if verified, ok := claims["email_verified"].(bool); ok && !verified && p.cfg.UsernameClaim == "email" {
+		return nil, fmt.Errorf("email is not verified")
+	}
+	name, _ := claims[p.cfg.UsernameClaim].(string)
+	username := NormaliseUsername(name)
+	if err := ValidateUsername(username); err != nil {
+		return nil, fmt.Errorf("claim %s: %v", p.cfg.UsernameClaim, err)
+	}
+
+	identity := &Identity{Subject: subject, Username: username, Groups: stringsClaim(claims[p.cfg.GroupsClaim])}
+	identity.Role = p.role(identity.Groups)
+	if identity.Role == "" {
+		return nil, ErrNoRole
+	}
+	return identity, nil
+}
+
+// role is the highest role the groups map to, or DefaultRole
+func (p *OIDCProvider) role(groups []string) string {
+	best := ""
+	for _, group := range groups {
+		role, ok := p.cfg.RoleGroups[group]
+		if ok && (best == "" || roleRank(role) < roleRank(best)) {
+			best = role
+		}
+	}
+	if best == "" {
+		return p.cfg.DefaultRole
+	}
+	return best
+}
+
+// roles are listed highest first
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return len(roles)
+}
+
+// stringsClaim reads a claim that is a list of strings or a single one,
+// groups that aren't valid group names are dropped
+func stringsClaim(v any) []string {
+	var items []string
+	switch v := v.(type) {
+	case string:
+		items = []string{v}
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				items = append(items, s)
+			}
+		}
+	}
+	groups := []string{}
+	for _, item := range items {
+		if ValidateGroup(item) == nil {
+			groups = append(groups, item)
+		}
+	}
+	return groups
+}
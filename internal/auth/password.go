@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passwords are hashed with argon2id and stored in the usual PHC string form,
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>, so the parameters can be
+// raised later without breaking the hashes already stored.
+
+type argonParams struct {
+	memory uint32 // KiB
+	time uint32
+	threads uint8
+}
+
+// the OWASP recommendation, every login costs this much memory for a moment
+var defaultParams = argonParams{memory: 19 * 1024, time: 2, threads: 1}
+
+const (
+	saltLen = 16
+	keyLen = 32
+)
+
+var errBadHash = errors.New("not an argon2id password hash")
+
+// dummyHash is verified against when a username doesn't exist, so a failed
+// login takes as long whether or not the account is there
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("rekazdrive dummy password")
+	return hash
+})
+
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := defaultParams
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether password matches hash, comparing in constant time
+func VerifyPassword(hash, password string) bool {
+	p, salt, key, err := decodeHash(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// VerifyNoUser burns the time of a VerifyPassword for a login with an unknown username
+func VerifyNoUser(password string) {
+	VerifyPassword(dummyHash(), password)
+}
+
+func decodeHash(hash string) (argonParams, []byte, []byte, error) {
+	var p argonParams
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errBadHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errBadHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil || p.time == 0 || p.threads == 0 {
+		return p, nil, nil, errBadHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errBadHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errBadHash
+	}
+	return p, salt, key, nil
+}
+
+// passwords that come with examples and installers, including ours
+var knownPasswords = []string{
+	"admin", "administrator", "password", "passw0rd", "changeme", "change_me", "change_me_pls",
+	"secret", "root", "toor", "letmein", "welcome", "qwerty", "12345678", "123456789", "rekazdrive",
+}
+
+// WeakPassword reports whether password is too short, a well-known default or
+// the username itself, the admin account must not start out with one
+func WeakPassword(username, password string) bool {
+	p := strings.ToLower(password)
+	return len(password) < MinPasswordLen || p == NormaliseUsername(username) || slices.Contains(knownPasswords, p)
+}
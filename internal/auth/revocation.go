@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"rekazdrive/internal/db"
+)
+
+// Revocations is the list of revoked access tokens, kept in memory so the
+// middleware doesn't hit the database on every request. Revoke writes through
+// to the store, tokens revoked by other replicas show up on the next Sync.
+type Revocations struct {
+	store db.TokenStore
+
+	mu sync.RWMutex
+	revoked map[string]time.Time // jti -> expiry of the token
+}
+
+func NewRevocations(store db.TokenStore) *Revocations {
+	return &Revocations{store: store, revoked: map[string]time.Time{}}
+}
+
+// Revoke blocks the token until it expires on its own
+func (r *Revocations) Revoke(jti string, expiresAt time.Time) error {
+	if err := r.store.RevokeToken(jti, expiresAt); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.revoked[jti] = expiresAt
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Revocations) Revoked(jti string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.revoked[jti]
+	return ok
+}
+
+// Sync adds what other replicas revoked and drops the tokens that expired
+func (r *Revocations) Sync(now time.Time) error {
+	revoked, err := r.store.RevokedTokens(now)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// a Revoke racing with the query above isn't in its result yet
+	for jti, exp := range r.revoked {
+		if _, ok := revoked[jti]; !ok && exp.After(now) {
+			revoked[jti] = exp
+		}
+	}
+	r.revoked = revoked
+	return nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Every user has one role and a role is a set of scopes. Tokens carry the
+// scopes of the role at login, routes ask for the scope they need with
+// middleware.RequireScope.
+
+const (
+	RoleAdmin = "admin"
+	RoleWriter = "writer"
+	RoleReader = "reader"
+)
+
+const (
+	ScopeBlobsRead = "blobs:read"
+	ScopeBlobsWrite = "blobs:write" // uploads, changes and deletes
+	ScopeAdminUsers = "admin:users"
+	ScopeAdmin = "admin:*" // every admin scope, and ACLs don't apply
+)
+
+var allScopes = []string{ScopeBlobsRead, ScopeBlobsWrite, ScopeAdminUsers, ScopeAdmin}
+
+// in the order the admin API lists them
+var roles = []string{RoleAdmin, RoleWriter, RoleReader}
+
+var roleScopes = map[string][]string{
+	RoleAdmin:  {ScopeBlobsRead, ScopeBlobsWrite, ScopeAdmin},
+	RoleWriter: {ScopeBlobsRead, ScopeBlobsWrite},
+	RoleReader: {ScopeBlobsRead},
+}
+
+func Roles() []string {
+	return append([]string{}, roles...)
+}
+
+func ValidateRole(role string) error {
+	if _, ok := roleScopes[role]; !ok {
+		return fmt.Errorf("role must be one of %s", strings.Join(roles, ", "))
+	}
+	return nil
+}
+
+// ValidateScope accepts the scopes there are, API keys may ask for any of them
+func ValidateScope(scope string) error {
+	for _, s := range allScopes {
+		if s == scope {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(allScopes, ", "))
+}
+
+// RoleScopes returns the scopes of a role, none for an unknown one
+func RoleScopes(role string) []string {
+	return append([]string{}, roleScopes[role]...)
+}
+
+// HasScope reports whether granted covers required. A scope ending in ":*"
+// covers every scope with the same prefix.
+func HasScope(granted []string, required string) bool {
+	for _, g := range granted {
+		if g == required {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(g, "*"); ok && strings.HasSuffix(prefix, ":") && strings.HasPrefix(required, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Narrow keeps the scopes of requested that allowed covers, a token can't
+// do more than its user's role allows now
+func Narrow(requested, allowed []string) []string {
+	scopes := []string{}
+	for _, s := range requested {
+		if HasScope(allowed, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"rekazdrive/internal/db"
+)
+
+// Claims is what a token says, sub is the user id and jti names the token for revocation
+type Claims struct {
+	Username string `json:"username"`
+	Role string `json:"role"`
+	Scope string `json:"scope"` // space separated, like OAuth scopes
+	jwt.RegisteredClaims
+}
+
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// IssueAccessToken signs a token for the user with the role's scopes and a fresh jti
+func IssueAccessToken(user *db.User, keys *Keyring, ttl time.Duration, now time.Time) (string, *Claims, error) {
+	jti, err := NewTokenID()
+	if err != nil {
+		return "", nil, err
+	}
+	claims := &Claims{
+		Username: user.Username,
+		Role:     user.Role,
+		Scope:    strings.Join(RoleScopes(user.Role), " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   user.ID,
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	signed, err := keys.Sign(claims, now)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// NewTokenID is a random id for a jti or a family of refresh tokens
+func NewTokenID() (string, error) {
+	return randomToken(16)
+}
+
+// NewRefreshToken returns an opaque refresh token and the hash it is stored under
+func NewRefreshToken() (token, hash string, err error) {
+	token, err = randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashToken(token), nil
+}
+
+// HashToken is what the database keeps instead of a refresh token or API key,
+// a plain sha256 is enough for 256 random bits
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"rekazdrive/internal/db"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxUsernameLen = 64
+	maxGroupLen = 64
+	MinPasswordLen = 8
+)
+
+// NormaliseUsername makes usernames case insensitive, logins go through it too
+func NormaliseUsername(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// ValidateUsername allows letters, digits and . _ - @, so an email works as a username
+func ValidateUsername(name string) error {
+	if name == "" || len(name) > maxUsernameLen {
+		return fmt.Errorf("username must be 1 to %d characters", maxUsernameLen)
+	}
+	for _, r := range name {
+		ok := r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("._-@", r)
+		if !ok {
+			return fmt.Errorf("username may only contain letters, digits and . _ - @")
+		}
+	}
+	return nil
+}
+
+// ValidateGroup takes any group name without spaces or control characters, the
+// names may come from elsewhere and are kept as they are
+func ValidateGroup(name string) error {
+	if name == "" || len(name) > maxGroupLen || !utf8.ValidString(name) {
+		return fmt.Errorf("group names must be 1 to %d bytes of UTF-8", maxGroupLen)
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return fmt.Errorf("group %q contains spaces or control characters", name)
+		}
+	}
+	return nil
+}
+
+// NewUser builds an account with a fresh id and the password hashed. The
+// password isn't checked against MinPasswordLen here, callers decide.
+func NewUser(username, password, role string, now time.Time) (*db.User, error) {
+	username = NormaliseUsername(username)
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if err := ValidateRole(role); err != nil {
+		return nil, err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &db.User{
+		ID:           hex.EncodeToString(id),
+		Username:     username,
+		PasswordHash: hash,
+		Role:         role,
+		CreatedAt:    now.UTC(),
+		UpdatedAt:    now.UTC(),
+	}, nil
+}
@@ -4,12 +4,37 @@ import "os"
 
 type Config struct {
 	JWTSecret string
-	JWTExpiration string
+	JWTExpiration string // access tokens, minutes or a duration like 15m, empty = 15m
+	RefreshExpiration string // refresh tokens, e.g. 30d, empty = 30d
+	JWTAlgorithm string // HS256 (JWT_SECRET, default), RS256, ES256 or EdDSA
+	JWTKeyRotation string // how long a signing key is used before the next one, empty = 30d
+	JWTMasterKeys string // "id:base64,id:base64" the signing keys are sealed with, empty = EncryptionKeys
+
+	// external identity provider, off while OIDCIssuer is empty
+	OIDCIssuer string
+	OIDCAudience string
+	OIDCUsernameClaim string // empty = email
+	OIDCGroupsClaim string // empty = groups
+	OIDCRoleGroups string // "group:role,...", the highest role of the user's groups applies
+	OIDCDefaultRole string // for users in none of those groups, empty refuses them
+	OIDCClockSkew string // empty = 1m
 
 	StorageBackend string
+	StorageDedup string // "true" stores identical content once, see storage.DedupBackend
+	EncryptionKeys string // "id:base64,id:base64", current master key first, empty disables encryption
+	Compression string // gzip or zstd, empty disables compression
+	CompressionMinSize string // bytes, smaller blobs are stored as they are
+	CompressionTypes string // comma separated media types, empty uses storage.DefaultCompressibleTypes
+	Versioning string // "true" keeps every upload as a version instead of overwriting
+	VersioningPrefixes string // comma separated id prefixes versioning applies to, empty = all ids
+	TrashRetention string // e.g. 30d or 12h, deleted blobs stay in the trash this long; empty or 0 deletes right away
+	TrashPurgeInterval string // how often expired trash is purged, empty = 1h
+	LifecycleRules string // "prefix:duration,...", e.g. tmp/:7d deletes blobs under tmp/ a week after their last change
+	LifecycleInterval string // how often expired blobs are deleted, empty = 1h
 
 	// Local
 	LocalPath string
+	LocalShardDepth string // hash-prefix directory levels, empty or 0 keeps the flat layout
 
 	// S3
 	S3Endpoint string
@@ -24,21 +49,51 @@ type Config struct {
 	FTPPass string
 	FTPBasePath string
 
+	// metadata store: postgres (default), sqlite or memory
+	MetadataBackend string
+	SQLitePath string
+
 	// DB DSN
 	MetadataDSN string
 	BlobDBDSN string
 
-	// Auth credentials
+	// first admin account, seeded while the users table is empty
 	AdminUser string
 	AdminPass string
+
+	TrustedProxies string // comma separated addresses or CIDRs whose X-Forwarded-For is believed, empty = none
+	DevMode string // "true" starts even with a weak JWT_SECRET or ADMIN_PASS, for local development only
 }
 
 func LoadFromEnv() Config {
 	return Config{
 		JWTSecret: os.Getenv("JWT_SECRET"),
 		JWTExpiration: os.Getenv("JWT_EXPIRATION"),
+		RefreshExpiration: os.Getenv("REFRESH_EXPIRATION"),
+		JWTAlgorithm: os.Getenv("JWT_ALGORITHM"),
+		JWTKeyRotation: os.Getenv("JWT_KEY_ROTATION"),
+		JWTMasterKeys: os.Getenv("JWT_MASTER_KEYS"),
+		OIDCIssuer: os.Getenv("OIDC_ISSUER"),
+		OIDCAudience: os.Getenv("OIDC_AUDIENCE"),
+		OIDCUsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+		OIDCGroupsClaim: os.Getenv("OIDC_GROUPS_CLAIM"),
+		OIDCRoleGroups: os.Getenv("OIDC_ROLE_GROUPS"),
+		OIDCDefaultRole: os.Getenv("OIDC_DEFAULT_ROLE"),
+		OIDCClockSkew: os.Getenv("OIDC_CLOCK_SKEW"),
 		StorageBackend: os.Getenv("STORAGE_BACKEND"),
+		StorageDedup: os.Getenv("STORAGE_DEDUP"),
+		EncryptionKeys: os.Getenv("ENCRYPTION_KEYS"),
+		Compression: os.Getenv("COMPRESSION"),
+		CompressionMinSize: os.Getenv("COMPRESSION_MIN_SIZE"),
+		CompressionTypes: os.Getenv("COMPRESSION_TYPES"),
+		Versioning: os.Getenv("VERSIONING"),
+		VersioningPrefixes: os.Getenv("VERSIONING_PREFIXES"),
+		TrashRetention: os.Getenv("TRASH_RETENTION"),
+		TrashPurgeInterval: os.Getenv("TRASH_PURGE_INTERVAL"),
+		LifecycleRules: os.Getenv("LIFECYCLE_RULES"),
+		LifecycleInterval: os.Getenv("LIFECYCLE_INTERVAL"),
 		LocalPath: os.Getenv("LOCAL_PATH"),
+		LocalShardDepth: os.Getenv("LOCAL_SHARD_DEPTH"),
 		S3Endpoint: os.Getenv("S3_ENDPOINT"),
 		S3Bucket: os.Getenv("S3_BUCKET"),
 		S3AccessKey: os.Getenv("S3_ACCESS_KEY"),
@@ -48,9 +103,13 @@ func LoadFromEnv() Config {
 		FTPUser: os.Getenv("FTP_USER"),
 		FTPPass: os.Getenv("FTP_PASS"),
 		FTPBasePath: os.Getenv("FTP_BASE_PATH"),
+		MetadataBackend: os.Getenv("METADATA_BACKEND"),
+		SQLitePath: os.Getenv("SQLITE_PATH"),
 		MetadataDSN: os.Getenv("METADATA_DSN"),
 		BlobDBDSN: os.Getenv("BLOB_DB_DSN"),
 		AdminUser: os.Getenv("ADMIN_USER"),
 		AdminPass: os.Getenv("ADMIN_PASS"),
+		TrustedProxies: os.Getenv("TRUSTED_PROXIES"),
+		DevMode: os.Getenv("DEV_MODE"),
 	}
 }
\ No newline at end of file
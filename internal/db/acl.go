@@ -0,0 +1,131 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+)
+
+// A blob belongs to the user who first uploaded it, the owner can do anything
+// with it. Everyone else only gets what a grant on the blob allows, given to
+// them directly or to one of their groups. Admins aren't limited by any of
+// this, the handlers decide that. Blobs from before owners existed have none,
+// so they are left to admins until someone grants access to them.
+
+const (
+	PermRead = "read"
+	PermWrite = "write"
+	PermDelete = "delete"
+
+	PrincipalUser = "user"
+	PrincipalGroup = "group"
+)
+
+// Grant allows one permission on a blob to a user or a group
+type Grant struct {
+	PrincipalType string // PrincipalUser or PrincipalGroup
+	Principal string // user id or group name
+	Permission string
+}
+
+// Viewer is a user as far as reading blobs goes, list queries only return what
+// it owns or may read. A nil Viewer sees everything.
+type Viewer struct {
+	UserID string
+	Groups []string
+}
+
+// ACLStore keeps the grants, part of every MetadataStore. Grants go with the
+// blob's row, a trashed blob keeps them and a deleted one takes them along.
+type ACLStore interface {
+	ListGrants(blobID string) ([]Grant, error)
+	// SetGrants replaces every grant of a live or trashed blob, sql.ErrNoRows if there is none
+	SetGrants(blobID string, grants []Grant) error
+	// HasGrant reports whether v was granted permission on the blob, ownership isn't checked
+	HasGrant(blobID, permission string, v Viewer) (bool, error)
+}
+
+// visibleTo is the read check of the list queries, $4 is the viewer's user id
+// (NULL for no check) and $5 its groups
+const visibleTo = `($4::text IS NULL OR owner_id = $4 OR EXISTS (
+	SELECT 1 FROM blob_acl a WHERE a.blob_id = blobs_metadata.id AND a.permission = 'read'
+	AND (a.principal_type = 'user' AND a.principal = $4 OR a.principal_type = 'group' AND a.principal = ANY($5::text[]))))`
+
+// same as visibleTo with the arguments of sqliteArgs
+const sqliteVisibleTo = `(? IS NULL OR owner_id = ? OR EXISTS (
+	SELECT 1 FROM blob_acl a WHERE a.blob_id = blobs_metadata.id AND a.permission = 'read'
+	AND (a.principal_type = 'user' AND a.principal = ? OR a.principal_type = 'group' AND a.principal IN (SELECT value FROM json_each(?)))))`
+
+func (v *Viewer) args() (any, []string) {
+	if v == nil {
+		return nil, nil
+	}
+	return v.UserID, nonNilSlice(v.Groups)
+}
+
+func (v *Viewer) sqliteArgs() []any {
+	userID, groups := v.args()
+	groupsJSON, _ := json.Marshal(nonNilSlice(groups))
+	return []any{userID, userID, userID, string(groupsJSON)}
+}
+
+func (m *MetadataDB) ListGrants(blobID string) ([]Grant, error) {
+	query := `SELECT principal_type, principal, permission FROM blob_acl WHERE blob_id = $1
+		      ORDER BY principal_type, principal, permission;`
+	return queryGrants(m.DB, query, blobID)
+}
+
+func (m *MetadataDB) SetGrants(blobID string, grants []Grant) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the row lock keeps a delete of the blob from slipping in between
+	var found int
+	query := `SELECT 1 FROM blobs_metadata WHERE id = $1 FOR UPDATE;`
+	if err := tx.QueryRow(query, blobID).Scan(&found); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM blob_acl WHERE blob_id = $1;`, blobID); err != nil {
+		return err
+	}
+	query = `INSERT INTO blob_acl(blob_id, principal_type, principal, permission) VALUES($1, $2, $3, $4)
+		     ON CONFLICT DO NOTHING;`
+	for _, g := range grants {
+		if _, err := tx.Exec(query, blobID, g.PrincipalType, g.Principal, g.Permission); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *MetadataDB) HasGrant(blobID, permission string, v Viewer) (bool, error) {
+	var found bool
+	query := `SELECT EXISTS (SELECT 1 FROM blob_acl WHERE blob_id = $1 AND permission = $2
+		      AND (principal_type = 'user' AND principal = $3 OR principal_type = 'group' AND principal = ANY($4::text[])));`
+	err := m.DB.QueryRow(query, blobID, permission, v.UserID, pq.Array(nonNilSlice(v.Groups))).Scan(&found)
+	return found, err
+}
+
+func queryGrants(sqlDB *sql.DB, query string, args ...any) ([]Grant, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []Grant{}
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.PrincipalType, &g.Principal, &g.Permission); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+
+	return grants, rows.Err()
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// APIKey is a long-lived key acting as its user, for scripts and CI. Like
+// refresh tokens, only a hash of the key is kept.
+type APIKey struct {
+	ID string
+	UserID string
+	Name string
+	Prefix string // the first characters of the key, to tell keys apart
+	Hash string // sha256 of the key, hex
+	Scope string // space separated, never more than the user's role allows
+	CreatedAt time.Time
+	ExpiresAt time.Time // zero never expires
+	LastUsedAt time.Time // zero if never used
+	RevokedAt time.Time // zero unless revoked
+}
+
+// APIKeyStore keeps the API keys, part of every MetadataStore
+type APIKeyStore interface {
+	CreateAPIKey(k *APIKey) error
+	GetAPIKey(id string) (*APIKey, error)
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	// ListAPIKeys returns the user's keys oldest first, revoked ones included
+	ListAPIKeys(userID string) ([]APIKey, error)
+	// RevokeAPIKey is sql.ErrNoRows for an unknown or already revoked key
+	RevokeAPIKey(id string, now time.Time) error
+	TouchAPIKey(id string, now time.Time) error
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scope, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var k APIKey
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Hash, &k.Scope, &k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	k.ExpiresAt, k.LastUsedAt, k.RevokedAt = expiresAt.Time, lastUsedAt.Time, revokedAt.Time
+	return &k, nil
+}
+
+func (m *MetadataDB) CreateAPIKey(k *APIKey) error {
+	query := `INSERT INTO api_keys(id, user_id, name, prefix, key_hash, scope, created_at, expires_at)
+		      VALUES($1, $2, $3, $4, $5, $6, $7, $8);`
+	_, err := m.DB.Exec(query, k.ID, k.UserID, k.Name, k.Prefix, k.Hash, k.Scope, k.CreatedAt.UTC(), nullTime(k.ExpiresAt))
+	return err
+}
+
+func (m *MetadataDB) GetAPIKey(id string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = $1;`
+	return scanAPIKey(m.DB.QueryRow(query, id))
+}
+
+func (m *MetadataDB) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1;`
+	return scanAPIKey(m.DB.QueryRow(query, hash))
+}
+
+func (m *MetadataDB) ListAPIKeys(userID string) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 ORDER BY created_at, id;`
+	return queryAPIKeys(m.DB, query, userID)
+}
+
+func (m *MetadataDB) RevokeAPIKey(id string, now time.Time) error {
+	query := `UPDATE api_keys SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL;`
+	return execOne(m.DB, query, id, now.UTC())
+}
+
+func (m *MetadataDB) TouchAPIKey(id string, now time.Time) error {
+	query := `UPDATE api_keys SET last_used_at = $2 WHERE id = $1;`
+	return execOne(m.DB, query, id, now.UTC())
+}
+
+func queryAPIKeys(sqlDB *sql.DB, query string, args ...any) ([]APIKey, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+
+	return keys, rows.Err()
+}
@@ -1,14 +1,17 @@
 package db
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+)
 
+// InitBlobTable brings the blob database up to the latest migration, see migrate.go
 func InitBlobTable(sqlDB *sql.DB) error {
-	query := `CREATE TABLE IF NOT EXISTS blobs_data (
-		id TEXT PRIMARY KEY,
-		data BYTEA NOT NULL,
-		created_at TIMESTAMPTZ NOT NULL
-		);`
-	_, err := sqlDB.Exec(query)
+	migrator, err := NewMigrator(sqlDB, ScopeBlob)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(context.Background())
 
 	return err
-}
\ No newline at end of file
+}
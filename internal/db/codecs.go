@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"rekazdrive/internal/storage"
+)
+
+// MetadataDB is the storage.CodecIndex of the compression mode, one entry per
+// blob in blob_codecs. blobs_metadata is left to the handlers, so an upload
+// that fails before its metadata is saved leaves no row there.
+
+const codecColumns = `id, object, codec, original_size, stored_size, created_at`
+
+func scanCodec(row interface{ Scan(...any) error }) (storage.StoredCodec, error) {
+	var c storage.StoredCodec
+	err := row.Scan(&c.ID, &c.Object, &c.Codec, &c.OriginalSize, &c.StoredSize, &c.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, storage.ErrNotFound
+	}
+	return c, err
+}
+
+func (m *MetadataDB) PutCodec(ctx context.Context, c storage.StoredCodec) (string, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO blob_codecs(` + codecColumns + `) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING;`
+	res, err := tx.ExecContext(ctx, query, c.ID, c.Object, c.Codec, c.OriginalSize, c.StoredSize, c.CreatedAt.UTC())
+	if err != nil {
+		return "", err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if n == 1 {
+		return "", tx.Commit() // first write of this id
+	}
+
+	// overwrite, lock the row so a concurrent writer gets our object as its previous one
+	var prev string
+	query = `SELECT object FROM blob_codecs WHERE id = $1 FOR UPDATE;`
+	if err := tx.QueryRowContext(ctx, query, c.ID).Scan(&prev); err != nil {
+		return "", err
+	}
+	query = `UPDATE blob_codecs SET object = $2, codec = $3, original_size = $4, stored_size = $5, created_at = $6 WHERE id = $1;`
+	if _, err := tx.ExecContext(ctx, query, c.ID, c.Object, c.Codec, c.OriginalSize, c.StoredSize, c.CreatedAt.UTC()); err != nil {
+		return "", err
+	}
+
+	return prev, tx.Commit()
+}
+
+func (m *MetadataDB) GetCodec(ctx context.Context, id string) (storage.StoredCodec, error) {
+	query := `SELECT ` + codecColumns + ` FROM blob_codecs WHERE id = $1;`
+	return scanCodec(m.DB.QueryRowContext(ctx, query, id))
+}
+
+func (m *MetadataDB) DeleteCodec(ctx context.Context, id string) (storage.StoredCodec, error) {
+	query := `DELETE FROM blob_codecs WHERE id = $1 RETURNING ` + codecColumns + `;`
+	return scanCodec(m.DB.QueryRowContext(ctx, query, id))
+}
+
+func (m *MetadataDB) ListCodecs(ctx context.Context, prefix, cursor string, limit int) ([]storage.StoredCodec, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	query := `SELECT ` + codecColumns + ` FROM blob_codecs
+		      WHERE id > $1 AND id LIKE $2 ESCAPE '\'
+			  ORDER BY id
+			  LIMIT $3;`
+	entries, err := queryCodecs(ctx, m.DB, query, cursor, storage.EscapeLike(prefix)+"%", limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+		return entries, entries[limit-1].ID, nil
+	}
+	return entries, "", nil
+}
+
+func queryCodecs(ctx context.Context, sqlDB *sql.DB, query string, args ...any) ([]storage.StoredCodec, error) {
+	rows, err := sqlDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []storage.StoredCodec
+	for rows.Next() {
+		c, err := scanCodec(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, c)
+	}
+	return entries, rows.Err()
+}
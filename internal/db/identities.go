@@ -0,0 +1,107 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// UserIdentity links an account to a user of an external identity provider,
+// the provider's issuer and its sub for the user
+type UserIdentity struct {
+	Issuer string
+	Subject string
+	UserID string
+	CreatedAt time.Time
+}
+
+// ErrIdentityLinked refuses to link an identity a second time
+var ErrIdentityLinked = errors.New("identity is already linked to an account")
+
+// IdentityStore keeps the links, part of UserStore. A provider's user only
+// ever gets the account it is linked to, never one that just has the name.
+type IdentityStore interface {
+	GetUserByIdentity(issuer, subject string) (*User, error)
+	// CreateLinkedUser creates u linked to the identity in one go,
+	// ErrUserExists if the username is taken
+	CreateLinkedUser(u *User, link *UserIdentity) error
+	// LinkIdentity links an existing account, for admins
+	LinkIdentity(link *UserIdentity) error
+	UnlinkIdentity(userID, issuer, subject string) error
+	ListIdentities(userID string) ([]UserIdentity, error)
+}
+
+func (m *MetadataDB) GetUserByIdentity(issuer, subject string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users
+			  WHERE id = (SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2);`
+	return scanUser(m.DB.QueryRow(query, issuer, subject))
+}
+
+func (m *MetadataDB) CreateLinkedUser(u *User, link *UserIdentity) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO users(` + userColumns + `) VALUES($1, $2, $3, $4, $5, $6, $6);`
+	_, err = tx.Exec(query, u.ID, u.Username, u.PasswordHash, u.Role, u.Disabled, u.CreatedAt.UTC())
+	if err = pqUnique(err, ErrUserExists); err != nil {
+		return err
+	}
+	query = `INSERT INTO user_identities(issuer, subject, user_id, created_at) VALUES($1, $2, $3, $4);`
+	_, err = tx.Exec(query, link.Issuer, link.Subject, u.ID, link.CreatedAt.UTC())
+	if err = pqUnique(err, ErrIdentityLinked); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *MetadataDB) LinkIdentity(link *UserIdentity) error {
+	query := `INSERT INTO user_identities(issuer, subject, user_id, created_at) VALUES($1, $2, $3, $4);`
+	_, err := m.DB.Exec(query, link.Issuer, link.Subject, link.UserID, link.CreatedAt.UTC())
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+		return sql.ErrNoRows
+	}
+	return pqUnique(err, ErrIdentityLinked)
+}
+
+func (m *MetadataDB) UnlinkIdentity(userID, issuer, subject string) error {
+	query := `DELETE FROM user_identities WHERE user_id = $1 AND issuer = $2 AND subject = $3;`
+	return execOne(m.DB, query, userID, issuer, subject)
+}
+
+func (m *MetadataDB) ListIdentities(userID string) ([]UserIdentity, error) {
+	query := `SELECT issuer, subject, user_id, created_at FROM user_identities WHERE user_id = $1 ORDER BY issuer, subject;`
+	return queryIdentities(m.DB, query, userID)
+}
+
+// pqUnique turns a unique_violation into errExists
+func pqUnique(err, errExists error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return errExists
+	}
+	return err
+}
+
+func queryIdentities(sqlDB *sql.DB, query string, args ...any) ([]UserIdentity, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []UserIdentity{}
+	for rows.Next() {
+		var i UserIdentity
+		if err := rows.Scan(&i.Issuer, &i.Subject, &i.UserID, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
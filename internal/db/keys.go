@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"rekazdrive/internal/storage"
+)
+
+// MetadataDB is the storage.KeyStore of encryption at rest, one envelope per
+// blob in blob_keys
+
+const keyColumns = `id, object, size, master_key_id, wrapped_key, nonce, created_at`
+
+func scanKey(row interface{ Scan(...any) error }) (storage.ObjectKey, error) {
+	var k storage.ObjectKey
+	err := row.Scan(&k.ID, &k.Object, &k.Size, &k.MasterKeyID, &k.WrappedKey, &k.Nonce, &k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return k, storage.ErrNotFound
+	}
+	return k, err
+}
+
+func (m *MetadataDB) PutKey(ctx context.Context, k storage.ObjectKey) (string, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO blob_keys(` + keyColumns + `) VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (id) DO NOTHING;`
+	res, err := tx.ExecContext(ctx, query, k.ID, k.Object, k.Size, k.MasterKeyID, k.WrappedKey, k.Nonce, k.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if n == 1 {
+		return "", tx.Commit() // first write of this id
+	}
+
+	// overwrite, lock the row so a concurrent writer gets our object as its previous one
+	var prev string
+	query = `SELECT object FROM blob_keys WHERE id = $1 FOR UPDATE;`
+	if err := tx.QueryRowContext(ctx, query, k.ID).Scan(&prev); err != nil {
+		return "", err
+	}
+	query = `UPDATE blob_keys SET object = $2, size = $3, master_key_id = $4, wrapped_key = $5, nonce = $6, created_at = $7 WHERE id = $1;`
+	if _, err := tx.ExecContext(ctx, query, k.ID, k.Object, k.Size, k.MasterKeyID, k.WrappedKey, k.Nonce, k.CreatedAt); err != nil {
+		return "", err
+	}
+
+	return prev, tx.Commit()
+}
+
+func (m *MetadataDB) GetKey(ctx context.Context, id string) (storage.ObjectKey, error) {
+	query := `SELECT ` + keyColumns + ` FROM blob_keys WHERE id = $1;`
+	return scanKey(m.DB.QueryRowContext(ctx, query, id))
+}
+
+func (m *MetadataDB) DeleteKey(ctx context.Context, id string) (storage.ObjectKey, error) {
+	query := `DELETE FROM blob_keys WHERE id = $1 RETURNING ` + keyColumns + `;`
+	return scanKey(m.DB.QueryRowContext(ctx, query, id))
+}
+
+func (m *MetadataDB) ListKeys(ctx context.Context, prefix, cursor string, limit int) ([]storage.ObjectKey, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	query := `SELECT ` + keyColumns + ` FROM blob_keys
+		      WHERE id > $1 AND id LIKE $2 ESCAPE '\'
+			  ORDER BY id
+			  LIMIT $3;`
+	keys, err := queryKeys(ctx, m.DB, query, cursor, storage.EscapeLike(prefix)+"%", limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+		return keys, keys[limit-1].ID, nil
+	}
+	return keys, "", nil
+}
+
+func (m *MetadataDB) StaleKeys(ctx context.Context, masterKeyID, cursor string, limit int) ([]storage.ObjectKey, error) {
+	query := `SELECT ` + keyColumns + ` FROM blob_keys
+		      WHERE master_key_id <> $1 AND id > $2
+			  ORDER BY id
+			  LIMIT $3;`
+	return queryKeys(ctx, m.DB, query, masterKeyID, cursor, limit)
+}
+
+// RewrapKey is a no-op when the blob was rewritten in the meantime, the new
+// envelope already uses the current master key
+func (m *MetadataDB) RewrapKey(ctx context.Context, k storage.ObjectKey) error {
+	query := `UPDATE blob_keys SET master_key_id = $3, wrapped_key = $4 WHERE id = $1 AND object = $2;`
+	_, err := m.DB.ExecContext(ctx, query, k.ID, k.Object, k.MasterKeyID, k.WrappedKey)
+	return err
+}
+
+func queryKeys(ctx context.Context, sqlDB *sql.DB, query string, args ...any) ([]storage.ObjectKey, error) {
+	rows, err := sqlDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []storage.ObjectKey
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"rekazdrive/internal/storage"
+	"time"
+)
+
+// Queries of the lifecycle worker, see internal/lifecycle. Both scans page by
+// id, so a sweep can stop anywhere and go on from the last id it handled.
+
+// ListExpired returns up to limit live blobs whose expiry is at or before now
+func (m *MetadataDB) ListExpired(now time.Time, cursor string, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + metaColumns + ` FROM blobs_metadata
+		      WHERE expires_at <= $1 AND id > $2 AND deleted_at IS NULL
+			  ORDER BY id
+			  LIMIT $3;`
+	return m.queryMetas(query, now.UTC(), cursor, limit)
+}
+
+// ListUpdatedBefore returns up to limit live blobs under prefix that haven't
+// changed since before
+func (m *MetadataDB) ListUpdatedBefore(prefix string, before time.Time, cursor string, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + metaColumns + ` FROM blobs_metadata
+		      WHERE id > $1 AND id LIKE $2 ESCAPE '\' AND id NOT LIKE '.%'
+			  AND updated_at < $3 AND deleted_at IS NULL
+			  ORDER BY id
+			  LIMIT $4;`
+	return m.queryMetas(query, cursor, storage.EscapeLike(prefix)+"%", before.UTC(), limit)
+}
+
+func (m *MetadataDB) queryMetas(query string, args ...any) ([]BlobMeta, error) {
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metas []BlobMeta
+	for rows.Next() {
+		meta, err := scanMeta(rows)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, *meta)
+	}
+
+	return metas, rows.Err()
+}
+
+// AcquireLease takes or renews the lease called name for holder until
+// now+ttl. Returns false while another holder's lease hasn't run out.
+func (m *MetadataDB) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	query := `INSERT INTO lifecycle_state(name, holder, lease_until) VALUES($1, $2, $3)
+		      ON CONFLICT (name) DO UPDATE
+			  SET holder = EXCLUDED.holder, lease_until = EXCLUDED.lease_until
+			  WHERE lifecycle_state.holder = EXCLUDED.holder OR lifecycle_state.lease_until IS NULL
+			  OR lifecycle_state.lease_until < $4;`
+	res, err := m.DB.Exec(query, name, holder, now.Add(ttl).UTC(), now.UTC())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseLease gives the lease up early, a no-op if holder doesn't hold it
+func (m *MetadataDB) ReleaseLease(name, holder string) error {
+	query := `UPDATE lifecycle_state SET lease_until = NULL WHERE name = $1 AND holder = $2;`
+	_, err := m.DB.Exec(query, name, holder)
+	return err
+}
+
+// Checkpoint is the cursor the scan called name got to, "" when it never ran or finished
+func (m *MetadataDB) Checkpoint(name string) (string, error) {
+	var cursor string
+	query := `SELECT scan_cursor FROM lifecycle_state WHERE name = $1;`
+	err := m.DB.QueryRow(query, name).Scan(&cursor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return cursor, err
+}
+
+func (m *MetadataDB) SaveCheckpoint(name, cursor string) error {
+	query := `INSERT INTO lifecycle_state(name, scan_cursor) VALUES($1, $2)
+		      ON CONFLICT (name) DO UPDATE SET scan_cursor = EXCLUDED.scan_cursor;`
+	_, err := m.DB.Exec(query, name, cursor)
+	return err
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LoginFailures counts the failed logins of a username or an address
+type LoginFailures struct {
+	Key string // "user:<username>" or "ip:<address>"
+	Failures int
+	LastFailureAt time.Time
+	LockedUntil time.Time // zero if never locked
+}
+
+// Lockout is a record of a key getting locked
+type Lockout struct {
+	ID string
+	Key string
+	Failures int
+	CreatedAt time.Time
+	LockedUntil time.Time
+}
+
+// LoginThrottleStore keeps failed logins and lockouts for auth.LoginGuard,
+// shared by every replica. Part of every MetadataStore.
+type LoginThrottleStore interface {
+	GetLoginFailures(key string) (*LoginFailures, error)
+	// AddLoginFailure counts a failure and returns the count, which starts
+	// over if the last failure was before since
+	AddLoginFailure(key string, now, since time.Time) (int, error)
+	// LockLogin locks l.Key until l.LockedUntil and records the lockout
+	LockLogin(l *Lockout) error
+	ClearLoginFailures(key string) error
+	// ListLockouts returns the latest lockouts, newest first
+	ListLockouts(limit int) ([]Lockout, error)
+	// DeleteStaleLoginFailures forgets keys whose last failure was before
+	// then and that aren't locked any more
+	DeleteStaleLoginFailures(before, now time.Time) (int, error)
+}
+
+func (m *MetadataDB) GetLoginFailures(key string) (*LoginFailures, error) {
+	query := `SELECT throttle_key, failures, last_failure_at, locked_until FROM login_failures WHERE throttle_key = $1;`
+	return scanLoginFailures(m.DB.QueryRow(query, key))
+}
+
+func scanLoginFailures(row interface{ Scan(...any) error }) (*LoginFailures, error) {
+	var f LoginFailures
+	var lockedUntil sql.NullTime
+	if err := row.Scan(&f.Key, &f.Failures, &f.LastFailureAt, &lockedUntil); err != nil {
+		return nil, err
+	}
+	f.LockedUntil = lockedUntil.Time
+	return &f, nil
+}
+
+func (m *MetadataDB) AddLoginFailure(key string, now, since time.Time) (int, error) {
+	query := `INSERT INTO login_failures(throttle_key, failures, last_failure_at) VALUES($1, 1, $2)
+			  ON CONFLICT (throttle_key) DO UPDATE SET
+			    failures = CASE WHEN login_failures.last_failure_at < $3 THEN 1 ELSE login_failures.failures + 1 END,
+			    last_failure_at = EXCLUDED.last_failure_at
+			  RETURNING failures;`
+	var failures int
+	err := m.DB.QueryRow(query, key, now.UTC(), since.UTC()).Scan(&failures)
+	return failures, err
+}
+
+func (m *MetadataDB) LockLogin(l *Lockout) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE login_failures SET locked_until = $2 WHERE throttle_key = $1;`, l.Key, l.LockedUntil.UTC()); err != nil {
+		return err
+	}
+	query := `INSERT INTO login_lockouts(id, throttle_key, failures, created_at, locked_until) VALUES($1, $2, $3, $4, $5);`
+	if _, err := tx.Exec(query, l.ID, l.Key, l.Failures, l.CreatedAt.UTC(), l.LockedUntil.UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *MetadataDB) ClearLoginFailures(key string) error {
+	_, err := m.DB.Exec(`DELETE FROM login_failures WHERE throttle_key = $1;`, key)
+	return err
+}
+
+func (m *MetadataDB) ListLockouts(limit int) ([]Lockout, error) {
+	query := `SELECT id, throttle_key, failures, created_at, locked_until FROM login_lockouts
+			  ORDER BY created_at DESC, id LIMIT $1;`
+	return queryLockouts(m.DB, query, limit)
+}
+
+func (m *MetadataDB) DeleteStaleLoginFailures(before, now time.Time) (int, error) {
+	query := `DELETE FROM login_failures WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until <= $2);`
+	res, err := m.DB.Exec(query, before.UTC(), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func queryLockouts(sqlDB *sql.DB, query string, args ...any) ([]Lockout, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lockouts []Lockout
+	for rows.Next() {
+		var l Lockout
+		if err := rows.Scan(&l.ID, &l.Key, &l.Failures, &l.CreatedAt, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+
+	return lockouts, rows.Err()
+}
@@ -0,0 +1,340 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps metadata in a map, for tests and throwaway dev servers.
+// Everything is gone on restart.
+type MemoryStore struct {
+	mu sync.RWMutex
+	blobs map[string]*BlobMeta
+	versions map[string]map[string]*BlobMeta // id -> version id -> version
+	users map[string]*User // id -> user, see memory_users.go
+	identities map[string]*UserIdentity // issuer + "\x00" + subject -> link, see memory_identities.go
+	groups map[string][]string // user id -> group names
+	grants map[string][]Grant // blob id -> grants, see memory_acl.go
+	refreshTokens map[string]*RefreshToken // hash -> token, see memory_tokens.go
+	revokedTokens map[string]time.Time // jti -> expiry
+	apiKeys map[string]*APIKey // id -> key, see memory_apikeys.go
+	signingKeys map[string]*SigningKey // kid -> key, see memory_signingkeys.go
+	loginFailures map[string]*LoginFailures // throttle key -> failures, see memory_loginthrottle.go
+	lockouts []Lockout
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		blobs:    map[string]*BlobMeta{},
+		versions: map[string]map[string]*BlobMeta{},
+		users:    map[string]*User{},
+		identities: map[string]*UserIdentity{},
+		groups:   map[string][]string{},
+		grants:   map[string][]Grant{},
+
+		refreshTokens: map[string]*RefreshToken{},
+		revokedTokens: map[string]time.Time{},
+		apiKeys:       map[string]*APIKey{},
+		signingKeys:   map[string]*SigningKey{},
+		loginFailures: map[string]*LoginFailures{},
+	}
+}
+
+func (m *MemoryStore) SaveMetadata(meta *BlobMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := cloneMeta(meta)
+	saved.UpdatedAt = meta.UpdatedAt.UTC()
+	saved.CreatedAt = saved.UpdatedAt
+	saved.DeletedAt = time.Time{}
+	if old, ok := m.blobs[meta.ID]; ok {
+		saved.CreatedAt = old.CreatedAt
+		if old.OwnerID != "" {
+			saved.OwnerID = old.OwnerID
+		}
+	}
+	m.blobs[meta.ID] = saved
+
+	if meta.VersionID != "" {
+		v := cloneMeta(saved)
+		v.CreatedAt = v.UpdatedAt
+		v.ExpiresAt = time.Time{}
+		v.OwnerID = ""
+		if m.versions[meta.ID] == nil {
+			m.versions[meta.ID] = map[string]*BlobMeta{}
+		}
+		m.versions[meta.ID][meta.VersionID] = v
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetMetadata(id string) (*BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	meta, ok := m.blobs[id]
+	if !ok || !meta.DeletedAt.IsZero() {
+		return nil, sql.ErrNoRows
+	}
+	return cloneMeta(meta), nil
+}
+
+func (m *MemoryStore) UpdateUserMetadata(id string, userMeta map[string]string, tags []string, now time.Time) (*BlobMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.blobs[id]
+	if !ok || !meta.DeletedAt.IsZero() {
+		return nil, sql.ErrNoRows
+	}
+	// same as the SQL stores, nil leaves that part as it is
+	updated := cloneMeta(&BlobMeta{UserMetadata: userMeta, Tags: tags})
+	if userMeta != nil {
+		meta.UserMetadata = updated.UserMetadata
+	}
+	if tags != nil {
+		meta.Tags = updated.Tags
+	}
+	meta.UpdatedAt = now.UTC()
+	return cloneMeta(meta), nil
+}
+
+func (m *MemoryStore) DeleteMetadata(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.blobs[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.blobs, id)
+	delete(m.grants, id)
+	return nil
+}
+
+// a full scan per page, fine for the sizes this store is meant for
+func (m *MemoryStore) ListMetadata(prefix, cursor string, limit int, viewer *Viewer, now time.Time) ([]BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id, meta := range m.blobs {
+		if id > cursor && strings.HasPrefix(id, prefix) && !strings.HasPrefix(id, ".") && meta.DeletedAt.IsZero() &&
+			(meta.ExpiresAt.IsZero() || meta.ExpiresAt.After(now)) && m.visible(meta, viewer) {
+			ids = append(ids, id)
+		}
+	}
+	return m.page(ids, limit), nil
+}
+
+// page sorts ids and returns copies of the first limit blobs
+func (m *MemoryStore) page(ids []string, limit int) []BlobMeta {
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	metas := make([]BlobMeta, 0, len(ids))
+	for _, id := range ids {
+		metas = append(metas, *cloneMeta(m.blobs[id]))
+	}
+	return metas
+}
+
+func (m *MemoryStore) ListVersions(id, cursor string, limit int) ([]BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for vid := range m.versions[id] {
+		if cursor == "" || vid < cursor {
+			ids = append(ids, vid)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	versions := make([]BlobMeta, 0, len(ids))
+	for _, vid := range ids {
+		versions = append(versions, *cloneMeta(m.versions[id][vid]))
+	}
+	return versions, nil
+}
+
+func (m *MemoryStore) GetVersion(id, versionID string) (*BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	v, ok := m.versions[id][versionID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return cloneMeta(v), nil
+}
+
+func (m *MemoryStore) RestoreVersion(id, versionID string, now time.Time) (*BlobMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.versions[id][versionID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	restored := cloneMeta(v)
+	restored.CreatedAt = now.UTC()
+	restored.UpdatedAt = now.UTC()
+	restored.DeletedAt = time.Time{}
+	if old, ok := m.blobs[id]; ok {
+		restored.CreatedAt = old.CreatedAt
+		restored.OwnerID = old.OwnerID
+	}
+	m.blobs[id] = restored
+	return cloneMeta(restored), nil
+}
+
+func (m *MemoryStore) DeleteVersion(id, versionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.versions[id][versionID]; !ok {
+		return sql.ErrNoRows
+	}
+	if current, ok := m.blobs[id]; ok && current.VersionID == versionID {
+		return ErrCurrentVersion
+	}
+	delete(m.versions[id], versionID)
+	if len(m.versions[id]) == 0 {
+		delete(m.versions, id)
+	}
+	return nil
+}
+
+func (m *MemoryStore) TrashMetadata(id string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.blobs[id]
+	if !ok || !meta.DeletedAt.IsZero() {
+		return sql.ErrNoRows
+	}
+	meta.DeletedAt = now.UTC()
+	return nil
+}
+
+func (m *MemoryStore) GetTrashed(id string) (*BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	meta, ok := m.blobs[id]
+	if !ok || meta.DeletedAt.IsZero() {
+		return nil, sql.ErrNoRows
+	}
+	return cloneMeta(meta), nil
+}
+
+func (m *MemoryStore) ListTrash(prefix, cursor string, limit int, viewer *Viewer) ([]BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id, meta := range m.blobs {
+		if id > cursor && strings.HasPrefix(id, prefix) && !meta.DeletedAt.IsZero() && m.visible(meta, viewer) {
+			ids = append(ids, id)
+		}
+	}
+	return m.page(ids, limit), nil
+}
+
+func (m *MemoryStore) ExpiredTrash(before time.Time, limit int) ([]BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var metas []BlobMeta
+	for _, meta := range m.blobs {
+		if !meta.DeletedAt.IsZero() && meta.DeletedAt.Before(before) {
+			metas = append(metas, *cloneMeta(meta))
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if !metas[i].DeletedAt.Equal(metas[j].DeletedAt) {
+			return metas[i].DeletedAt.Before(metas[j].DeletedAt)
+		}
+		return metas[i].ID < metas[j].ID
+	})
+	if len(metas) > limit {
+		metas = metas[:limit]
+	}
+	return metas, nil
+}
+
+func (m *MemoryStore) RestoreTrashed(id string) (*BlobMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.blobs[id]
+	if !ok || meta.DeletedAt.IsZero() {
+		return nil, sql.ErrNoRows
+	}
+	meta.DeletedAt = time.Time{}
+	return cloneMeta(meta), nil
+}
+
+func (m *MemoryStore) PurgeTrashed(id string, deletedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.blobs[id]
+	if !ok || meta.DeletedAt.IsZero() || !meta.DeletedAt.Equal(deletedAt) {
+		return sql.ErrNoRows
+	}
+	delete(m.blobs, id)
+	delete(m.grants, id)
+	return nil
+}
+
+func (m *MemoryStore) ListExpired(now time.Time, cursor string, limit int) ([]BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id, meta := range m.blobs {
+		if id > cursor && meta.DeletedAt.IsZero() && !meta.ExpiresAt.IsZero() && !meta.ExpiresAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return m.page(ids, limit), nil
+}
+
+func (m *MemoryStore) ListUpdatedBefore(prefix string, before time.Time, cursor string, limit int) ([]BlobMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id, meta := range m.blobs {
+		if id > cursor && strings.HasPrefix(id, prefix) && !strings.HasPrefix(id, ".") &&
+			meta.DeletedAt.IsZero() && meta.UpdatedAt.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	return m.page(ids, limit), nil
+}
+
+// the maps and slices of a BlobMeta are never shared between the caller and a store
+func cloneMeta(meta *BlobMeta) *BlobMeta {
+	c := *meta
+	if meta.UserMetadata != nil {
+		c.UserMetadata = make(map[string]string, len(meta.UserMetadata))
+		for k, v := range meta.UserMetadata {
+			c.UserMetadata[k] = v
+		}
+	}
+	if meta.Tags != nil {
+		c.Tags = append([]string{}, meta.Tags...)
+	}
+	return &c
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+)
+
+func (m *MemoryStore) ListGrants(blobID string) ([]Grant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// same order as the SQL stores
+	grants := append([]Grant{}, m.grants[blobID]...)
+	sort.Slice(grants, func(i, j int) bool {
+		a, b := grants[i], grants[j]
+		if a.PrincipalType != b.PrincipalType {
+			return a.PrincipalType < b.PrincipalType
+		}
+		if a.Principal != b.Principal {
+			return a.Principal < b.Principal
+		}
+		return a.Permission < b.Permission
+	})
+	return grants, nil
+}
+
+func (m *MemoryStore) SetGrants(blobID string, grants []Grant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.blobs[blobID]; !ok {
+		return sql.ErrNoRows
+	}
+	saved := []Grant{}
+	for _, g := range grants {
+		if !hasGrant(saved, g.Permission, g.PrincipalType, g.Principal) {
+			saved = append(saved, g)
+		}
+	}
+	m.grants[blobID] = saved
+	return nil
+}
+
+func (m *MemoryStore) HasGrant(blobID, permission string, v Viewer) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.granted(blobID, permission, v), nil
+}
+
+// granted is HasGrant with the lock held
+func (m *MemoryStore) granted(blobID, permission string, v Viewer) bool {
+	if hasGrant(m.grants[blobID], permission, PrincipalUser, v.UserID) {
+		return true
+	}
+	for _, g := range v.Groups {
+		if hasGrant(m.grants[blobID], permission, PrincipalGroup, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible is the read check of the list queries, see visibleTo
+func (m *MemoryStore) visible(meta *BlobMeta, v *Viewer) bool {
+	return v == nil || meta.OwnerID != "" && meta.OwnerID == v.UserID || m.granted(meta.ID, PermRead, *v)
+}
+
+func hasGrant(grants []Grant, permission, principalType, principal string) bool {
+	for _, g := range grants {
+		if g.Permission == permission && g.PrincipalType == principalType && g.Principal == principal {
+			return true
+		}
+	}
+	return false
+}
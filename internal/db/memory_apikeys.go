@@ -0,0 +1,85 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+func (m *MemoryStore) CreateAPIKey(k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *k
+	saved.CreatedAt, saved.ExpiresAt = k.CreatedAt.UTC(), k.ExpiresAt.UTC()
+	m.apiKeys[k.ID] = &saved
+	return nil
+}
+
+func (m *MemoryStore) GetAPIKey(id string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.apiKeys[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *k
+	return &c, nil
+}
+
+func (m *MemoryStore) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, k := range m.apiKeys {
+		if k.Hash == hash {
+			c := *k
+			return &c, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) ListAPIKeys(userID string) ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []APIKey
+	for _, k := range m.apiKeys {
+		if k.UserID == userID {
+			keys = append(keys, *k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (m *MemoryStore) RevokeAPIKey(id string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.apiKeys[id]
+	if !ok || !k.RevokedAt.IsZero() {
+		return sql.ErrNoRows
+	}
+	k.RevokedAt = now.UTC()
+	return nil
+}
+
+func (m *MemoryStore) TouchAPIKey(id string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.apiKeys[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	k.LastUsedAt = now.UTC()
+	return nil
+}
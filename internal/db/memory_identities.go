@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+)
+
+func identityKey(issuer, subject string) string {
+	return issuer + "\x00" + subject
+}
+
+func (m *MemoryStore) GetUserByIdentity(issuer, subject string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	link, ok := m.identities[identityKey(issuer, subject)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	u, ok := m.users[link.UserID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *u
+	return &c, nil
+}
+
+func (m *MemoryStore) CreateLinkedUser(u *User, link *UserIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.users {
+		if existing.Username == u.Username {
+			return ErrUserExists
+		}
+	}
+	key := identityKey(link.Issuer, link.Subject)
+	if _, ok := m.identities[key]; ok {
+		return ErrIdentityLinked
+	}
+	saved := *u
+	saved.CreatedAt = u.CreatedAt.UTC()
+	saved.UpdatedAt = saved.CreatedAt
+	m.users[u.ID] = &saved
+	m.identities[key] = &UserIdentity{Issuer: link.Issuer, Subject: link.Subject, UserID: u.ID, CreatedAt: link.CreatedAt.UTC()}
+	return nil
+}
+
+func (m *MemoryStore) LinkIdentity(link *UserIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[link.UserID]; !ok {
+		return sql.ErrNoRows
+	}
+	key := identityKey(link.Issuer, link.Subject)
+	if _, ok := m.identities[key]; ok {
+		return ErrIdentityLinked
+	}
+	saved := *link
+	saved.CreatedAt = link.CreatedAt.UTC()
+	m.identities[key] = &saved
+	return nil
+}
+
+func (m *MemoryStore) UnlinkIdentity(userID, issuer, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := identityKey(issuer, subject)
+	if link, ok := m.identities[key]; !ok || link.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(m.identities, key)
+	return nil
+}
+
+func (m *MemoryStore) ListIdentities(userID string) ([]UserIdentity, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	identities := []UserIdentity{}
+	for _, link := range m.identities {
+		if link.UserID == userID {
+			identities = append(identities, *link)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		if identities[i].Issuer != identities[j].Issuer {
+			return identities[i].Issuer < identities[j].Issuer
+		}
+		return identities[i].Subject < identities[j].Subject
+	})
+	return identities, nil
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+func (m *MemoryStore) GetLoginFailures(key string) (*LoginFailures, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.loginFailures[key]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *f
+	return &c, nil
+}
+
+func (m *MemoryStore) AddLoginFailure(key string, now, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.loginFailures[key]
+	if !ok {
+		f = &LoginFailures{Key: key}
+		m.loginFailures[key] = f
+	}
+	if f.LastFailureAt.Before(since) {
+		f.Failures = 0
+	}
+	f.Failures++
+	f.LastFailureAt = now.UTC()
+	return f.Failures, nil
+}
+
+func (m *MemoryStore) LockLogin(l *Lockout) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f, ok := m.loginFailures[l.Key]; ok {
+		f.LockedUntil = l.LockedUntil.UTC()
+	}
+	saved := *l
+	saved.CreatedAt, saved.LockedUntil = l.CreatedAt.UTC(), l.LockedUntil.UTC()
+	m.lockouts = append(m.lockouts, saved)
+	return nil
+}
+
+func (m *MemoryStore) ClearLoginFailures(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginFailures, key)
+	return nil
+}
+
+func (m *MemoryStore) ListLockouts(limit int) ([]Lockout, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	lockouts := append([]Lockout{}, m.lockouts...)
+	sort.Slice(lockouts, func(i, j int) bool {
+		if !lockouts[i].CreatedAt.Equal(lockouts[j].CreatedAt) {
+			return lockouts[i].CreatedAt.After(lockouts[j].CreatedAt)
+		}
+		return lockouts[i].ID < lockouts[j].ID
+	})
+	if len(lockouts) > limit {
+		lockouts = lockouts[:limit]
+	}
+	return lockouts, nil
+}
+
+func (m *MemoryStore) DeleteStaleLoginFailures(before, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for key, f := range m.loginFailures {
+		if f.LastFailureAt.Before(before) && !f.LockedUntil.After(now) {
+			delete(m.loginFailures, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
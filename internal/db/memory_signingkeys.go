@@ -0,0 +1,62 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+func (m *MemoryStore) CreateSigningKey(k *SigningKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *k
+	saved.PrivateKey = append([]byte{}, k.PrivateKey...)
+	saved.CreatedAt, saved.RetiresAt, saved.ExpiresAt = k.CreatedAt.UTC(), k.RetiresAt.UTC(), k.ExpiresAt.UTC()
+	m.signingKeys[k.KID] = &saved
+	return nil
+}
+
+func (m *MemoryStore) ListSigningKeys(now time.Time) ([]SigningKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []SigningKey
+	for _, k := range m.signingKeys {
+		if k.ExpiresAt.After(now) {
+			keys = append(keys, *k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].KID < keys[j].KID
+	})
+	return keys, nil
+}
+
+func (m *MemoryStore) DeleteExpiredSigningKeys(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for kid, k := range m.signingKeys {
+		if !k.ExpiresAt.After(now) {
+			delete(m.signingKeys, kid)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStore) ResealSigningKey(kid, masterKeyID string, privateKey []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.signingKeys[kid]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	k.MasterKeyID, k.PrivateKey = masterKeyID, append([]byte{}, privateKey...)
+	return nil
+}
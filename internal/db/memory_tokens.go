@@ -0,0 +1,107 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+func (m *MemoryStore) CreateRefreshToken(t *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *t
+	saved.CreatedAt, saved.ExpiresAt = t.CreatedAt.UTC(), t.ExpiresAt.UTC()
+	m.refreshTokens[t.Hash] = &saved
+	return nil
+}
+
+func (m *MemoryStore) GetRefreshToken(hash string) (*RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.refreshTokens[hash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *t
+	return &c, nil
+}
+
+func (m *MemoryStore) UseRefreshToken(hash string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.refreshTokens[hash]
+	if !ok || !t.UsedAt.IsZero() || !t.RevokedAt.IsZero() || !t.ExpiresAt.After(now) {
+		return sql.ErrNoRows
+	}
+	t.UsedAt = now.UTC()
+	return nil
+}
+
+func (m *MemoryStore) RevokeRefreshFamily(familyID string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.refreshTokens {
+		if t.FamilyID == familyID && t.RevokedAt.IsZero() {
+			t.RevokedAt = now.UTC()
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RevokeUserRefreshTokens(userID string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.refreshTokens {
+		if t.UserID == userID && t.RevokedAt.IsZero() {
+			t.RevokedAt = now.UTC()
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RevokeToken(jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.revokedTokens[jti]; !ok {
+		m.revokedTokens[jti] = expiresAt.UTC()
+	}
+	return nil
+}
+
+func (m *MemoryStore) RevokedTokens(now time.Time) (map[string]time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revoked := map[string]time.Time{}
+	for jti, exp := range m.revokedTokens {
+		if exp.After(now) {
+			revoked[jti] = exp
+		}
+	}
+	return revoked, nil
+}
+
+func (m *MemoryStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for hash, t := range m.refreshTokens {
+		if !t.ExpiresAt.After(now) {
+			delete(m.refreshTokens, hash)
+			deleted++
+		}
+	}
+	for jti, exp := range m.revokedTokens {
+		if !exp.After(now) {
+			delete(m.revokedTokens, jti)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
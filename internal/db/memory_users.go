@@ -0,0 +1,119 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+func (m *MemoryStore) CreateUser(u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.users {
+		if existing.Username == u.Username {
+			return ErrUserExists
+		}
+	}
+	saved := *u
+	saved.CreatedAt = u.CreatedAt.UTC()
+	saved.UpdatedAt = saved.CreatedAt
+	m.users[u.ID] = &saved
+	return nil
+}
+
+func (m *MemoryStore) GetUser(id string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *u
+	return &c, nil
+}
+
+func (m *MemoryStore) GetUserByName(username string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		if u.Username == username {
+			c := *u
+			return &c, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) ListUsers() ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (m *MemoryStore) CountUsers() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.users), nil
+}
+
+func (m *MemoryStore) SetUserDisabled(id string, disabled bool, now time.Time) error {
+	return m.updateUser(id, now, func(u *User) { u.Disabled = disabled })
+}
+
+func (m *MemoryStore) SetUserPassword(id, passwordHash string, now time.Time) error {
+	return m.updateUser(id, now, func(u *User) { u.PasswordHash = passwordHash })
+}
+
+func (m *MemoryStore) SetUserRole(id, role string, now time.Time) error {
+	return m.updateUser(id, now, func(u *User) { u.Role = role })
+}
+
+func (m *MemoryStore) updateUser(id string, now time.Time, update func(u *User)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	update(u)
+	u.UpdatedAt = now.UTC()
+	return nil
+}
+
+func (m *MemoryStore) UserGroups(id string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	groups := append([]string{}, m.groups[id]...)
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func (m *MemoryStore) SetUserGroups(id string, groups []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[id]; !ok {
+		return sql.ErrNoRows
+	}
+	set := map[string]bool{}
+	m.groups[id] = nil
+	for _, g := range groups {
+		if !set[g] {
+			set[g] = true
+			m.groups[id] = append(m.groups[id], g)
+		}
+	}
+	return nil
+}
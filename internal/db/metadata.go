@@ -1,8 +1,13 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"rekazdrive/internal/storage"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type MetadataDB struct {
@@ -11,8 +16,49 @@ type MetadataDB struct {
 
 type BlobMeta struct {
 	ID string
-	Size int
-	CreatedAt time.Time
+	Size int64
+	CreatedAt time.Time // first upload
+	UpdatedAt time.Time // last upload or metadata change
+	ContentType string
+	Filename string // original file name as given by the client
+	SHA256 string // hex
+	MD5 string // hex
+	UserMetadata map[string]string
+	Tags []string
+	VersionID string // current version of a versioned blob, empty otherwise
+	DeletedAt time.Time // when it went to the trash, zero for live blobs
+	ExpiresAt time.Time // the lifecycle worker deletes it after this, zero = never
+	OwnerID string // user who first uploaded it, empty for blobs from before accounts, see acl.go
+}
+
+// Key is where the blob's current data is stored
+func (b *BlobMeta) Key() string {
+	if b.VersionID != "" {
+		return storage.VersionKey(b.VersionID)
+	}
+	return b.ID
+}
+
+// rows from before these columns existed have NULLs, they read as empty values
+const metaColumns = `id, size, created_at, COALESCE(updated_at, created_at), COALESCE(content_type, ''),
+	COALESCE(filename, ''), COALESCE(sha256, ''), COALESCE(md5, ''), user_metadata, tags, COALESCE(version_id, ''), expires_at, COALESCE(owner_id, '')`
+
+// extra receives columns selected after metaColumns
+func scanMeta(row interface{ Scan(...any) error }, extra ...any) (*BlobMeta, error) {
+	var meta BlobMeta
+	var userMeta []byte
+	var expiresAt sql.NullTime
+	dest := []any{&meta.ID, &meta.Size, &meta.CreatedAt, &meta.UpdatedAt, &meta.ContentType,
+		&meta.Filename, &meta.SHA256, &meta.MD5, &userMeta, pq.Array(&meta.Tags), &meta.VersionID, &expiresAt, &meta.OwnerID}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	meta.ExpiresAt = expiresAt.Time
+	if err := json.Unmarshal(userMeta, &meta.UserMetadata); err != nil {
+		return nil, err
+	}
+	return &meta, nil
 }
 
 // initialize new MetadataDB using Postgres
@@ -24,38 +70,154 @@ func NewPostgres(dsn string) (*MetadataDB, error) {
 	return &MetadataDB{DB: db}, nil
 }
 
+// InitSchema brings the metadata database up to the latest migration, see migrate.go
 func (m *MetadataDB) InitSchema() error {
-	query := `CREATE TABLE IF NOT EXISTS blobs_metadata (
-		id TEXT PRIMARY KEY,
-		size INTEGER NOT NULL,
-		created_at TIMESTAMPTZ NOT NULL
-		);`
-	
-	_, err := m.DB.Exec(query)
+	migrator, err := NewMigrator(m.DB, ScopeMetadata)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(context.Background())
 
 	return err
 }
 
-func (m *MetadataDB) SaveMetadata(id string, size int, createdAt time.Time) error {
-	query := `INSERT INTO blobs_metadata(id, size, created_at)
-		      VALUES($1, $2, $3)
+// SaveMetadata records a finished upload. On overwrite everything is replaced,
+// the expiry too, except created_at and the owner, which stay those of the first upload. Uploading over
+// a trashed blob takes it out of the trash. A versioned upload also adds the
+// version, both become visible together.
+func (m *MetadataDB) SaveMetadata(meta *BlobMeta) error {
+	userMeta, err := json.Marshal(nonNilMap(meta.UserMetadata))
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if meta.VersionID != "" {
+		query := `INSERT INTO blob_versions(id, version_id, size, created_at, content_type, filename, sha256, md5, user_metadata, tags)
+			      VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`
+		_, err := tx.Exec(query, meta.ID, meta.VersionID, meta.Size, meta.UpdatedAt.UTC(), meta.ContentType, meta.Filename,
+			meta.SHA256, meta.MD5, userMeta, pq.Array(nonNilSlice(meta.Tags)))
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `INSERT INTO blobs_metadata(id, size, created_at, updated_at, content_type, filename, sha256, md5, user_metadata, tags, version_id, expires_at, owner_id)
+		      VALUES($1, $2, $3, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, NULLIF($12, ''))
 			  ON CONFLICT (id) DO UPDATE
-			  SET size = EXCLUDED.size, created_at = EXCLUDED.created_at;`
-	
-	_, err := m.DB.Exec(query, id, size, createdAt.UTC())
+			  SET size = EXCLUDED.size, updated_at = EXCLUDED.updated_at, content_type = EXCLUDED.content_type,
+			  filename = EXCLUDED.filename, sha256 = EXCLUDED.sha256, md5 = EXCLUDED.md5,
+			  user_metadata = EXCLUDED.user_metadata, tags = EXCLUDED.tags, version_id = EXCLUDED.version_id,
+			  expires_at = EXCLUDED.expires_at, deleted_at = NULL,
+			  owner_id = COALESCE(blobs_metadata.owner_id, EXCLUDED.owner_id);`
 
-	return err
+	_, err = tx.Exec(query, meta.ID, meta.Size, meta.UpdatedAt.UTC(), meta.ContentType, meta.Filename,
+		meta.SHA256, meta.MD5, userMeta, pq.Array(nonNilSlice(meta.Tags)), meta.VersionID, nullTime(meta.ExpiresAt), meta.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
+// GetMetadata doesn't see trashed blobs, see GetTrashed
 func (m *MetadataDB) GetMetadata(id string) (*BlobMeta, error) {
-	query := `SELECT id, size, created_at FROM blobs_metadata WHERE id = $1;`
-	row := m.DB.QueryRow(query, id)
+	query := `SELECT ` + metaColumns + ` FROM blobs_metadata WHERE id = $1 AND deleted_at IS NULL;`
+	return scanMeta(m.DB.QueryRow(query, id))
+}
 
-	var meta BlobMeta
-	err := row.Scan(&meta.ID, &meta.Size, &meta.CreatedAt)
+// UpdateUserMetadata replaces the user metadata and/or tags of an existing
+// blob, a nil argument leaves that part as it is. Returns sql.ErrNoRows for
+// unknown and trashed ids.
+func (m *MetadataDB) UpdateUserMetadata(id string, userMeta map[string]string, tags []string, now time.Time) (*BlobMeta, error) {
+	var metaJSON any // NULL keeps the current value
+	if userMeta != nil {
+		b, err := json.Marshal(userMeta)
+		if err != nil {
+			return nil, err
+		}
+		metaJSON = string(b)
+	}
+
+	query := `UPDATE blobs_metadata
+		      SET user_metadata = COALESCE($2::jsonb, user_metadata), tags = COALESCE($3::text[], tags), updated_at = $4
+			  WHERE id = $1 AND deleted_at IS NULL
+			  RETURNING ` + metaColumns + `;`
+	return scanMeta(m.DB.QueryRow(query, id, metaJSON, pq.Array(tags), now.UTC()))
+}
+
+// nullTime stores a zero time as NULL
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+func nonNilMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+func nonNilSlice(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// returns sql.ErrNoRows when there was nothing to delete, same as GetMetadata on a miss
+func (m *MetadataDB) DeleteMetadata(id string) error {
+	query := `DELETE FROM blobs_metadata WHERE id = $1;`
+	res, err := m.DB.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListMetadata returns up to limit rows whose id starts with prefix and sorts after cursor,
+// keyset pagination keeps every page an index range scan no matter how deep the client goes.
+// Trashed rows and rows of internal names (".versions/...", written by the storage layers)
+// are left out, and so is everything viewer may not read unless it is nil. Rows that expired
+// by now are left out too, here and not after the LIMIT so a page is never cut short.
+func (m *MetadataDB) ListMetadata(prefix, cursor string, limit int, viewer *Viewer, now time.Time) ([]BlobMeta, error) {
+	userID, groups := viewer.args()
+	query := `SELECT ` + metaColumns + ` FROM blobs_metadata
+		      WHERE id > $1 AND id LIKE $2 ESCAPE '\' AND id NOT LIKE '.%' AND deleted_at IS NULL
+			  AND (expires_at IS NULL OR expires_at > $6) AND ` + visibleTo + `
+			  ORDER BY id
+			  LIMIT $3;`
+	rows, err := m.DB.Query(query, cursor, storage.EscapeLike(prefix)+"%", limit, userID, pq.Array(groups), now.UTC())
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &meta, nil
-}
\ No newline at end of file
+	var metas []BlobMeta
+	for rows.Next() {
+		meta, err := scanMeta(rows)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, *meta)
+	}
+
+	return metas, rows.Err()
+}
@@ -0,0 +1,248 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema changes ship as numbered SQL files in migrations/<scope>/:
+//
+//	0006_add_owner.up.sql    applied by Up
+//	0006_add_owner.down.sql  applied by Down, undoes the up file
+//
+// Every file runs in its own transaction together with its row in
+// schema_migrations, so a failed migration leaves nothing half applied.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// the two Postgres databases, they can also be one and the same, and the
+// SQLite metadata file
+const (
+	ScopeMetadata = "metadata"
+	ScopeBlob = "blob"
+	ScopeSQLite = "sqlite"
+)
+
+type Migration struct {
+	Version int
+	Name string
+	Up string
+	Down string
+}
+
+// MigrationStatus is one known migration and whether it is applied
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies the migrations of one scope to one database
+type Migrator struct {
+	DB *sql.DB
+	Scope string
+	Migrations []Migration
+	// SQLite has no advisory locks and no TIMESTAMPTZ, the file belongs to one process anyway
+	SQLite bool
+}
+
+func NewMigrator(sqlDB *sql.DB, scope string) (*Migrator, error) {
+	migrations, err := LoadMigrations(migrationFiles, path.Join("migrations", scope))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: sqlDB, Scope: scope, Migrations: migrations, SQLite: scope == ScopeSQLite}, nil
+}
+
+// LoadMigrations reads NNNN_name.up.sql / NNNN_name.down.sql pairs from dir,
+// sorted by version. Every version needs both files and versions must not repeat.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") || !ok || direction != "up" && direction != "down" {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+		num, label, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: %q is not a version number", name, num)
+		}
+
+		body, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if m.Name != label {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies every pending migration in order and returns the versions it applied
+func (m *Migrator) Up(ctx context.Context) ([]int, error) {
+	var done []int
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for _, mig := range m.Migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			record := `INSERT INTO schema_migrations(scope, version, name, applied_at) VALUES($1, $2, $3, $4);`
+			if err := m.apply(ctx, conn, mig, mig.Up, record, m.Scope, mig.Version, mig.Name, time.Now().UTC()); err != nil {
+				return err
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the last steps applied migrations, newest first
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int, error) {
+	var done []int
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for i := len(m.Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.Migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			record := `DELETE FROM schema_migrations WHERE scope = $1 AND version = $2;`
+			if err := m.apply(ctx, conn, mig, mig.Down, record, m.Scope, mig.Version); err != nil {
+				return err
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every known migration with the time it was applied, if it was
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for _, mig := range m.Migrations {
+			s := MigrationStatus{Migration: mig}
+			if at, ok := applied[mig.Version]; ok {
+				s.AppliedAt = &at
+			}
+			status = append(status, s)
+		}
+		return nil
+	})
+	return status, err
+}
+
+// apply runs one migration file and its schema_migrations bookkeeping in one transaction
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration, script, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("%s migration %04d_%s: %w", m.Scope, mig.Version, mig.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// locked runs fn while holding the scope's advisory lock, so replicas starting
+// at the same time apply each migration once: the first one migrates, the
+// others wait and then find nothing left to do
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, applied map[int]time.Time) error) error {
+	// session level locks belong to a connection, so everything runs on this one
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timestamp := "TIMESTAMP"
+	if !m.SQLite {
+		key := advisoryKey("rekazdrive-migrations-" + m.Scope)
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, key); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1);`, key)
+		timestamp = "TIMESTAMPTZ"
+	}
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		scope TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		applied_at ` + timestamp + ` NOT NULL,
+		PRIMARY KEY (scope, version)
+		);`
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations WHERE scope = $1;`, m.Scope)
+	if err != nil {
+		return err
+	}
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = at
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return fn(conn, applied)
+}
+
+func advisoryKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS blobs_data (
+	id TEXT PRIMARY KEY,
+	data BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
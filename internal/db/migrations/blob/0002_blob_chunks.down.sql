@@ -0,0 +1,7 @@
+ALTER TABLE blobs_data ADD COLUMN data BYTEA NOT NULL DEFAULT '';
+UPDATE blobs_data b SET data = c.data
+FROM (SELECT blob_id, string_agg(data, '' ORDER BY seq) AS data FROM blob_chunks GROUP BY blob_id) c
+WHERE c.blob_id = b.id;
+ALTER TABLE blobs_data ALTER COLUMN data DROP DEFAULT;
+ALTER TABLE blobs_data DROP COLUMN size;
+DROP TABLE IF EXISTS blob_chunks;
@@ -0,0 +1,19 @@
+-- blob data moves into rows of at most 4 MiB, appending to one bytea value
+-- rewrote all of it every time and capped a blob at 1 GB. pos is where the
+-- chunk starts in the blob, so range reads find their first chunk.
+CREATE TABLE blob_chunks (
+	blob_id TEXT NOT NULL REFERENCES blobs_data (id) ON DELETE CASCADE,
+	seq INTEGER NOT NULL,
+	pos BIGINT NOT NULL,
+	data BYTEA NOT NULL,
+	PRIMARY KEY (blob_id, seq)
+);
+CREATE INDEX blob_chunks_pos ON blob_chunks (blob_id, pos);
+
+ALTER TABLE blobs_data ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+UPDATE blobs_data SET size = octet_length(data);
+INSERT INTO blob_chunks (blob_id, seq, pos, data)
+SELECT id, s, s::BIGINT * 4194304, substring(data from s * 4194304 + 1 for 4194304)
+FROM blobs_data, generate_series(0, (octet_length(data) - 1) / 4194304) AS s
+WHERE octet_length(data) > 0;
+ALTER TABLE blobs_data DROP COLUMN data;
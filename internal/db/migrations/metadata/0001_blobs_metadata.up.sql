@@ -0,0 +1,7 @@
+-- IF NOT EXISTS everywhere up to 0005: deployments from before versioned
+-- migrations already have these tables from the old InitSchema
+CREATE TABLE IF NOT EXISTS blobs_metadata (
+	id TEXT PRIMARY KEY,
+	size INTEGER NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS blob_digests;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS digest;
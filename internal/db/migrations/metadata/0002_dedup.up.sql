@@ -0,0 +1,7 @@
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS digest TEXT;
+
+CREATE TABLE IF NOT EXISTS blob_digests (
+	digest TEXT PRIMARY KEY,
+	size BIGINT NOT NULL,
+	refcount INTEGER NOT NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS stored_size;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS original_size;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS codec;
@@ -0,0 +1,3 @@
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS codec TEXT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS original_size BIGINT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS stored_size BIGINT;
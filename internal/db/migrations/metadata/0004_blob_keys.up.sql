@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS blob_keys (
+	id TEXT PRIMARY KEY,
+	object TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	master_key_id TEXT NOT NULL,
+	wrapped_key BYTEA NOT NULL,
+	nonce BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,9 @@
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS tags;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS user_metadata;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS md5;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS sha256;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS filename;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS content_type;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS updated_at;
+-- fails if a blob of 2 GiB or more was stored since
+ALTER TABLE blobs_metadata ALTER COLUMN size TYPE INTEGER;
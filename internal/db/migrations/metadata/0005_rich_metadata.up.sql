@@ -0,0 +1,9 @@
+-- INTEGER overflowed at 2 GiB
+ALTER TABLE blobs_metadata ALTER COLUMN size TYPE BIGINT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS content_type TEXT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS filename TEXT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS sha256 TEXT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS md5 TEXT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS user_metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
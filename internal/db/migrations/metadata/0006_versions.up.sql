@@ -0,0 +1,17 @@
+-- versioned blobs point at their current version, every version keeps the
+-- metadata it was written with
+ALTER TABLE blobs_metadata ADD COLUMN version_id TEXT;
+
+CREATE TABLE blob_versions (
+	id TEXT NOT NULL,
+	version_id TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	content_type TEXT NOT NULL DEFAULT '',
+	filename TEXT NOT NULL DEFAULT '',
+	sha256 TEXT NOT NULL DEFAULT '',
+	md5 TEXT NOT NULL DEFAULT '',
+	user_metadata JSONB NOT NULL DEFAULT '{}',
+	tags TEXT[] NOT NULL DEFAULT '{}',
+	PRIMARY KEY (id, version_id)
+);
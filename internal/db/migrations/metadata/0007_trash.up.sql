@@ -0,0 +1,3 @@
+-- a deleted blob stays in the trash until it is restored or purged
+ALTER TABLE blobs_metadata ADD COLUMN deleted_at TIMESTAMPTZ;
+CREATE INDEX blobs_metadata_deleted_at ON blobs_metadata (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS lifecycle_state;
+DROP INDEX IF EXISTS blobs_metadata_expires_at;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,11 @@
+-- per-blob expiry, swept by the lifecycle worker
+ALTER TABLE blobs_metadata ADD COLUMN expires_at TIMESTAMPTZ;
+CREATE INDEX blobs_metadata_expires_at ON blobs_metadata (expires_at) WHERE expires_at IS NOT NULL;
+
+-- leader lease and scan checkpoints of the lifecycle worker, one row each
+CREATE TABLE lifecycle_state (
+	name TEXT PRIMARY KEY,
+	holder TEXT NOT NULL DEFAULT '',
+	lease_until TIMESTAMPTZ,
+	scan_cursor TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,4 @@
+-- one role per user instead of the admin flag, see auth/scopes.go
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'writer' CHECK (role IN ('admin', 'writer', 'reader'));
+UPDATE users SET role = 'admin' WHERE is_admin;
+ALTER TABLE users DROP COLUMN is_admin;
@@ -0,0 +1,12 @@
+-- keys access tokens are signed with when JWT_ALGORITHM isn't HS256. A key
+-- signs until retires_at and still verifies until expires_at, after which no
+-- token it signed is valid any more.
+CREATE TABLE signing_keys (
+	kid TEXT PRIMARY KEY,
+	algorithm TEXT NOT NULL,
+	private_key BYTEA NOT NULL, -- PKCS #8, DER
+	created_at TIMESTAMPTZ NOT NULL,
+	retires_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX signing_keys_expires_at ON signing_keys (expires_at);
@@ -0,0 +1,19 @@
+-- failed logins, throttle_key is "user:<username>" or "ip:<address>". The
+-- count starts over once the last failure is old enough.
+CREATE TABLE login_failures (
+	throttle_key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure_at TIMESTAMPTZ NOT NULL,
+	locked_until TIMESTAMPTZ
+);
+CREATE INDEX login_failures_last_failure_at ON login_failures (last_failure_at);
+
+-- every time a username or address got locked, for admins to look into
+CREATE TABLE login_lockouts (
+	id TEXT PRIMARY KEY,
+	throttle_key TEXT NOT NULL,
+	failures INTEGER NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	locked_until TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX login_lockouts_created_at ON login_lockouts (created_at);
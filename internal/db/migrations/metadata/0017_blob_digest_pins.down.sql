@@ -0,0 +1 @@
+ALTER TABLE blob_digests DROP COLUMN IF EXISTS pending;
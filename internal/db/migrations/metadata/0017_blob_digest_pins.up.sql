@@ -0,0 +1,2 @@
+-- writers that are uploading a digest's object, it isn't deleted while any are
+ALTER TABLE blob_digests ADD COLUMN IF NOT EXISTS pending INTEGER NOT NULL DEFAULT 0;
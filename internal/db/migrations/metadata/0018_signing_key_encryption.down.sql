@@ -0,0 +1 @@
+ALTER TABLE signing_keys DROP COLUMN IF EXISTS master_key_id;
@@ -0,0 +1,3 @@
+-- private keys are sealed with the master key master_key_id names, '' is a
+-- key from before that, stored as plain PKCS #8 until it is sealed
+ALTER TABLE signing_keys ADD COLUMN IF NOT EXISTS master_key_id TEXT NOT NULL DEFAULT '';
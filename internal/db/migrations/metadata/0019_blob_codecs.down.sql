@@ -0,0 +1,10 @@
+-- only blobs still stored under their own id can go back, the others lose their codec
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS codec TEXT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS original_size BIGINT;
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS stored_size BIGINT;
+
+UPDATE blobs_metadata m
+SET codec = NULLIF(c.codec, ''), original_size = c.original_size, stored_size = c.stored_size
+FROM blob_codecs c WHERE c.id = m.id AND c.object = c.id;
+
+DROP TABLE IF EXISTS blob_codecs;
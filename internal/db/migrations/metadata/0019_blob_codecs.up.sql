@@ -0,0 +1,20 @@
+-- where CompressedBackend keeps each blob and how it encoded it, apart from
+-- blobs_metadata so an upload that fails leaves no row behind. Blobs written
+-- before this are stored under their own id.
+CREATE TABLE IF NOT EXISTS blob_codecs (
+	id TEXT PRIMARY KEY,
+	object TEXT NOT NULL,
+	codec TEXT NOT NULL, -- '' for none
+	original_size BIGINT NOT NULL,
+	stored_size BIGINT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+INSERT INTO blob_codecs(id, object, codec, original_size, stored_size, created_at)
+SELECT id, id, COALESCE(codec, ''), original_size, stored_size, created_at
+FROM blobs_metadata WHERE stored_size IS NOT NULL
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS codec;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS original_size;
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS stored_size;
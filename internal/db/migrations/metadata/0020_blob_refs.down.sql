@@ -0,0 +1,5 @@
+ALTER TABLE blobs_metadata ADD COLUMN IF NOT EXISTS digest TEXT;
+
+UPDATE blobs_metadata m SET digest = r.digest FROM blob_refs r WHERE r.id = m.id;
+
+DROP TABLE IF EXISTS blob_refs;
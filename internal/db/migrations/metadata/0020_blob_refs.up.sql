@@ -0,0 +1,14 @@
+-- which content every id has in the dedup mode, apart from blobs_metadata so
+-- an upload that fails before its metadata is saved leaves no row behind
+CREATE TABLE IF NOT EXISTS blob_refs (
+	id TEXT PRIMARY KEY,
+	digest TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+INSERT INTO blob_refs(id, digest, size, created_at)
+SELECT id, digest, size, created_at FROM blobs_metadata WHERE digest IS NOT NULL
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE blobs_metadata DROP COLUMN IF EXISTS digest;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS blob_keys;
+DROP TABLE IF EXISTS blob_digests;
+DROP TABLE IF EXISTS blobs_metadata;
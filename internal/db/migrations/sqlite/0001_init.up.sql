@@ -0,0 +1,34 @@
+-- the SQLite schema starts out with everything the Postgres one has after
+-- metadata/0005. Times are TIMESTAMP so the driver hands them back as time.Time.
+CREATE TABLE blobs_metadata (
+	id TEXT PRIMARY KEY,
+	size INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	content_type TEXT NOT NULL DEFAULT '',
+	filename TEXT NOT NULL DEFAULT '',
+	sha256 TEXT NOT NULL DEFAULT '',
+	md5 TEXT NOT NULL DEFAULT '',
+	user_metadata TEXT NOT NULL DEFAULT '{}', -- JSON object
+	tags TEXT NOT NULL DEFAULT '[]', -- JSON array
+	digest TEXT,
+	codec TEXT,
+	original_size INTEGER,
+	stored_size INTEGER
+);
+
+CREATE TABLE blob_digests (
+	digest TEXT PRIMARY KEY,
+	size INTEGER NOT NULL,
+	refcount INTEGER NOT NULL
+);
+
+CREATE TABLE blob_keys (
+	id TEXT PRIMARY KEY,
+	object TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	master_key_id TEXT NOT NULL,
+	wrapped_key BLOB NOT NULL,
+	nonce BLOB NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
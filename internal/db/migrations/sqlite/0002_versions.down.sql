@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS blob_versions;
+ALTER TABLE blobs_metadata DROP COLUMN version_id;
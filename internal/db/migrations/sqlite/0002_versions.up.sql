@@ -0,0 +1,15 @@
+ALTER TABLE blobs_metadata ADD COLUMN version_id TEXT;
+
+CREATE TABLE blob_versions (
+	id TEXT NOT NULL,
+	version_id TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	content_type TEXT NOT NULL DEFAULT '',
+	filename TEXT NOT NULL DEFAULT '',
+	sha256 TEXT NOT NULL DEFAULT '',
+	md5 TEXT NOT NULL DEFAULT '',
+	user_metadata TEXT NOT NULL DEFAULT '{}',
+	tags TEXT NOT NULL DEFAULT '[]',
+	PRIMARY KEY (id, version_id)
+);
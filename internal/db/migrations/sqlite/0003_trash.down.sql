@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS blobs_metadata_deleted_at;
+ALTER TABLE blobs_metadata DROP COLUMN deleted_at;
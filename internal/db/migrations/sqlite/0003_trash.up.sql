@@ -0,0 +1,2 @@
+ALTER TABLE blobs_metadata ADD COLUMN deleted_at TIMESTAMP;
+CREATE INDEX blobs_metadata_deleted_at ON blobs_metadata (deleted_at) WHERE deleted_at IS NOT NULL;
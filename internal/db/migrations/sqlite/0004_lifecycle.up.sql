@@ -0,0 +1,9 @@
+ALTER TABLE blobs_metadata ADD COLUMN expires_at TIMESTAMP;
+CREATE INDEX blobs_metadata_expires_at ON blobs_metadata (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE lifecycle_state (
+	name TEXT PRIMARY KEY,
+	holder TEXT NOT NULL DEFAULT '',
+	lease_until TIMESTAMP,
+	scan_cursor TEXT NOT NULL DEFAULT ''
+);
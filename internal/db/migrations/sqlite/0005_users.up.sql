@@ -0,0 +1,10 @@
+-- accounts that can log in, the first admin is seeded from ADMIN_USER/ADMIN_PASS
+CREATE TABLE users (
+	id TEXT PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	is_admin BOOLEAN NOT NULL DEFAULT false,
+	disabled BOOLEAN NOT NULL DEFAULT false,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
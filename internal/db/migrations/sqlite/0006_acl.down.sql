@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_groups;
+DROP TABLE IF EXISTS blob_acl;
+ALTER TABLE blobs_metadata DROP COLUMN owner_id;
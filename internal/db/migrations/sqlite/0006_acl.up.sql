@@ -0,0 +1,17 @@
+-- the foreign keys need _foreign_keys=1 on the connection, see NewSQLite
+ALTER TABLE blobs_metadata ADD COLUMN owner_id TEXT;
+
+CREATE TABLE blob_acl (
+	blob_id TEXT NOT NULL REFERENCES blobs_metadata (id) ON DELETE CASCADE,
+	principal_type TEXT NOT NULL CHECK (principal_type IN ('user', 'group')),
+	principal TEXT NOT NULL,
+	permission TEXT NOT NULL CHECK (permission IN ('read', 'write', 'delete')),
+	PRIMARY KEY (blob_id, principal_type, principal, permission)
+);
+CREATE INDEX blob_acl_principal ON blob_acl (principal_type, principal);
+
+CREATE TABLE user_groups (
+	user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	group_name TEXT NOT NULL,
+	PRIMARY KEY (user_id, group_name)
+);
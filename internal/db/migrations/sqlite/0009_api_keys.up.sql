@@ -0,0 +1,15 @@
+-- long-lived keys for scripts and CI, acting as their user. Only a hash of the
+-- key is stored, prefix is its first characters so people can tell keys apart.
+CREATE TABLE api_keys (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE,
+	scope TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP,
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP
+);
+CREATE INDEX api_keys_user ON api_keys (user_id);
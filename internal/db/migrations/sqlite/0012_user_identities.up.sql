@@ -0,0 +1,10 @@
+-- accounts of users from an external OIDC provider, by the provider's issuer
+-- and its sub for the user. Usernames alone don't decide who an account is.
+CREATE TABLE user_identities (
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX user_identities_user_id ON user_identities (user_id);
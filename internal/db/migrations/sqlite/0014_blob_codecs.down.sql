@@ -0,0 +1,11 @@
+-- only blobs still stored under their own id can go back, the others lose their codec
+ALTER TABLE blobs_metadata ADD COLUMN codec TEXT;
+ALTER TABLE blobs_metadata ADD COLUMN original_size INTEGER;
+ALTER TABLE blobs_metadata ADD COLUMN stored_size INTEGER;
+
+UPDATE blobs_metadata
+SET codec = (SELECT NULLIF(codec, '') FROM blob_codecs c WHERE c.id = blobs_metadata.id AND c.object = c.id),
+    original_size = (SELECT original_size FROM blob_codecs c WHERE c.id = blobs_metadata.id AND c.object = c.id),
+    stored_size = (SELECT stored_size FROM blob_codecs c WHERE c.id = blobs_metadata.id AND c.object = c.id);
+
+DROP TABLE blob_codecs;
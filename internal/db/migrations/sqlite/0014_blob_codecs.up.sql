@@ -0,0 +1,19 @@
+-- where CompressedBackend keeps each blob and how it encoded it, apart from
+-- blobs_metadata so an upload that fails leaves no row behind. Blobs written
+-- before this are stored under their own id.
+CREATE TABLE blob_codecs (
+	id TEXT PRIMARY KEY,
+	object TEXT NOT NULL,
+	codec TEXT NOT NULL, -- '' for none
+	original_size INTEGER NOT NULL,
+	stored_size INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO blob_codecs(id, object, codec, original_size, stored_size, created_at)
+SELECT id, id, COALESCE(codec, ''), original_size, stored_size, created_at
+FROM blobs_metadata WHERE stored_size IS NOT NULL;
+
+ALTER TABLE blobs_metadata DROP COLUMN codec;
+ALTER TABLE blobs_metadata DROP COLUMN original_size;
+ALTER TABLE blobs_metadata DROP COLUMN stored_size;
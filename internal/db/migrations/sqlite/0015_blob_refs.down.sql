@@ -0,0 +1,5 @@
+ALTER TABLE blobs_metadata ADD COLUMN digest TEXT;
+
+UPDATE blobs_metadata SET digest = (SELECT digest FROM blob_refs r WHERE r.id = blobs_metadata.id);
+
+DROP TABLE blob_refs;
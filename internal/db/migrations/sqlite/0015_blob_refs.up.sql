@@ -0,0 +1,13 @@
+-- which content every id has in the dedup mode, apart from blobs_metadata so
+-- an upload that fails before its metadata is saved leaves no row behind
+CREATE TABLE blob_refs (
+	id TEXT PRIMARY KEY,
+	digest TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO blob_refs(id, digest, size, created_at)
+SELECT id, digest, size, created_at FROM blobs_metadata WHERE digest IS NOT NULL;
+
+ALTER TABLE blobs_metadata DROP COLUMN digest;
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"rekazdrive/internal/storage"
+	"time"
+)
+
+// MetadataDB is the storage.RefIndex of the dedup mode: blob_refs says which
+// content an id has, blob_digests counts how many ids share it. Neither touches
+// blobs_metadata, that row only exists once the handler saved the metadata.
+//
+// No object is uploaded or deleted inside a transaction. A writer first pins
+// the digest (blob_digests.pending) and uploads if nothing references it, the
+// reference is then taken in a short transaction. An object is only deleted
+// after the transaction that took its count to zero has committed, and only
+// while its row is still at zero and unpinned, so a concurrent writer of the
+// same content can never end up with a count but without the object.
+
+func (m *MetadataDB) Ref(ctx context.Context, id, digest string, size int64, upload func() error, release func(digest string) error) error {
+	var refs int
+	query := `INSERT INTO blob_digests(digest, size, refcount, pending) VALUES($1, $2, 0, 1)
+		      ON CONFLICT (digest) DO UPDATE SET pending = blob_digests.pending + 1
+			  RETURNING refcount;`
+	if err := m.DB.QueryRowContext(ctx, query, digest, size).Scan(&refs); err != nil {
+		return err
+	}
+	// a release that got the row first has deleted the object, the pin keeps any later one off it
+	if refs == 0 {
+		if err := upload(); err != nil {
+			m.unpin(digest)
+			return err
+		}
+	}
+
+	old, err := m.ref(ctx, id, digest, size)
+	if err != nil {
+		m.unpin(digest)
+		return err
+	}
+	return m.releaseObject(ctx, old, release)
+}
+
+// ref points id at the pinned digest and drops the pin, it returns the digest
+// id pointed at until now if that lost its last reference
+func (m *MetadataDB) ref(ctx context.Context, id, digest string, size int64) (string, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// the first write of id inserts its row, an overwrite locks the one that is there
+	now := time.Now().UTC()
+	query := `INSERT INTO blob_refs(id, digest, size, created_at) VALUES($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING;`
+	res, err := tx.ExecContext(ctx, query, id, digest, size, now)
+	if err != nil {
+		return "", err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	var old sql.NullString
+	if n == 0 {
+		query = `SELECT digest FROM blob_refs WHERE id = $1 FOR UPDATE;`
+		if err := tx.QueryRowContext(ctx, query, id).Scan(&old); err != nil {
+			return "", err
+		}
+	}
+	same := old.Valid && old.String == digest // same content again, only the pin goes
+
+	inc := 1
+	if same {
+		inc = 0
+	}
+	query = `UPDATE blob_digests SET pending = pending - 1, refcount = refcount + $2 WHERE digest = $1;`
+	if _, err := tx.ExecContext(ctx, query, digest, inc); err != nil {
+		return "", err
+	}
+	if same {
+		return "", tx.Commit()
+	}
+
+	var released string
+	if old.Valid {
+		query = `UPDATE blob_refs SET digest = $2, size = $3, created_at = $4 WHERE id = $1;`
+		if _, err := tx.ExecContext(ctx, query, id, digest, size, now); err != nil {
+			return "", err
+		}
+		if released, err = unrefDigest(ctx, tx, old.String); err != nil {
+			return "", err
+		}
+	}
+	return released, tx.Commit()
+}
+
+// unpin drops a pin whose reference was never taken. If that fails the object
+// is never deleted, which only costs space.
+func (m *MetadataDB) unpin(digest string) {
+	query := `UPDATE blob_digests SET pending = pending - 1 WHERE digest = $1;`
+	m.DB.Exec(query, digest)
+}
+
+func (m *MetadataDB) Unref(ctx context.Context, id string, release func(digest string) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var digest string
+	query := `DELETE FROM blob_refs WHERE id = $1 RETURNING digest;`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&digest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	released, err := unrefDigest(ctx, tx, digest)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return m.releaseObject(ctx, released, release)
+}
+
+// unrefDigest decrements the count and returns the digest if that was the
+// last reference. The row stays at zero until releaseObject deletes the object.
+func unrefDigest(ctx context.Context, tx *sql.Tx, digest string) (string, error) {
+	var refs int
+	query := `UPDATE blob_digests SET refcount = refcount - 1 WHERE digest = $1 RETURNING refcount;`
+	err := tx.QueryRowContext(ctx, query, digest).Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil // never counted, nothing to release
+	}
+	if err != nil || refs > 0 {
+		return "", err
+	}
+	return digest, nil
+}
+
+// releaseObject deletes the object of a digest that lost its last reference,
+// unless it got a new one or a pin in the meantime. The row lock only keeps
+// new writers of this one digest waiting for the delete. If the delete fails
+// the row stays at zero and the object behind, which only costs space, the
+// next writer of the content uploads it again.
+func (m *MetadataDB) releaseObject(ctx context.Context, digest string, release func(digest string) error) error {
+	if digest == "" {
+		return nil
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var refs, pending int
+	query := `SELECT refcount, pending FROM blob_digests WHERE digest = $1 FOR UPDATE;`
+	err = tx.QueryRowContext(ctx, query, digest).Scan(&refs, &pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // released by someone else
+	}
+	if err != nil || refs > 0 || pending > 0 {
+		return err
+	}
+
+	if err := release(digest); err != nil {
+		return err
+	}
+	query = `DELETE FROM blob_digests WHERE digest = $1;`
+	if _, err := tx.ExecContext(ctx, query, digest); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *MetadataDB) Digest(ctx context.Context, id string) (string, error) {
+	var digest string
+	query := `SELECT digest FROM blob_refs WHERE id = $1;`
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&digest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", storage.ErrNotFound
+	}
+	return digest, err
+}
+
+func (m *MetadataDB) ListRefs(ctx context.Context, prefix, cursor string, limit int) ([]storage.Info, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	query := `SELECT id, size, created_at FROM blob_refs
+		      WHERE id > $1 AND id LIKE $2 ESCAPE '\'
+			  ORDER BY id
+			  LIMIT $3;`
+	rows, err := m.DB.QueryContext(ctx, query, cursor, storage.EscapeLike(prefix)+"%", limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var infos []storage.Info
+	for rows.Next() {
+		var info storage.Info
+		if err := rows.Scan(&info.ID, &info.Size, &info.ModTime); err != nil {
+			return nil, "", err
+		}
+		infos = append(infos, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(infos) > limit {
+		infos = infos[:limit]
+		return infos, infos[limit-1].ID, nil
+	}
+	return infos, "", nil
+}
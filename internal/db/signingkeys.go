@@ -0,0 +1,74 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SigningKey is a key access tokens are signed with, see auth.Keyring
+type SigningKey struct {
+	KID string
+	Algorithm string // RS256, ES256 or EdDSA
+	PrivateKey []byte // PKCS #8 DER sealed with the master key MasterKeyID, see auth.Keyring
+	MasterKeyID string // "" for a key from before sealing, plain PKCS #8
+	CreatedAt time.Time
+	RetiresAt time.Time // signs no more tokens from then on
+	ExpiresAt time.Time // verifies no more tokens from then on
+}
+
+// SigningKeyStore keeps the signing keys, shared by every replica. Part of
+// every MetadataStore.
+type SigningKeyStore interface {
+	CreateSigningKey(k *SigningKey) error
+	// ListSigningKeys returns the keys that haven't expired, newest first
+	ListSigningKeys(now time.Time) ([]SigningKey, error)
+	DeleteExpiredSigningKeys(now time.Time) (int, error)
+	// ResealSigningKey replaces the private key of kid with one sealed by another master key
+	ResealSigningKey(kid, masterKeyID string, privateKey []byte) error
+}
+
+const signingKeyColumns = `kid, algorithm, private_key, master_key_id, created_at, retires_at, expires_at`
+
+func (m *MetadataDB) CreateSigningKey(k *SigningKey) error {
+	query := `INSERT INTO signing_keys(` + signingKeyColumns + `) VALUES($1, $2, $3, $4, $5, $6, $7);`
+	_, err := m.DB.Exec(query, k.KID, k.Algorithm, k.PrivateKey, k.MasterKeyID, k.CreatedAt.UTC(), k.RetiresAt.UTC(), k.ExpiresAt.UTC())
+	return err
+}
+
+func (m *MetadataDB) ListSigningKeys(now time.Time) ([]SigningKey, error) {
+	query := `SELECT ` + signingKeyColumns + ` FROM signing_keys WHERE expires_at > $1 ORDER BY created_at DESC, kid;`
+	return querySigningKeys(m.DB, query, now.UTC())
+}
+
+func (m *MetadataDB) DeleteExpiredSigningKeys(now time.Time) (int, error) {
+	res, err := m.DB.Exec(`DELETE FROM signing_keys WHERE expires_at <= $1;`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (m *MetadataDB) ResealSigningKey(kid, masterKeyID string, privateKey []byte) error {
+	query := `UPDATE signing_keys SET master_key_id = $2, private_key = $3 WHERE kid = $1;`
+	return execOne(m.DB, query, kid, masterKeyID, privateKey)
+}
+
+func querySigningKeys(sqlDB *sql.DB, query string, args ...any) ([]SigningKey, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		var k SigningKey
+		if err := rows.Scan(&k.KID, &k.Algorithm, &k.PrivateKey, &k.MasterKeyID, &k.CreatedAt, &k.RetiresAt, &k.ExpiresAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
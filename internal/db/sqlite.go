@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"rekazdrive/internal/storage"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // SQLite driver
+)
+
+// SQLiteStore keeps metadata in a single SQLite file, for single node
+// deployments without a Postgres server. It has the same tables as the
+// Postgres metadata DB, except that user metadata and tags are JSON text.
+type SQLiteStore struct {
+	DB *sql.DB
+
+	// serialises Ref and Unref, see sqlite_index.go
+	refMu sync.Mutex
+}
+
+// NewSQLite opens (or creates) the database file at path. Transactions take
+// the write lock when they begin, so a read-then-write inside one can't race
+// another writer, LIKE is made case sensitive like in Postgres and foreign
+// keys are enforced, which the ACL tables rely on.
+func NewSQLite(path string) (*SQLiteStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	params := url.Values{
+		"_txlock":       {"immediate"},
+		"_busy_timeout": {"5000"},
+		"_journal_mode": {"WAL"},
+		"_cslike":       {"true"},
+		"_foreign_keys": {"1"},
+	}
+	sqlDB, err := sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{DB: sqlDB}, nil
+}
+
+// InitSchema brings the file up to the latest SQLite migration, see migrate.go
+func (s *SQLiteStore) InitSchema() error {
+	migrator, err := NewMigrator(s.DB, ScopeSQLite)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(context.Background())
+
+	return err
+}
+
+const sqliteMetaColumns = `id, size, created_at, updated_at, content_type, filename, sha256, md5, user_metadata, tags, COALESCE(version_id, ''), expires_at, COALESCE(owner_id, '')`
+
+func scanSQLiteMeta(row interface{ Scan(...any) error }, extra ...any) (*BlobMeta, error) {
+	var meta BlobMeta
+	var userMeta, tags string
+	var expiresAt sql.NullTime
+	dest := []any{&meta.ID, &meta.Size, &meta.CreatedAt, &meta.UpdatedAt, &meta.ContentType,
+		&meta.Filename, &meta.SHA256, &meta.MD5, &userMeta, &tags, &meta.VersionID, &expiresAt, &meta.OwnerID}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	meta.ExpiresAt = expiresAt.Time
+	if err := json.Unmarshal([]byte(userMeta), &meta.UserMetadata); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(tags), &meta.Tags); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (s *SQLiteStore) SaveMetadata(meta *BlobMeta) error {
+	userMeta, err := json.Marshal(nonNilMap(meta.UserMetadata))
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(nonNilSlice(meta.Tags))
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := meta.UpdatedAt.UTC()
+	if meta.VersionID != "" {
+		query := `INSERT INTO blob_versions(id, version_id, size, created_at, content_type, filename, sha256, md5, user_metadata, tags)
+			      VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+		_, err := tx.Exec(query, meta.ID, meta.VersionID, meta.Size, now, meta.ContentType, meta.Filename,
+			meta.SHA256, meta.MD5, string(userMeta), string(tags))
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `INSERT INTO blobs_metadata(id, size, created_at, updated_at, content_type, filename, sha256, md5, user_metadata, tags, version_id, expires_at, owner_id)
+		      VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''))
+			  ON CONFLICT (id) DO UPDATE
+			  SET size = excluded.size, updated_at = excluded.updated_at, content_type = excluded.content_type,
+			  filename = excluded.filename, sha256 = excluded.sha256, md5 = excluded.md5,
+			  user_metadata = excluded.user_metadata, tags = excluded.tags, version_id = excluded.version_id,
+			  expires_at = excluded.expires_at, deleted_at = NULL,
+			  owner_id = COALESCE(blobs_metadata.owner_id, excluded.owner_id);`
+	_, err = tx.Exec(query, meta.ID, meta.Size, now, now, meta.ContentType, meta.Filename,
+		meta.SHA256, meta.MD5, string(userMeta), string(tags), meta.VersionID, nullTime(meta.ExpiresAt), meta.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetMetadata(id string) (*BlobMeta, error) {
+	query := `SELECT ` + sqliteMetaColumns + ` FROM blobs_metadata WHERE id = ? AND deleted_at IS NULL;`
+	return scanSQLiteMeta(s.DB.QueryRow(query, id))
+}
+
+func (s *SQLiteStore) UpdateUserMetadata(id string, userMeta map[string]string, tags []string, now time.Time) (*BlobMeta, error) {
+	var metaJSON, tagsJSON any // NULL keeps the current value
+	if userMeta != nil {
+		b, err := json.Marshal(userMeta)
+		if err != nil {
+			return nil, err
+		}
+		metaJSON = string(b)
+	}
+	if tags != nil {
+		b, err := json.Marshal(tags)
+		if err != nil {
+			return nil, err
+		}
+		tagsJSON = string(b)
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE blobs_metadata
+		      SET user_metadata = COALESCE(?, user_metadata), tags = COALESCE(?, tags), updated_at = ?
+			  WHERE id = ? AND deleted_at IS NULL;`
+	if _, err := tx.Exec(query, metaJSON, tagsJSON, now.UTC(), id); err != nil {
+		return nil, err
+	}
+	query = `SELECT ` + sqliteMetaColumns + ` FROM blobs_metadata WHERE id = ? AND deleted_at IS NULL;`
+	meta, err := scanSQLiteMeta(tx.QueryRow(query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteMetadata(id string) error {
+	query := `DELETE FROM blobs_metadata WHERE id = ?;`
+	res, err := s.DB.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) ListMetadata(prefix, cursor string, limit int, viewer *Viewer, now time.Time) ([]BlobMeta, error) {
+	query := `SELECT ` + sqliteMetaColumns + ` FROM blobs_metadata
+		      WHERE id > ? AND id LIKE ? ESCAPE '\' AND id NOT LIKE '.%' AND deleted_at IS NULL
+			  AND (expires_at IS NULL OR expires_at > ?) AND ` + sqliteVisibleTo + `
+			  ORDER BY id
+			  LIMIT ?;`
+	args := append([]any{cursor, storage.EscapeLike(prefix) + "%", now.UTC()}, viewer.sqliteArgs()...)
+	rows, err := s.DB.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metas []BlobMeta
+	for rows.Next() {
+		meta, err := scanSQLiteMeta(rows)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, *meta)
+	}
+
+	return metas, rows.Err()
+}
@@ -0,0 +1,48 @@
+package db
+
+import "encoding/json"
+
+// SQLite versions of the grant queries in acl.go
+
+func (s *SQLiteStore) ListGrants(blobID string) ([]Grant, error) {
+	query := `SELECT principal_type, principal, permission FROM blob_acl WHERE blob_id = ?
+		      ORDER BY principal_type, principal, permission;`
+	return queryGrants(s.DB, query, blobID)
+}
+
+func (s *SQLiteStore) SetGrants(blobID string, grants []Grant) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	if err := tx.QueryRow(`SELECT 1 FROM blobs_metadata WHERE id = ?;`, blobID).Scan(&found); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM blob_acl WHERE blob_id = ?;`, blobID); err != nil {
+		return err
+	}
+	query := `INSERT INTO blob_acl(blob_id, principal_type, principal, permission) VALUES(?, ?, ?, ?)
+		      ON CONFLICT DO NOTHING;`
+	for _, g := range grants {
+		if _, err := tx.Exec(query, blobID, g.PrincipalType, g.Principal, g.Permission); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) HasGrant(blobID, permission string, v Viewer) (bool, error) {
+	groups, err := json.Marshal(nonNilSlice(v.Groups))
+	if err != nil {
+		return false, err
+	}
+	var found bool
+	query := `SELECT EXISTS (SELECT 1 FROM blob_acl WHERE blob_id = ? AND permission = ?
+		      AND (principal_type = 'user' AND principal = ? OR principal_type = 'group' AND principal IN (SELECT value FROM json_each(?))));`
+	err = s.DB.QueryRow(query, blobID, permission, v.UserID, string(groups)).Scan(&found)
+	return found, err
+}
@@ -0,0 +1,37 @@
+package db
+
+import "time"
+
+// SQLite versions of the API key queries in apikeys.go
+
+func (s *SQLiteStore) CreateAPIKey(k *APIKey) error {
+	query := `INSERT INTO api_keys(id, user_id, name, prefix, key_hash, scope, created_at, expires_at)
+		      VALUES(?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := s.DB.Exec(query, k.ID, k.UserID, k.Name, k.Prefix, k.Hash, k.Scope, k.CreatedAt.UTC(), nullTime(k.ExpiresAt))
+	return err
+}
+
+func (s *SQLiteStore) GetAPIKey(id string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = ?;`
+	return scanAPIKey(s.DB.QueryRow(query, id))
+}
+
+func (s *SQLiteStore) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ?;`
+	return scanAPIKey(s.DB.QueryRow(query, hash))
+}
+
+func (s *SQLiteStore) ListAPIKeys(userID string) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = ? ORDER BY created_at, id;`
+	return queryAPIKeys(s.DB, query, userID)
+}
+
+func (s *SQLiteStore) RevokeAPIKey(id string, now time.Time) error {
+	query := `UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL;`
+	return execOne(s.DB, query, now.UTC(), id)
+}
+
+func (s *SQLiteStore) TouchAPIKey(id string, now time.Time) error {
+	query := `UPDATE api_keys SET last_used_at = ? WHERE id = ?;`
+	return execOne(s.DB, query, now.UTC(), id)
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLite versions of the identity queries in identities.go
+
+func (s *SQLiteStore) GetUserByIdentity(issuer, subject string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users
+			  WHERE id = (SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?);`
+	return scanUser(s.DB.QueryRow(query, issuer, subject))
+}
+
+func (s *SQLiteStore) CreateLinkedUser(u *User, link *UserIdentity) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO users(` + userColumns + `) VALUES(?, ?, ?, ?, ?, ?, ?);`
+	now := u.CreatedAt.UTC()
+	_, err = tx.Exec(query, u.ID, u.Username, u.PasswordHash, u.Role, u.Disabled, now, now)
+	if err = sqliteUnique(err, ErrUserExists); err != nil {
+		return err
+	}
+	query = `INSERT INTO user_identities(issuer, subject, user_id, created_at) VALUES(?, ?, ?, ?);`
+	_, err = tx.Exec(query, link.Issuer, link.Subject, u.ID, link.CreatedAt.UTC())
+	if err = sqliteUnique(err, ErrIdentityLinked); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) LinkIdentity(link *UserIdentity) error {
+	query := `INSERT INTO user_identities(issuer, subject, user_id, created_at) VALUES(?, ?, ?, ?);`
+	_, err := s.DB.Exec(query, link.Issuer, link.Subject, link.UserID, link.CreatedAt.UTC())
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+		return sql.ErrNoRows
+	}
+	return sqliteUnique(err, ErrIdentityLinked)
+}
+
+func (s *SQLiteStore) UnlinkIdentity(userID, issuer, subject string) error {
+	query := `DELETE FROM user_identities WHERE user_id = ? AND issuer = ? AND subject = ?;`
+	return execOne(s.DB, query, userID, issuer, subject)
+}
+
+func (s *SQLiteStore) ListIdentities(userID string) ([]UserIdentity, error) {
+	query := `SELECT issuer, subject, user_id, created_at FROM user_identities WHERE user_id = ? ORDER BY issuer, subject;`
+	return queryIdentities(s.DB, query, userID)
+}
+
+// sqliteUnique turns a unique or primary key violation into errExists
+func sqliteUnique(err, errExists error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return errExists
+	}
+	return err
+}
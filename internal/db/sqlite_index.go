@@ -0,0 +1,327 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"rekazdrive/internal/storage"
+	"time"
+)
+
+// SQLiteStore is also the storage.RefIndex, storage.KeyStore and
+// storage.CodecIndex of the SQLite mode, on the same tables as MetadataDB.
+//
+// SQLite locks the whole file for writing, so the pins of the Postgres version
+// would only add work: Ref and Unref are serialised with a mutex instead, which
+// is enough because only this process uses the file. The upload runs before and
+// the release after the short transactions, the layers below dedup write their
+// own rows (blob_keys) during both and would wait on an open one forever.
+
+func (s *SQLiteStore) Ref(ctx context.Context, id, digest string, size int64, upload func() error, release func(digest string) error) error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+
+	old, err := s.Digest(ctx, id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if old == digest {
+		return nil // same content again, nothing changes
+	}
+
+	var refs int
+	query := `SELECT refcount FROM blob_digests WHERE digest = ?;`
+	err = s.DB.QueryRowContext(ctx, query, digest).Scan(&refs)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if refs == 0 {
+		if err := upload(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query = `INSERT INTO blob_refs(id, digest, size, created_at) VALUES(?, ?, ?, ?)
+		      ON CONFLICT (id) DO UPDATE SET digest = excluded.digest, size = excluded.size, created_at = excluded.created_at;`
+	if _, err := tx.ExecContext(ctx, query, id, digest, size, time.Now().UTC()); err != nil {
+		return err
+	}
+	query = `INSERT INTO blob_digests(digest, size, refcount) VALUES(?, ?, 1)
+		      ON CONFLICT (digest) DO UPDATE SET refcount = refcount + 1;`
+	if _, err := tx.ExecContext(ctx, query, digest, size); err != nil {
+		return err
+	}
+	released, err := sqliteUnrefDigest(ctx, tx, old)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return releaseDigest(released, release)
+}
+
+func (s *SQLiteStore) Unref(ctx context.Context, id string, release func(digest string) error) error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+
+	digest, err := s.Digest(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM blob_refs WHERE id = ?;`
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return err
+	}
+	released, err := sqliteUnrefDigest(ctx, tx, digest)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return releaseDigest(released, release)
+}
+
+// sqliteUnrefDigest decrements the count and returns the digest if that was
+// the last reference, its object is deleted once the transaction is committed
+func sqliteUnrefDigest(ctx context.Context, tx *sql.Tx, digest string) (string, error) {
+	if digest == "" {
+		return "", nil
+	}
+	query := `UPDATE blob_digests SET refcount = refcount - 1 WHERE digest = ?;`
+	if _, err := tx.ExecContext(ctx, query, digest); err != nil {
+		return "", err
+	}
+	query = `DELETE FROM blob_digests WHERE digest = ? AND refcount <= 0;`
+	res, err := tx.ExecContext(ctx, query, digest)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "", err
+	}
+	return digest, nil
+}
+
+// if the delete fails the object is left behind without a count, which only costs space
+func releaseDigest(digest string, release func(digest string) error) error {
+	if digest == "" {
+		return nil
+	}
+	return release(digest)
+}
+
+func (s *SQLiteStore) Digest(ctx context.Context, id string) (string, error) {
+	var digest string
+	query := `SELECT digest FROM blob_refs WHERE id = ?;`
+	err := s.DB.QueryRowContext(ctx, query, id).Scan(&digest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", storage.ErrNotFound
+	}
+	return digest, err
+}
+
+func (s *SQLiteStore) ListRefs(ctx context.Context, prefix, cursor string, limit int) ([]storage.Info, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	query := `SELECT id, size, created_at FROM blob_refs
+		      WHERE id > ? AND id LIKE ? ESCAPE '\'
+			  ORDER BY id
+			  LIMIT ?;`
+	rows, err := s.DB.QueryContext(ctx, query, cursor, storage.EscapeLike(prefix)+"%", limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var infos []storage.Info
+	for rows.Next() {
+		var info storage.Info
+		if err := rows.Scan(&info.ID, &info.Size, &info.ModTime); err != nil {
+			return nil, "", err
+		}
+		infos = append(infos, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(infos) > limit {
+		infos = infos[:limit]
+		return infos, infos[limit-1].ID, nil
+	}
+	return infos, "", nil
+}
+
+func (s *SQLiteStore) PutKey(ctx context.Context, k storage.ObjectKey) (string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// the transaction holds the write lock from the start, nobody can slip in between
+	var prev string
+	query := `SELECT object FROM blob_keys WHERE id = ?;`
+	err = tx.QueryRowContext(ctx, query, k.ID).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	query = `INSERT INTO blob_keys(` + keyColumns + `) VALUES(?, ?, ?, ?, ?, ?, ?)
+		      ON CONFLICT (id) DO UPDATE
+			  SET object = excluded.object, size = excluded.size, master_key_id = excluded.master_key_id,
+			  wrapped_key = excluded.wrapped_key, nonce = excluded.nonce, created_at = excluded.created_at;`
+	if _, err := tx.ExecContext(ctx, query, k.ID, k.Object, k.Size, k.MasterKeyID, k.WrappedKey, k.Nonce, k.CreatedAt.UTC()); err != nil {
+		return "", err
+	}
+
+	return prev, tx.Commit()
+}
+
+func (s *SQLiteStore) GetKey(ctx context.Context, id string) (storage.ObjectKey, error) {
+	query := `SELECT ` + keyColumns + ` FROM blob_keys WHERE id = ?;`
+	return scanKey(s.DB.QueryRowContext(ctx, query, id))
+}
+
+func (s *SQLiteStore) DeleteKey(ctx context.Context, id string) (storage.ObjectKey, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.ObjectKey{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + keyColumns + ` FROM blob_keys WHERE id = ?;`
+	k, err := scanKey(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return k, err
+	}
+	query = `DELETE FROM blob_keys WHERE id = ?;`
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return k, err
+	}
+
+	return k, tx.Commit()
+}
+
+func (s *SQLiteStore) ListKeys(ctx context.Context, prefix, cursor string, limit int) ([]storage.ObjectKey, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	query := `SELECT ` + keyColumns + ` FROM blob_keys
+		      WHERE id > ? AND id LIKE ? ESCAPE '\'
+			  ORDER BY id
+			  LIMIT ?;`
+	keys, err := queryKeys(ctx, s.DB, query, cursor, storage.EscapeLike(prefix)+"%", limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+		return keys, keys[limit-1].ID, nil
+	}
+	return keys, "", nil
+}
+
+func (s *SQLiteStore) StaleKeys(ctx context.Context, masterKeyID, cursor string, limit int) ([]storage.ObjectKey, error) {
+	query := `SELECT ` + keyColumns + ` FROM blob_keys
+		      WHERE master_key_id <> ? AND id > ?
+			  ORDER BY id
+			  LIMIT ?;`
+	return queryKeys(ctx, s.DB, query, masterKeyID, cursor, limit)
+}
+
+func (s *SQLiteStore) RewrapKey(ctx context.Context, k storage.ObjectKey) error {
+	query := `UPDATE blob_keys SET master_key_id = ?, wrapped_key = ? WHERE id = ? AND object = ?;`
+	_, err := s.DB.ExecContext(ctx, query, k.MasterKeyID, k.WrappedKey, k.ID, k.Object)
+	return err
+}
+
+func (s *SQLiteStore) PutCodec(ctx context.Context, c storage.StoredCodec) (string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// the transaction holds the write lock from the start, nobody can slip in between
+	var prev string
+	query := `SELECT object FROM blob_codecs WHERE id = ?;`
+	err = tx.QueryRowContext(ctx, query, c.ID).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	query = `INSERT INTO blob_codecs(` + codecColumns + `) VALUES(?, ?, ?, ?, ?, ?)
+		      ON CONFLICT (id) DO UPDATE
+			  SET object = excluded.object, codec = excluded.codec, original_size = excluded.original_size,
+			  stored_size = excluded.stored_size, created_at = excluded.created_at;`
+	if _, err := tx.ExecContext(ctx, query, c.ID, c.Object, c.Codec, c.OriginalSize, c.StoredSize, c.CreatedAt.UTC()); err != nil {
+		return "", err
+	}
+
+	return prev, tx.Commit()
+}
+
+func (s *SQLiteStore) GetCodec(ctx context.Context, id string) (storage.StoredCodec, error) {
+	query := `SELECT ` + codecColumns + ` FROM blob_codecs WHERE id = ?;`
+	return scanCodec(s.DB.QueryRowContext(ctx, query, id))
+}
+
+func (s *SQLiteStore) DeleteCodec(ctx context.Context, id string) (storage.StoredCodec, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.StoredCodec{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + codecColumns + ` FROM blob_codecs WHERE id = ?;`
+	c, err := scanCodec(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return c, err
+	}
+	query = `DELETE FROM blob_codecs WHERE id = ?;`
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return c, err
+	}
+
+	return c, tx.Commit()
+}
+
+func (s *SQLiteStore) ListCodecs(ctx context.Context, prefix, cursor string, limit int) ([]storage.StoredCodec, string, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	query := `SELECT ` + codecColumns + ` FROM blob_codecs
+		      WHERE id > ? AND id LIKE ? ESCAPE '\'
+			  ORDER BY id
+			  LIMIT ?;`
+	entries, err := queryCodecs(ctx, s.DB, query, cursor, storage.EscapeLike(prefix)+"%", limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+		return entries, entries[limit-1].ID, nil
+	}
+	return entries, "", nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"rekazdrive/internal/storage"
+	"time"
+)
+
+// SQLite versions of the lifecycle queries in lifecycle.go
+
+func (s *SQLiteStore) ListExpired(now time.Time, cursor string, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + sqliteMetaColumns + ` FROM blobs_metadata
+		      WHERE expires_at <= ? AND id > ? AND deleted_at IS NULL
+			  ORDER BY id
+			  LIMIT ?;`
+	return s.queryMetas(query, now.UTC(), cursor, limit)
+}
+
+func (s *SQLiteStore) ListUpdatedBefore(prefix string, before time.Time, cursor string, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + sqliteMetaColumns + ` FROM blobs_metadata
+		      WHERE id > ? AND id LIKE ? ESCAPE '\' AND id NOT LIKE '.%'
+			  AND updated_at < ? AND deleted_at IS NULL
+			  ORDER BY id
+			  LIMIT ?;`
+	return s.queryMetas(query, cursor, storage.EscapeLike(prefix)+"%", before.UTC(), limit)
+}
+
+func (s *SQLiteStore) queryMetas(query string, args ...any) ([]BlobMeta, error) {
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metas []BlobMeta
+	for rows.Next() {
+		meta, err := scanSQLiteMeta(rows)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, *meta)
+	}
+
+	return metas, rows.Err()
+}
+
+func (s *SQLiteStore) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	query := `INSERT INTO lifecycle_state(name, holder, lease_until) VALUES(?, ?, ?)
+		      ON CONFLICT (name) DO UPDATE
+			  SET holder = excluded.holder, lease_until = excluded.lease_until
+			  WHERE lifecycle_state.holder = excluded.holder OR lifecycle_state.lease_until IS NULL
+			  OR lifecycle_state.lease_until < ?;`
+	res, err := s.DB.Exec(query, name, holder, now.Add(ttl).UTC(), now.UTC())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *SQLiteStore) ReleaseLease(name, holder string) error {
+	query := `UPDATE lifecycle_state SET lease_until = NULL WHERE name = ? AND holder = ?;`
+	_, err := s.DB.Exec(query, name, holder)
+	return err
+}
+
+func (s *SQLiteStore) Checkpoint(name string) (string, error) {
+	var cursor string
+	query := `SELECT scan_cursor FROM lifecycle_state WHERE name = ?;`
+	err := s.DB.QueryRow(query, name).Scan(&cursor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return cursor, err
+}
+
+func (s *SQLiteStore) SaveCheckpoint(name, cursor string) error {
+	query := `INSERT INTO lifecycle_state(name, scan_cursor) VALUES(?, ?)
+		      ON CONFLICT (name) DO UPDATE SET scan_cursor = excluded.scan_cursor;`
+	_, err := s.DB.Exec(query, name, cursor)
+	return err
+}
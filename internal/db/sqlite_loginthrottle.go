@@ -0,0 +1,69 @@
+package db
+
+import "time"
+
+// SQLite versions of the login throttle queries in loginthrottle.go
+
+func (s *SQLiteStore) GetLoginFailures(key string) (*LoginFailures, error) {
+	query := `SELECT throttle_key, failures, last_failure_at, locked_until FROM login_failures WHERE throttle_key = ?;`
+	return scanLoginFailures(s.DB.QueryRow(query, key))
+}
+
+func (s *SQLiteStore) AddLoginFailure(key string, now, since time.Time) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO login_failures(throttle_key, failures, last_failure_at) VALUES(?, 1, ?)
+			  ON CONFLICT (throttle_key) DO UPDATE SET
+			    failures = CASE WHEN login_failures.last_failure_at < ? THEN 1 ELSE login_failures.failures + 1 END,
+			    last_failure_at = excluded.last_failure_at;`
+	if _, err := tx.Exec(query, key, now.UTC(), since.UTC()); err != nil {
+		return 0, err
+	}
+	var failures int
+	if err := tx.QueryRow(`SELECT failures FROM login_failures WHERE throttle_key = ?;`, key).Scan(&failures); err != nil {
+		return 0, err
+	}
+	return failures, tx.Commit()
+}
+
+func (s *SQLiteStore) LockLogin(l *Lockout) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE login_failures SET locked_until = ? WHERE throttle_key = ?;`, l.LockedUntil.UTC(), l.Key); err != nil {
+		return err
+	}
+	query := `INSERT INTO login_lockouts(id, throttle_key, failures, created_at, locked_until) VALUES(?, ?, ?, ?, ?);`
+	if _, err := tx.Exec(query, l.ID, l.Key, l.Failures, l.CreatedAt.UTC(), l.LockedUntil.UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ClearLoginFailures(key string) error {
+	_, err := s.DB.Exec(`DELETE FROM login_failures WHERE throttle_key = ?;`, key)
+	return err
+}
+
+func (s *SQLiteStore) ListLockouts(limit int) ([]Lockout, error) {
+	query := `SELECT id, throttle_key, failures, created_at, locked_until FROM login_lockouts
+			  ORDER BY created_at DESC, id LIMIT ?;`
+	return queryLockouts(s.DB, query, limit)
+}
+
+func (s *SQLiteStore) DeleteStaleLoginFailures(before, now time.Time) (int, error) {
+	query := `DELETE FROM login_failures WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until <= ?);`
+	res, err := s.DB.Exec(query, before.UTC(), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,30 @@
+package db
+
+import "time"
+
+// SQLite versions of the signing key queries in signingkeys.go
+
+func (s *SQLiteStore) CreateSigningKey(k *SigningKey) error {
+	query := `INSERT INTO signing_keys(` + signingKeyColumns + `) VALUES(?, ?, ?, ?, ?, ?, ?);`
+	_, err := s.DB.Exec(query, k.KID, k.Algorithm, k.PrivateKey, k.MasterKeyID, k.CreatedAt.UTC(), k.RetiresAt.UTC(), k.ExpiresAt.UTC())
+	return err
+}
+
+func (s *SQLiteStore) ListSigningKeys(now time.Time) ([]SigningKey, error) {
+	query := `SELECT ` + signingKeyColumns + ` FROM signing_keys WHERE expires_at > ? ORDER BY created_at DESC, kid;`
+	return querySigningKeys(s.DB, query, now.UTC())
+}
+
+func (s *SQLiteStore) DeleteExpiredSigningKeys(now time.Time) (int, error) {
+	res, err := s.DB.Exec(`DELETE FROM signing_keys WHERE expires_at <= ?;`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *SQLiteStore) ResealSigningKey(kid, masterKeyID string, privateKey []byte) error {
+	query := `UPDATE signing_keys SET master_key_id = ?, private_key = ? WHERE kid = ?;`
+	return execOne(s.DB, query, masterKeyID, privateKey, kid)
+}
@@ -0,0 +1,50 @@
+package db
+
+import "time"
+
+// SQLite versions of the token queries in tokens.go
+
+func (s *SQLiteStore) CreateRefreshToken(t *RefreshToken) error {
+	query := `INSERT INTO refresh_tokens(token_hash, user_id, family_id, created_at, expires_at) VALUES(?, ?, ?, ?, ?);`
+	_, err := s.DB.Exec(query, t.Hash, t.UserID, t.FamilyID, t.CreatedAt.UTC(), t.ExpiresAt.UTC())
+	return err
+}
+
+func (s *SQLiteStore) GetRefreshToken(hash string) (*RefreshToken, error) {
+	query := `SELECT ` + refreshColumns + ` FROM refresh_tokens WHERE token_hash = ?;`
+	return scanRefreshToken(s.DB.QueryRow(query, hash))
+}
+
+func (s *SQLiteStore) UseRefreshToken(hash string, now time.Time) error {
+	query := `UPDATE refresh_tokens SET used_at = ?
+		      WHERE token_hash = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?;`
+	return execOne(s.DB, query, now.UTC(), hash, now.UTC())
+}
+
+func (s *SQLiteStore) RevokeRefreshFamily(familyID string, now time.Time) error {
+	query := `UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL;`
+	_, err := s.DB.Exec(query, now.UTC(), familyID)
+	return err
+}
+
+func (s *SQLiteStore) RevokeUserRefreshTokens(userID string, now time.Time) error {
+	query := `UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL;`
+	_, err := s.DB.Exec(query, now.UTC(), userID)
+	return err
+}
+
+func (s *SQLiteStore) RevokeToken(jti string, expiresAt time.Time) error {
+	query := `INSERT INTO revoked_tokens(jti, expires_at) VALUES(?, ?) ON CONFLICT (jti) DO NOTHING;`
+	_, err := s.DB.Exec(query, jti, expiresAt.UTC())
+	return err
+}
+
+func (s *SQLiteStore) RevokedTokens(now time.Time) (map[string]time.Time, error) {
+	query := `SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > ?;`
+	return queryRevoked(s.DB, query, now.UTC())
+}
+
+func (s *SQLiteStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	return deleteExpiredTokens(s.DB, `DELETE FROM refresh_tokens WHERE expires_at <= ?;`,
+		`DELETE FROM revoked_tokens WHERE expires_at <= ?;`, now.UTC())
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"database/sql"
+	"rekazdrive/internal/storage"
+	"time"
+)
+
+// SQLite versions of the trash queries in trash.go
+
+func (s *SQLiteStore) TrashMetadata(id string, now time.Time) error {
+	query := `UPDATE blobs_metadata SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL;`
+	res, err := s.DB.Exec(query, now.UTC(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) GetTrashed(id string) (*BlobMeta, error) {
+	var deletedAt time.Time
+	query := `SELECT ` + sqliteMetaColumns + `, deleted_at FROM blobs_metadata WHERE id = ? AND deleted_at IS NOT NULL;`
+	meta, err := scanSQLiteMeta(s.DB.QueryRow(query, id), &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+	meta.DeletedAt = deletedAt
+	return meta, nil
+}
+
+func (s *SQLiteStore) ListTrash(prefix, cursor string, limit int, viewer *Viewer) ([]BlobMeta, error) {
+	query := `SELECT ` + sqliteMetaColumns + `, deleted_at FROM blobs_metadata
+		      WHERE id > ? AND id LIKE ? ESCAPE '\' AND id NOT LIKE '.%' AND deleted_at IS NOT NULL AND ` + sqliteVisibleTo + `
+			  ORDER BY id
+			  LIMIT ?;`
+	args := append([]any{cursor, storage.EscapeLike(prefix) + "%"}, viewer.sqliteArgs()...)
+	return s.queryTrash(query, append(args, limit)...)
+}
+
+// times are stored as UTC text by the driver, which sorts the same as the times do
+func (s *SQLiteStore) ExpiredTrash(before time.Time, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + sqliteMetaColumns + `, deleted_at FROM blobs_metadata
+		      WHERE deleted_at < ?
+			  ORDER BY deleted_at, id
+			  LIMIT ?;`
+	return s.queryTrash(query, before.UTC(), limit)
+}
+
+func (s *SQLiteStore) queryTrash(query string, args ...any) ([]BlobMeta, error) {
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metas []BlobMeta
+	for rows.Next() {
+		var deletedAt time.Time
+		meta, err := scanSQLiteMeta(rows, &deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		meta.DeletedAt = deletedAt
+		metas = append(metas, *meta)
+	}
+
+	return metas, rows.Err()
+}
+
+func (s *SQLiteStore) RestoreTrashed(id string) (*BlobMeta, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE blobs_metadata SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL;`
+	res, err := tx.Exec(query, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	query = `SELECT ` + sqliteMetaColumns + ` FROM blobs_metadata WHERE id = ?;`
+	meta, err := scanSQLiteMeta(tx.QueryRow(query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, tx.Commit()
+}
+
+func (s *SQLiteStore) PurgeTrashed(id string, deletedAt time.Time) error {
+	query := `DELETE FROM blobs_metadata WHERE id = ? AND deleted_at = ?;`
+	res, err := s.DB.Exec(query, id, deletedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
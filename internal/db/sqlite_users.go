@@ -0,0 +1,86 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLite versions of the user queries in users.go
+
+func (s *SQLiteStore) CreateUser(u *User) error {
+	query := `INSERT INTO users(` + userColumns + `) VALUES(?, ?, ?, ?, ?, ?, ?);`
+	now := u.CreatedAt.UTC()
+	_, err := s.DB.Exec(query, u.ID, u.Username, u.PasswordHash, u.Role, u.Disabled, now, now)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrUserExists
+	}
+	return err
+}
+
+func (s *SQLiteStore) GetUser(id string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?;`
+	return scanUser(s.DB.QueryRow(query, id))
+}
+
+func (s *SQLiteStore) GetUserByName(username string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = ?;`
+	return scanUser(s.DB.QueryRow(query, username))
+}
+
+func (s *SQLiteStore) ListUsers() ([]User, error) {
+	query := `SELECT ` + userColumns + ` FROM users ORDER BY username;`
+	return queryUsers(s.DB, query)
+}
+
+func (s *SQLiteStore) CountUsers() (int, error) {
+	var n int
+	err := s.DB.QueryRow(`SELECT count(*) FROM users;`).Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteStore) SetUserDisabled(id string, disabled bool, now time.Time) error {
+	query := `UPDATE users SET disabled = ?, updated_at = ? WHERE id = ?;`
+	return execOne(s.DB, query, disabled, now.UTC(), id)
+}
+
+func (s *SQLiteStore) SetUserPassword(id, passwordHash string, now time.Time) error {
+	query := `UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?;`
+	return execOne(s.DB, query, passwordHash, now.UTC(), id)
+}
+
+func (s *SQLiteStore) SetUserRole(id, role string, now time.Time) error {
+	query := `UPDATE users SET role = ?, updated_at = ? WHERE id = ?;`
+	return execOne(s.DB, query, role, now.UTC(), id)
+}
+
+func (s *SQLiteStore) UserGroups(id string) ([]string, error) {
+	query := `SELECT group_name FROM user_groups WHERE user_id = ? ORDER BY group_name;`
+	return queryStrings(s.DB, query, id)
+}
+
+func (s *SQLiteStore) SetUserGroups(id string, groups []string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	if err := tx.QueryRow(`SELECT 1 FROM users WHERE id = ?;`, id).Scan(&found); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_groups WHERE user_id = ?;`, id); err != nil {
+		return err
+	}
+	query := `INSERT INTO user_groups(user_id, group_name) VALUES(?, ?) ON CONFLICT DO NOTHING;`
+	for _, g := range groups {
+		if _, err := tx.Exec(query, id, g); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// version history on SQLite, same tables and rules as versions.go. The
+// transactions hold the write lock from the start, no row locks needed.
+
+func (s *SQLiteStore) ListVersions(id, cursor string, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + versionColumns + ` FROM blob_versions
+		      WHERE id = ? AND (? = '' OR version_id < ?)
+			  ORDER BY version_id DESC
+			  LIMIT ?;`
+	rows, err := s.DB.Query(query, id, cursor, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []BlobMeta
+	for rows.Next() {
+		v, err := scanSQLiteMeta(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+
+	return versions, rows.Err()
+}
+
+func (s *SQLiteStore) GetVersion(id, versionID string) (*BlobMeta, error) {
+	query := `SELECT ` + versionColumns + ` FROM blob_versions WHERE id = ? AND version_id = ?;`
+	return scanSQLiteMeta(s.DB.QueryRow(query, id, versionID))
+}
+
+func (s *SQLiteStore) RestoreVersion(id, versionID string, now time.Time) (*BlobMeta, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// WHERE true keeps the upsert from being parsed as part of the SELECT
+	query := `INSERT INTO blobs_metadata(id, size, created_at, updated_at, content_type, filename, sha256, md5, user_metadata, tags, version_id)
+		      SELECT id, size, ?, ?, content_type, filename, sha256, md5, user_metadata, tags, version_id
+			  FROM blob_versions WHERE id = ? AND version_id = ? AND true
+			  ON CONFLICT (id) DO UPDATE
+			  SET size = excluded.size, updated_at = excluded.updated_at, content_type = excluded.content_type,
+			  filename = excluded.filename, sha256 = excluded.sha256, md5 = excluded.md5,
+			  user_metadata = excluded.user_metadata, tags = excluded.tags, version_id = excluded.version_id,
+			  expires_at = NULL, deleted_at = NULL;`
+	res, err := tx.Exec(query, now.UTC(), now.UTC(), id, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	query = `SELECT ` + sqliteMetaColumns + ` FROM blobs_metadata WHERE id = ?;`
+	meta, err := scanSQLiteMeta(tx.QueryRow(query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteVersion(id, versionID string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullString
+	query := `SELECT version_id FROM blobs_metadata WHERE id = ?;`
+	err = tx.QueryRow(query, id).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	query = `DELETE FROM blob_versions WHERE id = ? AND version_id = ?;`
+	res, err := tx.Exec(query, id, versionID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	if current.String == versionID {
+		return ErrCurrentVersion // rolls the delete back
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,52 @@
+package db
+
+import "time"
+
+// MetadataStore is what the blob handlers need from a metadata backend.
+// MetadataDB keeps it in Postgres, SQLiteStore in a local file for single node
+// deployments and MemoryStore in a map for tests.
+//
+// A miss is always sql.ErrNoRows, whatever the backend.
+type MetadataStore interface {
+	SaveMetadata(meta *BlobMeta) error
+	GetMetadata(id string) (*BlobMeta, error)
+	UpdateUserMetadata(id string, userMeta map[string]string, tags []string, now time.Time) (*BlobMeta, error)
+	DeleteMetadata(id string) error
+	ListMetadata(prefix, cursor string, limit int, viewer *Viewer, now time.Time) ([]BlobMeta, error)
+
+	// history of versioned blobs, see versions.go
+	ListVersions(id, cursor string, limit int) ([]BlobMeta, error)
+	GetVersion(id, versionID string) (*BlobMeta, error)
+	RestoreVersion(id, versionID string, now time.Time) (*BlobMeta, error)
+	DeleteVersion(id, versionID string) error
+
+	// trashed blobs, see trash.go
+	TrashMetadata(id string, now time.Time) error
+	GetTrashed(id string) (*BlobMeta, error)
+	ListTrash(prefix, cursor string, limit int, viewer *Viewer) ([]BlobMeta, error)
+	ExpiredTrash(before time.Time, limit int) ([]BlobMeta, error)
+	RestoreTrashed(id string) (*BlobMeta, error)
+	PurgeTrashed(id string, deletedAt time.Time) error
+
+	// scans of the lifecycle worker, see lifecycle.go
+	ListExpired(now time.Time, cursor string, limit int) ([]BlobMeta, error)
+	ListUpdatedBefore(prefix string, before time.Time, cursor string, limit int) ([]BlobMeta, error)
+
+	// owners' grants to others, see acl.go
+	ACLStore
+
+	// accounts, see users.go
+	UserStore
+
+	// sessions, see tokens.go
+	TokenStore
+
+	// keys for scripts and CI, see apikeys.go
+	APIKeyStore
+
+	// keys tokens are signed with, see signingkeys.go
+	SigningKeyStore
+
+	// failed logins and lockouts, see loginthrottle.go
+	LoginThrottleStore
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RefreshToken is a refresh token as stored, the token itself is never kept
+type RefreshToken struct {
+	Hash string // sha256 of the token, hex
+	UserID string
+	FamilyID string // every token that came from the same login
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt time.Time // zero until it was exchanged for the next one
+	RevokedAt time.Time // zero unless its family was logged out or reused
+}
+
+// TokenStore keeps the refresh tokens and the revoked access tokens, part of
+// every MetadataStore
+type TokenStore interface {
+	CreateRefreshToken(t *RefreshToken) error
+	GetRefreshToken(hash string) (*RefreshToken, error)
+	// UseRefreshToken marks a token used, sql.ErrNoRows unless it was unused, not revoked and not expired
+	UseRefreshToken(hash string, now time.Time) error
+	RevokeRefreshFamily(familyID string, now time.Time) error
+	// RevokeUserRefreshTokens revokes every family of the user, after a password reset or disabling
+	RevokeUserRefreshTokens(userID string, now time.Time) error
+
+	RevokeToken(jti string, expiresAt time.Time) error
+	// RevokedTokens returns jti -> expiry of the revoked access tokens that haven't expired yet
+	RevokedTokens(now time.Time) (map[string]time.Time, error)
+	// DeleteExpiredTokens forgets refresh and revoked tokens that expired, they are useless by then
+	DeleteExpiredTokens(now time.Time) (int, error)
+}
+
+const refreshColumns = `token_hash, user_id, family_id, created_at, expires_at, used_at, revoked_at`
+
+func scanRefreshToken(row interface{ Scan(...any) error }) (*RefreshToken, error) {
+	var t RefreshToken
+	var usedAt, revokedAt sql.NullTime
+	err := row.Scan(&t.Hash, &t.UserID, &t.FamilyID, &t.CreatedAt, &t.ExpiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.UsedAt, t.RevokedAt = usedAt.Time, revokedAt.Time
+	return &t, nil
+}
+
+func (m *MetadataDB) CreateRefreshToken(t *RefreshToken) error {
+	query := `INSERT INTO refresh_tokens(token_hash, user_id, family_id, created_at, expires_at) VALUES($1, $2, $3, $4, $5);`
+	_, err := m.DB.Exec(query, t.Hash, t.UserID, t.FamilyID, t.CreatedAt.UTC(), t.ExpiresAt.UTC())
+	return err
+}
+
+func (m *MetadataDB) GetRefreshToken(hash string) (*RefreshToken, error) {
+	query := `SELECT ` + refreshColumns + ` FROM refresh_tokens WHERE token_hash = $1;`
+	return scanRefreshToken(m.DB.QueryRow(query, hash))
+}
+
+// only one of two requests racing with the same token gets through
+func (m *MetadataDB) UseRefreshToken(hash string, now time.Time) error {
+	query := `UPDATE refresh_tokens SET used_at = $2
+		      WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > $2;`
+	return execOne(m.DB, query, hash, now.UTC())
+}
+
+func (m *MetadataDB) RevokeRefreshFamily(familyID string, now time.Time) error {
+	query := `UPDATE refresh_tokens SET revoked_at = $2 WHERE family_id = $1 AND revoked_at IS NULL;`
+	_, err := m.DB.Exec(query, familyID, now.UTC())
+	return err
+}
+
+func (m *MetadataDB) RevokeUserRefreshTokens(userID string, now time.Time) error {
+	query := `UPDATE refresh_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL;`
+	_, err := m.DB.Exec(query, userID, now.UTC())
+	return err
+}
+
+func (m *MetadataDB) RevokeToken(jti string, expiresAt time.Time) error {
+	query := `INSERT INTO revoked_tokens(jti, expires_at) VALUES($1, $2) ON CONFLICT (jti) DO NOTHING;`
+	_, err := m.DB.Exec(query, jti, expiresAt.UTC())
+	return err
+}
+
+func (m *MetadataDB) RevokedTokens(now time.Time) (map[string]time.Time, error) {
+	query := `SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > $1;`
+	return queryRevoked(m.DB, query, now.UTC())
+}
+
+func (m *MetadataDB) DeleteExpiredTokens(now time.Time) (int, error) {
+	return deleteExpiredTokens(m.DB, `DELETE FROM refresh_tokens WHERE expires_at <= $1;`,
+		`DELETE FROM revoked_tokens WHERE expires_at <= $1;`, now.UTC())
+}
+
+func queryRevoked(sqlDB *sql.DB, query string, args ...any) (map[string]time.Time, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := map[string]time.Time{}
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return nil, err
+		}
+		revoked[jti] = expiresAt
+	}
+
+	return revoked, rows.Err()
+}
+
+func deleteExpiredTokens(sqlDB *sql.DB, refreshQuery, revokedQuery string, now time.Time) (int, error) {
+	deleted := 0
+	for _, query := range []string{refreshQuery, revokedQuery} {
+		res, err := sqlDB.Exec(query, now)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int(n)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"database/sql"
+	"rekazdrive/internal/storage"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A trashed blob keeps its row with deleted_at set. GetMetadata, ListMetadata
+// and UpdateUserMetadata don't see it until it is restored, an upload to the
+// same id brings it back with the new content.
+
+// TrashMetadata moves a live blob to the trash. Returns sql.ErrNoRows for
+// unknown ids and for blobs already in the trash.
+func (m *MetadataDB) TrashMetadata(id string, now time.Time) error {
+	query := `UPDATE blobs_metadata SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL;`
+	res, err := m.DB.Exec(query, id, now.UTC())
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *MetadataDB) GetTrashed(id string) (*BlobMeta, error) {
+	var deletedAt time.Time
+	query := `SELECT ` + metaColumns + `, deleted_at FROM blobs_metadata WHERE id = $1 AND deleted_at IS NOT NULL;`
+	meta, err := scanMeta(m.DB.QueryRow(query, id), &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+	meta.DeletedAt = deletedAt
+	return meta, nil
+}
+
+// ListTrash pages through the trash by id, like ListMetadata does for live blobs
+func (m *MetadataDB) ListTrash(prefix, cursor string, limit int, viewer *Viewer) ([]BlobMeta, error) {
+	userID, groups := viewer.args()
+	query := `SELECT ` + metaColumns + `, deleted_at FROM blobs_metadata
+		      WHERE id > $1 AND id LIKE $2 ESCAPE '\' AND id NOT LIKE '.%' AND deleted_at IS NOT NULL AND ` + visibleTo + `
+			  ORDER BY id
+			  LIMIT $3;`
+	return m.queryTrash(query, cursor, storage.EscapeLike(prefix)+"%", limit, userID, pq.Array(groups))
+}
+
+// ExpiredTrash returns up to limit blobs trashed before the given time, oldest first
+func (m *MetadataDB) ExpiredTrash(before time.Time, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + metaColumns + `, deleted_at FROM blobs_metadata
+		      WHERE deleted_at < $1
+			  ORDER BY deleted_at, id
+			  LIMIT $2;`
+	return m.queryTrash(query, before.UTC(), limit)
+}
+
+func (m *MetadataDB) queryTrash(query string, args ...any) ([]BlobMeta, error) {
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metas []BlobMeta
+	for rows.Next() {
+		var deletedAt time.Time
+		meta, err := scanMeta(rows, &deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		meta.DeletedAt = deletedAt
+		metas = append(metas, *meta)
+	}
+
+	return metas, rows.Err()
+}
+
+// RestoreTrashed takes a blob out of the trash as it was
+func (m *MetadataDB) RestoreTrashed(id string) (*BlobMeta, error) {
+	query := `UPDATE blobs_metadata SET deleted_at = NULL
+		      WHERE id = $1 AND deleted_at IS NOT NULL
+			  RETURNING ` + metaColumns + `;`
+	return scanMeta(m.DB.QueryRow(query, id))
+}
+
+// PurgeTrashed deletes the row of a trashed blob, but only if it is still the
+// same trashing: deletedAt is the DeletedAt the caller read. A blob that was
+// restored or uploaded again in the meantime stays, sql.ErrNoRows then.
+func (m *MetadataDB) PurgeTrashed(id string, deletedAt time.Time) error {
+	query := `DELETE FROM blobs_metadata WHERE id = $1 AND deleted_at = $2;`
+	res, err := m.DB.Exec(query, id, deletedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// User is an account that can log in. Usernames are stored lowercase.
+type User struct {
+	ID string
+	Username string
+	PasswordHash string // see auth.HashPassword
+	Role string // see auth.Roles
+	Disabled bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ErrUserExists refuses a second account with the same username
+var ErrUserExists = errors.New("username is already taken")
+
+// UserStore keeps the accounts, part of every MetadataStore.
+// A miss is sql.ErrNoRows, like for blobs.
+type UserStore interface {
+	CreateUser(u *User) error
+	GetUser(id string) (*User, error)
+	GetUserByName(username string) (*User, error)
+	ListUsers() ([]User, error)
+	CountUsers() (int, error)
+	SetUserDisabled(id string, disabled bool, now time.Time) error
+	SetUserPassword(id, passwordHash string, now time.Time) error
+	SetUserRole(id, role string, now time.Time) error
+
+	// the groups a user is in, ACL grants can name them
+	UserGroups(id string) ([]string, error)
+	SetUserGroups(id string, groups []string) error
+
+	// links to users of an external identity provider, see identities.go
+	IdentityStore
+}
+
+const userColumns = `id, username, password_hash, role, disabled, created_at, updated_at`
+
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.Disabled, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (m *MetadataDB) CreateUser(u *User) error {
+	query := `INSERT INTO users(` + userColumns + `) VALUES($1, $2, $3, $4, $5, $6, $6);`
+	_, err := m.DB.Exec(query, u.ID, u.Username, u.PasswordHash, u.Role, u.Disabled, u.CreatedAt.UTC())
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+		return ErrUserExists
+	}
+	return err
+}
+
+func (m *MetadataDB) GetUser(id string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1;`
+	return scanUser(m.DB.QueryRow(query, id))
+}
+
+func (m *MetadataDB) GetUserByName(username string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1;`
+	return scanUser(m.DB.QueryRow(query, username))
+}
+
+// ListUsers returns every account by username, there are few of them
+func (m *MetadataDB) ListUsers() ([]User, error) {
+	query := `SELECT ` + userColumns + ` FROM users ORDER BY username;`
+	return queryUsers(m.DB, query)
+}
+
+func (m *MetadataDB) CountUsers() (int, error) {
+	var n int
+	err := m.DB.QueryRow(`SELECT count(*) FROM users;`).Scan(&n)
+	return n, err
+}
+
+func (m *MetadataDB) SetUserDisabled(id string, disabled bool, now time.Time) error {
+	query := `UPDATE users SET disabled = $2, updated_at = $3 WHERE id = $1;`
+	return execOne(m.DB, query, id, disabled, now.UTC())
+}
+
+func (m *MetadataDB) SetUserPassword(id, passwordHash string, now time.Time) error {
+	query := `UPDATE users SET password_hash = $2, updated_at = $3 WHERE id = $1;`
+	return execOne(m.DB, query, id, passwordHash, now.UTC())
+}
+
+func (m *MetadataDB) SetUserRole(id, role string, now time.Time) error {
+	query := `UPDATE users SET role = $2, updated_at = $3 WHERE id = $1;`
+	return execOne(m.DB, query, id, role, now.UTC())
+}
+
+// UserGroups returns the user's groups by name, none for unknown users
+func (m *MetadataDB) UserGroups(id string) ([]string, error) {
+	query := `SELECT group_name FROM user_groups WHERE user_id = $1 ORDER BY group_name;`
+	return queryStrings(m.DB, query, id)
+}
+
+// SetUserGroups replaces the user's groups, sql.ErrNoRows for unknown users
+func (m *MetadataDB) SetUserGroups(id string, groups []string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	if err := tx.QueryRow(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE;`, id).Scan(&found); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_groups WHERE user_id = $1;`, id); err != nil {
+		return err
+	}
+	query := `INSERT INTO user_groups(user_id, group_name) VALUES($1, $2) ON CONFLICT DO NOTHING;`
+	for _, g := range groups {
+		if _, err := tx.Exec(query, id, g); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func queryUsers(sqlDB *sql.DB, query string, args ...any) ([]User, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+
+	return users, rows.Err()
+}
+
+func queryStrings(sqlDB *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, rows.Err()
+}
+
+// execOne runs a statement that must change exactly one row, sql.ErrNoRows if it changed none
+func execOne(sqlDB *sql.DB, query string, args ...any) error {
+	res, err := sqlDB.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
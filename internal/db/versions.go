@@ -0,0 +1,113 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Versions of versioned blobs live in blob_versions, one row per upload,
+// never updated. blobs_metadata.version_id says which one is current.
+
+// ErrCurrentVersion refuses deleting the version a blob currently points at
+var ErrCurrentVersion = errors.New("version is the blob's current version")
+
+// same order as metaColumns, a version never changes so created_at is also its updated_at.
+// Versions don't expire, only the blob does, and they belong to the blob's owner.
+const versionColumns = `id, size, created_at, created_at, content_type, filename, sha256, md5, user_metadata, tags, version_id, NULL, ''`
+
+// ListVersions returns up to limit versions of id older than cursor, newest first.
+// Version ids sort by creation time, so they double as the cursor.
+func (m *MetadataDB) ListVersions(id, cursor string, limit int) ([]BlobMeta, error) {
+	query := `SELECT ` + versionColumns + ` FROM blob_versions
+		      WHERE id = $1 AND ($2 = '' OR version_id < $2)
+			  ORDER BY version_id DESC
+			  LIMIT $3;`
+	rows, err := m.DB.Query(query, id, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []BlobMeta
+	for rows.Next() {
+		v, err := scanMeta(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+
+	return versions, rows.Err()
+}
+
+func (m *MetadataDB) GetVersion(id, versionID string) (*BlobMeta, error) {
+	query := `SELECT ` + versionColumns + ` FROM blob_versions WHERE id = $1 AND version_id = $2;`
+	return scanMeta(m.DB.QueryRow(query, id, versionID))
+}
+
+// RestoreVersion makes a version current again, with the metadata it was
+// written with. This also brings back a blob that was trashed or deleted since.
+func (m *MetadataDB) RestoreVersion(id, versionID string, now time.Time) (*BlobMeta, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// DeleteVersion takes the same lock, so the version can't go away under us
+	var found int
+	query := `SELECT 1 FROM blob_versions WHERE id = $1 AND version_id = $2 FOR UPDATE;`
+	if err := tx.QueryRow(query, id, versionID).Scan(&found); err != nil {
+		return nil, err
+	}
+
+	query = `INSERT INTO blobs_metadata(id, size, created_at, updated_at, content_type, filename, sha256, md5, user_metadata, tags, version_id)
+		      SELECT id, size, $3, $3, content_type, filename, sha256, md5, user_metadata, tags, version_id
+			  FROM blob_versions WHERE id = $1 AND version_id = $2
+			  ON CONFLICT (id) DO UPDATE
+			  SET size = EXCLUDED.size, updated_at = EXCLUDED.updated_at, content_type = EXCLUDED.content_type,
+			  filename = EXCLUDED.filename, sha256 = EXCLUDED.sha256, md5 = EXCLUDED.md5,
+			  user_metadata = EXCLUDED.user_metadata, tags = EXCLUDED.tags, version_id = EXCLUDED.version_id,
+			  expires_at = NULL, deleted_at = NULL
+			  RETURNING ` + metaColumns + `;`
+	meta, err := scanMeta(tx.QueryRow(query, id, versionID, now.UTC()))
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, tx.Commit()
+}
+
+// DeleteVersion removes one version's row, the caller deletes its data afterwards.
+// Returns sql.ErrNoRows for unknown versions and ErrCurrentVersion for the current one.
+func (m *MetadataDB) DeleteVersion(id, versionID string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	query := `SELECT 1 FROM blob_versions WHERE id = $1 AND version_id = $2 FOR UPDATE;`
+	if err := tx.QueryRow(query, id, versionID).Scan(&found); err != nil {
+		return err
+	}
+
+	var current sql.NullString
+	query = `SELECT version_id FROM blobs_metadata WHERE id = $1;`
+	err = tx.QueryRow(query, id).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if current.String == versionID {
+		return ErrCurrentVersion
+	}
+
+	query = `DELETE FROM blob_versions WHERE id = $1 AND version_id = $2;`
+	if _, err := tx.Exec(query, id, versionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Who may do what with a blob is in db/acl.go. Refusals are a 403 for reads
+// too, an upload to the id would tell that it is taken anyway.
+
+// at most this many grants per blob, they are all checked on every request
+const maxGrants = 100
+
+// grantReq names the grantee by username or group, the store keeps user ids
+type grantReq struct {
+	User string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	Permission string `json:"permission"`
+}
+
+type aclReq struct {
+	Grants []grantReq `json:"grants"`
+}
+
+type aclResp struct {
+	OwnerID string `json:"owner_id"`
+	Grants []grantReq `json:"grants"`
+}
+
+// allowed reports whether the caller may do perm with meta. Admins and the
+// owner may do anything, requests without a caller nothing.
+func (h *BlobHandler) allowed(c *gin.Context, meta *db.BlobMeta, perm string) (bool, error) {
+	caller, ok := middleware.CallerFrom(c)
+	switch {
+	case !ok:
+		return false, nil
+	case caller.Admin || meta.OwnerID != "" && meta.OwnerID == caller.UserID:
+		return true, nil
+	}
+	return h.Meta.HasGrant(meta.ID, perm, db.Viewer{UserID: caller.UserID, Groups: caller.Groups})
+}
+
+// authorize is allowed for handlers, on refusal the error response is already written
+func (h *BlobHandler) authorize(c *gin.Context, meta *db.BlobMeta, perm string) bool {
+	ok, err := h.allowed(c, meta, perm)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "access check failed", "detail": err.Error()})
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return false
+	}
+	return true
+}
+
+// viewer is what list queries filter by, nil for admins who see everything
+func viewer(c *gin.Context) *db.Viewer {
+	caller, ok := middleware.CallerFrom(c)
+	if ok && caller.Admin {
+		return nil
+	}
+	return &db.Viewer{UserID: caller.UserID, Groups: caller.Groups}
+}
+
+// existing returns the row of id whether it is live or in the trash
+func (h *BlobHandler) existing(id string) (*db.BlobMeta, error) {
+	meta, err := h.Meta.GetMetadata(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		meta, err = h.Meta.GetTrashed(id)
+	}
+	return meta, err
+}
+
+// aclMeta is what access to the versions of id is decided by: the blob, live
+// or trashed. Versions of a deleted blob have no owner left, only admins get at them.
+func (h *BlobHandler) aclMeta(id string) (*db.BlobMeta, error) {
+	meta, err := h.existing(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &db.BlobMeta{ID: id}, nil
+	}
+	return meta, err
+}
+
+// GetACL shows the owner and grants of a blob, to the owner and admins
+func (h *BlobHandler) GetACL(c *gin.Context) {
+	meta, err := h.getMeta(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.owns(c, meta) {
+		return
+	}
+	h.respondACL(c, meta)
+}
+
+// PutACL replaces every grant of a blob, an empty list takes all access back
+func (h *BlobHandler) PutACL(c *gin.Context) {
+	var r aclReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	meta, err := h.getMeta(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.owns(c, meta) {
+		return
+	}
+
+	grants, err := h.toGrants(r.Grants)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown user"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err = h.Meta.SetGrants(meta.ID, grants)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "acl update failed", "detail": err.Error()})
+		return
+	}
+
+	h.respondACL(c, meta)
+}
+
+// owns lets the owner and admins manage a blob's grants, on refusal the
+// error response is already written
+func (h *BlobHandler) owns(c *gin.Context, meta *db.BlobMeta) bool {
+	caller, ok := middleware.CallerFrom(c)
+	if !ok || !caller.Admin && (meta.OwnerID == "" || meta.OwnerID != caller.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner can change who has access"})
+		return false
+	}
+	return true
+}
+
+// toGrants validates the requested grants and resolves usernames to ids,
+// sql.ErrNoRows for a username that doesn't exist
+func (h *BlobHandler) toGrants(reqs []grantReq) ([]db.Grant, error) {
+	if len(reqs) > maxGrants {
+		return nil, fmt.Errorf("at most %d grants are allowed", maxGrants)
+	}
+	grants := make([]db.Grant, 0, len(reqs))
+	for _, r := range reqs {
+		switch r.Permission {
+		case db.PermRead, db.PermWrite, db.PermDelete:
+		default:
+			return nil, fmt.Errorf("permission must be read, write or delete")
+		}
+
+		switch {
+		case (r.User == "") == (r.Group == ""):
+			return nil, fmt.Errorf("every grant needs either a user or a group")
+		case r.Group != "":
+			if err := auth.ValidateGroup(r.Group); err != nil {
+				return nil, err
+			}
+			grants = append(grants, db.Grant{PrincipalType: db.PrincipalGroup, Principal: r.Group, Permission: r.Permission})
+		default:
+			user, err := h.Meta.GetUserByName(auth.NormaliseUsername(r.User))
+			if err != nil {
+				return nil, err
+			}
+			grants = append(grants, db.Grant{PrincipalType: db.PrincipalUser, Principal: user.ID, Permission: r.Permission})
+		}
+	}
+	return grants, nil
+}
+
+func (h *BlobHandler) respondACL(c *gin.Context, meta *db.BlobMeta) {
+	grants, err := h.Meta.ListGrants(meta.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "acl read failed", "detail": err.Error()})
+		return
+	}
+
+	resp := aclResp{OwnerID: meta.OwnerID, Grants: make([]grantReq, 0, len(grants))}
+	for _, g := range grants {
+		r := grantReq{Group: g.Principal, Permission: g.Permission}
+		if g.PrincipalType == db.PrincipalUser {
+			r = grantReq{User: g.Principal, Permission: g.Permission}
+			// users are never deleted, but a failed lookup still shows the id
+			if user, err := h.Meta.GetUser(g.Principal); err == nil {
+				r.User = user.Username
+			}
+		}
+		resp.Grants = append(resp.Grants, r)
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/middleware"
+)
+
+const maxKeyNameLen = 100
+
+type createKeyReq struct {
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"` // all of the caller's scopes if left out
+
+	// at most one of them, neither means the key never expires
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL string `json:"ttl"` // e.g. 90d from now
+}
+
+// apiKeyResp is a key as the API returns it, with the key itself only when it is created
+type apiKeyResp struct {
+	ID string `json:"id"`
+	Key string `json:"key,omitempty"`
+	Name string `json:"name"`
+	Prefix string `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	LastUsedAt string `json:"last_used_at,omitempty"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+}
+
+func newAPIKeyResp(k *db.APIKey) apiKeyResp {
+	resp := apiKeyResp{
+		ID:        k.ID,
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		Scopes:    strings.Fields(k.Scope),
+		CreatedAt: k.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if !k.ExpiresAt.IsZero() {
+		resp.ExpiresAt = k.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if !k.LastUsedAt.IsZero() {
+		resp.LastUsedAt = k.LastUsedAt.UTC().Format(time.RFC3339)
+	}
+	if !k.RevokedAt.IsZero() {
+		resp.RevokedAt = k.RevokedAt.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+func validateKeyName(name string) error {
+	if name == "" || len(name) > maxKeyNameLen || !utf8.ValidString(name) {
+		return fmt.Errorf("name must be 1 to %d bytes of UTF-8", maxKeyNameLen)
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("name contains control characters")
+		}
+	}
+	return nil
+}
+
+// keyScopes checks the requested scopes, a key can't do more than its creator
+func keyScopes(requested, allowed []string) ([]string, error) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	scopes := []string{}
+	for _, s := range requested {
+		if err := auth.ValidateScope(s); err != nil {
+			return nil, err
+		}
+		if !auth.HasScope(allowed, s) {
+			return nil, fmt.Errorf("scope %s is more than your role allows", s)
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// CreateAPIKey makes a key for the caller. API keys can't make more keys, so
+// a leaked key can't be used to stay in after it is revoked.
+func (h *AuthHandler) CreateAPIKey(c *gin.Context) {
+	caller, _ := middleware.CallerFrom(c)
+	if caller.APIKeyID != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys can't create API keys, log in instead"})
+		return
+	}
+
+	var r createKeyReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	r.Name = strings.TrimSpace(r.Name)
+	if err := validateKeyName(r.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	scopes, err := keyScopes(r.Scopes, caller.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now().UTC()
+	expiry, err := parseExpiry(r.ExpiresAt, r.TTL, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, apiKey, err := auth.NewAPIKey(caller.UserID, r.Name, scopes, expiry, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate key"})
+		return
+	}
+	if err := h.Meta.CreateAPIKey(apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "create failed", "detail": err.Error()})
+		return
+	}
+
+	resp := newAPIKeyResp(apiKey)
+	resp.Key = key
+	c.JSON(http.StatusCreated, resp)
+}
+
+// ListAPIKeys lists the caller's keys, admins can pass ?user_id= for someone else's
+func (h *AuthHandler) ListAPIKeys(c *gin.Context) {
+	caller, _ := middleware.CallerFrom(c)
+	userID := caller.UserID
+	if other := c.Query("user_id"); other != "" && other != caller.UserID {
+		if !caller.Admin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		userID = other
+	}
+
+	keys, err := h.Meta.ListAPIKeys(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list failed", "detail": err.Error()})
+		return
+	}
+
+	resp := make([]apiKeyResp, 0, len(keys))
+	for i := range keys {
+		resp = append(resp, newAPIKeyResp(&keys[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"items": resp})
+}
+
+// RevokeAPIKey revokes one of the caller's keys, admins may revoke anyone's
+func (h *AuthHandler) RevokeAPIKey(c *gin.Context) {
+	caller, _ := middleware.CallerFrom(c)
+	id := c.Param("id")
+
+	// someone else's key is as good as missing
+	key, err := h.Meta.GetAPIKey(id)
+	if err == nil && key.UserID != caller.UserID && !caller.Admin {
+		err = sql.ErrNoRows
+	}
+	if err == nil {
+		err = h.Meta.RevokeAPIKey(id, time.Now().UTC())
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed", "detail": err.Error()})
+		return
+	}
+
+	key, err = h.Meta.GetAPIKey(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "lookup failed", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, newAPIKeyResp(key))
+}
@@ -1,51 +1,259 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 
-	"rekazdrive/internal/config"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/middleware"
 )
 
+const (
+	DefaultAccessTTL = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// AuthHandler hands out tokens: a short-lived access token for the API and a
+// refresh token that is exchanged for a new pair once, each exchange rotates it
+type AuthHandler struct {
+	Keys *auth.Keyring
+	Meta db.MetadataStore
+	Revoked *auth.Revocations
+	AccessTTL time.Duration
+	RefreshTTL time.Duration
+	Guard *auth.LoginGuard // failed login throttling
+}
+
+func NewAuthHandler(keys *auth.Keyring, meta db.MetadataStore, revoked *auth.Revocations) *AuthHandler {
+	return &AuthHandler{
+		Keys:       keys,
+		Meta:       meta,
+		Revoked:    revoked,
+		AccessTTL:  DefaultAccessTTL,
+		RefreshTTL: DefaultRefreshTTL,
+		Guard:      auth.NewLoginGuard(meta, auth.DefaultLoginPolicy),
+	}
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
-func LoginHandler(cfg config.Config) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var req LoginRequest
+type refreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenResp struct {
+	Token string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn int `json:"expires_in"` // seconds until token expires
+}
+
+func (h *AuthHandler) Login(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "bad request format"})
+		return
+	}
+
+	// a locked username or address isn't even checked, guessing gets no answers
+	username, ip, now := auth.NormaliseUsername(req.Username), c.ClientIP(), time.Now().UTC()
+	wait, err := h.Guard.Check(username, ip, now)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "login throttle failed", "detail": err.Error()})
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(c, wait)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins, try again later"})
+		return
+	}
+
+	// unknown users cost a hash too, so timing doesn't tell which usernames exist
+	user, err := h.Meta.GetUserByName(username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(500, gin.H{"error": "user lookup failed", "detail": err.Error()})
+		return
+	}
+	if err != nil {
+		auth.VerifyNoUser(req.Password)
+		h.loginFailed(c, username, ip, now)
+		return
+	}
+	if !auth.VerifyPassword(user.PasswordHash, req.Password) || user.Disabled {
+		h.loginFailed(c, username, ip, now)
+		return
+	}
+	if err := h.Guard.Reset(username); err != nil {
+		c.JSON(500, gin.H{"error": "login throttle failed", "detail": err.Error()})
+		return
+	}
+
+	// every login starts a new family of refresh tokens
+	family, err := auth.NewTokenID()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to generate token"})
+		return
+	}
+	h.issue(c, user, family)
+}
+
+// loginFailed counts the failure against the username and the address, the
+// response says when to try again once that locked either of them
+func (h *AuthHandler) loginFailed(c *gin.Context, username, ip string, now time.Time) {
+	wait, err := h.Guard.Failed(username, ip, now)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "login throttle failed", "detail": err.Error()})
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(c, wait)
+	}
+	c.JSON(401, gin.H{"error": "invalid username or password"})
+}
+
+// setRetryAfter sets Retry-After in whole seconds, rounded up so a client
+// that waits exactly that long isn't refused again
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+}
+
+// Refresh swaps a refresh token for a new pair. A refresh token that was
+// already used means it leaked, so the whole family is revoked and whoever
+// holds the newer one has to log in again.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req refreshReq
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(400, gin.H{"error": "refresh_token is required"})
+		return
+	}
+
+	now := time.Now().UTC()
+	hash := auth.HashToken(req.RefreshToken)
+	token, err := h.Meta.GetRefreshToken(hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(401, gin.H{"error": "invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "token lookup failed", "detail": err.Error()})
+		return
+	}
+	if !token.ExpiresAt.After(now) {
+		c.JSON(401, gin.H{"error": "invalid refresh token"})
+		return
+	}
+
+	// a second request with the same token loses here too
+	err = h.Meta.UseRefreshToken(hash, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := h.Meta.RevokeRefreshFamily(token.FamilyID, now); err != nil {
+			c.JSON(500, gin.H{"error": "failed to revoke tokens", "detail": err.Error()})
+			return
+		}
+		c.JSON(401, gin.H{"error": "invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to use token", "detail": err.Error()})
+		return
+	}
+
+	user, err := h.Meta.GetUser(token.UserID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(500, gin.H{"error": "user lookup failed", "detail": err.Error()})
+		return
+	}
+	if err != nil || user.Disabled {
+		c.JSON(401, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	h.issue(c, user, token.FamilyID)
+}
+
+// Logout revokes the access token it is called with and, if given, the family
+// of the caller's refresh token
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req refreshReq
+	if c.Request.ContentLength != 0 {
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(400, gin.H{"error": "bad request format"})
 			return
 		}
+	}
+
+	claims, ok := middleware.ClaimsFrom(c)
+	if !ok {
+		c.JSON(400, gin.H{"error": "only tokens from /v1/auth/login can log out"})
+		return
+	}
+	if err := h.Revoked.Revoke(claims.ID, claims.ExpiresAt.Time); err != nil {
+		c.JSON(500, gin.H{"error": "failed to revoke token", "detail": err.Error()})
+		return
+	}
 
-		// simple auth check using login credentials from .env, I could implement a full login & register system if needed.
-		if req.Username != cfg.AdminUser || req.Password != cfg.AdminPass {
-			c.JSON(401, gin.H{"error": "invalid username or password"})
+	if req.RefreshToken != "" {
+		token, err := h.Meta.GetRefreshToken(auth.HashToken(req.RefreshToken))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			c.JSON(500, gin.H{"error": "token lookup failed", "detail": err.Error()})
 			return
 		}
-
-		// generate JWT
-		var expMinutes int = 60 // default expiration time in minutes
-		if val, err := time.ParseDuration(cfg.JWTExpiration); err == nil {
-			expMinutes = int(val.Minutes())
+		// someone else's token is left alone, the caller can't know it's valid
+		if err == nil && token.UserID == claims.Subject {
+			if err := h.Meta.RevokeRefreshFamily(token.FamilyID, time.Now().UTC()); err != nil {
+				c.JSON(500, gin.H{"error": "failed to revoke tokens", "detail": err.Error()})
+				return
+			}
 		}
+	}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"username": req.Username,
-			"exp": time.Now().Add(time.Duration(expMinutes) * time.Minute).Unix(),
-			"iat": time.Now().Unix(),
-		})
+	c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+}
 
-		tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
-		if err != nil {
-			c.JSON(500, gin.H{"error": "failed to generate token"})
-			return
-		}
+// JWKS serves the public keys tokens are verified with, for other services
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	jwks, err := h.Keys.JWKS()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to list keys", "detail": err.Error()})
+		return
+	}
+	// verifiers fetch again when they see a kid they don't know
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwks)
+}
 
-		c.JSON(200, gin.H{"token": tokenString})
+// issue responds with a new access token and a refresh token in the family
+func (h *AuthHandler) issue(c *gin.Context, user *db.User, family string) {
+	now := time.Now().UTC()
+	access, _, err := auth.IssueAccessToken(user, h.Keys, h.AccessTTL, now)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to generate token"})
+		return
+	}
+	refresh, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to generate token"})
+		return
 	}
-}
\ No newline at end of file
+	err = h.Meta.CreateRefreshToken(&db.RefreshToken{
+		Hash:      hash,
+		UserID:    user.ID,
+		FamilyID:  family,
+		CreatedAt: now,
+		ExpiresAt: now.Add(h.RefreshTTL),
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to save token", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(200, tokenResp{Token: access, RefreshToken: refresh, ExpiresIn: int(h.AccessTTL.Seconds())})
+}
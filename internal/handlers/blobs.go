@@ -1,10 +1,23 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"rekazdrive/internal/db"
+	"rekazdrive/internal/middleware"
 	"rekazdrive/internal/storage"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,10 +25,12 @@ import (
 
 type BlobHandler struct {
 	Store storage.StorageBackend
-	Meta *db.MetadataDB
+	Meta db.MetadataStore
+	Versioning VersioningPolicy // off unless set
+	TrashRetention time.Duration // > 0 makes DeleteBlob move blobs to the trash, see trash.go
 }
 
-func NewBlobHandler(store storage.StorageBackend, meta *db.MetadataDB) *BlobHandler {
+func NewBlobHandler(store storage.StorageBackend, meta db.MetadataStore) *BlobHandler {
 	return &BlobHandler{
 		Store: store,
 		Meta:  meta,
@@ -25,13 +40,28 @@ func NewBlobHandler(store storage.StorageBackend, meta *db.MetadataDB) *BlobHand
 type postReq struct {
 	ID string `json:"id"`
 	Data string `json:"data"`
+	blobFields
 }
 
+// patchReq replaces what it contains, an absent or null field stays as it is
+type patchReq struct {
+	Metadata map[string]string `json:"metadata"`
+	Tags []string `json:"tags"`
+}
+
+type listResp struct {
+	Items []metaResp `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit = 1000
+)
+
 type getResp struct {
-	ID string `json:"id"`
+	metaResp
 	Data string `json:"data"` // Base64 encoded data
-	Size int `json:"size"`
-	CreatedAt string `json:"created_at"`
 }
 
 func (h *BlobHandler) PostBlob (c *gin.Context) {
@@ -40,8 +70,12 @@ func (h *BlobHandler) PostBlob (c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
 		return
 	}
-	if r.ID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id required"})
+	if err := storage.ValidateID(r.ID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := r.blobFields.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	data, err := base64.StdEncoding.DecodeString(r.Data)
@@ -50,14 +84,17 @@ func (h *BlobHandler) PostBlob (c *gin.Context) {
 		return
 	}
 
-	if err := h.Store.Save(r.ID, data); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "save failed", "detail": err.Error()})
+	// the data is all here, so a corrupted upload is refused before it replaces anything
+	if sum := sha256.Sum256(data); r.SHA256 != "" && r.SHA256 != hex.EncodeToString(sum[:]) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sha256 does not match the data"})
+		return
+	}
+	if sum := md5.Sum(data); r.MD5 != "" && r.MD5 != hex.EncodeToString(sum[:]) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "md5 does not match the data"})
 		return
 	}
 
-	if err := h.Meta.SaveMetadata(r.ID, len(data), time.Now().UTC()); err != nil {
-		_ = h.Store.Delete(r.ID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta save failed", "detail": err.Error()})
+	if !h.storeBlob(c, r.ID, bytes.NewReader(data), int64(len(data)), r.blobFields) {
 		return
 	}
 
@@ -65,22 +102,380 @@ func (h *BlobHandler) PostBlob (c *gin.Context) {
 }
 
 func (h *BlobHandler) GetBlob(c *gin.Context) {
-	id := c.Param("id")
-	meta, err := h.Meta.GetMetadata(id)
+	meta, err := h.getMeta(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
-	data, err := h.Store.Load(id)
+	if !h.authorize(c, meta, db.PermRead) {
+		return
+	}
+	data, err := h.Store.Load(meta.Key())
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
 	resp := getResp{
-		ID:        id,
-		Data:      base64.StdEncoding.EncodeToString(data),
-		Size:      meta.Size,
-		CreatedAt: meta.CreatedAt.UTC().Format(time.RFC3339),
+		metaResp: newMetaResp(meta),
+		Data:     base64.StdEncoding.EncodeToString(data),
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// PutBlobContent stores the raw request body under :id, no base64 round trip
+func (h *BlobHandler) PutBlobContent(c *gin.Context) {
+	id := c.Param("id")
+	if err := storage.ValidateID(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the descriptive fields come from the usual upload headers here
+	fields := blobFields{ContentType: c.GetHeader("Content-Type")}
+	if _, params, err := mime.ParseMediaType(c.GetHeader("Content-Disposition")); err == nil {
+		fields.Filename = params["filename"]
+	}
+	if err := fields.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// lets a compressing backend decide by the declared type instead of sniffing
+	if fields.ContentType != "" {
+		c.Request = c.Request.WithContext(storage.WithContentType(c.Request.Context(), fields.ContentType))
+	}
+
+	// ContentLength is -1 for chunked uploads, backends handle the unknown size
+	if !h.storeBlob(c, id, c.Request.Body, c.Request.ContentLength, fields) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"status": "created"})
+}
+
+// GetBlobContent streams the stored bytes as-is, honouring Range and conditional headers
+func (h *BlobHandler) GetBlobContent(c *gin.Context) {
+	meta, err := h.getMeta(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.authorize(c, meta, db.PermRead) {
+		return
+	}
+
+	h.serveContent(c, meta, etagFor(meta))
+}
+
+// serveContent sends the data stored under meta.Key(), the current blob or one of its versions
+func (h *BlobHandler) serveContent(c *gin.Context, meta *db.BlobMeta, etag string) {
+	key := meta.Key()
+	var content *blobSeeker
+	if encoded, codec, size, ok := h.encodedFor(c, key); ok {
+		// the compressed bytes are a representation of their own, with their own validator
+		c.Header("Content-Encoding", codec)
+		etag = strings.TrimSuffix(etag, `"`) + "-" + codec + `"`
+		content = newBlobSeeker(c.Request.Context(), encoded, key, size)
+	} else {
+		content = newBlobSeeker(c.Request.Context(), h.Store, key, meta.Size)
+	}
+	defer content.Close()
+
+	// a plain download reads everything anyway, opening now keeps a missing object a clean 404
+	if c.GetHeader("Range") == "" {
+		if err := content.open(); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+	}
+
+	for k, v := range blobHeaders(meta) {
+		c.Header(k, v)
+	}
+	c.Header("ETag", etag)
+	http.ServeContent(c.Writer, c.Request, "", meta.UpdatedAt, content)
+}
+
+// HeadBlob answers with the blob's size and dates, no payload
+func (h *BlobHandler) HeadBlob(c *gin.Context) {
+	meta, err := h.getMeta(c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !h.authorize(c, meta, db.PermRead) {
+		return
+	}
+
+	for k, v := range blobHeaders(meta) {
+		c.Header(k, v)
+	}
+	c.Header("Content-Length", strconv.FormatInt(meta.Size, 10))
+	c.Header("Accept-Ranges", "bytes")
+	c.Status(http.StatusOK)
+}
+
+// DeleteBlob removes the stored data first, then the metadata row, so a failure
+// half way leaves a row pointing at nothing rather than unreachable data.
+// The data of a versioned blob is its current version and stays in the history.
+// With a TrashRetention the blob only goes to the trash, see trash.go.
+func (h *BlobHandler) DeleteBlob(c *gin.Context) {
+	id := c.Param("id")
+	meta, err := h.getMeta(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.authorize(c, meta, db.PermDelete) {
+		return
+	}
+
+	if h.TrashRetention > 0 {
+		err := h.Meta.TrashMetadata(id, time.Now().UTC())
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "trash failed", "detail": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "trashed"})
+		return
+	}
+
+	if meta.VersionID == "" {
+		if err := h.Store.Delete(id); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed", "detail": err.Error()})
+			return
+		}
+	}
+
+	if err := h.Meta.DeleteMetadata(id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta delete failed", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// ListBlobs pages through metadata in id order, ?prefix= filters and
+// ?cursor= continues from the next_cursor of the previous page. Only blobs
+// the caller may read are listed.
+func (h *BlobHandler) ListBlobs(c *gin.Context) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	// one extra row tells us whether there is another page
+	metas, err := h.Meta.ListMetadata(c.Query("prefix"), after, limit+1, viewer(c), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list failed", "detail": err.Error()})
+		return
+	}
+
+	resp := listResp{Items: make([]metaResp, 0, len(metas))}
+	if len(metas) > limit {
+		metas = metas[:limit]
+		resp.NextCursor = encodeCursor(metas[limit-1].ID)
+	}
+	for i := range metas {
+		resp.Items = append(resp.Items, newMetaResp(&metas[i]))
 	}
 	c.JSON(http.StatusOK, resp)
-}
\ No newline at end of file
+}
+
+// PatchBlob updates the user metadata and tags of a blob without touching its data
+func (h *BlobHandler) PatchBlob(c *gin.Context) {
+	var r patchReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	fields := blobFields{Metadata: r.Metadata, Tags: r.Tags}
+	if err := fields.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id := c.Param("id")
+	current, err := h.getMeta(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.authorize(c, current, db.PermWrite) {
+		return
+	}
+	meta, err := h.Meta.UpdateUserMetadata(id, fields.Metadata, fields.Tags, time.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta update failed", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, newMetaResp(meta))
+}
+
+// storeBlob writes data through the backend and records its metadata,
+// on failure the error response is already written and false is returned
+func (h *BlobHandler) storeBlob(c *gin.Context, id string, r io.Reader, size int64, fields blobFields) bool {
+	ctx := c.Request.Context()
+
+	// overwriting takes write access, a new id belongs to whoever uploads it
+	existing, err := h.existing(id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "save failed", "detail": err.Error()})
+		return false
+	}
+	if err == nil && !h.authorize(c, existing, db.PermWrite) {
+		return false
+	}
+	caller, _ := middleware.CallerFrom(c)
+
+	// a versioned blob is never overwritten: every upload gets a key of its
+	// own and the previous data stays behind as an older version
+	key, versionID := id, ""
+	if h.Versioning.Versioned(id) {
+		if err := h.keepUnversioned(ctx, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "save failed", "detail": err.Error()})
+			return false
+		}
+		versionID = newVersionID(time.Now())
+		key = storage.VersionKey(versionID)
+	}
+
+	// checksums are taken on the way through, the data is never read twice
+	sha, md := sha256.New(), md5.New()
+	n, err := h.putCounted(ctx, key, io.TeeReader(r, io.MultiWriter(sha, md)), size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "save failed", "detail": err.Error()})
+		return false
+	}
+
+	meta := &db.BlobMeta{
+		ID:           id,
+		Size:         n,
+		UpdatedAt:    time.Now().UTC(),
+		ContentType:  fields.ContentType,
+		Filename:     fields.Filename,
+		SHA256:       hex.EncodeToString(sha.Sum(nil)),
+		MD5:          hex.EncodeToString(md.Sum(nil)),
+		UserMetadata: fields.Metadata,
+		Tags:         fields.Tags,
+		VersionID:    versionID,
+		ExpiresAt:    fields.expiry,
+		OwnerID:      caller.UserID, // an overwrite keeps the first owner
+	}
+	if err := h.Meta.SaveMetadata(meta); err != nil {
+		_ = h.Store.Delete(key)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta save failed", "detail": err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// getMeta looks up a blob. Internal storage names can have rows written by
+// the storage layers (dedup, compression), those are never blobs of their own.
+// An expired blob is gone already, even before the lifecycle worker deletes it.
+func (h *BlobHandler) getMeta(id string) (*db.BlobMeta, error) {
+	if internalName(id) {
+		return nil, sql.ErrNoRows
+	}
+	meta, err := h.Meta.GetMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	if expired(meta, time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	return meta, nil
+}
+
+func expired(meta *db.BlobMeta, now time.Time) bool {
+	return !meta.ExpiresAt.IsZero() && !meta.ExpiresAt.After(now)
+}
+
+// internal names like ".versions/..." start with a dot, no valid id does
+func internalName(id string) bool {
+	return strings.HasPrefix(id, ".")
+}
+
+// pageParams reads ?limit= and ?cursor= of a list request,
+// on failure the error response is already written
+func pageParams(c *gin.Context) (int, string, bool) {
+	limit := defaultListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+			return 0, "", false
+		}
+		limit = n
+	}
+
+	after := ""
+	if v := c.Query("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return 0, "", false
+		}
+		after = string(b)
+	}
+	return limit, after, true
+}
+
+// cursors are opaque to clients, ids and version ids alike
+func encodeCursor(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// putCounted streams r into the backend and returns the number of bytes written
+func (h *BlobHandler) putCounted(ctx context.Context, id string, r io.Reader, size int64) (int64, error) {
+	cr := &countingReader{r: r}
+	if err := h.Store.Put(ctx, id, cr, size); err != nil {
+		return 0, err
+	}
+	return cr.n, nil
+}
+
+// blobHeaders are the type and caching headers shared by every download response
+func blobHeaders(meta *db.BlobMeta) map[string]string {
+	headers := map[string]string{
+		"ETag":          etagFor(meta),
+		"Last-Modified": meta.UpdatedAt.UTC().Format(http.TimeFormat),
+		"Content-Type":  "application/octet-stream",
+	}
+	if meta.ContentType != "" {
+		headers["Content-Type"] = meta.ContentType
+	}
+	if cd := mime.FormatMediaType("inline", map[string]string{"filename": meta.Filename}); meta.Filename != "" && cd != "" {
+		headers["Content-Disposition"] = cd
+	}
+	if meta.VersionID != "" {
+		headers["X-Version-Id"] = meta.VersionID
+	}
+	return headers
+}
+
+// updated_at moves on every upload, so size + timestamp identify a version
+func etagFor(meta *db.BlobMeta) string {
+	return fmt.Sprintf("\"%x-%x\"", meta.Size, meta.UpdatedAt.UnixNano())
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"rekazdrive/internal/storage"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// encodedFor reports whether the blob is stored compressed in a coding the
+// client accepts, in which case the stored bytes can be sent as they are
+func (h *BlobHandler) encodedFor(c *gin.Context, id string) (rangeReader, string, int64, bool) {
+	er, ok := h.Store.(storage.EncodedReader)
+	if !ok {
+		return nil, "", 0, false
+	}
+	codec, size, err := er.Encoding(c.Request.Context(), id)
+	if err != nil || codec == "" {
+		return nil, "", 0, false
+	}
+
+	// the response depends on Accept-Encoding either way, caches must know
+	c.Header("Vary", "Accept-Encoding")
+	if !acceptsEncoding(c.GetHeader("Accept-Encoding"), codec) {
+		return nil, "", 0, false
+	}
+	return encodedRanges{er}, codec, size, true
+}
+
+// acceptsEncoding parses "gzip, zstd;q=0.5, br;q=0", a q of 0 means not acceptable
+func acceptsEncoding(header, coding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) {
+			continue
+		}
+		params = strings.TrimSpace(params)
+		if q, ok := strings.CutPrefix(params, "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			return err == nil && v > 0
+		}
+		return true
+	}
+	return false
+}
+
+// encodedRanges reads the stored form of a blob for blobSeeker
+type encodedRanges struct {
+	store storage.EncodedReader
+}
+
+func (e encodedRanges) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	return e.store.GetEncodedRange(ctx, id, offset, length)
+}
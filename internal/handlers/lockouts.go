@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lockoutResp is a lock of a username or an address, key is "user:<username>" or "ip:<address>"
+type lockoutResp struct {
+	ID string `json:"id"`
+	Key string `json:"key"`
+	Failures int `json:"failures"`
+	CreatedAt string `json:"created_at"`
+	LockedUntil string `json:"locked_until"`
+}
+
+// ListLockouts shows the latest locks from failed logins, newest first
+func (h *AuthHandler) ListLockouts(c *gin.Context) {
+	limit := defaultListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+			return
+		}
+		limit = n
+	}
+
+	lockouts, err := h.Meta.ListLockouts(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list failed", "detail": err.Error()})
+		return
+	}
+	resp := make([]lockoutResp, 0, len(lockouts))
+	for _, l := range lockouts {
+		resp = append(resp, lockoutResp{
+			ID:          l.ID,
+			Key:         l.Key,
+			Failures:    l.Failures,
+			CreatedAt:   l.CreatedAt.UTC().Format(time.RFC3339),
+			LockedUntil: l.LockedUntil.UTC().Format(time.RFC3339),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"items": resp})
+}
+
+// UnlockUser lets :id log in again right away. A locked address stays locked,
+// it unlocks on its own.
+func (h *AuthHandler) UnlockUser(c *gin.Context) {
+	user, err := h.Meta.GetUser(c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user read failed", "detail": err.Error()})
+		return
+	}
+	if err := h.Guard.Reset(user.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unlock failed", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "unlocked"})
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/lifecycle"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// limits on what clients can attach to a blob, the row has to stay small
+const (
+	maxUserMetadataKeys = 32
+	maxUserMetadataKeyLen = 64
+	maxUserMetadataValueLen = 1024
+	maxTags = 32
+	maxTagLen = 128
+	maxFilenameLen = 255
+)
+
+// blobFields are the optional descriptive fields of an upload
+type blobFields struct {
+	ContentType string `json:"content_type"`
+	Filename string `json:"filename"`
+	SHA256 string `json:"sha256"` // if given, the upload is rejected when the data doesn't match
+	MD5 string `json:"md5"`
+	Metadata map[string]string `json:"metadata"`
+	Tags []string `json:"tags"`
+
+	// at most one of them, the lifecycle worker deletes the blob once it has expired
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL string `json:"ttl"` // e.g. 30m or 7d from now
+
+	expiry time.Time // set by validate from ExpiresAt or TTL
+}
+
+// validate checks every field and normalises the checksums to lowercase hex
+func (f *blobFields) validate() error {
+	if f.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(f.ContentType); err != nil {
+			return fmt.Errorf("invalid content_type: %v", err)
+		}
+	}
+	if err := validateFilename(f.Filename); err != nil {
+		return err
+	}
+
+	var err error
+	if f.SHA256, err = normaliseDigest("sha256", f.SHA256, 32); err != nil {
+		return err
+	}
+	if f.MD5, err = normaliseDigest("md5", f.MD5, 16); err != nil {
+		return err
+	}
+
+	if err := validateUserMetadata(f.Metadata); err != nil {
+		return err
+	}
+	if f.Tags, err = normaliseTags(f.Tags); err != nil {
+		return err
+	}
+	return f.validateExpiry(time.Now())
+}
+
+func (f *blobFields) validateExpiry(now time.Time) error {
+	var err error
+	f.expiry, err = parseExpiry(f.ExpiresAt, f.TTL, now)
+	return err
+}
+
+// parseExpiry reads an expires_at or ttl field pair, zero if neither is given
+func parseExpiry(expiresAt *time.Time, ttl string, now time.Time) (time.Time, error) {
+	switch {
+	case expiresAt != nil && ttl != "":
+		return time.Time{}, fmt.Errorf("give either expires_at or ttl, not both")
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return time.Time{}, fmt.Errorf("expires_at must be in the future")
+		}
+		return expiresAt.UTC(), nil
+	case ttl != "":
+		d, err := lifecycle.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("ttl must be a positive duration like 30m or 7d")
+		}
+		return now.Add(d).UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+func validateFilename(name string) error {
+	if name == "" {
+		return nil
+	}
+	if len(name) > maxFilenameLen {
+		return fmt.Errorf("filename is longer than %d bytes", maxFilenameLen)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("filename must be a plain file name without directories")
+	}
+	if !printable(name) {
+		return fmt.Errorf("filename contains control characters or invalid UTF-8")
+	}
+	return nil
+}
+
+func normaliseDigest(name, value string, size int) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	value = strings.ToLower(value)
+	if b, err := hex.DecodeString(value); err != nil || len(b) != size {
+		return "", fmt.Errorf("%s must be %d hex characters", name, 2*size)
+	}
+	return value, nil
+}
+
+func validateUserMetadata(m map[string]string) error {
+	if len(m) > maxUserMetadataKeys {
+		return fmt.Errorf("at most %d metadata keys are allowed", maxUserMetadataKeys)
+	}
+	for k, v := range m {
+		if k == "" || len(k) > maxUserMetadataKeyLen {
+			return fmt.Errorf("metadata key %q must be 1 to %d bytes", k, maxUserMetadataKeyLen)
+		}
+		for _, r := range k {
+			if !(r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.')) {
+				return fmt.Errorf("metadata key %q may only use letters, digits, '-', '_' and '.'", k)
+			}
+		}
+		if len(v) > maxUserMetadataValueLen {
+			return fmt.Errorf("metadata value of %q is longer than %d bytes", k, maxUserMetadataValueLen)
+		}
+		if !printable(v) {
+			return fmt.Errorf("metadata value of %q contains control characters or invalid UTF-8", k)
+		}
+	}
+	return nil
+}
+
+// normaliseTags drops duplicates, keeping the order the client sent
+func normaliseTags(tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+
+	seen := map[string]bool{}
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t == "" || len(t) > maxTagLen {
+			return nil, fmt.Errorf("tag %q must be 1 to %d bytes", t, maxTagLen)
+		}
+		if !printable(t) {
+			return nil, fmt.Errorf("tag %q contains control characters or invalid UTF-8", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// metaResp is a blob's metadata as the API returns it
+type metaResp struct {
+	ID string `json:"id"`
+	Size int64 `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	MD5 string `json:"md5,omitempty"`
+	Metadata map[string]string `json:"metadata"`
+	Tags []string `json:"tags"`
+	VersionID string `json:"version_id,omitempty"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	OwnerID string `json:"owner_id,omitempty"`
+}
+
+func newMetaResp(meta *db.BlobMeta) metaResp {
+	resp := metaResp{
+		ID:          meta.ID,
+		Size:        meta.Size,
+		ContentType: meta.ContentType,
+		Filename:    meta.Filename,
+		SHA256:      meta.SHA256,
+		MD5:         meta.MD5,
+		Metadata:    meta.UserMetadata,
+		Tags:        meta.Tags,
+		VersionID:   meta.VersionID,
+		CreatedAt:   meta.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt:   meta.UpdatedAt.UTC().Format(time.RFC3339),
+		OwnerID:     meta.OwnerID,
+	}
+	if !meta.ExpiresAt.IsZero() {
+		resp.ExpiresAt = meta.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if resp.Metadata == nil {
+		resp.Metadata = map[string]string{}
+	}
+	if resp.Tags == nil {
+		resp.Tags = []string{}
+	}
+	return resp
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// blobSeeker exposes a stored blob as an io.ReadSeeker so http.ServeContent can
+// answer Range, If-Range, If-None-Match and If-Modified-Since for us.
+// Seeking only moves the offset, the next Read opens a ranged stream there,
+// so a byte range request never pulls the whole object from the backend.
+// An open stream is kept across seeks and reused if the Read comes back to
+// where it is, ServeContent seeks to the end and back to 0 before reading.
+type blobSeeker struct {
+	ctx    context.Context
+	store  rangeReader
+	id     string
+	size   int64
+	offset int64
+	rc     io.ReadCloser
+	rcPos  int64 // where the next byte of rc is
+}
+
+// rangeReader is the part of storage.StorageBackend the seeker needs
+type rangeReader interface {
+	GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error)
+}
+
+func newBlobSeeker(ctx context.Context, store rangeReader, id string, size int64) *blobSeeker {
+	return &blobSeeker{ctx: ctx, store: store, id: id, size: size}
+}
+
+// open starts a stream at the current offset running to the end of the blob
+func (b *blobSeeker) open() error {
+	rc, err := b.store.GetRange(b.ctx, b.id, b.offset, b.size-b.offset)
+	if err != nil {
+		return err
+	}
+	b.rc = rc
+	b.rcPos = b.offset
+	return nil
+}
+
+func (b *blobSeeker) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.rc != nil && b.rcPos != b.offset {
+		b.rc.Close()
+		b.rc = nil
+	}
+	if b.rc == nil {
+		if err := b.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.rc.Read(p)
+	b.offset += int64(n)
+	b.rcPos = b.offset
+	return n, err
+}
+
+func (b *blobSeeker) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = b.offset + offset
+	case io.SeekEnd:
+		abs = b.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.offset = abs
+	return abs, nil
+}
+
+func (b *blobSeeker) Close() error {
+	if b.rc == nil {
+		return nil
+	}
+	err := b.rc.Close()
+	b.rc = nil
+	return err
+}
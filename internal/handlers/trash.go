@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With a TrashRetention, DeleteBlob only moves a blob to the trash. Its data
+// stays in the backend until the blob is purged, by hand or by PurgeExpiredTrash once
+// it has been in the trash for longer than the retention.
+
+// how many expired blobs PurgeExpiredTrash reads per query
+const purgeBatch = 100
+
+type trashResp struct {
+	metaResp
+	DeletedAt string `json:"deleted_at"`
+	PurgeAt string `json:"purge_at"`
+}
+
+type trashListResp struct {
+	Items []trashResp `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListTrash pages through trashed blobs in id order, same parameters and
+// visibility as ListBlobs
+func (h *BlobHandler) ListTrash(c *gin.Context) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	metas, err := h.Meta.ListTrash(c.Query("prefix"), after, limit+1, viewer(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list failed", "detail": err.Error()})
+		return
+	}
+
+	resp := trashListResp{Items: make([]trashResp, 0, len(metas))}
+	if len(metas) > limit {
+		metas = metas[:limit]
+		resp.NextCursor = encodeCursor(metas[limit-1].ID)
+	}
+	for i := range metas {
+		m := &metas[i]
+		resp.Items = append(resp.Items, trashResp{
+			metaResp:  newMetaResp(m),
+			DeletedAt: m.DeletedAt.UTC().Format(time.RFC3339),
+			PurgeAt:   m.DeletedAt.Add(h.TrashRetention).UTC().Format(time.RFC3339),
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RestoreFromTrash brings a trashed blob back as it was when it was deleted.
+// Like purging, it takes the permission to delete the blob.
+func (h *BlobHandler) RestoreFromTrash(c *gin.Context) {
+	id := c.Param("id")
+	if !h.authorizeTrashed(c, id) {
+		return
+	}
+
+	meta, err := h.Meta.RestoreTrashed(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "restore failed", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, newMetaResp(meta))
+}
+
+// PurgeFromTrash deletes a trashed blob for good without waiting for the retention
+func (h *BlobHandler) PurgeFromTrash(c *gin.Context) {
+	id := c.Param("id")
+	if internalName(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	meta, err := h.Meta.GetTrashed(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta read failed", "detail": err.Error()})
+		return
+	}
+	if !h.authorize(c, meta, db.PermDelete) {
+		return
+	}
+
+	if err := h.purge(meta); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "purge failed", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "purged"})
+}
+
+// PurgeExpiredTrash purges every blob trashed for longer than TrashRetention
+// and returns how many it purged. It is safe to run on several nodes at once,
+// a blob purged elsewhere is just skipped.
+func (h *BlobHandler) PurgeExpiredTrash(ctx context.Context, now time.Time) (int, error) {
+	purged := 0
+	for {
+		metas, err := h.Meta.ExpiredTrash(now.Add(-h.TrashRetention), purgeBatch)
+		if err != nil {
+			return purged, err
+		}
+		for i := range metas {
+			if err := ctx.Err(); err != nil {
+				return purged, err
+			}
+			err := h.purge(&metas[i])
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return purged, err
+			}
+			purged++
+		}
+		if len(metas) < purgeBatch {
+			return purged, nil
+		}
+	}
+}
+
+// purge deletes the data and then the row of a trashed blob, like DeleteBlob
+// without a trash. A failure in between leaves the blob in the trash for the
+// next try. The versions of a versioned blob stay, like they do on a delete.
+// Returns sql.ErrNoRows if the blob was restored, re-uploaded or purged since
+// meta was read.
+func (h *BlobHandler) purge(meta *db.BlobMeta) error {
+	if meta.VersionID == "" {
+		current, err := h.Meta.GetTrashed(meta.ID)
+		if err != nil {
+			return err
+		}
+		if !current.DeletedAt.Equal(meta.DeletedAt) {
+			return sql.ErrNoRows // deleted again since, its retention starts over
+		}
+		if err := h.Store.Delete(meta.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return h.Meta.PurgeTrashed(meta.ID, meta.DeletedAt)
+}
+
+// authorizeTrashed checks the delete permission on a trashed blob, on refusal
+// or a miss the error response is already written
+func (h *BlobHandler) authorizeTrashed(c *gin.Context, id string) bool {
+	if internalName(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return false
+	}
+	meta, err := h.Meta.GetTrashed(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta read failed", "detail": err.Error()})
+		return false
+	}
+	return h.authorize(c, meta, db.PermDelete)
+}
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/middleware"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserHandler is the admin API for accounts, mounted behind middleware.RequireScope(auth.ScopeAdminUsers)
+type UserHandler struct {
+	Users db.UserStore
+	Tokens db.TokenStore // refresh tokens are revoked on password resets and disabling
+}
+
+func NewUserHandler(users db.UserStore, tokens db.TokenStore) *UserHandler {
+	return &UserHandler{Users: users, Tokens: tokens}
+}
+
+type createUserReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role string `json:"role"` // writer if left out
+}
+
+type passwordReq struct {
+	Password string `json:"password"`
+}
+
+type roleReq struct {
+	Role string `json:"role"`
+}
+
+type roleResp struct {
+	Role string `json:"role"`
+	Scopes []string `json:"scopes"`
+}
+
+type groupsReq struct {
+	Groups []string `json:"groups"`
+}
+
+// at most this many groups per user, every blob request carries them along
+const maxUserGroups = 100
+
+// userResp is an account as the API returns it, never with the hash
+type userResp struct {
+	ID string `json:"id"`
+	Username string `json:"username"`
+	Role string `json:"role"`
+	Disabled bool `json:"disabled"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+func newUserResp(u *db.User) userResp {
+	return userResp{
+		ID:        u.ID,
+		Username:  u.Username,
+		Role:      u.Role,
+		Disabled:  u.Disabled,
+		CreatedAt: u.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt: u.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func validatePassword(password string) error {
+	if len(password) < auth.MinPasswordLen {
+		return fmt.Errorf("password must be at least %d characters", auth.MinPasswordLen)
+	}
+	return nil
+}
+
+func (h *UserHandler) CreateUser(c *gin.Context) {
+	var r createUserReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	if err := validatePassword(r.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if r.Role == "" {
+		r.Role = auth.RoleWriter
+	}
+	user, err := auth.NewUser(r.Username, r.Password, r.Role, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = h.Users.CreateUser(user)
+	if errors.Is(err, db.ErrUserExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "create failed", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, newUserResp(user))
+}
+
+func (h *UserHandler) ListUsers(c *gin.Context) {
+	users, err := h.Users.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list failed", "detail": err.Error()})
+		return
+	}
+
+	resp := make([]userResp, 0, len(users))
+	for i := range users {
+		resp = append(resp, newUserResp(&users[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"items": resp})
+}
+
+// DisableUser locks an account out, its tokens stop working right away and
+// its refresh tokens stay revoked when it is enabled again
+func (h *UserHandler) DisableUser(c *gin.Context) {
+	// an admin can't lock themselves out by accident
+	if caller, _ := middleware.CallerFrom(c); caller.UserID == c.Param("id") {
+		c.JSON(http.StatusConflict, gin.H{"error": "you can't disable your own account"})
+		return
+	}
+	h.setDisabled(c, true)
+}
+
+func (h *UserHandler) EnableUser(c *gin.Context) {
+	h.setDisabled(c, false)
+}
+
+func (h *UserHandler) setDisabled(c *gin.Context, disabled bool) {
+	now := time.Now()
+	err := h.Users.SetUserDisabled(c.Param("id"), disabled, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed", "detail": err.Error()})
+		return
+	}
+	if disabled {
+		if err := h.Tokens.RevokeUserRefreshTokens(c.Param("id"), now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens", "detail": err.Error()})
+			return
+		}
+	}
+	h.respondUser(c)
+}
+
+// ResetPassword sets a new password chosen by the admin. Every refresh token
+// of the user is revoked, a leaked one mustn't outlive the old password.
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	var r passwordReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	if err := validatePassword(r.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hash, err := auth.HashPassword(r.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed", "detail": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	err = h.Users.SetUserPassword(c.Param("id"), hash, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed", "detail": err.Error()})
+		return
+	}
+	if err := h.Tokens.RevokeUserRefreshTokens(c.Param("id"), now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens", "detail": err.Error()})
+		return
+	}
+	h.respondUser(c)
+}
+
+// ListRoles shows every role with the scopes it grants
+func (h *UserHandler) ListRoles(c *gin.Context) {
+	resp := []roleResp{}
+	for _, role := range auth.Roles() {
+		resp = append(resp, roleResp{Role: role, Scopes: auth.RoleScopes(role)})
+	}
+	c.JSON(http.StatusOK, gin.H{"items": resp})
+}
+
+// SetRole assigns :id a role, tokens the user already has are held to it from
+// the next request
+func (h *UserHandler) SetRole(c *gin.Context) {
+	var r roleReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	if err := auth.ValidateRole(r.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// same as disabling, an admin can't demote themselves by accident
+	if caller, _ := middleware.CallerFrom(c); caller.UserID == c.Param("id") {
+		c.JSON(http.StatusConflict, gin.H{"error": "you can't change your own role"})
+		return
+	}
+
+	err := h.Users.SetUserRole(c.Param("id"), r.Role, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed", "detail": err.Error()})
+		return
+	}
+	h.respondUser(c)
+}
+
+// GetGroups lists the groups of :id, the names ACL grants can be given to
+func (h *UserHandler) GetGroups(c *gin.Context) {
+	if _, err := h.Users.GetUser(c.Param("id")); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user read failed", "detail": err.Error()})
+		return
+	}
+	h.respondGroups(c)
+}
+
+// SetGroups replaces the groups of :id, it takes effect on the user's next request
+func (h *UserHandler) SetGroups(c *gin.Context) {
+	var r groupsReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	if len(r.Groups) > maxUserGroups {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d groups are allowed", maxUserGroups)})
+		return
+	}
+	for _, g := range r.Groups {
+		if err := auth.ValidateGroup(g); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err := h.Users.SetUserGroups(c.Param("id"), r.Groups)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed", "detail": err.Error()})
+		return
+	}
+	h.respondGroups(c)
+}
+
+func (h *UserHandler) respondGroups(c *gin.Context) {
+	groups, err := h.Users.UserGroups(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user read failed", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, groupsReq{Groups: groups})
+}
+
+// respondUser answers with the account of :id as it is now
+func (h *UserHandler) respondUser(c *gin.Context) {
+	user, err := h.Users.GetUser(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user read failed", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, newUserResp(user))
+}
+
+type identityReq struct {
+	Issuer string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+type identityResp struct {
+	Issuer string `json:"issuer"`
+	Subject string `json:"subject"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ListIdentities shows the provider users linked to :id
+func (h *UserHandler) ListIdentities(c *gin.Context) {
+	if _, err := h.Users.GetUser(c.Param("id")); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user read failed", "detail": err.Error()})
+		return
+	}
+	h.respondIdentities(c)
+}
+
+// LinkIdentity lets a provider's user sign in as :id. It's the only way a
+// provider user gets an account that already existed, such as one with a
+// password: the provider then decides its role and groups.
+func (h *UserHandler) LinkIdentity(c *gin.Context) {
+	var r identityReq
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	if r.Issuer == "" || r.Subject == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "issuer and subject are required"})
+		return
+	}
+
+	err := h.Users.LinkIdentity(&db.UserIdentity{Issuer: r.Issuer, Subject: r.Subject, UserID: c.Param("id"), CreatedAt: time.Now()})
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if errors.Is(err, db.ErrIdentityLinked) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "link failed", "detail": err.Error()})
+		return
+	}
+	h.respondIdentities(c)
+}
+
+// UnlinkIdentity takes ?issuer= and ?subject= away from :id, the provider's
+// user is refused from then on as long as the account keeps their username
+func (h *UserHandler) UnlinkIdentity(c *gin.Context) {
+	err := h.Users.UnlinkIdentity(c.Param("id"), c.Query("issuer"), c.Query("subject"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unlink failed", "detail": err.Error()})
+		return
+	}
+	h.respondIdentities(c)
+}
+
+func (h *UserHandler) respondIdentities(c *gin.Context) {
+	identities, err := h.Users.ListIdentities(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user read failed", "detail": err.Error()})
+		return
+	}
+	resp := make([]identityResp, 0, len(identities))
+	for _, i := range identities {
+		resp = append(resp, identityResp{Issuer: i.Issuer, Subject: i.Subject, CreatedAt: i.CreatedAt.UTC().Format(time.RFC3339)})
+	}
+	c.JSON(http.StatusOK, gin.H{"items": resp})
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/storage"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VersioningPolicy says which blobs keep their old data on overwrite
+type VersioningPolicy struct {
+	Enabled bool
+	Prefixes []string // with Enabled, only ids under these prefixes; empty means every id
+}
+
+func (p VersioningPolicy) Versioned(id string) bool {
+	if !p.Enabled {
+		return false
+	}
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// newVersionID is the creation time in hex plus some randomness, so version
+// ids of one blob sort oldest to newest and never collide
+func newVersionID(t time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%016x%s", t.UnixNano(), hex.EncodeToString(suffix))
+}
+
+// keepUnversioned turns data written before versioning applied to id into a
+// version of its own, so nothing is lost when the first versioned upload or a
+// restore moves the blob over to a version key. That includes a trashed blob,
+// it leaves the trash the moment it gets its new current version anyway.
+func (h *BlobHandler) keepUnversioned(ctx context.Context, id string) error {
+	meta, err := h.Meta.GetMetadata(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		meta, err = h.Meta.GetTrashed(id)
+	}
+	if errors.Is(err, sql.ErrNoRows) || err == nil && meta.VersionID != "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rc, _, err := h.Store.Get(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// same metadata and updated_at, so the ETag doesn't change either
+	meta.VersionID = newVersionID(meta.UpdatedAt)
+	key := storage.VersionKey(meta.VersionID)
+	if err := h.Store.Put(storage.WithContentType(ctx, meta.ContentType), key, rc, meta.Size); err != nil {
+		return err
+	}
+	if err := h.Meta.SaveMetadata(meta); err != nil {
+		_ = h.Store.Delete(key)
+		return err
+	}
+
+	// the copy is current now
+	if err := h.Store.Delete(id); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+type versionResp struct {
+	metaResp
+	Current bool `json:"current"`
+}
+
+type versionListResp struct {
+	Items []versionResp `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListVersions pages through a blob's versions, newest first. The versions of
+// a deleted blob are still there until they are deleted one by one.
+func (h *BlobHandler) ListVersions(c *gin.Context) {
+	id := c.Param("id")
+	if internalName(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	versions, err := h.Meta.ListVersions(id, after, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list failed", "detail": err.Error()})
+		return
+	}
+	current := ""
+	meta, err := h.Meta.GetMetadata(id)
+	switch {
+	case err == nil:
+		current = meta.VersionID
+	case !errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list failed", "detail": err.Error()})
+		return
+	case len(versions) == 0 && after == "":
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.authorizeVersions(c, id, db.PermRead) {
+		return
+	}
+
+	resp := versionListResp{Items: make([]versionResp, 0, len(versions))}
+	if len(versions) > limit {
+		versions = versions[:limit]
+		resp.NextCursor = encodeCursor(versions[limit-1].VersionID)
+	}
+	for i := range versions {
+		v := &versions[i]
+		resp.Items = append(resp.Items, versionResp{
+			metaResp: newMetaResp(v),
+			Current:  v.VersionID == current,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetVersionContent streams one version's data, like GetBlobContent does for the current one
+func (h *BlobHandler) GetVersionContent(c *gin.Context) {
+	id := c.Param("id")
+	if internalName(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	v, err := h.Meta.GetVersion(id, c.Param("version"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta read failed", "detail": err.Error()})
+		return
+	}
+	if !h.authorizeVersions(c, id, db.PermRead) {
+		return
+	}
+
+	// a version never changes, its id is a strong validator
+	h.serveContent(c, v, `"`+v.VersionID+`"`)
+}
+
+// RestoreVersion makes an older version current again, the versions in
+// between stay in the history
+func (h *BlobHandler) RestoreVersion(c *gin.Context) {
+	id := c.Param("id")
+	if internalName(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.authorizeVersions(c, id, db.PermWrite) {
+		return
+	}
+	if err := h.keepUnversioned(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "restore failed", "detail": err.Error()})
+		return
+	}
+
+	meta, err := h.Meta.RestoreVersion(id, c.Param("version"), time.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "restore failed", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, newMetaResp(meta))
+}
+
+// DeleteVersion removes one version for good. The row goes first, the store
+// refuses that for the current version, so the data of the current blob is
+// never touched. A failure after it leaves unreferenced data, not a version
+// without data.
+func (h *BlobHandler) DeleteVersion(c *gin.Context) {
+	id, versionID := c.Param("id"), c.Param("version")
+	if internalName(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if !h.authorizeVersions(c, id, db.PermDelete) {
+		return
+	}
+
+	err := h.Meta.DeleteVersion(id, versionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if errors.Is(err, db.ErrCurrentVersion) {
+		c.JSON(http.StatusConflict, gin.H{"error": "this is the current version, restore another one or delete the blob first"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "meta delete failed", "detail": err.Error()})
+		return
+	}
+
+	if err := h.Store.Delete(storage.VersionKey(versionID)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// authorizeVersions checks perm against the blob the versions belong to, see
+// aclMeta. On refusal the error response is already written.
+func (h *BlobHandler) authorizeVersions(c *gin.Context, id, perm string) bool {
+	meta, err := h.aclMeta(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "access check failed", "detail": err.Error()})
+		return false
+	}
+	return h.authorize(c, meta, perm)
+}
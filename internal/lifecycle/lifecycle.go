@@ -0,0 +1,235 @@
+package lifecycle
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The lifecycle worker deletes blobs whose expiry has passed and blobs that a
+// Rule says are too old. Every sweep pages through the metadata by id and
+// saves how far it got after each batch, so a sweep that is cut short (restart,
+// lost lease) is picked up by the next one where it stopped.
+
+const (
+	leaseName = "lifecycle"
+	defaultBatchSize = 100
+	defaultLeaseTTL = 5 * time.Minute
+)
+
+// ErrLeaseLost stops a sweep when another replica took the lease over meanwhile
+var ErrLeaseLost = errors.New("lifecycle lease lost to another replica")
+
+// Rule deletes blobs under Prefix that haven't changed for After
+type Rule struct {
+	Prefix string
+	After time.Duration
+}
+
+// Coordinator holds the leader lease and the scan checkpoints, so only one
+// replica sweeps at a time and the next one continues where it stopped.
+// db.MetadataDB and db.SQLiteStore implement it.
+type Coordinator interface {
+	AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseLease(name, holder string) error
+	Checkpoint(name string) (string, error)
+	SaveCheckpoint(name, cursor string) error
+}
+
+type Worker struct {
+	Store storage.StorageBackend
+	Meta db.MetadataStore
+	Rules []Rule
+
+	// nil sweeps without a lease and starts every scan from the top, fine
+	// for a single node
+	Coordinator Coordinator
+	Holder string // this replica's name in the lease
+
+	BatchSize int // 0 = 100
+	LeaseTTL time.Duration // 0 = 5 minutes, renewed after every batch
+}
+
+// scan is one pass over the metadata, the expiry scan or one rule
+type scan struct {
+	name string
+	list func(cursor string, limit int) ([]db.BlobMeta, error)
+}
+
+// Sweep runs every scan once and returns how many blobs it deleted. Without
+// the lease it does nothing and returns 0. A blob that can't be deleted is
+// logged and skipped, it is tried again on the next pass over its scan.
+func (w *Worker) Sweep(ctx context.Context, now time.Time) (int, error) {
+	if w.Coordinator != nil {
+		ok, err := w.Coordinator.AcquireLease(leaseName, w.Holder, time.Now(), w.leaseTTL())
+		if err != nil || !ok {
+			return 0, err
+		}
+		defer w.Coordinator.ReleaseLease(leaseName, w.Holder)
+	}
+
+	scans := []scan{{
+		name: "expired",
+		list: func(cursor string, limit int) ([]db.BlobMeta, error) {
+			return w.Meta.ListExpired(now, cursor, limit)
+		},
+	}}
+	for _, rule := range w.Rules {
+		rule := rule
+		scans = append(scans, scan{
+			name: "rule:" + rule.Prefix,
+			list: func(cursor string, limit int) ([]db.BlobMeta, error) {
+				return w.Meta.ListUpdatedBefore(rule.Prefix, now.Add(-rule.After), cursor, limit)
+			},
+		})
+	}
+
+	deleted := 0
+	for _, s := range scans {
+		n, err := w.run(ctx, s)
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf("%s scan: %w", s.name, err)
+		}
+	}
+	return deleted, nil
+}
+
+func (w *Worker) run(ctx context.Context, s scan) (int, error) {
+	cursor, err := w.checkpoint(s.name)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		metas, err := s.list(cursor, w.batchSize())
+		if err != nil {
+			return deleted, err
+		}
+		for i := range metas {
+			err := w.delete(&metas[i])
+			switch {
+			case err == nil:
+				deleted++
+			case !errors.Is(err, sql.ErrNoRows):
+				log.Printf("lifecycle: deleting %s: %v", metas[i].ID, err)
+			}
+		}
+
+		// a full batch means there may be more, an empty cursor marks the scan as done
+		cursor = ""
+		if len(metas) == w.batchSize() {
+			cursor = metas[len(metas)-1].ID
+		}
+		if err := w.saveCheckpoint(s.name, cursor); err != nil {
+			return deleted, err
+		}
+		if cursor == "" {
+			return deleted, nil
+		}
+		if w.Coordinator != nil {
+			ok, err := w.Coordinator.AcquireLease(leaseName, w.Holder, time.Now(), w.leaseTTL())
+			if err != nil {
+				return deleted, err
+			}
+			if !ok {
+				return deleted, ErrLeaseLost
+			}
+		}
+	}
+}
+
+// delete removes the data and then the row, like a blob delete without the
+// trash. The row is read again first, a blob uploaded again since the scan
+// saw it isn't touched (sql.ErrNoRows). Versions of a versioned blob stay.
+func (w *Worker) delete(seen *db.BlobMeta) error {
+	meta, err := w.Meta.GetMetadata(seen.ID)
+	if err != nil {
+		return err
+	}
+	if !meta.UpdatedAt.Equal(seen.UpdatedAt) || !meta.ExpiresAt.Equal(seen.ExpiresAt) {
+		return sql.ErrNoRows
+	}
+
+	if meta.VersionID == "" {
+		if err := w.Store.Delete(meta.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return w.Meta.DeleteMetadata(meta.ID)
+}
+
+func (w *Worker) checkpoint(name string) (string, error) {
+	if w.Coordinator == nil {
+		return "", nil
+	}
+	return w.Coordinator.Checkpoint(name)
+}
+
+func (w *Worker) saveCheckpoint(name, cursor string) error {
+	if w.Coordinator == nil {
+		return nil
+	}
+	return w.Coordinator.SaveCheckpoint(name, cursor)
+}
+
+func (w *Worker) batchSize() int {
+	if w.BatchSize > 0 {
+		return w.BatchSize
+	}
+	return defaultBatchSize
+}
+
+func (w *Worker) leaseTTL() time.Duration {
+	if w.LeaseTTL > 0 {
+		return w.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+// ParseDuration is time.ParseDuration plus whole days, "7d"
+func ParseDuration(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// ParseRules reads "prefix:duration" pairs separated by commas, e.g. "tmp/:7d,cache/:12h"
+func ParseRules(v string) ([]Rule, error) {
+	var rules []Rule
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("rule %q is not prefix:duration", item)
+		}
+		after, err := ParseDuration(item[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if after <= 0 {
+			return nil, fmt.Errorf("rule %q: duration must be positive", item)
+		}
+		rules = append(rules, Rule{Prefix: item[:i], After: after})
+	}
+	return rules, nil
+}
@@ -1,36 +1,202 @@
 package middleware
 
 import (
+	"database/sql"
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+)
+
+// Caller is the user a request was made by, AuthMiddleware puts it on the context
+type Caller struct {
+	UserID string
+	Username string
+	Role string
+	Scopes []string // what the token may do, never more than Role allows
+	Admin bool // has auth.ScopeAdmin, ACLs don't apply
+	Groups []string // for the ACL grants to groups
+	APIKeyID string // set when the request came with an API key instead of a token
+}
+
+const (
+	callerKey = "caller"
+	claimsKey = "claims"
 )
 
-func AuthMiddleware(secret string) gin.HandlerFunc {
+// ClaimsFrom returns the claims of the request's token as AuthMiddleware verified them,
+// false for requests made with an API key
+func ClaimsFrom(c *gin.Context) (*auth.Claims, bool) {
+	v, ok := c.Get(claimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(*auth.Claims)
+	return claims, ok
+}
+
+// SetCaller records who the request is from, for middlewares that authenticate
+func SetCaller(c *gin.Context, caller Caller) {
+	c.Set(callerKey, caller)
+}
+
+// CallerFrom returns the authenticated caller, false on routes without AuthMiddleware
+func CallerFrom(c *gin.Context) (Caller, bool) {
+	v, ok := c.Get(callerKey)
+	if !ok {
+		return Caller{}, false
+	}
+	caller, ok := v.(Caller)
+	return caller, ok
+}
+
+// AuthMiddleware accepts a valid token or API key of an existing, enabled
+// user. The user is looked up on every request, so disabling an account locks
+// it out at once and the scopes are cut down to what the user's role allows
+// now. Tokens that were logged out are turned away through revoked. With oidc
+// set, tokens of that provider are accepted too, see oidcUser.
+func AuthMiddleware(keys *auth.Keyring, meta db.MetadataStore, revoked *auth.Revocations, oidc *auth.OIDCProvider) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// API keys come as X-API-Key or as a bearer token, told apart from JWTs by their prefix
 		authHeader := c.GetHeader("Authorization")
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
-			return
+		bearer, isBearer := strings.CutPrefix(authHeader, "Bearer ")
+		key := c.GetHeader("X-API-Key")
+		if key == "" && isBearer && auth.IsAPIKey(bearer) {
+			key = bearer
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-
-		// validate with JWT
-		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-			_, ok := t.Method.(*jwt.SigningMethodHMAC)
+		var subject, keyID string
+		var granted []string
+		if key != "" {
+			apiKey, ok := apiKeyFrom(c, meta, key)
 			if !ok {
-				return nil, jwt.ErrSignatureInvalid
+				return
 			}
-			return []byte(secret), nil
-		})
+			subject, keyID, granted = apiKey.UserID, apiKey.ID, strings.Fields(apiKey.Scope)
+		} else if oidc != nil && isBearer && tokenIssuer(bearer) == oidc.Issuer() {
+			identity, err := oidc.Verify(c.Request.Context(), bearer)
+			if errors.Is(err, auth.ErrNoRole) {
+				c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(401, gin.H{"error": "bad token"})
+				return
+			}
+			subject, err = oidcUser(meta, oidc.Issuer(), identity)
+			if errors.Is(err, errNotLinked) {
+				// the subject is what the admin needs to link the account
+				c.AbortWithStatusJSON(403, gin.H{"error": err.Error(), "issuer": oidc.Issuer(), "subject": identity.Subject})
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(500, gin.H{"error": "user lookup failed", "detail": err.Error()})
+				return
+			}
+			granted = auth.RoleScopes(identity.Role)
+		} else {
+			if !isBearer {
+				c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+				return
+			}
+			claims, ok := claimsFrom(c, keys, revoked, bearer)
+			if !ok {
+				return
+			}
+			c.Set(claimsKey, claims)
+			subject, granted = claims.Subject, claims.Scopes()
+		}
 
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(401, gin.H{"error": "bad token"})
+		user, err := meta.GetUser(subject)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			c.AbortWithStatusJSON(500, gin.H{"error": "user lookup failed", "detail": err.Error()})
+			return
+		}
+		if err != nil || user.Disabled {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		groups, err := meta.UserGroups(user.ID)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": "user lookup failed", "detail": err.Error()})
 			return
 		}
 
+		scopes := auth.Narrow(granted, auth.RoleScopes(user.Role))
+		SetCaller(c, Caller{
+			UserID:   user.ID,
+			Username: user.Username,
+			Role:     user.Role,
+			Scopes:   scopes,
+			Admin:    auth.HasScope(scopes, auth.ScopeAdmin),
+			Groups:   groups,
+			APIKeyID: keyID,
+		})
 		c.Next() // validation passed
 	}
-}
\ No newline at end of file
+}
+
+// claimsFrom verifies a JWT, on failure it has responded already
+func claimsFrom(c *gin.Context, keys *auth.Keyring, revoked *auth.Revocations, tokenString string) (*auth.Claims, bool) {
+	claims := &auth.Claims{}
+	// the key is picked by kid, see auth.Keyring
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc, jwt.WithExpirationRequired())
+
+	if err != nil || !token.Valid {
+		c.AbortWithStatusJSON(401, gin.H{"error": "bad token"})
+		return nil, false
+	}
+
+	// the user id is the subject, tokens from before accounts existed have none,
+	// those from before roles have no scope and those from before logout no jti
+	if claims.Subject == "" || claims.Scope == "" || claims.ID == "" {
+		c.AbortWithStatusJSON(401, gin.H{"error": "bad token"})
+		return nil, false
+	}
+	if revoked.Revoked(claims.ID) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "token revoked"})
+		return nil, false
+	}
+	return claims, true
+}
+
+// last_used_at is only written once a minute, not on every request
+const apiKeyTouchInterval = time.Minute
+
+// apiKeyFrom looks up a live API key, on failure it has responded already
+func apiKeyFrom(c *gin.Context, keys db.APIKeyStore, key string) (*db.APIKey, bool) {
+	apiKey, err := keys.GetAPIKeyByHash(auth.HashToken(key))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(500, gin.H{"error": "api key lookup failed", "detail": err.Error()})
+		return nil, false
+	}
+	now := time.Now().UTC()
+	if err != nil || !apiKey.RevokedAt.IsZero() || (!apiKey.ExpiresAt.IsZero() && !apiKey.ExpiresAt.After(now)) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "invalid api key"})
+		return nil, false
+	}
+
+	// only bookkeeping, the request goes on if it fails
+	if now.Sub(apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		_ = keys.TouchAPIKey(apiKey.ID, now)
+	}
+	return apiKey, true
+}
+
+// RequireScope lets only callers with the scope through, it goes after AuthMiddleware
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, ok := CallerFrom(c)
+		if !ok || !auth.HasScope(caller.Scopes, scope) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "missing scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+)
+
+// tokenIssuer reads iss without verifying anything, only to tell the
+// provider's tokens from ours
+func tokenIssuer(token string) string {
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
+
+// errNotLinked refuses a provider's user whose username belongs to an account
+// that isn't linked to them, an admin has to link the two
+var errNotLinked = errors.New("an account with this username exists, an admin has to link it to this identity")
+
+// oidcUser finds the local account linked to a provider's user by issuer and
+// sub, making it on the first request, and brings its role and groups in line
+// with the token. The provider decides both, changes made through the admin
+// API are overwritten on the user's next request.
+func oidcUser(meta db.MetadataStore, issuer string, identity *auth.Identity) (string, error) {
+	user, err := meta.GetUserByIdentity(issuer, identity.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		// nobody knows the password, the account is used through the provider
+		var password string
+		if password, err = auth.NewTokenID(); err != nil {
+			return "", err
+		}
+		now := time.Now()
+		if user, err = auth.NewUser(identity.Username, password, identity.Role, now); err != nil {
+			return "", err
+		}
+		err = meta.CreateLinkedUser(user, &db.UserIdentity{Issuer: issuer, Subject: identity.Subject, CreatedAt: now})
+		if errors.Is(err, db.ErrUserExists) || errors.Is(err, db.ErrIdentityLinked) {
+			// another request was first, or the name is someone else's
+			user, err = meta.GetUserByIdentity(issuer, identity.Subject)
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", errNotLinked
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if user.Role != identity.Role {
+		if err := meta.SetUserRole(user.ID, identity.Role, time.Now()); err != nil {
+			return "", err
+		}
+	}
+	groups, err := meta.UserGroups(user.ID)
+	if err != nil {
+		return "", err
+	}
+	want := append([]string{}, identity.Groups...)
+	sort.Strings(want)
+	if !slices.Equal(groups, slices.Compact(want)) {
+		if err := meta.SetUserGroups(user.ID, identity.Groups); err != nil {
+			return "", err
+		}
+	}
+	return user.ID, nil
+}
@@ -1,8 +1,142 @@
 package storage
 
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// returned when the backend has no object for the id, Delete on a missing object may also just succeed
+var ErrNotFound = errors.New("blob not found")
+
+// Info describes a stored object without its payload
+type Info struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+	ETag    string // empty when the backend has no native entity tag
+}
+
 // abstract interface to be implemented by different storage methods
 type StorageBackend interface {
 	Save(id string, data []byte) error
 	Load(id string) ([]byte, error)
 	Delete (id string) error
-}
\ No newline at end of file
+
+	// streaming variants, size is the expected length of r or -1 when unknown
+	Put(ctx context.Context, id string, r io.Reader, size int64) error
+	Get(ctx context.Context, id string) (io.ReadCloser, Info, error)
+
+	// GetRange reads length bytes starting at offset, length -1 reads to the end
+	GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error)
+
+	// List returns up to limit objects whose id starts with prefix in storage
+	// key order (hash order on a sharded LocalBackend), plus a cursor for the
+	// next page ("" once exhausted). Cursors are opaque and only meaningful to
+	// the backend that issued them.
+	List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error)
+}
+
+// page size used when a caller passes limit <= 0
+const defaultListLimit = 1000
+
+// saveBytes implements Save on top of Put so every backend shares one write path
+func saveBytes(b StorageBackend, id string, data []byte) error {
+	return b.Put(context.Background(), id, bytes.NewReader(data), int64(len(data)))
+}
+
+// loadBytes implements Load on top of Get
+func loadBytes(b StorageBackend, id string) ([]byte, error) {
+	rc, _, err := b.Get(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// copySized copies r into w and checks the result against the announced size
+func copySized(ctx context.Context, w io.Writer, r io.Reader, size int64) (int64, error) {
+	n, err := io.Copy(w, &ctxReader{ctx: ctx, r: r})
+	if err != nil {
+		return n, err
+	}
+	if size >= 0 && n != size {
+		return n, fmt.Errorf("size mismatch: expected %d bytes, got %d", size, n)
+	}
+	return n, nil
+}
+
+// ctxReader stops a long copy as soon as the request context is cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// listEntry is an object as a name-based backend sees it, key is the encoded id
+type listEntry struct {
+	key  string
+	info Info
+}
+
+// pageEntries applies prefix, cursor and limit to entries already sorted by key,
+// for backends that can only enumerate everything and filter client side.
+// EncodeKey works byte by byte, so an id prefix is also a key prefix.
+func pageEntries(entries []listEntry, prefix, cursor string, limit int) ([]Info, string) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	keyPrefix := EncodeKey(prefix)
+
+	var page []Info
+	last := ""
+	for _, e := range entries {
+		if !strings.HasPrefix(e.key, keyPrefix) || e.key <= cursor {
+			continue
+		}
+		if len(page) == limit {
+			return page, last
+		}
+		page = append(page, e.info)
+		last = e.key
+	}
+	return page, ""
+}
+
+// countingReader records how many bytes went through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readCloser pairs a wrapped reader with the closer of the underlying stream
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// limitReadCloser caps rc at length bytes, -1 leaves it unbounded
+func limitReadCloser(rc io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return rc
+	}
+	return readCloser{Reader: io.LimitReader(rc, length), Closer: rc}
+}
@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// codecs, named like their HTTP content-coding so they can be served as-is
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// StoredCodec says where CompressedBackend put the data of one blob and how it encoded it
+type StoredCodec struct {
+	ID string
+	Object string // name of the stored data in the wrapped backend
+	Codec string // "" when stored plain
+	OriginalSize int64
+	StoredSize int64
+	CreatedAt time.Time
+}
+
+// CodecIndex keeps the StoredCodec of every blob, db.MetadataDB implements it
+// on the blob_codecs table
+type CodecIndex interface {
+	// PutCodec makes c the current entry of c.ID and returns the object the
+	// previous one pointed at, "" if there was none
+	PutCodec(ctx context.Context, c StoredCodec) (string, error)
+	// GetCodec and DeleteCodec return ErrNotFound for blobs that were never
+	// recorded, they are stored plain under their own id
+	GetCodec(ctx context.Context, id string) (StoredCodec, error)
+	DeleteCodec(ctx context.Context, id string) (StoredCodec, error)
+	// ListCodecs pages over the entries by id, same contract as StorageBackend.List
+	ListCodecs(ctx context.Context, prefix, cursor string, limit int) ([]StoredCodec, string, error)
+}
+
+// EncodedReader is implemented by backends that keep blobs in a content-coding
+// and can hand out the stored bytes without decoding them
+type EncodedReader interface {
+	// Encoding returns the codec of id ("" when stored plain) and the stored size
+	Encoding(ctx context.Context, id string) (string, int64, error)
+	GetEncodedRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error)
+}
+
+// CompressionPolicy picks the codec for each new blob
+type CompressionPolicy struct {
+	Codec string // CodecGzip or CodecZstd
+	MinSize int64 // smaller blobs are stored as they are, unknown sizes count as large
+	Types []string // media types worth compressing, "text/" matches the whole family
+}
+
+// DefaultCompressibleTypes are the text formats that typically shrink 5-10x
+var DefaultCompressibleTypes = []string{
+	"text/", "application/json", "application/x-ndjson", "application/xml",
+	"application/javascript", "application/yaml", "application/x-yaml", "image/svg+xml",
+}
+
+func (p CompressionPolicy) choose(contentType string, size int64) string {
+	if size >= 0 && size < p.MinSize {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	for _, t := range p.Types {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return p.Codec
+		}
+	}
+	return ""
+}
+
+type contentTypeKey struct{}
+
+// WithContentType tells CompressedBackend.Put what the client said it uploads,
+// without it the type is sniffed from the first bytes
+func WithContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+// CompressedBackend compresses blobs whose type and size match the policy
+// before they reach the wrapped backend, and decompresses them on the way out.
+//
+// Like EncryptedBackend, every write goes to a fresh object ".cmp/<random>"
+// and the index is switched over to it afterwards, so the data and the codec
+// it is read with can never get out of step. The previous object is deleted
+// once nothing points at it any more.
+type CompressedBackend struct {
+	Base StorageBackend
+	Index CodecIndex
+	Policy CompressionPolicy
+}
+
+const cmpPrefix = ".cmp/"
+
+func NewCompressedBackend(base StorageBackend, index CodecIndex, policy CompressionPolicy) (*CompressedBackend, error) {
+	if policy.Codec != CodecGzip && policy.Codec != CodecZstd {
+		return nil, fmt.Errorf("unsupported codec %q, use %s or %s", policy.Codec, CodecGzip, CodecZstd)
+	}
+	if policy.Types == nil {
+		policy.Types = DefaultCompressibleTypes
+	}
+	return &CompressedBackend{Base: base, Index: index, Policy: policy}, nil
+}
+
+func (c *CompressedBackend) Save(id string, data []byte) error {
+	return saveBytes(c, id, data)
+}
+
+func (c *CompressedBackend) Load(id string) ([]byte, error) {
+	return loadBytes(c, id)
+}
+
+func (c *CompressedBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	if id == "" {
+		return ErrInvalidID
+	}
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return err
+	}
+	entry := StoredCodec{ID: id, Object: cmpPrefix + hex.EncodeToString(name), CreatedAt: time.Now().UTC()}
+
+	br := bufio.NewReaderSize(r, 512)
+	contentType, _ := ctx.Value(contentTypeKey{}).(string)
+	if contentType == "" || contentType == "application/octet-stream" {
+		head, _ := br.Peek(512) // a short or failing read shows up again in the copy below
+		contentType = http.DetectContentType(head)
+	}
+
+	entry.Codec = c.Policy.choose(contentType, size)
+	plain := &countingReader{r: br}
+	if entry.Codec == "" {
+		if err := c.Base.Put(ctx, entry.Object, plain, size); err != nil {
+			return err
+		}
+		entry.OriginalSize, entry.StoredSize = plain.n, plain.n
+	} else {
+		// the encoder writes into a pipe the backend reads from, nothing is buffered whole
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(encode(ctx, entry.Codec, pw, plain, size))
+		}()
+
+		stored := &countingReader{r: pr}
+		err := c.Base.Put(ctx, entry.Object, stored, -1)
+		pr.CloseWithError(errors.New("upload aborted")) // unblocks the encoder if Put gave up early
+		if err != nil {
+			return err
+		}
+		entry.OriginalSize, entry.StoredSize = plain.n, stored.n
+	}
+
+	prev, err := c.Index.PutCodec(ctx, entry)
+	if err != nil {
+		c.Base.Delete(entry.Object)
+		return err
+	}
+
+	// drop what the id pointed at before, or its copy from before compression was enabled
+	if prev == "" {
+		prev = id
+	}
+	if err := c.Base.Delete(prev); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("compressed storage: removing old object %s: %v", prev, err)
+	}
+	return nil
+}
+
+func encode(ctx context.Context, codec string, w io.Writer, r io.Reader, size int64) error {
+	var enc io.WriteCloser
+	switch codec {
+	case CodecGzip:
+		enc = gzip.NewWriter(w)
+	case CodecZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		enc = zw
+	default:
+		return fmt.Errorf("unsupported codec %q", codec)
+	}
+
+	if _, err := copySized(ctx, enc, r, size); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+func decode(codec string, rc io.ReadCloser) (io.ReadCloser, error) {
+	switch codec {
+	case CodecGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{Reader: zr, Closer: rc}, nil
+	case CodecZstd:
+		zr, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{Reader: zr, Closer: closerFunc(func() error {
+			zr.Close()
+			return rc.Close()
+		})}, nil
+	}
+	return nil, fmt.Errorf("unsupported codec %q", codec)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// entryOf treats blobs the index has never seen as stored plain under their own id
+func (c *CompressedBackend) entryOf(ctx context.Context, id string) (StoredCodec, error) {
+	entry, err := c.Index.GetCodec(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return StoredCodec{ID: id, Object: id, OriginalSize: -1, StoredSize: -1}, nil
+	}
+	return entry, err
+}
+
+func (c *CompressedBackend) Get(ctx context.Context, id string) (io.ReadCloser, Info, error) {
+	entry, err := c.entryOf(ctx, id)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	rc, info, err := c.Base.Get(ctx, entry.Object)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info.ID = id
+	if entry.Codec == "" {
+		return rc, info, nil
+	}
+
+	dec, err := decode(entry.Codec, rc)
+	if err != nil {
+		rc.Close()
+		return nil, Info{}, err
+	}
+	info.Size = entry.OriginalSize
+	return dec, info, nil
+}
+
+// GetRange of a compressed blob has to decode from the start and skip to
+// offset, fine for the occasional resumed download of a text file
+func (c *CompressedBackend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	entry, err := c.entryOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Codec == "" {
+		return c.Base.GetRange(ctx, entry.Object, offset, length)
+	}
+
+	rc, _, err := c.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil && !errors.Is(err, io.EOF) {
+		rc.Close()
+		return nil, err
+	}
+	return limitReadCloser(rc, length), nil
+}
+
+// List comes from the index, Base only has the object names. Ids from before
+// compression was enabled are not included until they are written again.
+func (c *CompressedBackend) List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	entries, next, err := c.Index.ListCodecs(ctx, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	infos := make([]Info, len(entries))
+	for i, e := range entries {
+		infos[i] = Info{ID: e.ID, Size: e.OriginalSize, ModTime: e.CreatedAt}
+	}
+	return infos, next, nil
+}
+
+// Delete drops the entry first, the object is unreachable without it
+func (c *CompressedBackend) Delete(id string) error {
+	entry, err := c.Index.DeleteCodec(context.Background(), id)
+	if errors.Is(err, ErrNotFound) {
+		return c.Base.Delete(id)
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.Base.Delete(entry.Object); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (c *CompressedBackend) Encoding(ctx context.Context, id string) (string, int64, error) {
+	entry, err := c.entryOf(ctx, id)
+	return entry.Codec, entry.StoredSize, err
+}
+
+func (c *CompressedBackend) GetEncodedRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	entry, err := c.entryOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Base.GetRange(ctx, entry.Object, offset, length)
+}
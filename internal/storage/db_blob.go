@@ -1,10 +1,21 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"io"
+	"strings"
 	"time"
 )
 
+// blobs are stored as rows of blob_chunks of this size, the last one may be
+// shorter, so a blob never has to sit in memory or in one bytea in one piece
+const dbChunkSize = 4 << 20
+
+// DBBlobBackend keys blobs_data by the id itself, a TEXT primary key has no
+// naming restrictions so unlike the other backends no EncodeKey is needed.
+// The data is in blob_chunks, numbered by seq from 0.
 type DBBlobBackend struct {
 	db *sql.DB
 }
@@ -14,24 +25,237 @@ func NewDBBlobBackend(db *sql.DB) *DBBlobBackend {
 }
 
 func (d *DBBlobBackend) Save(id string, data []byte) error {
-	query := `INSERT INTO blobs_data(id, data, created_at) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, created_at = EXCLUDED.created_at`
-	_, err := d.db.Exec(query, id, data, time.Now().UTC().Format(time.RFC3339))
-	return err
+	return saveBytes(d, id, data)
 }
 
 func (d *DBBlobBackend) Load(id string) ([]byte, error) {
-	query := `SELECT data FROM blobs_data WHERE id = $1`
-	row := d.db.QueryRow(query, id)
-	var data []byte
-	err := row.Scan(&data)
+	return loadBytes(d, id)
+}
+
+// Put streams r into blob_chunks one chunk per row inside one transaction,
+// readers keep seeing the previous version until commit
+func (d *DBBlobBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	if _, err := keyFor(id); err != nil {
+		return err // same empty id rule as everywhere else
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the row lock also makes a second writer of the id wait for this one
+	query := `INSERT INTO blobs_data(id, size, created_at) VALUES ($1, 0, $2) ON CONFLICT (id) DO UPDATE SET size = 0, created_at = EXCLUDED.created_at`
+	if _, err := tx.ExecContext(ctx, query, id, time.Now().UTC()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blob_chunks WHERE blob_id = $1`, id); err != nil {
+		return err
+	}
+
+	w := &dbChunkWriter{ctx: ctx, tx: tx, id: id}
+	if _, err := copySized(ctx, w, r, size); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE blobs_data SET size = $2 WHERE id = $1`, id, w.pos); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *DBBlobBackend) Get(ctx context.Context, id string) (io.ReadCloser, Info, error) {
+	// repeatable read keeps every chunk on the same snapshot even if the blob is overwritten mid-download
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
+		return nil, Info{}, err
+	}
+
+	info := Info{ID: id}
+	query := `SELECT size, created_at FROM blobs_data WHERE id = $1`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&info.Size, &info.ModTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return nil, Info{}, ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, Info{}, err
+	}
+
+	return &dbChunkReader{ctx: ctx, tx: tx, id: id, remaining: info.Size}, info, nil
+}
+
+func (d *DBBlobBackend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	query := `SELECT size FROM blobs_data WHERE id = $1`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&size)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	remaining := size - offset
+	if remaining < 0 {
+		remaining = 0
+	}
+	if length >= 0 && length < remaining {
+		remaining = length
+	}
+	r := &dbChunkReader{ctx: ctx, tx: tx, id: id, remaining: remaining}
+	if remaining == 0 {
+		return r, nil
+	}
+
+	// the chunk the range starts in, the reader skips up to offset in it
+	var pos int64
+	query = `SELECT seq, pos FROM blob_chunks WHERE blob_id = $1 AND pos <= $2 ORDER BY pos DESC LIMIT 1`
+	if err := tx.QueryRowContext(ctx, query, id, offset).Scan(&r.seq, &pos); err != nil {
+		tx.Rollback()
 		return nil, err
 	}
-	return data, nil
+	r.skip = offset - pos
+	return r, nil
+}
+
+// List uses keyset pagination on the primary key, the cursor is the last id returned
+func (d *DBBlobBackend) List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	// one extra row tells us whether there is another page
+	query := `SELECT id, size, created_at FROM blobs_data WHERE id > $1 AND id LIKE $2 ESCAPE '\' ORDER BY id LIMIT $3`
+	rows, err := d.db.QueryContext(ctx, query, cursor, EscapeLike(prefix)+"%", limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var page []Info
+	for rows.Next() {
+		var info Info
+		if err := rows.Scan(&info.ID, &info.Size, &info.ModTime); err != nil {
+			return nil, "", err
+		}
+		page = append(page, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(page) > limit {
+		page = page[:limit]
+		return page, page[limit-1].ID, nil
+	}
+	return page, "", nil
 }
 
 func (d *DBBlobBackend) Delete(id string) error {
 	query := `DELETE FROM blobs_data WHERE id = $1`
 	_, err := d.db.Exec(query, id)
 	return err
-}
\ No newline at end of file
+}
+
+// EscapeLike makes a user supplied prefix match literally inside LIKE, with
+// ESCAPE '\'. The metadata store pages by prefix the same way.
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// dbChunkWriter buffers up to dbChunkSize bytes and inserts them as the next chunk
+type dbChunkWriter struct {
+	ctx context.Context
+	tx  *sql.Tx
+	id  string
+	seq int
+	pos int64 // bytes written so far
+	buf []byte
+}
+
+func (w *dbChunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := dbChunkSize - len(w.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+		p = p[room:]
+		if len(w.buf) == dbChunkSize {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *dbChunkWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	query := `INSERT INTO blob_chunks(blob_id, seq, pos, data) VALUES ($1, $2, $3, $4)`
+	if _, err := w.tx.ExecContext(w.ctx, query, w.id, w.seq, w.pos, w.buf); err != nil {
+		return err
+	}
+	w.seq++
+	w.pos += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// dbChunkReader reads the chunks in seq order, one row at a time
+type dbChunkReader struct {
+	ctx       context.Context
+	tx        *sql.Tx
+	id        string
+	seq       int   // next chunk
+	skip      int64 // bytes of the next chunk before the range starts
+	remaining int64
+	buf       []byte
+}
+
+func (r *dbChunkReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.remaining <= 0 {
+			return 0, io.EOF
+		}
+		// substring() leaves out what is before or after the range, it wants skip+1
+		query := `SELECT substring(data from $3 for $4) FROM blob_chunks WHERE blob_id = $1 AND seq = $2`
+		err := r.tx.QueryRowContext(r.ctx, query, r.id, r.seq, r.skip+1, min(r.remaining, dbChunkSize)).Scan(&r.buf)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(r.buf) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.seq++
+		r.skip = 0
+		r.remaining -= int64(len(r.buf))
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *dbChunkReader) Close() error {
+	return r.tx.Rollback()
+}
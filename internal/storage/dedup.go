@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RefIndex is where DedupBackend records which digest every id points at and
+// how many ids share each digest. db.MetadataDB implements it on blob_refs
+// and blob_digests.
+type RefIndex interface {
+	// Ref points id at digest. upload runs before the reference is taken, when
+	// nothing referenced the digest. release runs for the digest id pointed at
+	// until now if that lost its last reference, after that is committed.
+	Ref(ctx context.Context, id, digest string, size int64, upload func() error, release func(digest string) error) error
+
+	// Unref drops id's reference and runs release once that is committed if it
+	// was the last one for the digest, ErrNotFound when id points at nothing
+	Unref(ctx context.Context, id string, release func(digest string) error) error
+
+	// Digest returns what id points at, ErrNotFound when it has no digest
+	Digest(ctx context.Context, id string) (string, error)
+
+	// ListRefs pages over the ids that have a digest, same contract as StorageBackend.List
+	ListRefs(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error)
+}
+
+// DedupBackend stores the data of every id once per distinct content, under
+// its SHA-256 digest in the wrapped backend:
+//
+//	PUT a.tar -> sha256 e3b0... -> Base object ".cas/sha256/e3b0..." (refcount 1)
+//	PUT b.tar, same bytes      -> only the index changes (refcount 2)
+//	DELETE a.tar               -> refcount 1, object stays
+//	DELETE b.tar               -> refcount 0, object deleted
+//
+// The digest keys start with a dot, which no valid id can, so they never clash
+// with ids that Base stores directly. Ids written before dedup was enabled have
+// no digest and are read from and deleted in Base as they are.
+type DedupBackend struct {
+	Base StorageBackend
+	Index RefIndex
+}
+
+func NewDedupBackend(base StorageBackend, index RefIndex) *DedupBackend {
+	return &DedupBackend{Base: base, Index: index}
+}
+
+// casPrefix is where content objects live in the wrapped backend
+const casPrefix = ".cas/sha256/"
+
+func casID(digest string) string {
+	return casPrefix + digest
+}
+
+func (d *DedupBackend) Save(id string, data []byte) error {
+	return saveBytes(d, id, data)
+}
+
+func (d *DedupBackend) Load(id string) ([]byte, error) {
+	return loadBytes(d, id)
+}
+
+// Put has to hash the whole stream before it knows where it goes, so the data
+// is spooled to a temp file first and only uploaded if the digest is new
+func (d *DedupBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	if id == "" {
+		return ErrInvalidID
+	}
+
+	h := sha256.New()
+	tmp, n, err := spoolToTemp(ctx, io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if size >= 0 && n != size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", size, n)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	_, err = d.Index.Digest(ctx, id)
+	legacy := errors.Is(err, ErrNotFound)
+	if err != nil && !legacy {
+		return err
+	}
+
+	upload := func() error {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return d.Base.Put(ctx, casID(digest), tmp, n)
+	}
+	if err := d.Index.Ref(ctx, id, digest, n, upload, d.release); err != nil {
+		return err
+	}
+
+	// a copy from before dedup was enabled is now shadowed by the digest
+	if legacy {
+		if err := d.Base.Delete(id); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// release deletes a content object nobody references anymore
+func (d *DedupBackend) release(digest string) error {
+	if err := d.Base.Delete(casID(digest)); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// baseID is where the data of id sits in the wrapped backend
+func (d *DedupBackend) baseID(ctx context.Context, id string) (string, error) {
+	digest, err := d.Index.Digest(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return id, nil // stored before dedup was enabled
+	}
+	if err != nil {
+		return "", err
+	}
+	return casID(digest), nil
+}
+
+func (d *DedupBackend) Get(ctx context.Context, id string) (io.ReadCloser, Info, error) {
+	obj, err := d.baseID(ctx, id)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	rc, info, err := d.Base.Get(ctx, obj)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info.ID = id
+	return rc, info, nil
+}
+
+func (d *DedupBackend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	obj, err := d.baseID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return d.Base.GetRange(ctx, obj, offset, length)
+}
+
+// List comes from the index, Base only knows digests. Ids from before dedup
+// was enabled are not included until they are written again.
+func (d *DedupBackend) List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	return d.Index.ListRefs(ctx, prefix, cursor, limit)
+}
+
+func (d *DedupBackend) Delete(id string) error {
+	ctx := context.Background()
+	err := d.Index.Unref(ctx, id, d.release)
+	if errors.Is(err, ErrNotFound) {
+		return d.Base.Delete(id)
+	}
+	return err
+}
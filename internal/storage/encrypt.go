@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// ObjectKey is the envelope of one encrypted object: its data key wrapped by
+// a master key, and the nonce its segments are derived from
+type ObjectKey struct {
+	ID string
+	Object string // name of the ciphertext in the wrapped backend
+	Size int64 // plaintext size
+	MasterKeyID string
+	WrappedKey []byte
+	Nonce []byte
+	CreatedAt time.Time
+}
+
+// KeyStore keeps the envelopes of EncryptedBackend, db.MetadataDB implements
+// it on the blob_keys table
+type KeyStore interface {
+	// PutKey stores k as the current envelope of k.ID and returns the object
+	// the previous one pointed at, "" if there was none
+	PutKey(ctx context.Context, k ObjectKey) (string, error)
+	// GetKey and DeleteKey return ErrNotFound when the id has no envelope
+	GetKey(ctx context.Context, id string) (ObjectKey, error)
+	DeleteKey(ctx context.Context, id string) (ObjectKey, error)
+	// ListKeys pages over the envelopes by id, same contract as StorageBackend.List
+	ListKeys(ctx context.Context, prefix, cursor string, limit int) ([]ObjectKey, string, error)
+	// StaleKeys returns up to limit envelopes after cursor (by id) that are not
+	// wrapped with masterKeyID
+	StaleKeys(ctx context.Context, masterKeyID, cursor string, limit int) ([]ObjectKey, error)
+	// RewrapKey replaces the wrapped key of k.ID, as long as it still points at k.Object
+	RewrapKey(ctx context.Context, k ObjectKey) error
+}
+
+// EncryptedBackend encrypts every blob with its own random AES-256 data key
+// before it reaches the wrapped backend, which only ever sees ciphertext.
+// The data key is wrapped (AES-256-GCM) with the current master key and kept
+// in the KeyStore together with the nonce.
+//
+// The plaintext is sealed in segments of encSegment bytes, each with its own
+// GCM tag, so downloads stream and range reads only decrypt the segments they
+// touch. Segment i uses the object nonce xor i and the last one is marked in
+// the additional data, so reordered, dropped or truncated segments fail to open.
+//
+// Every write goes to a fresh object ".enc/<random>" and the envelope is
+// switched over afterwards, data and key can never get out of step. No id can
+// start with a dot, so these names don't clash with anything else in the backend.
+type EncryptedBackend struct {
+	Base StorageBackend
+	Keys KeyStore
+
+	masters map[string]cipher.AEAD
+	current string
+}
+
+const (
+	encPrefix = ".enc/"
+	encSegment = 64 << 10
+	encOverhead = 16 // GCM tag per segment
+	dataKeySize = 32
+)
+
+// NewEncryptedBackend wraps new data keys with masters[current], the other
+// master keys are only used to unwrap envelopes that were not re-wrapped yet
+func NewEncryptedBackend(base StorageBackend, keys KeyStore, masters map[string][]byte, current string) (*EncryptedBackend, error) {
+	if _, ok := masters[current]; !ok {
+		return nil, fmt.Errorf("master key %q is not configured", current)
+	}
+
+	e := &EncryptedBackend{Base: base, Keys: keys, masters: map[string]cipher.AEAD{}, current: current}
+	for id, key := range masters {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 bytes, got %d", id, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		e.masters[id] = aead
+	}
+	return e, nil
+}
+
+// ParseMasterKeys reads "id:base64key,id:base64key", the first key is the
+// current one and the rest are older keys still needed for unwrapping
+func ParseMasterKeys(s string) (map[string][]byte, string, error) {
+	masters := map[string][]byte{}
+	current := ""
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, b64, ok := strings.Cut(part, ":")
+		if !ok || id == "" {
+			return nil, "", fmt.Errorf("master key %q is not in id:base64 form", part)
+		}
+		key, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, "", fmt.Errorf("master key %q: %w", id, err)
+		}
+		if _, dup := masters[id]; dup {
+			return nil, "", fmt.Errorf("master key %q is listed twice", id)
+		}
+		masters[id] = key
+		if current == "" {
+			current = id
+		}
+	}
+	if current == "" {
+		return nil, "", errors.New("no master keys given")
+	}
+	return masters, current, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *EncryptedBackend) Save(id string, data []byte) error {
+	return saveBytes(e, id, data)
+}
+
+func (e *EncryptedBackend) Load(id string) ([]byte, error) {
+	return loadBytes(e, id)
+}
+
+func (e *EncryptedBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	if id == "" {
+		return ErrInvalidID
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	nonce := make([]byte, 12)
+	name := make([]byte, 16)
+	for _, b := range [][]byte{dataKey, nonce, name} {
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+	}
+	k := ObjectKey{ID: id, Object: encPrefix + hex.EncodeToString(name), Nonce: nonce, CreatedAt: time.Now().UTC()}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	if err := e.wrap(&k, dataKey); err != nil {
+		return err
+	}
+
+	plain := &countingReader{r: r}
+	sealed := &sealReader{aead: aead, nonce: nonce, aad: []byte(k.Object), src: bufio.NewReaderSize(plain, encSegment)}
+	if err := e.Base.Put(ctx, k.Object, sealed, cipherSize(size)); err != nil {
+		return err
+	}
+	k.Size = plain.n
+
+	prev, err := e.Keys.PutKey(ctx, k)
+	if err != nil {
+		e.Base.Delete(k.Object)
+		return err
+	}
+
+	// drop what the id pointed at before, or its plaintext copy from before encryption was enabled
+	if prev == "" {
+		prev = id
+	}
+	if err := e.Base.Delete(prev); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("encrypted storage: removing old object %s: %v", prev, err)
+	}
+	return nil
+}
+
+// wrap seals the data key with the current master key, bound to the object name
+func (e *EncryptedBackend) wrap(k *ObjectKey, dataKey []byte) error {
+	master := e.masters[e.current]
+	wrapNonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(wrapNonce); err != nil {
+		return err
+	}
+	k.MasterKeyID = e.current
+	k.WrappedKey = master.Seal(wrapNonce, wrapNonce, dataKey, []byte(k.Object))
+	return nil
+}
+
+func (e *EncryptedBackend) unwrap(k ObjectKey) ([]byte, error) {
+	master, ok := e.masters[k.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("blob %s is wrapped with unknown master key %q", k.ID, k.MasterKeyID)
+	}
+	n := master.NonceSize()
+	if len(k.WrappedKey) < n {
+		return nil, fmt.Errorf("blob %s has a malformed wrapped key", k.ID)
+	}
+	dataKey, err := master.Open(nil, k.WrappedKey[:n], k.WrappedKey[n:], []byte(k.Object))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping key of blob %s: %w", k.ID, err)
+	}
+	return dataKey, nil
+}
+
+// open prepares reading plaintext segments [first, ...] of an object
+func (e *EncryptedBackend) open(k ObjectKey, src io.Reader, first int64) (*openReader, error) {
+	dataKey, err := e.unwrap(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{aead: aead, nonce: k.Nonce, aad: []byte(k.Object), src: src, seq: first, size: k.Size}, nil
+}
+
+func (e *EncryptedBackend) Get(ctx context.Context, id string) (io.ReadCloser, Info, error) {
+	k, err := e.Keys.GetKey(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return e.Base.Get(ctx, id) // written before encryption was enabled
+	}
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	rc, info, err := e.Base.Get(ctx, k.Object)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	or, err := e.open(k, rc, 0)
+	if err != nil {
+		rc.Close()
+		return nil, Info{}, err
+	}
+	info.ID, info.Size = id, k.Size
+	return readCloser{Reader: or, Closer: rc}, info, nil
+}
+
+func (e *EncryptedBackend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	k, err := e.Keys.GetKey(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return e.Base.GetRange(ctx, id, offset, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if offset >= k.Size {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	// fetch whole segments around the range, the first partial one is skipped after decryption
+	first := offset / encSegment
+	cipherOff, cipherLen := first*(encSegment+encOverhead), int64(-1)
+	if length >= 0 {
+		last := (offset + length - 1) / encSegment
+		cipherLen = (last+1)*(encSegment+encOverhead) - cipherOff
+	}
+	rc, err := e.Base.GetRange(ctx, k.Object, cipherOff, cipherLen)
+	if err != nil {
+		return nil, err
+	}
+	or, err := e.open(k, rc, first)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	or.skip = offset - first*encSegment
+	return limitReadCloser(readCloser{Reader: or, Closer: rc}, length), nil
+}
+
+// List comes from the KeyStore, Base only has the object names. Ids from before
+// encryption was enabled are not included until they are written again.
+func (e *EncryptedBackend) List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	keys, next, err := e.Keys.ListKeys(ctx, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	infos := make([]Info, len(keys))
+	for i, k := range keys {
+		infos[i] = Info{ID: k.ID, Size: k.Size, ModTime: k.CreatedAt}
+	}
+	return infos, next, nil
+}
+
+// Delete drops the envelope first, without it the object is unreadable anyway
+func (e *EncryptedBackend) Delete(id string) error {
+	k, err := e.Keys.DeleteKey(context.Background(), id)
+	if errors.Is(err, ErrNotFound) {
+		return e.Base.Delete(id)
+	}
+	if err != nil {
+		return err
+	}
+	if err := e.Base.Delete(k.Object); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Rewrap re-wraps every data key that is not under the current master key,
+// the objects themselves are not touched. It runs in the background after a
+// rotation and returns how many keys it re-wrapped. Once it reports nothing
+// left, the old master keys can be removed from the config.
+func (e *EncryptedBackend) Rewrap(ctx context.Context) (int, error) {
+	done := 0
+	cursor := ""
+	for {
+		keys, err := e.Keys.StaleKeys(ctx, e.current, cursor, 100)
+		if err != nil {
+			return done, err
+		}
+		if len(keys) == 0 {
+			return done, nil
+		}
+
+		for _, k := range keys {
+			cursor = k.ID
+			dataKey, err := e.unwrap(k)
+			if err != nil {
+				log.Printf("encrypted storage: %v", err) // a missing master key must not stop the others
+				continue
+			}
+			if err := e.wrap(&k, dataKey); err != nil {
+				return done, err
+			}
+			if err := e.Keys.RewrapKey(ctx, k); err != nil {
+				return done, err
+			}
+			done++
+		}
+	}
+}
+
+// cipherSize is the stored size of size bytes of plaintext, -1 stays unknown
+func cipherSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	// an empty blob is still one (empty) segment
+	return size + (lastSegment(size)+1)*encOverhead
+}
+
+// segment i is sealed under the object nonce with i xor'ed into its last 8 bytes
+func segmentNonce(nonce []byte, seq int64) []byte {
+	n := append([]byte(nil), nonce...)
+	tail := n[len(n)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^uint64(seq))
+	return n
+}
+
+func segmentAAD(aad []byte, final bool) []byte {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	return append(append([]byte(nil), aad...), flag)
+}
+
+// sealReader turns plaintext into the segment stream
+type sealReader struct {
+	aead cipher.AEAD
+	nonce []byte
+	aad []byte
+	src *bufio.Reader
+
+	seq int64
+	plain, buf, out []byte
+	done bool
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+func (s *sealReader) next() error {
+	if s.plain == nil {
+		s.plain = make([]byte, encSegment)
+		s.buf = make([]byte, 0, encSegment+encOverhead)
+	}
+	n, err := io.ReadFull(s.src, s.plain)
+	final := false
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		final = true
+	case err != nil:
+		return err
+	default:
+		// a full segment is the last one only if nothing follows
+		if _, err := s.src.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	s.out = s.aead.Seal(s.buf[:0], segmentNonce(s.nonce, s.seq), s.plain[:n], segmentAAD(s.aad, final))
+	s.seq++
+	s.done = final
+	return nil
+}
+
+// openReader decrypts the segment stream, starting at segment seq
+type openReader struct {
+	aead cipher.AEAD
+	nonce []byte
+	aad []byte
+	src io.Reader
+	seq int64
+	size int64 // plaintext size, tells which segment is the last
+	skip int64 // plaintext bytes to drop from the first segment
+
+	in, buf, out []byte
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.seq > lastSegment(o.size) {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	if o.in == nil {
+		o.in = make([]byte, encSegment+encOverhead)
+		o.buf = make([]byte, 0, encSegment)
+	}
+
+	final := o.seq == lastSegment(o.size)
+	plainLen := int64(encSegment)
+	if final {
+		plainLen = o.size - o.seq*encSegment
+	}
+	in := o.in[:plainLen+encOverhead]
+	if _, err := io.ReadFull(o.src, in); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("reading encrypted segment %d: %w", o.seq, err)
+	}
+
+	out, err := o.aead.Open(o.buf[:0], segmentNonce(o.nonce, o.seq), in, segmentAAD(o.aad, final))
+	if err != nil {
+		return fmt.Errorf("decrypting segment %d: %w", o.seq, err)
+	}
+	o.seq++
+
+	o.out = out[o.skip:]
+	o.skip = 0
+	return nil
+}
+
+// lastSegment is the index of the final segment of size bytes of plaintext
+func lastSegment(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	return (size - 1) / encSegment
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
 	"path"
-	"strings"
+	"sort"
 	"time"
 
 	"github.com/jlaffaye/ftp"
@@ -23,12 +26,12 @@ func NewFTPBackend(host, user, pass, basePath string) *FTPBackend {
 	return &FTPBackend{host: host, user: user, pass: pass, basePath: basePath}
 }
 
-func (f *FTPBackend) dial() (*ftp.ServerConn, error) {
-	conn, err := ftp.Dial(f.host, ftp.DialWithTimeout(5*time.Second))
+func (f *FTPBackend) dial(ctx context.Context) (*ftp.ServerConn, error) {
+	conn, err := ftp.Dial(f.host, ftp.DialWithTimeout(5*time.Second), ftp.DialWithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
-	
+
 	if err := conn.Login(f.user, f.pass); err != nil {
 		conn.Quit()
 		return nil, err
@@ -37,61 +40,222 @@ func (f *FTPBackend) dial() (*ftp.ServerConn, error) {
 	return conn, nil // connection established
 }
 
-func sanitizeID(id string) string {
-	id = strings.ReplaceAll(id, "/", "_") // prevent directory traversal
+// keys have no slashes, so every blob is a direct child of basePath
+func (f *FTPBackend) pathForKey(key string) string {
+	return path.Join(f.basePath, key)
+}
 
-	if id == "" {
-		id = "someblob"
+func (f *FTPBackend) pathFor(id string) (string, error) {
+	key, err := keyFor(id)
+	if err != nil {
+		return "", err
 	}
+	return f.pathForKey(key), nil
+}
 
-	return id
+// 550 is what servers answer for RETR/SIZE/DELE on a missing file
+func isFTPNotFound(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code == ftp.StatusFileUnavailable
 }
 
 func (f *FTPBackend) Save(id string, data []byte) error {
-	conn, err := f.dial()
+	return saveBytes(f, id, data)
+}
+
+func (f *FTPBackend) Load(id string) ([]byte, error) {
+	return loadBytes(f, id)
+}
+
+func (f *FTPBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	fullPath, err := f.pathFor(id)
 	if err != nil {
 		return err
 	}
-	defer conn.Quit() // closing connection after saving to avoid memory leaks
+	return f.stor(ctx, fullPath, r, size)
+}
 
-	safeID := sanitizeID(id)
-	fullPath := path.Join(f.basePath, safeID)
+func (f *FTPBackend) stor(ctx context.Context, fullPath string, r io.Reader, size int64) error {
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Quit() // closing connection after saving to avoid memory leaks
 
-	return conn.Stor(fullPath, bytes.NewReader(data))
+	cr := &countingReader{r: &ctxReader{ctx: ctx, r: r}}
+	if err := conn.Stor(fullPath, cr); err != nil {
+		return err
+	}
+	if size >= 0 && cr.n != size {
+		_ = conn.Delete(fullPath) // don't leave a truncated upload behind
+		return io.ErrUnexpectedEOF
+	}
+	return nil
 }
 
-func (f *FTPBackend) Load(id string) ([]byte, error) {
-	conn, err := f.dial()
+func (f *FTPBackend) Get(ctx context.Context, id string) (io.ReadCloser, Info, error) {
+	fullPath, err := f.pathFor(id)
 	if err != nil {
-		return nil, err
+		return nil, Info{}, err
+	}
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return nil, Info{}, err
 	}
-	defer conn.Quit()
 
-	safeID := sanitizeID(id)
-	fullPath := path.Join(f.basePath, safeID)
+	// SIZE and MDTM have to go over the control connection before the transfer starts
+	info := Info{ID: id}
+	info.Size, err = conn.FileSize(fullPath)
+	if err != nil {
+		conn.Quit()
+		if isFTPNotFound(err) {
+			return nil, Info{}, ErrNotFound
+		}
+		return nil, Info{}, err
+	}
+	if conn.IsGetTimeSupported() {
+		info.ModTime, _ = conn.GetTime(fullPath)
+	}
 
 	response, err := conn.Retr(fullPath)
+	if err != nil {
+		conn.Quit()
+		if isFTPNotFound(err) {
+			return nil, Info{}, ErrNotFound
+		}
+		return nil, Info{}, err
+	}
+
+	return &ftpReader{Response: response, conn: conn}, info, nil
+}
+
+func (f *FTPBackend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	fullPath, err := f.pathFor(id)
 	if err != nil {
 		return nil, err
 	}
-	defer response.Close()
+	rc, err := f.retrFrom(ctx, fullPath, offset)
+	if err != nil {
+		return nil, err
+	}
+	return limitReadCloser(rc, length), nil
+}
 
-	buf := new(bytes.Buffer)
-	if _, err := buf.ReadFrom(response); err != nil {
+func (f *FTPBackend) retrFrom(ctx context.Context, fullPath string, offset int64) (io.ReadCloser, error) {
+	conn, err := f.dial(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	// RetrFrom sends REST before RETR so the server starts at offset
+	response, err := conn.RetrFrom(fullPath, uint64(offset))
+	if err != nil {
+		conn.Quit()
+		if isFTPNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &ftpReader{Response: response, conn: conn}, nil
+}
+
+// List reads the base directory (MLSD when the server supports it, LIST otherwise),
+// FTP has no server side paging so prefix and cursor are applied here
+func (f *FTPBackend) List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Quit()
+
+	ftpEntries, err := conn.List(f.basePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]listEntry, 0, len(ftpEntries))
+	for _, e := range ftpEntries {
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		id, err := DecodeKey(e.Name)
+		if err != nil {
+			continue // not one of ours
+		}
+		entries = append(entries, listEntry{key: e.Name, info: Info{ID: id, Size: int64(e.Size), ModTime: e.Time}})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	page, next := pageEntries(entries, prefix, cursor, limit)
+	return page, next, nil
 }
 
 func (f *FTPBackend) Delete(id string) error {
-	conn, err := f.dial()
+	fullPath, err := f.pathFor(id)
+	if err != nil {
+		return err
+	}
+	return f.dele(context.Background(), fullPath)
+}
+
+func (f *FTPBackend) dele(ctx context.Context, fullPath string) error {
+	conn, err := f.dial(ctx)
 	if err != nil {
 		return err
 	}
 	defer conn.Quit()
-	safeID := sanitizeID(id)
-	fullPath := path.Join(f.basePath, safeID)
 
-	return conn.Delete(fullPath)
-}
\ No newline at end of file
+	if err := conn.Delete(fullPath); err != nil {
+		if isFTPNotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+/* ------------ legacy key migration ------------ */
+
+func (f *FTPBackend) statKey(ctx context.Context, key string) (bool, error) {
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Quit()
+
+	_, err = conn.FileSize(f.pathForKey(key))
+	if isFTPNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FTP has no server side copy, so stream through us over a second connection
+func (f *FTPBackend) copyKey(ctx context.Context, src, dst string) error {
+	rc, err := f.retrFrom(ctx, f.pathForKey(src), 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return f.stor(ctx, f.pathForKey(dst), rc, -1)
+}
+
+func (f *FTPBackend) deleteKey(ctx context.Context, key string) error {
+	return f.dele(ctx, f.pathForKey(key))
+}
+
+// ftpReader owns the connection for the duration of a download
+type ftpReader struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+}
+
+func (r *ftpReader) Close() error {
+	err := r.Response.Close()
+	if qErr := r.conn.Quit(); err == nil {
+		err = qErr
+	}
+	return err
+}
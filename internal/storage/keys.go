@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Blob ID grammar, enforced by the API on every write:
+//
+//	id      = segment *( "/" segment )
+//	segment = 1*( ALPHA / DIGIT / "." / "_" / "-" ), not starting with "."
+//
+// and at most MaxIDLength bytes. So "builds/app-1.2/linux_amd64.tar.gz" is fine,
+// while "", "/a", "a//b", "a/", "../x" and "a/.hidden" are rejected.
+const MaxIDLength = 255
+
+var ErrInvalidID = errors.New("invalid blob id")
+
+func ValidateID(id string) error {
+	if id == "" {
+		return fmt.Errorf("%w: id is empty", ErrInvalidID)
+	}
+	if len(id) > MaxIDLength {
+		return fmt.Errorf("%w: id is longer than %d bytes", ErrInvalidID, MaxIDLength)
+	}
+
+	for _, seg := range strings.Split(id, "/") {
+		if seg == "" {
+			return fmt.Errorf("%w: empty path segment (leading, trailing or double slash)", ErrInvalidID)
+		}
+		if seg[0] == '.' {
+			return fmt.Errorf("%w: segment %q starts with a dot", ErrInvalidID, seg)
+		}
+		for i := 0; i < len(seg); i++ {
+			if !isIDChar(seg[i]) {
+				return fmt.Errorf("%w: character %q is not allowed, use letters, digits, '.', '_', '-' and '/'", ErrInvalidID, seg[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// VersionKey is where the data of one version of a versioned blob is stored.
+// Like every internal name it starts with ".", so it can't collide with an id.
+func VersionKey(versionID string) string {
+	return ".versions/" + versionID
+}
+
+func isIDChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-'
+}
+
+// EncodeKey turns any id into a flat storage name that is safe as a file name,
+// an FTP path element and an S3 key. The mapping is reversible, so two ids can
+// never share a name:
+//
+//	"/"            -> "~"
+//	leading "."    -> "%2E"  (no hidden files, no "." or "..")
+//	anything else outside [A-Za-z0-9._-] -> "%XX"
+//
+// An id that follows the grammar only has its slashes rewritten, so its key is
+// exactly as long as the id and always fits in a single file name.
+func EncodeKey(id string) string {
+	var b strings.Builder
+	b.Grow(len(id))
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c == '/':
+			b.WriteByte('~')
+		case c == '.' && i == 0:
+			b.WriteString("%2E")
+		case isIDChar(c):
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeKey reverses EncodeKey, names that EncodeKey could not have produced are an error
+func DecodeKey(key string) (string, error) {
+	var b strings.Builder
+	b.Grow(len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c == '~':
+			b.WriteByte('/')
+		case c == '%':
+			if i+2 >= len(key) {
+				return "", fmt.Errorf("truncated escape in key %q", key)
+			}
+			v, ok := unhex(key[i+1], key[i+2])
+			if !ok {
+				return "", fmt.Errorf("bad escape in key %q", key)
+			}
+			b.WriteByte(v)
+			i += 2
+		case c == '.' && i == 0, !isIDChar(c):
+			return "", fmt.Errorf("key %q is not an encoded id", key)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	id := b.String()
+	if EncodeKey(id) != key {
+		return "", fmt.Errorf("key %q is not in canonical form", key) // e.g. "%41" for "A"
+	}
+	return id, nil
+}
+
+func unhex(hi, lo byte) (byte, bool) {
+	h, ok1 := hexVal(hi)
+	l, ok2 := hexVal(lo)
+	return h<<4 | l, ok1 && ok2
+}
+
+func hexVal(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// keyFor is what the name-based backends store an id under
+func keyFor(id string) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("%w: id is empty", ErrInvalidID)
+	}
+	return EncodeKey(id), nil
+}
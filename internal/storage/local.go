@@ -1,44 +1,291 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
+// in-flight writes live next to their target as ".tmp-<random>", a leading dot
+// can never start an encoded key so they don't collide with blobs or show up in List
+const (
+	tempPrefix = ".tmp-"
+	staleTempAge = time.Hour // a temp file untouched this long belongs to a writer that died
+)
+
+// LocalBackend writes every blob to a temp file, fsyncs it and renames it over
+// the final path, so readers only ever see complete files. Concurrent writers
+// to the same id each get their own temp file and the last rename wins.
+//
+// With ShardDepth > 0 files are fanned out into hash-prefix directories, see local_shard.go.
 type LocalBackend struct {
 	BasePath string
+	ShardDepth int
 }
 
+// NewLocalBackend keeps every blob directly in basePath
 func NewLocalBackend(basePath string) *LocalBackend {
-	_ = os.MkdirAll(basePath, 0755)
-	return &LocalBackend{BasePath: basePath}
+	return newLocalBackend(basePath, 0)
 }
 
-func (l *LocalBackend) pathFor(id string) string {
-	id = strings.ReplaceAll(id, "/", "_") // replace slashes to avoid directory traversal
-	if id == "" {
-		id = "someblob"
+// NewShardedLocalBackend stores blobs depth directory levels below basePath,
+// depth is 0 to 3
+func NewShardedLocalBackend(basePath string, depth int) (*LocalBackend, error) {
+	if err := checkShardDepth(depth); err != nil {
+		return nil, err
 	}
-	return filepath.Join(l.BasePath, id) // example output: /path/to/base/id
+	return newLocalBackend(basePath, depth), nil
+}
+
+func newLocalBackend(basePath string, depth int) *LocalBackend {
+	basePath = filepath.Clean(basePath)
+	_ = os.MkdirAll(basePath, 0755)
+	// walking a big tree takes a while, startup does not wait for it
+	go removeStaleTemps(basePath, staleTempAge)
+	return &LocalBackend{BasePath: basePath, ShardDepth: depth}
 }
 
 func (l *LocalBackend) Save(id string, data []byte) error {
-	p := l.pathFor(id)
-	dir := filepath.Dir(p) // path without the file name to ensure the directory exists
-	// Create the directory if it does not exist
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	return saveBytes(l, id, data)
+}
+
+func (l *LocalBackend) Load(id string) ([]byte, error) {
+	return loadBytes(l, id)
+}
+
+func (l *LocalBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	key, err := keyFor(id)
+	if err != nil {
+		return err
+	}
+	p := l.pathForKey(key)
+	// Create the shard directories if they do not exist
+	if err := l.makeParent(p); err != nil {
+		return err
+	}
+
+	if err := writeAtomic(ctx, p, r, size); err != nil {
 		return err
 	}
-	return os.WriteFile(p, data, 0644)
+
+	// an older copy in another layout must not come back if this one is deleted later
+	return l.removeOtherLayouts(key)
 }
 
-func (l *LocalBackend) Load(id string) ([]byte, error) {
-	p := l.pathFor(id)
-	return os.ReadFile(p)
+// writeAtomic is temp file -> fsync -> rename -> fsync dir, a crash at any
+// point leaves either the old file or the new one, never a truncated mix
+func writeAtomic(ctx context.Context, p string, r io.Reader, size int64) (err error) {
+	dir := filepath.Dir(p)
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = copySized(ctx, tmp, r, size); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil { // CreateTemp uses 0600
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	// the rename itself is only durable once the directory entry is on disk
+	return syncDir(dir)
 }
 
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeStaleTemps deletes temp files left behind by crashed writers, live
+// ones are recognised by a recent mtime since every write touches it.
+// Errors are logged and the walk goes on, a leftover temp file only costs space.
+func removeStaleTemps(base string, olderThan time.Duration) {
+	cutoff := time.Now().Add(-olderThan)
+	filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("local storage: cleaning temp files in %s: %v", p, err)
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		st, err := d.Info()
+		if err != nil {
+			return nil // already gone
+		}
+		if st.ModTime().Before(cutoff) {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("local storage: removing %s: %v", p, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (l *LocalBackend) Get(ctx context.Context, id string) (io.ReadCloser, Info, error) {
+	key, err := keyFor(id)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := l.openKey(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Info{}, err
+	}
+
+	return f, Info{ID: id, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (l *LocalBackend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	key, err := keyFor(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.openKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return limitReadCloser(f, length), nil
+}
+
+// List walks the whole tree under BasePath, files whose names are not encoded
+// ids are skipped. A sharded tree is listed in hash order instead, see listShards.
+func (l *LocalBackend) List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	if l.ShardDepth > 0 {
+		return l.listShards(ctx, prefix, cursor, limit)
+	}
+	byKey := map[string]listEntry{}
+	err := l.walkBlobs(ctx, func(p, key string, d fs.DirEntry) error {
+		id, err := DecodeKey(key)
+		if err != nil {
+			return nil
+		}
+		// mid-reshard a blob can briefly exist in two layouts, report the canonical one
+		if _, dup := byKey[key]; dup && p != l.pathForKey(key) {
+			return nil
+		}
+		st, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // deleted while we were listing
+		}
+		if err != nil {
+			return err
+		}
+		byKey[key] = listEntry{key: key, info: Info{ID: id, Size: st.Size(), ModTime: st.ModTime()}}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]listEntry, 0, len(byKey))
+	for _, e := range byKey {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	page, next := pageEntries(entries, prefix, cursor, limit)
+	return page, next, nil
+}
+
+// Delete removes the blob from every layout it might be in, the canonical path
+// last so a concurrent Reshard can't link an old copy back into place
 func (l *LocalBackend) Delete(id string) error {
-	p := l.pathFor(id)
-	return os.Remove(p)
-}
\ No newline at end of file
+	key, err := keyFor(id)
+	if err != nil {
+		return err
+	}
+	return l.deleteKey(context.Background(), key)
+}
+
+/* ------------ legacy key migration ------------ */
+
+func (l *LocalBackend) statKey(ctx context.Context, key string) (bool, error) {
+	for _, p := range l.candidatePaths(key) {
+		ok, err := isBlobFile(p)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// a hard link makes the copy free and fails instead of clobbering an existing dst
+func (l *LocalBackend) copyKey(ctx context.Context, src, dst string) error {
+	f, err := l.openKey(src)
+	if err != nil {
+		return err
+	}
+	srcPath := f.Name()
+	f.Close()
+
+	dstPath := l.pathForKey(dst)
+	if err := l.makeParent(dstPath); err != nil {
+		return err
+	}
+	return os.Link(srcPath, dstPath)
+}
+
+func (l *LocalBackend) deleteKey(ctx context.Context, key string) error {
+	paths := l.candidatePaths(key)
+	removed := false
+	for i := len(paths) - 1; i >= 0; i-- {
+		ok, err := isBlobFile(paths[i])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = os.Remove(paths[i])
+		if err == nil {
+			removed = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if !removed {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Sharded layout: with ShardDepth = 2 the key "logs~app.txt" lives at
+//
+//	<BasePath>/3f/a9/logs~app.txt
+//
+// where 3f and a9 are the first bytes of sha256(key) in hex. Two levels give
+// 65536 leaf directories, enough to keep each one small at tens of millions
+// of blobs. Depth 0 is the original flat layout.
+const maxShardDepth = 3
+
+// a not yet moved blob that sits where a shard directory has to go (a flat
+// blob named "3f") is renamed to ".reshard-<key>" next to where it was, and
+// Reshard picks it up from there
+const parkPrefix = ".reshard-"
+
+func checkShardDepth(depth int) error {
+	if depth < 0 || depth > maxShardDepth {
+		return fmt.Errorf("shard depth must be between 0 and %d, got %d", maxShardDepth, depth)
+	}
+	return nil
+}
+
+// keyHash is the hex sha256 of a key, its shard directories are the first bytes
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (l *LocalBackend) pathAtDepth(key string, depth int) string {
+	h := keyHash(key)
+
+	parts := []string{l.BasePath}
+	for i := 0; i < depth; i++ {
+		parts = append(parts, h[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, key)...) // keys never contain a path separator
+}
+
+// where the key lives in the configured layout
+func (l *LocalBackend) pathForKey(key string) string {
+	return l.pathAtDepth(key, l.ShardDepth)
+}
+
+// every place a key may be while a Reshard is running, canonical first
+func (l *LocalBackend) candidatePaths(key string) []string {
+	paths := []string{l.pathForKey(key)}
+	for depth := 0; depth <= maxShardDepth; depth++ {
+		if depth != l.ShardDepth {
+			paths = append(paths, l.pathAtDepth(key, depth))
+		}
+	}
+	for depth := 0; depth <= maxShardDepth; depth++ {
+		if depth != l.ShardDepth {
+			// parked in the directory it was in, under the key's own shards
+			paths = append(paths, filepath.Join(filepath.Dir(l.pathAtDepth(key, depth)), parkPrefix+key))
+		}
+	}
+	return paths
+}
+
+// openKey finds the key in any layout so reads keep working during a reshard
+func (l *LocalBackend) openKey(key string) (*os.File, error) {
+	for _, p := range l.candidatePaths(key) {
+		f, err := os.Open(p)
+		if err == nil {
+			if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+				return f, nil
+			}
+			f.Close()
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) && !isNotDir(err) {
+			return nil, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// isBlobFile reports whether p is a blob file. The path of a short key in
+// another layout can be a shard directory ("0b" flat is a depth 1 shard),
+// that one is never the blob.
+func isBlobFile(p string) (bool, error) {
+	st, err := os.Lstat(p)
+	if err == nil {
+		return st.Mode().IsRegular(), nil
+	}
+	if errors.Is(err, fs.ErrNotExist) || isNotDir(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (l *LocalBackend) removeOtherLayouts(key string) error {
+	for _, p := range l.candidatePaths(key)[1:] {
+		ok, err := isBlobFile(p)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeParent creates the shard directories above p, parking any blob file
+// that is in the way
+func (l *LocalBackend) makeParent(p string) error {
+	dir := filepath.Dir(p)
+	for attempt := 0; ; attempt++ {
+		err := os.MkdirAll(dir, 0755)
+		if err == nil || attempt > maxShardDepth {
+			return err
+		}
+
+		blocker := l.blockingFile(dir)
+		if blocker == "" {
+			return err
+		}
+		parked := filepath.Join(filepath.Dir(blocker), parkPrefix+filepath.Base(blocker))
+		if err := os.Rename(blocker, parked); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("moving %s out of the way: %w", blocker, err)
+		}
+	}
+}
+
+// blockingFile returns the first regular file on the way from BasePath to dir
+func (l *LocalBackend) blockingFile(dir string) string {
+	rel, err := filepath.Rel(l.BasePath, dir)
+	if err != nil || rel == "." {
+		return ""
+	}
+	cur := l.BasePath
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		st, err := os.Lstat(cur)
+		if err != nil {
+			return ""
+		}
+		if st.Mode().IsRegular() {
+			return cur
+		}
+	}
+	return ""
+}
+
+// relocate moves the blob file at p to its canonical path and reports whether
+// it did. A link never overwrites, so if a writer already put a newer copy
+// there the old one is simply dropped.
+func (l *LocalBackend) relocate(p string) (bool, error) {
+	key := strings.TrimPrefix(filepath.Base(p), parkPrefix)
+	dst := l.pathForKey(key)
+	if dst == p {
+		return false, nil
+	}
+	// p may have been parked since it was listed and a shard directory created in its place
+	if st, err := os.Lstat(p); err != nil || !st.Mode().IsRegular() {
+		return false, nil
+	}
+	if err := l.makeParent(dst); err != nil {
+		return false, err
+	}
+
+	if err := os.Link(p, dst); err != nil && !errors.Is(err, fs.ErrExist) {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil // deleted, or parked by makeParent and left for the next pass
+		}
+		return false, err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	// drop shard directories the move left empty, non-empty ones just fail
+	for dir := filepath.Dir(p); dir != l.BasePath && strings.HasPrefix(dir, l.BasePath); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return true, syncDir(filepath.Dir(dst))
+}
+
+// walkBlobs calls fn for every blob file in any layout (parked ones included),
+// temp files are skipped
+func (l *LocalBackend) walkBlobs(ctx context.Context, fn func(p, key string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(l.BasePath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p != l.BasePath {
+				return nil // removed by a concurrent reshard
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		return fn(p, strings.TrimPrefix(d.Name(), parkPrefix), d)
+	})
+}
+
+// errPageFull stops listShards once it has found enough blobs
+var errPageFull = errors.New("page full")
+
+// shardEntry is a blob file found by listShards
+type shardEntry struct {
+	hash string
+	key string
+	path string
+	d fs.DirEntry
+}
+
+// shardLister collects the blobs of a sharded tree in hash order, which is
+// the order of its directories, so a page only reads the directories from the
+// cursor on and stops once it is full
+type shardLister struct {
+	l *LocalBackend
+	ctx context.Context
+	keyPrefix string
+	after string // hash of the cursor, "" from the start
+	want int
+	out []listEntry
+}
+
+// listShards is List for ShardDepth > 0. The blobs come in the order of their
+// key hashes, the cursor is still the last key.
+func (l *LocalBackend) listShards(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	s := &shardLister{l: l, ctx: ctx, keyPrefix: EncodeKey(prefix), want: limit + 1}
+	if cursor != "" {
+		s.after = keyHash(cursor)
+	}
+	if err := s.dir(l.BasePath, "", nil); err != nil && !errors.Is(err, errPageFull) {
+		return nil, "", err
+	}
+
+	// one extra blob tells us whether there is another page
+	page := make([]Info, 0, len(s.out))
+	for _, e := range s.out {
+		page = append(page, e.info)
+	}
+	if len(page) > limit {
+		return page[:limit], s.out[limit-1].key, nil
+	}
+	return page, "", nil
+}
+
+// dir lists the shard directory for the hash prefix hexPrefix. pending are
+// the blobs of that prefix found higher up, which mid-reshard haven't moved
+// down here yet, they are merged in by hash.
+func (s *shardLister) dir(dir, hexPrefix string, pending []shardEntry) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) && dir != s.l.BasePath {
+		entries = nil // removed by a concurrent reshard
+	} else if err != nil {
+		return err
+	}
+
+	files := append([]shardEntry{}, pending...)
+	var subdirs []string
+	for _, d := range entries {
+		name := d.Name()
+		if d.IsDir() {
+			p := hexPrefix + name
+			if !isShardDir(name) || len(p) > 2*maxShardDepth || s.after != "" && p < s.after[:len(p)] {
+				continue // not ours, or only has blobs before the cursor
+			}
+			subdirs = append(subdirs, name)
+			continue
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(name, tempPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(name, parkPrefix)
+		if _, err := DecodeKey(key); err != nil || !strings.HasPrefix(key, s.keyPrefix) {
+			continue
+		}
+		h := keyHash(key)
+		if h <= s.after || !strings.HasPrefix(h, hexPrefix) {
+			continue
+		}
+		files = append(files, shardEntry{hash: h, key: key, path: filepath.Join(dir, name), d: d})
+	}
+	// mid-reshard a blob can briefly exist in two layouts, the canonical one goes first
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].hash != files[j].hash {
+			return files[i].hash < files[j].hash
+		}
+		return files[i].path == s.l.pathForKey(files[i].key)
+	})
+
+	i := 0
+	for _, name := range subdirs {
+		p := hexPrefix + name
+		for ; i < len(files) && files[i].hash[:len(p)] < p; i++ {
+			if err := s.emit(files[i]); err != nil {
+				return err
+			}
+		}
+		j := i
+		for j < len(files) && strings.HasPrefix(files[j].hash, p) {
+			j++
+		}
+		if err := s.dir(filepath.Join(dir, name), p, files[i:j]); err != nil {
+			return err
+		}
+		i = j
+	}
+	for ; i < len(files); i++ {
+		if err := s.emit(files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardLister) emit(e shardEntry) error {
+	if n := len(s.out); n > 0 && s.out[n-1].key == e.key {
+		return nil // the other copy of a blob that is being moved
+	}
+	st, err := e.d.Info()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // deleted while we were listing
+	}
+	if err != nil {
+		return err
+	}
+	id, _ := DecodeKey(e.key)
+	s.out = append(s.out, listEntry{key: e.key, info: Info{ID: id, Size: st.Size(), ModTime: st.ModTime()}})
+	if len(s.out) == s.want {
+		return errPageFull
+	}
+	return nil
+}
+
+// shard directories are named by two lowercase hex digits
+func isShardDir(name string) bool {
+	return len(name) == 2 && strings.Trim(name, "0123456789abcdef") == ""
+}
+
+// Reshard moves every blob that is not at its path for the configured
+// ShardDepth, e.g. a flat directory after sharding was switched on. It is safe
+// to run while the server is live: reads and deletes look in every layout,
+// writes always go to the new one, and a move never overwrites a newer copy.
+// It returns the number of blobs moved and can be re-run after an interruption.
+func (l *LocalBackend) Reshard(ctx context.Context) (int, error) {
+	moved := 0
+	// blobs parked while making room are only seen by the following pass
+	for pass := 0; pass <= maxShardDepth+1; pass++ {
+		var misplaced []string
+		err := l.walkBlobs(ctx, func(p, key string, d fs.DirEntry) error {
+			if _, err := DecodeKey(key); err != nil {
+				return nil // not one of ours
+			}
+			if p != l.pathForKey(key) {
+				misplaced = append(misplaced, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+		if len(misplaced) == 0 {
+			return moved, nil
+		}
+
+		for _, p := range misplaced {
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+			ok, err := l.relocate(p)
+			if err != nil {
+				return moved, fmt.Errorf("moving %s: %w", p, err)
+			}
+			if ok {
+				moved++
+			}
+		}
+	}
+	return moved, nil
+}
+
+// opening "a/b" where a is a file fails with ENOTDIR, for us that is just "not here"
+func isNotDir(err error) bool {
+	return errors.Is(err, syscall.ENOTDIR)
+}
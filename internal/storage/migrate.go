@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// keyStore is implemented by the backends that map ids to names, it gives the
+// migration raw access to names that no longer correspond to any id
+type keyStore interface {
+	statKey(ctx context.Context, key string) (bool, error)
+	copyKey(ctx context.Context, src, dst string) error
+	deleteKey(ctx context.Context, key string) error
+}
+
+// legacyKey is how LocalBackend, FTPBackend and S3Backend used to name objects,
+// it flattened slashes so "a/b" and "a_b" ended up in the same file
+func legacyKey(id string) string {
+	id = strings.ReplaceAll(id, "/", "_")
+	if id == "" {
+		id = "someblob"
+	}
+	return id
+}
+
+// MigrateLegacyKeys moves objects written under the old slash-flattening
+// names to their EncodeKey names. ids should be every id the metadata knows.
+//
+// Each object is copied rather than renamed, because when "a/b" and "a_b" both
+// exist their old names collided and both must keep the data they can still
+// read today. Old names that no current id maps to are removed at the end.
+// The migration is idempotent, objects already at their new name are skipped,
+// and it returns how many objects were copied. Backends that never flattened
+// ids (DBBlobBackend) have nothing to do.
+func MigrateLegacyKeys(ctx context.Context, b StorageBackend, ids []string) (int, error) {
+	ks, ok := b.(keyStore)
+	if !ok {
+		return 0, nil
+	}
+
+	current := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		current[EncodeKey(id)] = true
+	}
+
+	copied := 0
+	stale := map[string]bool{}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		oldKey, newKey := legacyKey(id), EncodeKey(id)
+		if oldKey == newKey {
+			continue
+		}
+
+		exists, err := ks.statKey(ctx, oldKey)
+		if err != nil {
+			return copied, fmt.Errorf("stat %s: %w", oldKey, err)
+		}
+		if !exists {
+			continue // already migrated, or the object was lost before
+		}
+
+		done, err := ks.statKey(ctx, newKey)
+		if err != nil {
+			return copied, fmt.Errorf("stat %s: %w", newKey, err)
+		}
+		if !done {
+			if err := ks.copyKey(ctx, oldKey, newKey); err != nil {
+				return copied, fmt.Errorf("copy %s to %s: %w", oldKey, newKey, err)
+			}
+			copied++
+		}
+
+		if !current[oldKey] {
+			stale[oldKey] = true
+		}
+	}
+
+	for key := range stale {
+		if err := ks.deleteKey(ctx, key); err != nil {
+			return copied, fmt.Errorf("delete %s: %w", key, err)
+		}
+	}
+
+	return copied, nil
+}
@@ -1,16 +1,18 @@
 package storage
 
 import (
-	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"path"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -35,23 +37,55 @@ func NewS3Backend(endpoint, bucket, accessKey, secret, region string) *S3Backend
 	}
 }
 
-func (s *S3Backend) objectURL(object string) string {
-	// <endpoint>/<bucket>/<object>
-	return s.Endpoint + "/" + s.Bucket + "/" + path.Clean("/"+object)[1:]
+func (s *S3Backend) objectURL(key string) string {
+	// <endpoint>/<bucket>/<key>, keys are slash free so escaping them as one segment is enough
+	return s.Endpoint + "/" + s.Bucket + "/" + awsEscape(key)
 }
 
 func (s *S3Backend) Save(id string, data []byte) error {
-	obj := sanitizeID(id)
+	return saveBytes(s, id, data)
+}
+
+func (s *S3Backend) Load(id string) ([]byte, error) {
+	return loadBytes(s, id)
+}
+
+func (s *S3Backend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	key, err := keyFor(id)
+	if err != nil {
+		return err
+	}
+	return s.putObject(ctx, key, r, size)
+}
+
+func (s *S3Backend) putObject(ctx context.Context, obj string, r io.Reader, size int64) error {
 	urlStr := s.objectURL(obj)
 
-	req, err := http.NewRequest("PUT", urlStr, bytes.NewReader(data))
+	// a plain PUT needs Content-Length up front, so unknown-size streams are spooled to disk first
+	if size < 0 {
+		tmp, n, err := spoolToTemp(ctx, r)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		r, size = tmp, n
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", urlStr, nil)
 	if err != nil {
 		return err
 	}
+	req.Body = http.NoBody
+	if size > 0 {
+		req.Body = io.NopCloser(r)
+	}
+	req.ContentLength = size
 	req.Header.Set("Host", req.URL.Host)
 	req.Header.Set("Content-Type", "application/octet-stream") // binary data stream
 
-	if err := s.signV4(req, data, time.Now().UTC()); err != nil {
+	// the body is streamed so it can't be hashed before sending
+	if err := s.signV4(req, unsignedPayload, time.Now().UTC()); err != nil {
 		return err
 	}
 	resp, err := s.client.Do(req)
@@ -68,49 +102,186 @@ func (s *S3Backend) Save(id string, data []byte) error {
 	return nil // success
 }
 
-func (s *S3Backend) Load(id string) ([]byte, error) {
-	obj := sanitizeID(id)
+func (s *S3Backend) Get(ctx context.Context, id string) (io.ReadCloser, Info, error) {
+	key, err := keyFor(id)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	rc, info, err := s.getObject(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info.ID = id
+	return rc, info, nil
+}
+
+func (s *S3Backend) getObject(ctx context.Context, obj string) (io.ReadCloser, Info, error) {
 	urlStr := s.objectURL(obj)
 
-	req, err := http.NewRequest("GET", urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	req.Header.Set("Host", req.URL.Host)
+
+	if err := s.signV4(req, emptyPayloadHash, time.Now().UTC()); err != nil {
+		return nil, Info{}, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, Info{}, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, Info{}, fmt.Errorf("failed to load object %s: status: %d body: %s", obj, resp.StatusCode, string(b))
+	}
+
+	info := Info{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return resp.Body, info, nil // caller closes the body
+}
+
+func (s *S3Backend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil // nothing to fetch
+	}
+	obj, err := keyFor(id)
+	if err != nil {
+		return nil, err
+	}
+	urlStr := s.objectURL(obj)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Host", req.URL.Host)
+	if length < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
 
-	if err := s.signV4(req, []byte{}, time.Now().UTC()); err != nil {
+	if err := s.signV4(req, emptyPayloadHash, time.Now().UTC()); err != nil {
 		return nil, err
 	}
 	resp, err := s.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	case resp.StatusCode == http.StatusOK:
+		// server ignored the Range header, skip ahead ourselves
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return limitReadCloser(resp.Body, length), nil
+	case resp.StatusCode >= 300:
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to load range of object %s: status: %d body: %s", obj, resp.StatusCode, string(b))
+	}
+
+	return resp.Body, nil // 206 partial content
+}
+
+// response body of ListObjectsV2, only the fields we use
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List maps straight onto ListObjectsV2, the cursor is S3's continuation token
+func (s *S3Backend) List(ctx context.Context, prefix, cursor string, limit int) ([]Info, string, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("max-keys", strconv.Itoa(limit))
+	if prefix != "" {
+		q.Set("prefix", EncodeKey(prefix)) // encoding is byte-wise, an id prefix stays a key prefix
+	}
+	if cursor != "" {
+		q.Set("continuation-token", cursor)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.Endpoint+"/"+s.Bucket+"?"+awsQueryEscape(q), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Host", req.URL.Host)
+
+	if err := s.signV4(req, emptyPayloadHash, time.Now().UTC()); err != nil {
+		return nil, "", err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to load object %s: status: %d body: %s", obj, resp.StatusCode, string(b))
+		return nil, "", fmt.Errorf("failed to list bucket %s: status: %d body: %s", s.Bucket, resp.StatusCode, string(b))
 	}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	var result listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
 	}
 
-	return data, nil // success
+	page := make([]Info, 0, len(result.Contents))
+	for _, obj := range result.Contents {
+		id, err := DecodeKey(obj.Key)
+		if err != nil {
+			continue // not written by us
+		}
+		page = append(page, Info{ID: id, Size: obj.Size, ModTime: obj.LastModified, ETag: obj.ETag})
+	}
+	if !result.IsTruncated {
+		return page, "", nil
+	}
+	return page, result.NextContinuationToken, nil
 }
 
 func (s *S3Backend) Delete(id string) error {
-	obj := sanitizeID(id)
+	key, err := keyFor(id)
+	if err != nil {
+		return err
+	}
+	return s.deleteObject(context.Background(), key)
+}
+
+func (s *S3Backend) deleteObject(ctx context.Context, obj string) error {
 	urlStr := s.objectURL(obj)
 
-	req, err := http.NewRequest("DELETE", urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", urlStr, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Host", req.URL.Host)
 
-	if err := s.signV4(req, []byte{}, time.Now().UTC()); err != nil {
+	if err := s.signV4(req, emptyPayloadHash, time.Now().UTC()); err != nil {
 		return err
 	}
 	resp, err := s.client.Do(req)
@@ -128,21 +299,89 @@ func (s *S3Backend) Delete(id string) error {
 }
 
 
+/* ------------ legacy key migration ------------ */
+
+func (s *S3Backend) statKey(ctx context.Context, key string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", s.objectURL(key), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Host", req.URL.Host)
+
+	if err := s.signV4(req, emptyPayloadHash, time.Now().UTC()); err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("failed to stat object %s: status: %d", key, resp.StatusCode)
+	}
+	return true, nil
+}
+
+// streamed through us rather than x-amz-copy-source, which would need extra signed headers
+func (s *S3Backend) copyKey(ctx context.Context, src, dst string) error {
+	rc, info, err := s.getObject(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return s.putObject(ctx, dst, rc, info.Size)
+}
+
+func (s *S3Backend) deleteKey(ctx context.Context, key string) error {
+	return s.deleteObject(ctx, key)
+}
+
+// spoolToTemp copies r into an anonymous temp file and rewinds it
+func spoolToTemp(ctx context.Context, r io.Reader) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "rekazdrive-spool-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := copySized(ctx, tmp, r, -1)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, n, nil
+}
+
+
 /* ------------ AWS Signature V4 implementation ------------ */
-func (s *S3Backend) signV4(req *http.Request, payload []byte, t time.Time) error {
+
+// x-amz-content-sha256 values for bodies that are streamed or empty
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+var emptyPayloadHash = func() string {
+	h := sha256.Sum256(nil)
+	return hex.EncodeToString(h[:])
+}()
+
+func (s *S3Backend) signV4(req *http.Request, payloadHashHex string, t time.Time) error {
 	service := "s3"
 
 	amzDate := t.UTC().Format("20060102T150405Z")
 	dateStamp := t.UTC().Format("20060102")
 
 	// payload hash
-	payloadHash := sha256.Sum256(payload)
-	payloadHashHex := hex.EncodeToString(payloadHash[:])
 	req.Header.Set("x-amz-content-sha256", payloadHashHex)
 	req.Header.Set("x-amz-date", amzDate)
 
 	// canonical URL
-	canonicalURL := req.URL.Path
+	canonicalURL := req.URL.EscapedPath()
 	// canonical query
 	var keys []string
 	for k := range req.URL.Query() {
@@ -154,7 +393,7 @@ func (s *S3Backend) signV4(req *http.Request, payload []byte, t time.Time) error
 		if i > 0 {
 			canonicalQuery += "&"
 		}
-		canonicalQuery += url.QueryEscape(k) + "=" + url.QueryEscape(req.URL.Query().Get(k))
+		canonicalQuery += awsEscape(k) + "=" + awsEscape(req.URL.Query().Get(k))
 	}
 
 	// canonical headers
@@ -189,6 +428,26 @@ func (s *S3Backend) signV4(req *http.Request, payload []byte, t time.Time) error
 	return nil
 }
 
+// aws wants RFC 3986 escaping, QueryEscape is the same except for spaces
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// awsQueryEscape encodes q sorted by key, the same way the signature sees it
+func awsQueryEscape(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, awsEscape(k)+"="+awsEscape(q.Get(k)))
+	}
+	return strings.Join(parts, "&")
+}
+
 // helper function that hashes input data using SHA256, returns hex-encoded string
 func hmacSHA256(key []byte, data string) []byte {
 	m := hmac.New(sha256.New, key)
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"rekazdrive/internal/auth"
 	"rekazdrive/internal/config"
 	"rekazdrive/internal/db"
 	"rekazdrive/internal/handlers"
+	"rekazdrive/internal/lifecycle"
 	"rekazdrive/internal/middleware"
 	"rekazdrive/internal/storage"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -23,19 +33,314 @@ func main() {
 
 	cfg := config.LoadFromEnv()
 
-	metaDB, err := db.NewPostgres(cfg.MetadataDSN)
+	// schema changes run before anything touches the tables
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(cfg, os.Args[2:])
+		return
+	}
+
+	meta := newMetadataStore(cfg)
+
+	// the storage layers keep their bookkeeping in the metadata store, the
+	// in-memory one can't hold it across restarts and doesn't offer it
+	base := newBackend(cfg)
+	backend := base
+	var encrypted *storage.EncryptedBackend
+	if cfg.EncryptionKeys != "" {
+		keys, ok := meta.(storage.KeyStore)
+		if !ok {
+			log.Fatalf("ENCRYPTION_KEYS needs METADATA_BACKEND=postgres or sqlite")
+		}
+		masters, current, err := storage.ParseMasterKeys(cfg.EncryptionKeys)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPTION_KEYS: %v", err)
+		}
+		if encrypted, err = storage.NewEncryptedBackend(backend, keys, masters, current); err != nil {
+			log.Fatalf("Invalid ENCRYPTION_KEYS: %v", err)
+		}
+		backend = encrypted
+	}
+	// dedup goes on top so identical plaintext still hashes the same
+	if cfg.StorageDedup == "true" {
+		refs, ok := meta.(storage.RefIndex)
+		if !ok {
+			log.Fatalf("STORAGE_DEDUP needs METADATA_BACKEND=postgres or sqlite")
+		}
+		backend = storage.NewDedupBackend(backend, refs)
+	}
+	// outermost, the layers below see the compressed bytes
+	if cfg.Compression != "" {
+		codecs, ok := meta.(storage.CodecIndex)
+		if !ok {
+			log.Fatalf("COMPRESSION needs METADATA_BACKEND=postgres or sqlite")
+		}
+		backend = newCompressedBackend(cfg, backend, codecs)
+	}
+
+	// one-off maintenance commands run instead of the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-keys":
+			migrateKeys(meta, base)
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+		return
+	}
+
+	// bring an existing directory in line with LOCAL_SHARD_DEPTH while already serving,
+	// reads find blobs in either layout until it is done
+	if local, ok := base.(*storage.LocalBackend); ok {
+		go func() {
+			moved, err := local.Reshard(context.Background())
+			if err != nil {
+				log.Printf("Reshard of %s stopped after %d blobs: %v", local.BasePath, moved, err)
+				return
+			}
+			if moved > 0 {
+				log.Printf("Reshard of %s done: %d blobs moved", local.BasePath, moved)
+			}
+		}()
+	}
+
+	// after a master key rotation, move every data key over to the new master key
+	if encrypted != nil {
+		go func() {
+			n, err := encrypted.Rewrap(context.Background())
+			if err != nil {
+				log.Printf("Re-wrap of data keys stopped after %d keys: %v", n, err)
+				return
+			}
+			if n > 0 {
+				log.Printf("Re-wrap of data keys done: %d keys moved to the current master key", n)
+			}
+		}()
+	}
+
+	router := gin.Default()
+	// ids may contain "/", clients send it as %2F and it must reach :id intact
+	router.UseRawPath = true
+	router.UnescapePathValues = true
+	// logins are throttled per client address, a forged X-Forwarded-For mustn't pick a new one
+	if err := router.SetTrustedProxies(splitList(cfg.TrustedProxies)); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	refuseWeakCredentials(cfg, meta)
+	bootstrapAdmin(cfg, meta)
+
+	revoked := auth.NewRevocations(meta)
+	if err := revoked.Sync(time.Now().UTC()); err != nil {
+		log.Fatalf("Failed to load revoked tokens: %v", err)
+	}
+	accessTTL := tokenTTL("JWT_EXPIRATION", cfg.JWTExpiration, handlers.DefaultAccessTTL)
+	signing := newKeyring(cfg, meta, accessTTL)
+	authHandler := handlers.NewAuthHandler(signing, meta, revoked)
+	authHandler.AccessTTL = accessTTL
+	authHandler.RefreshTTL = tokenTTL("REFRESH_EXPIRATION", cfg.RefreshExpiration, handlers.DefaultRefreshTTL)
+	go syncTokens(meta, revoked, authHandler.Guard, tokenSyncInterval)
+
+	router.GET("/.well-known/jwks.json", authHandler.JWKS)
+
+	// public group
+	v1 := router.Group("/v1")
+	v1.POST("/auth/login", authHandler.Login)
+	v1.POST("/auth/refresh", authHandler.Refresh)
+
+	// protected group
+	protected := v1.Group("")
+	protected.Use(middleware.AuthMiddleware(signing, meta, revoked, newOIDCProvider(cfg)))
+	protected.POST("/auth/logout", authHandler.Logout)
+	keys := protected.Group("/keys")
+	{
+		keys.POST("", authHandler.CreateAPIKey)
+		keys.GET("", authHandler.ListAPIKeys)
+		keys.DELETE("/:id", authHandler.RevokeAPIKey)
+	}
+
+	blobHandler := handlers.NewBlobHandler(backend, meta)
+	blobHandler.Versioning = handlers.VersioningPolicy{
+		Enabled:  cfg.Versioning == "true",
+		Prefixes: splitList(cfg.VersioningPrefixes),
+	}
+	if cfg.TrashRetention != "" {
+		retention, err := lifecycle.ParseDuration(cfg.TrashRetention)
+		if err != nil {
+			log.Fatalf("Invalid TRASH_RETENTION: %v", err)
+		}
+		blobHandler.TrashRetention = retention
+	}
+	if blobHandler.TrashRetention > 0 {
+		interval := time.Hour
+		if cfg.TrashPurgeInterval != "" {
+			var err error
+			if interval, err = lifecycle.ParseDuration(cfg.TrashPurgeInterval); err != nil || interval <= 0 {
+				log.Fatalf("Invalid TRASH_PURGE_INTERVAL: %q", cfg.TrashPurgeInterval)
+			}
+		}
+		go purgeTrash(blobHandler, interval)
+	}
+	go runLifecycle(newLifecycleWorker(cfg, backend, meta), lifecycleInterval(cfg))
+	// reads and writes need their scope on top of what the blob's ACL allows
+	read, write := middleware.RequireScope(auth.ScopeBlobsRead), middleware.RequireScope(auth.ScopeBlobsWrite)
+	blobs := protected.Group("/blobs")
+	{
+		blobs.POST("", write, blobHandler.PostBlob)
+		blobs.GET("", read, blobHandler.ListBlobs)
+		blobs.GET("/:id", read, blobHandler.GetBlob)
+		blobs.HEAD("/:id", read, blobHandler.HeadBlob)
+		blobs.DELETE("/:id", write, blobHandler.DeleteBlob)
+		blobs.PATCH("/:id", write, blobHandler.PatchBlob)
+		blobs.PUT("/:id", write, blobHandler.PutBlobContent)
+		blobs.GET("/:id/content", read, blobHandler.GetBlobContent)
+		blobs.GET("/:id/versions", read, blobHandler.ListVersions)
+		blobs.GET("/:id/versions/:version", read, blobHandler.GetVersionContent)
+		blobs.POST("/:id/versions/:version/restore", write, blobHandler.RestoreVersion)
+		blobs.DELETE("/:id/versions/:version", write, blobHandler.DeleteVersion)
+		blobs.GET("/:id/acl", read, blobHandler.GetACL)
+		blobs.PUT("/:id/acl", write, blobHandler.PutACL)
+	}
+	trash := protected.Group("/trash")
+	{
+		trash.GET("", read, blobHandler.ListTrash)
+		trash.POST("/:id/restore", write, blobHandler.RestoreFromTrash)
+		trash.DELETE("/:id", write, blobHandler.PurgeFromTrash)
+	}
+
+	// admin group
+	admin := protected.Group("/admin")
+	admin.Use(middleware.RequireScope(auth.ScopeAdminUsers))
+	userHandler := handlers.NewUserHandler(meta, meta)
+	{
+		admin.POST("/users", userHandler.CreateUser)
+		admin.GET("/users", userHandler.ListUsers)
+		admin.POST("/users/:id/disable", userHandler.DisableUser)
+		admin.POST("/users/:id/enable", userHandler.EnableUser)
+		admin.POST("/users/:id/password", userHandler.ResetPassword)
+		admin.PUT("/users/:id/role", userHandler.SetRole)
+		admin.GET("/roles", userHandler.ListRoles)
+		admin.GET("/users/:id/groups", userHandler.GetGroups)
+		admin.PUT("/users/:id/groups", userHandler.SetGroups)
+		admin.GET("/users/:id/identities", userHandler.ListIdentities)
+		admin.POST("/users/:id/identities", userHandler.LinkIdentity)
+		admin.DELETE("/users/:id/identities", userHandler.UnlinkIdentity)
+		admin.POST("/users/:id/unlock", authHandler.UnlockUser)
+		admin.GET("/lockouts", authHandler.ListLockouts)
+	}
+
+	port := "8080"
+	log.Printf("Starting server on port %s", port)
+	router.Run(":" + port)
+}
+
+// bootstrapAdmin creates the first account from ADMIN_USER/ADMIN_PASS while
+// there are none, later changes to the env vars don't touch existing users
+func bootstrapAdmin(cfg config.Config, users db.UserStore) {
+	n, err := users.CountUsers()
+	if err != nil {
+		log.Fatalf("Failed to count users: %v", err)
+	}
+	if n > 0 {
+		return
+	}
+	if cfg.AdminUser == "" || cfg.AdminPass == "" {
+		log.Println("No users yet, set ADMIN_USER and ADMIN_PASS to create the first admin")
+		return
+	}
+
+	admin, err := auth.NewUser(cfg.AdminUser, cfg.AdminPass, auth.RoleAdmin, time.Now())
 	if err != nil {
-		log.Fatalf("Failed to connect to metadata database: %v", err)
+		log.Fatalf("Invalid ADMIN_USER: %v", err)
 	}
-	if err := metaDB.InitSchema(); err != nil {
-		log.Fatalf("Failed to initialize metadata schema: %v", err)
+	// another replica may have been first
+	if err := users.CreateUser(admin); err != nil && !errors.Is(err, db.ErrUserExists) {
+		log.Fatalf("Failed to create the admin user: %v", err)
 	}
+	log.Printf("Created admin user %s", admin.Username)
+}
 
-	// storage backend selection from env
-	var backend storage.StorageBackend
+// refuseWeakCredentials stops the server while JWT_SECRET can be guessed or
+// the admin account has, or would get, a well-known ADMIN_PASS. DEV_MODE=true
+// only warns, for a local setup with admin/admin.
+func refuseWeakCredentials(cfg config.Config, users db.UserStore) {
+	var problems []string
+	if cfg.JWTAlgorithm == "" || cfg.JWTAlgorithm == auth.AlgHS256 {
+		if err := auth.CheckSecret(cfg.JWTSecret); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if cfg.AdminUser != "" && cfg.AdminPass != "" && auth.WeakPassword(cfg.AdminUser, cfg.AdminPass) {
+		// ADMIN_PASS only matters while it creates the admin or still logs in as one
+		n, err := users.CountUsers()
+		if err != nil {
+			log.Fatalf("Failed to count users: %v", err)
+		}
+		if n == 0 {
+			problems = append(problems, "ADMIN_PASS is a weak password")
+		} else if admin, err := users.GetUserByName(auth.NormaliseUsername(cfg.AdminUser)); err == nil && !admin.Disabled && auth.VerifyPassword(admin.PasswordHash, cfg.AdminPass) {
+			problems = append(problems, fmt.Sprintf("%s still logs in with the weak ADMIN_PASS", admin.Username))
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Fatalf("Failed to read the admin user: %v", err)
+		}
+	}
+	if len(problems) == 0 {
+		return
+	}
+	if cfg.DevMode == "true" {
+		for _, p := range problems {
+			log.Printf("DEV_MODE=true, starting anyway: %s", p)
+		}
+		return
+	}
+	log.Fatalf("Refusing to start: %s. Fix them, or set DEV_MODE=true for local development", strings.Join(problems, "; "))
+}
+
+// metadata store selection from env, the schema is brought up to date before it's returned
+func newMetadataStore(cfg config.Config) db.MetadataStore {
+	switch cfg.MetadataBackend {
+	case "postgres", "":
+		metaDB, err := db.NewPostgres(cfg.MetadataDSN)
+		if err != nil {
+			log.Fatalf("Failed to connect to metadata database: %v", err)
+		}
+		if err := metaDB.InitSchema(); err != nil {
+			log.Fatalf("Failed to initialize metadata schema: %v", err)
+		}
+		return metaDB
+	case "sqlite":
+		store, err := db.NewSQLite(cfg.SQLitePath)
+		if err != nil {
+			log.Fatalf("Failed to open SQLite metadata store: %v", err)
+		}
+		if err := store.InitSchema(); err != nil {
+			log.Fatalf("Failed to initialize metadata schema: %v", err)
+		}
+		return store
+	case "memory":
+		log.Println("METADATA_BACKEND=memory, blob metadata is lost on restart")
+		return db.NewMemoryStore()
+	default:
+		log.Fatalf("Unsupported metadata backend: %s", cfg.MetadataBackend)
+	}
+	return nil
+}
+
+// storage backend selection from env
+func newBackend(cfg config.Config) storage.StorageBackend {
 	switch cfg.StorageBackend {
 	case "local":
-		backend = storage.NewLocalBackend(cfg.LocalPath)
+		depth := 0
+		if cfg.LocalShardDepth != "" {
+			var err error
+			if depth, err = strconv.Atoi(cfg.LocalShardDepth); err != nil {
+				log.Fatalf("Invalid LOCAL_SHARD_DEPTH: %v", err)
+			}
+		}
+		local, err := storage.NewShardedLocalBackend(cfg.LocalPath, depth)
+		if err != nil {
+			log.Fatalf("Invalid LOCAL_SHARD_DEPTH: %v", err)
+		}
+		return local
 	case "db":
 		blobDB, err := sql.Open("postgres", cfg.BlobDBDSN)
 		if err != nil {
@@ -44,32 +349,349 @@ func main() {
 		if err := db.InitBlobTable(blobDB); err != nil {
 			log.Fatalf("Failed to initialize blob table: %v", err)
 		}
-		backend = storage.NewDBBlobBackend(blobDB)
+		return storage.NewDBBlobBackend(blobDB)
 	case "ftp":
-		backend = storage.NewFTPBackend(cfg.FTPHost, cfg.FTPUser, cfg.FTPPass, cfg.FTPBasePath)
+		return storage.NewFTPBackend(cfg.FTPHost, cfg.FTPUser, cfg.FTPPass, cfg.FTPBasePath)
 	case "s3":
-		backend = storage.NewS3Backend(cfg.S3Endpoint, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3Region)
+		return storage.NewS3Backend(cfg.S3Endpoint, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3Region)
 	default:
 		log.Fatalf("Unsupported storage backend: %s", cfg.StorageBackend)
 	}
+	return nil
+}
 
-	router := gin.Default()
+func newCompressedBackend(cfg config.Config, backend storage.StorageBackend, codecs storage.CodecIndex) storage.StorageBackend {
+	policy := storage.CompressionPolicy{Codec: cfg.Compression}
+	if cfg.CompressionMinSize != "" {
+		n, err := strconv.ParseInt(cfg.CompressionMinSize, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid COMPRESSION_MIN_SIZE: %v", err)
+		}
+		policy.MinSize = n
+	}
+	policy.Types = splitList(cfg.CompressionTypes)
 
-	// public group
-	v1 := router.Group("/v1")
-	v1.POST("/auth/login", handlers.LoginHandler(cfg))
+	compressed, err := storage.NewCompressedBackend(backend, codecs, policy)
+	if err != nil {
+		log.Fatalf("Invalid COMPRESSION: %v", err)
+	}
+	return compressed
+}
 
-	// protected group
-	protected := v1.Group("")
-	protected.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+// purgeTrash purges expired trash every interval, for as long as the server runs
+func purgeTrash(h *handlers.BlobHandler, interval time.Duration) {
+	for {
+		n, err := h.PurgeExpiredTrash(context.Background(), time.Now().UTC())
+		if err != nil {
+			log.Printf("Trash purge stopped after %d blobs: %v", n, err)
+		} else if n > 0 {
+			log.Printf("Trash purge done: %d blobs purged", n)
+		}
+		time.Sleep(interval)
+	}
+}
 
-	blobs := protected.Group("/blobs")
-	{
-		blobs.POST("", handlers.NewBlobHandler(backend, metaDB).PostBlob)
-		blobs.GET("/:id", handlers.NewBlobHandler(backend, metaDB).GetBlob)
+// other replicas' logouts reach this one's revocation list within this long
+const tokenSyncInterval = 30 * time.Second
+
+// tokenTTL reads a token lifetime, a bare number is minutes as in the old JWT_EXPIRATION=60
+func tokenTTL(name, v string, def time.Duration) time.Duration {
+	if v == "" {
+		return def
+	}
+	if _, err := strconv.Atoi(v); err == nil {
+		v += "m"
 	}
+	ttl, err := lifecycle.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		log.Fatalf("Invalid %s: %q", name, v)
+	}
+	return ttl
+}
 
-	port := "8080"
-	log.Printf("Starting server on port %s", port)
-	router.Run(":" + port)
-}
\ No newline at end of file
+// signing keys are checked for rotation, and other replicas' new keys loaded, this often
+const keyCheckInterval = time.Minute
+
+// newKeyring sets up token signing from JWT_ALGORITHM. A signing key keeps
+// verifying for one access token lifetime after it retired, plus a minute for
+// clocks that are a little off.
+func newKeyring(cfg config.Config, meta db.MetadataStore, accessTTL time.Duration) *auth.Keyring {
+	if cfg.JWTAlgorithm == "" || cfg.JWTAlgorithm == auth.AlgHS256 {
+		return auth.NewHMACKeyring(cfg.JWTSecret)
+	}
+	rotation := 30 * 24 * time.Hour
+	if cfg.JWTKeyRotation != "" {
+		var err error
+		if rotation, err = lifecycle.ParseDuration(cfg.JWTKeyRotation); err != nil || rotation <= 0 {
+			log.Fatalf("Invalid JWT_KEY_ROTATION: %q", cfg.JWTKeyRotation)
+		}
+	}
+	// the private keys are sealed at rest, with ENCRYPTION_KEYS unless they have their own
+	masterKeys := cfg.JWTMasterKeys
+	if masterKeys == "" {
+		masterKeys = cfg.EncryptionKeys
+	}
+	if masterKeys == "" {
+		log.Fatalf("JWT_ALGORITHM=%s needs JWT_MASTER_KEYS or ENCRYPTION_KEYS to seal its signing keys", cfg.JWTAlgorithm)
+	}
+	masters, current, err := storage.ParseMasterKeys(masterKeys)
+	if err != nil {
+		log.Fatalf("Invalid JWT_MASTER_KEYS: %v", err)
+	}
+	keyring, err := auth.NewKeyring(cfg.JWTAlgorithm, meta, masters, current, rotation, accessTTL+time.Minute)
+	if err != nil {
+		log.Fatalf("Invalid JWT_ALGORITHM or JWT_MASTER_KEYS: %v", err)
+	}
+	if err := keyring.Rotate(time.Now().UTC()); err != nil {
+		log.Fatalf("Failed to set up signing keys: %v", err)
+	}
+	go rotateKeys(keyring, meta, keyCheckInterval)
+	return keyring
+}
+
+// newOIDCProvider sets up the external identity provider, nil while OIDC_ISSUER is empty
+func newOIDCProvider(cfg config.Config) *auth.OIDCProvider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	roleGroups, err := auth.ParseRoleGroups(cfg.OIDCRoleGroups)
+	if err != nil {
+		log.Fatalf("Invalid OIDC_ROLE_GROUPS: %v", err)
+	}
+	skew := time.Minute
+	if cfg.OIDCClockSkew != "" {
+		if skew, err = time.ParseDuration(cfg.OIDCClockSkew); err != nil || skew < 0 {
+			log.Fatalf("Invalid OIDC_CLOCK_SKEW: %q", cfg.OIDCClockSkew)
+		}
+	}
+	provider, err := auth.NewOIDCProvider(auth.OIDCConfig{
+		Issuer:        cfg.OIDCIssuer,
+		Audience:      cfg.OIDCAudience,
+		UsernameClaim: cfg.OIDCUsernameClaim,
+		GroupsClaim:   cfg.OIDCGroupsClaim,
+		RoleGroups:    roleGroups,
+		DefaultRole:   cfg.OIDCDefaultRole,
+		ClockSkew:     skew,
+	})
+	if err != nil {
+		log.Fatalf("Invalid OIDC settings: %v", err)
+	}
+	// the provider may just be down, its tokens are refused until it is back
+	if err := provider.Discover(context.Background()); err != nil {
+		log.Printf("OIDC discovery for %s failed, retrying on the first token: %v", cfg.OIDCIssuer, err)
+	}
+	return provider
+}
+
+// rotateKeys makes the next signing key when the current one retires and
+// forgets the expired ones, for as long as the server runs
+func rotateKeys(keyring *auth.Keyring, meta db.MetadataStore, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		now := time.Now().UTC()
+		if err := keyring.Rotate(now); err != nil {
+			log.Printf("Signing key rotation failed: %v", err)
+		}
+		if _, err := meta.DeleteExpiredSigningKeys(now); err != nil {
+			log.Printf("Expired signing key cleanup failed: %v", err)
+		}
+	}
+}
+
+// syncTokens refreshes the revocation list and forgets expired tokens and old
+// failed logins every interval
+func syncTokens(meta db.MetadataStore, revoked *auth.Revocations, guard *auth.LoginGuard, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		now := time.Now().UTC()
+		if err := revoked.Sync(now); err != nil {
+			log.Printf("Revoked token sync failed: %v", err)
+		}
+		if _, err := meta.DeleteExpiredTokens(now); err != nil {
+			log.Printf("Expired token cleanup failed: %v", err)
+		}
+		if _, err := guard.Cleanup(now); err != nil {
+			log.Printf("Failed login cleanup failed: %v", err)
+		}
+	}
+}
+
+func newLifecycleWorker(cfg config.Config, backend storage.StorageBackend, meta db.MetadataStore) *lifecycle.Worker {
+	rules, err := lifecycle.ParseRules(cfg.LifecycleRules)
+	if err != nil {
+		log.Fatalf("Invalid LIFECYCLE_RULES: %v", err)
+	}
+	worker := &lifecycle.Worker{Store: backend, Meta: meta, Rules: rules}
+	// replicas sharing a metadata database take turns, the in-memory store is never shared
+	if coordinator, ok := meta.(lifecycle.Coordinator); ok {
+		host, _ := os.Hostname()
+		worker.Coordinator = coordinator
+		worker.Holder = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return worker
+}
+
+func lifecycleInterval(cfg config.Config) time.Duration {
+	if cfg.LifecycleInterval == "" {
+		return time.Hour
+	}
+	interval, err := lifecycle.ParseDuration(cfg.LifecycleInterval)
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid LIFECYCLE_INTERVAL: %q", cfg.LifecycleInterval)
+	}
+	return interval
+}
+
+// runLifecycle sweeps expired blobs every interval, for as long as the server runs
+func runLifecycle(worker *lifecycle.Worker, interval time.Duration) {
+	for {
+		n, err := worker.Sweep(context.Background(), time.Now().UTC())
+		if err != nil {
+			log.Printf("Lifecycle sweep stopped after %d blobs: %v", n, err)
+		} else if n > 0 {
+			log.Printf("Lifecycle sweep done: %d blobs deleted", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// splitList reads a comma separated setting, blanks are dropped
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runMigrate is "migrate [-db metadata|blob|all] up | down [n] | status",
+// all covers the blob database only when STORAGE_BACKEND=db. The metadata
+// database is the one METADATA_BACKEND points at, Postgres or SQLite.
+func runMigrate(cfg config.Config, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	which := flags.String("db", "all", "database to migrate: metadata, blob or all")
+	flags.Parse(args)
+	if *which != "metadata" && *which != "blob" && *which != "all" {
+		log.Fatalf("Unknown -db %q, use metadata, blob or all", *which)
+	}
+
+	var migrators []*db.Migrator
+	add := func(sqlDB *sql.DB, scope string) {
+		m, err := db.NewMigrator(sqlDB, scope)
+		if err != nil {
+			log.Fatalf("Failed to load %s migrations: %v", scope, err)
+		}
+		migrators = append(migrators, m)
+	}
+	if *which == "metadata" || *which == "all" {
+		switch cfg.MetadataBackend {
+		case "postgres", "":
+			metaDB, err := db.NewPostgres(cfg.MetadataDSN)
+			if err != nil {
+				log.Fatalf("Failed to connect to metadata database: %v", err)
+			}
+			add(metaDB.DB, db.ScopeMetadata)
+		case "sqlite":
+			store, err := db.NewSQLite(cfg.SQLitePath)
+			if err != nil {
+				log.Fatalf("Failed to open SQLite metadata store: %v", err)
+			}
+			add(store.DB, db.ScopeSQLite)
+		case "memory":
+			if *which == "metadata" {
+				log.Fatalf("METADATA_BACKEND=memory has no schema to migrate")
+			}
+		default:
+			log.Fatalf("Unsupported metadata backend: %s", cfg.MetadataBackend)
+		}
+	}
+	if *which == "blob" || *which == "all" && cfg.StorageBackend == "db" {
+		blobDB, err := sql.Open("postgres", cfg.BlobDBDSN)
+		if err != nil {
+			log.Fatalf("Failed to connect to blob database: %v", err)
+		}
+		add(blobDB, db.ScopeBlob)
+	}
+	if len(migrators) == 0 {
+		log.Fatalf("Nothing to migrate for -db %s", *which)
+	}
+
+	ctx := context.Background()
+	cmd := flags.Arg(0)
+	for _, m := range migrators {
+		switch cmd {
+		case "up", "":
+			done, err := m.Up(ctx)
+			logMigrations(m.Scope, "applied", done)
+			if err != nil {
+				log.Fatalf("Migrating %s database failed: %v", m.Scope, err)
+			}
+		case "down":
+			steps := 1
+			if flags.NArg() > 1 {
+				n, err := strconv.Atoi(flags.Arg(1))
+				if err != nil || n < 1 {
+					log.Fatalf("Invalid number of steps: %s", flags.Arg(1))
+				}
+				steps = n
+			}
+			done, err := m.Down(ctx, steps)
+			logMigrations(m.Scope, "rolled back", done)
+			if err != nil {
+				log.Fatalf("Rolling back %s database failed: %v", m.Scope, err)
+			}
+		case "status":
+			status, err := m.Status(ctx)
+			if err != nil {
+				log.Fatalf("Failed to read %s migrations: %v", m.Scope, err)
+			}
+			for _, s := range status {
+				applied := "pending"
+				if s.AppliedAt != nil {
+					applied = "applied " + s.AppliedAt.UTC().Format(time.RFC3339)
+				}
+				fmt.Printf("%-8s %04d_%-24s %s\n", m.Scope, s.Version, s.Name, applied)
+			}
+		default:
+			log.Fatalf("Unknown migrate command %q, use up, down [n] or status", cmd)
+		}
+	}
+}
+
+func logMigrations(scope, what string, versions []int) {
+	if len(versions) == 0 {
+		log.Printf("%s database: nothing %s", scope, what)
+		return
+	}
+	for _, v := range versions {
+		log.Printf("%s database: %s migration %04d", scope, what, v)
+	}
+}
+
+// migrateKeys renames objects stored under the old slash-flattened names, see storage.MigrateLegacyKeys
+func migrateKeys(meta db.MetadataStore, backend storage.StorageBackend) {
+	var ids []string
+	cursor := ""
+	for {
+		// a zero now keeps the expired ones too, the lifecycle worker still has to find their objects
+		metas, err := meta.ListMetadata("", cursor, 1000, nil, time.Time{})
+		if err != nil {
+			log.Fatalf("Failed to list metadata: %v", err)
+		}
+		if len(metas) == 0 {
+			break
+		}
+		for _, m := range metas {
+			ids = append(ids, m.ID)
+		}
+		cursor = metas[len(metas)-1].ID
+	}
+
+	copied, err := storage.MigrateLegacyKeys(context.Background(), backend, ids)
+	if err != nil {
+		log.Fatalf("Key migration failed after %d objects: %v", copied, err)
+	}
+	log.Printf("Key migration done: %d of %d blobs moved to their new names", copied, len(ids))
+}
@@ -2,10 +2,14 @@ package integration
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -27,6 +31,201 @@ func TestBlobsAPI_LocalFS(t *testing.T) {
     require.Equal(t, blobID, blob["id"])
 }
 
+func TestBlobsAPI_RawContent(t *testing.T) {
+    baseURL := "http://localhost:8080/v1"
+    token := login(t, baseURL)
+
+    blobID := "raw-test-id"
+    data := []byte("raw bytes, no base64 here")
+
+    req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/blobs/%s", baseURL, blobID), bytes.NewReader(data))
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("Content-Type", "application/octet-stream")
+
+    resp, err := http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+    req, _ = http.NewRequest("GET", fmt.Sprintf("%s/blobs/%s/content", baseURL, blobID), nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+
+    resp, err = http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    defer resp.Body.Close()
+    require.Equal(t, http.StatusOK, resp.StatusCode)
+    require.Equal(t, int64(len(data)), resp.ContentLength)
+    require.NotEmpty(t, resp.Header.Get("ETag"))
+    require.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+    body, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    require.Equal(t, data, body)
+}
+
+func TestBlobsAPI_RangeAndConditional(t *testing.T) {
+    baseURL := "http://localhost:8080/v1"
+    token := login(t, baseURL)
+
+    blobID := "range-test-id"
+    createBlob(t, baseURL, token, blobID, []byte("0123456789"))
+    url := fmt.Sprintf("%s/blobs/%s/content", baseURL, blobID)
+
+    // single range
+    req, _ := http.NewRequest("GET", url, nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("Range", "bytes=2-5")
+    resp, err := http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+    require.Equal(t, "bytes 2-5/10", resp.Header.Get("Content-Range"))
+    require.Equal(t, "2345", string(body))
+
+    // multi range
+    req.Header.Set("Range", "bytes=0-1,8-")
+    resp, err = http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+    require.Contains(t, resp.Header.Get("Content-Type"), "multipart/byteranges")
+
+    // unsatisfiable
+    req.Header.Set("Range", "bytes=50-60")
+    resp, err = http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+    // conditional
+    req.Header.Del("Range")
+    resp, err = http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    etag := resp.Header.Get("ETag")
+    require.NotEmpty(t, etag)
+
+    req.Header.Set("If-None-Match", etag)
+    resp, err = http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+func TestBlobsAPI_HeadDeleteList(t *testing.T) {
+    baseURL := "http://localhost:8080/v1"
+    token := login(t, baseURL)
+
+    for _, id := range []string{"list-a", "list-b", "list-c", "other"} {
+        createBlob(t, baseURL, token, id, []byte("hello "+id))
+    }
+
+    // list with prefix, one item per page
+    var ids []string
+    cursor := ""
+    for {
+        url := fmt.Sprintf("%s/blobs?prefix=list-&limit=1&cursor=%s", baseURL, cursor)
+        req, _ := http.NewRequest("GET", url, nil)
+        req.Header.Set("Authorization", "Bearer "+token)
+        resp, err := http.DefaultClient.Do(req)
+        require.NoError(t, err)
+        require.Equal(t, http.StatusOK, resp.StatusCode)
+
+        var page struct {
+            Items []struct {
+                ID string `json:"id"`
+            } `json:"items"`
+            NextCursor string `json:"next_cursor"`
+        }
+        json.NewDecoder(resp.Body).Decode(&page)
+        resp.Body.Close()
+        for _, item := range page.Items {
+            ids = append(ids, item.ID)
+        }
+        if page.NextCursor == "" {
+            break
+        }
+        cursor = page.NextCursor
+    }
+    require.Equal(t, []string{"list-a", "list-b", "list-c"}, ids)
+
+    // head returns the size without a body
+    req, _ := http.NewRequest("HEAD", baseURL+"/blobs/list-a", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    resp, err := http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusOK, resp.StatusCode)
+    require.Equal(t, int64(len("hello list-a")), resp.ContentLength)
+    require.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+    // delete, then the blob is gone
+    req, _ = http.NewRequest("DELETE", baseURL+"/blobs/list-a", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    resp, err = http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusOK, resp.StatusCode)
+
+    req, _ = http.NewRequest("GET", baseURL+"/blobs/list-a", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    resp, err = http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestBlobsAPI_Metadata(t *testing.T) {
+    baseURL := "http://localhost:8080/v1"
+    token := login(t, baseURL)
+
+    data := []byte(`{"hello":"world"}`)
+    sum := sha256.Sum256(data)
+    body := map[string]any{
+        "id":           "meta-test-id",
+        "data":         base64.StdEncoding.EncodeToString(data),
+        "content_type": "application/json",
+        "filename":     "hello.json",
+        "sha256":       hex.EncodeToString(sum[:]),
+        "metadata":     map[string]string{"team": "infra"},
+        "tags":         []string{"nightly", "nightly", "keep"},
+    }
+    resp := doJSON(t, "POST", baseURL+"/blobs", token, body)
+    resp.Body.Close()
+    require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+    blob := getBlob(t, baseURL, token, "meta-test-id")
+    require.Equal(t, "application/json", blob["content_type"])
+    require.Equal(t, "hello.json", blob["filename"])
+    require.Equal(t, hex.EncodeToString(sum[:]), blob["sha256"])
+    require.NotEmpty(t, blob["md5"])
+    require.Equal(t, map[string]any{"team": "infra"}, blob["metadata"])
+    require.Equal(t, []any{"nightly", "keep"}, blob["tags"])
+
+    // a wrong checksum is refused
+    body["sha256"] = strings.Repeat("0", 64)
+    resp = doJSON(t, "POST", baseURL+"/blobs", token, body)
+    resp.Body.Close()
+    require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+    // patch only the tags, the metadata stays
+    resp = doJSON(t, "PATCH", baseURL+"/blobs/meta-test-id", token, map[string]any{"tags": []string{"release"}})
+    var patched map[string]any
+    json.NewDecoder(resp.Body).Decode(&patched)
+    resp.Body.Close()
+    require.Equal(t, http.StatusOK, resp.StatusCode)
+    require.Equal(t, []any{"release"}, patched["tags"])
+    require.Equal(t, map[string]any{"team": "infra"}, patched["metadata"])
+
+    // the download carries the stored type
+    req, _ := http.NewRequest("GET", baseURL+"/blobs/meta-test-id/content", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    resp, err := http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+}
+
 func login(t *testing.T, baseURL string) string {
     body := map[string]string{
         "username": "admin",
@@ -74,4 +273,14 @@ func getBlob(t *testing.T, baseURL, token, blobID string) map[string]any {
     var result map[string]interface{}
     json.NewDecoder(resp.Body).Decode(&result)
     return result
-}
\ No newline at end of file
+}
+func doJSON(t *testing.T, method, url, token string, body any) *http.Response {
+    jsonBody, _ := json.Marshal(body)
+    req, _ := http.NewRequest(method, url, bytes.NewReader(jsonBody))
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    return resp
+}
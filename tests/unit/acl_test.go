@@ -0,0 +1,203 @@
+package unit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataStore_ACL(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: "a/1", UpdatedAt: now, OwnerID: "alice"}))
+			require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: "a/2", UpdatedAt: now, OwnerID: "bob"}))
+			require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: "a/3", UpdatedAt: now})) // from before owners
+
+			// an overwrite keeps the first owner
+			require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: "a/1", UpdatedAt: now.Add(time.Minute), OwnerID: "bob"}))
+			got, err := store.GetMetadata("a/1")
+			require.NoError(t, err)
+			require.Equal(t, "alice", got.OwnerID)
+
+			grants := []db.Grant{
+				{PrincipalType: db.PrincipalUser, Principal: "bob", Permission: db.PermRead},
+				{PrincipalType: db.PrincipalGroup, Principal: "team", Permission: db.PermWrite},
+				{PrincipalType: db.PrincipalGroup, Principal: "team", Permission: db.PermWrite},
+			}
+			require.NoError(t, store.SetGrants("a/1", grants))
+			require.ErrorIs(t, store.SetGrants("missing", grants), sql.ErrNoRows)
+			listed, err := store.ListGrants("a/1")
+			require.NoError(t, err)
+			require.ElementsMatch(t, grants[:2], listed)
+
+			ok, err := store.HasGrant("a/1", db.PermRead, db.Viewer{UserID: "bob"})
+			require.NoError(t, err)
+			require.True(t, ok)
+			ok, err = store.HasGrant("a/1", db.PermWrite, db.Viewer{UserID: "bob"})
+			require.NoError(t, err)
+			require.False(t, ok)
+			ok, err = store.HasGrant("a/1", db.PermWrite, db.Viewer{UserID: "carol", Groups: []string{"other", "team"}})
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			// lists only show what the viewer owns or may read
+			visible := func(v *db.Viewer) []string {
+				metas, err := store.ListMetadata("", "", 10, v, time.Now())
+				require.NoError(t, err)
+				return metaIDs(metas)
+			}
+			require.Equal(t, []string{"a/1", "a/2", "a/3"}, visible(nil))
+			require.Equal(t, []string{"a/1", "a/2"}, visible(&db.Viewer{UserID: "bob"}))
+			require.Equal(t, []string{"a/1"}, visible(&db.Viewer{UserID: "alice"}))
+			require.Empty(t, visible(&db.Viewer{UserID: "carol", Groups: []string{"team"}}))
+			require.Empty(t, visible(&db.Viewer{}))
+
+			require.NoError(t, store.TrashMetadata("a/1", now))
+			trash, err := store.ListTrash("", "", 10, &db.Viewer{UserID: "bob"})
+			require.NoError(t, err)
+			require.Equal(t, []string{"a/1"}, metaIDs(trash))
+			trash, err = store.ListTrash("", "", 10, &db.Viewer{UserID: "carol"})
+			require.NoError(t, err)
+			require.Empty(t, trash)
+
+			// the grants go with the row, a new blob under the id starts without any
+			require.NoError(t, store.PurgeTrashed("a/1", now))
+			require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: "a/1", UpdatedAt: now, OwnerID: "carol"}))
+			listed, err = store.ListGrants("a/1")
+			require.NoError(t, err)
+			require.Empty(t, listed)
+		})
+	}
+}
+
+func TestMetadataStore_UserGroups(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := auth.NewUser("omar", "long enough", auth.RoleWriter, time.Now())
+			require.NoError(t, err)
+			require.NoError(t, store.CreateUser(user))
+
+			groups, err := store.UserGroups(user.ID)
+			require.NoError(t, err)
+			require.Empty(t, groups)
+
+			require.NoError(t, store.SetUserGroups(user.ID, []string{"team", "Ops", "team"}))
+			groups, err = store.UserGroups(user.ID)
+			require.NoError(t, err)
+			require.Equal(t, []string{"Ops", "team"}, groups)
+
+			require.NoError(t, store.SetUserGroups(user.ID, nil))
+			groups, err = store.UserGroups(user.ID)
+			require.NoError(t, err)
+			require.Empty(t, groups)
+
+			require.ErrorIs(t, store.SetUserGroups("missing", []string{"team"}), sql.ErrNoRows)
+		})
+	}
+}
+
+func TestAuth_BlobACL(t *testing.T) {
+	router, _ := newAuthRouter(t)
+	adminToken, _ := loginAs(t, router, "admin", "admin password")
+	newUser := func(name string) (string, string) {
+		rec := serve(router, "POST", "/v1/admin/users", []byte(`{"username":"`+name+`","password":"long enough"}`), bearer(adminToken))
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var created struct {
+			ID string `json:"id"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+		token, code := loginAs(t, router, name, "long enough")
+		require.Equal(t, http.StatusOK, code)
+		return created.ID, token
+	}
+	aliceID, alice := newUser("alice")
+	bobID, bob := newUser("bob")
+	listed := func(token, path string) []string {
+		rec := serve(router, "GET", path, nil, bearer(token))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp struct {
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		ids := []string{}
+		for _, item := range resp.Items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	rec := serve(router, "PUT", "/v1/blobs/alice.txt", []byte("alice's"), bearer(alice))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	// nothing granted yet, bob can't see, overwrite, change or delete it
+	rec = serve(router, "GET", "/v1/blobs/alice.txt", nil, bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(router, "PUT", "/v1/blobs/alice.txt", []byte("bob's"), bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(router, "PATCH", "/v1/blobs/alice.txt", []byte(`{"tags":["x"]}`), bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(router, "DELETE", "/v1/blobs/alice.txt", nil, bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Empty(t, listed(bob, "/v1/blobs"))
+	require.Equal(t, []string{"alice.txt"}, listed(alice, "/v1/blobs"))
+	require.Equal(t, []string{"alice.txt"}, listed(adminToken, "/v1/blobs"))
+
+	// only the owner hands out access
+	acl := []byte(`{"grants":[{"user":"Bob","permission":"read"},{"group":"team","permission":"write"}]}`)
+	rec = serve(router, "PUT", "/v1/blobs/alice.txt/acl", acl, bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(router, "PUT", "/v1/blobs/alice.txt/acl", []byte(`{"grants":[{"user":"nobody","permission":"read"}]}`), bearer(alice))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(router, "PUT", "/v1/blobs/alice.txt/acl", []byte(`{"grants":[{"user":"bob","permission":"admin"}]}`), bearer(alice))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(router, "PUT", "/v1/blobs/alice.txt/acl", acl, bearer(alice))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.JSONEq(t, `{"owner_id":"`+aliceID+`","grants":[
+		{"group":"team","permission":"write"},{"user":"bob","permission":"read"}]}`, rec.Body.String())
+
+	rec = serve(router, "GET", "/v1/blobs/alice.txt", nil, bearer(bob))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"alice.txt"}, listed(bob, "/v1/blobs"))
+	rec = serve(router, "PUT", "/v1/blobs/alice.txt", []byte("bob's"), bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// write through the group, the blob stays alice's
+	rec = serve(router, "PUT", "/v1/admin/users/"+bobID+"/groups", []byte(`{"groups":["team"]}`), bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.JSONEq(t, `{"groups":["team"]}`, rec.Body.String())
+	rec = serve(router, "PUT", "/v1/blobs/alice.txt", []byte("bob's"), bearer(bob))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = serve(router, "GET", "/v1/blobs/alice.txt/acl", nil, bearer(alice))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"owner_id":"`+aliceID+`"`)
+	rec = serve(router, "GET", "/v1/blobs/alice.txt/acl", nil, bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// a trashed blob shows to those who could read it, restoring takes delete
+	rec = serve(router, "DELETE", "/v1/blobs/alice.txt", nil, bearer(alice))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"alice.txt"}, listed(bob, "/v1/trash"))
+	rec = serve(router, "POST", "/v1/trash/alice.txt/restore", nil, bearer(bob))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(router, "POST", "/v1/trash/alice.txt/restore", nil, bearer(alice))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// uploading over a trashed blob still needs write access
+	rec = serve(router, "PUT", "/v1/blobs/bob.txt", []byte("bob's"), bearer(bob))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	rec = serve(router, "DELETE", "/v1/blobs/bob.txt", nil, bearer(bob))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "PUT", "/v1/blobs/bob.txt", []byte("alice's"), bearer(alice))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Empty(t, listed(alice, "/v1/trash"))
+	require.Equal(t, []string{"alice.txt"}, listed(alice, "/v1/blobs"))
+}
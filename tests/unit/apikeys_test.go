@@ -0,0 +1,177 @@
+package unit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataStore_APIKeys(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			user, err := auth.NewUser("ci", "long enough", auth.RoleWriter, now)
+			require.NoError(t, err)
+			require.NoError(t, store.CreateUser(user))
+
+			key, first, err := auth.NewAPIKey(user.ID, "deploy", []string{auth.ScopeBlobsRead}, time.Time{}, now)
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(key, first.Prefix))
+			require.NoError(t, store.CreateAPIKey(first))
+			_, second, err := auth.NewAPIKey(user.ID, "backup", []string{auth.ScopeBlobsRead, auth.ScopeBlobsWrite}, now.Add(time.Hour), now.Add(time.Second))
+			require.NoError(t, err)
+			require.NoError(t, store.CreateAPIKey(second))
+
+			got, err := store.GetAPIKeyByHash(auth.HashToken(key))
+			require.NoError(t, err)
+			require.Equal(t, *first, *got)
+			_, err = store.GetAPIKeyByHash(auth.HashToken("rkz_other"))
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			require.NoError(t, store.TouchAPIKey(first.ID, now.Add(time.Minute)))
+			require.ErrorIs(t, store.TouchAPIKey("missing", now), sql.ErrNoRows)
+			require.NoError(t, store.RevokeAPIKey(second.ID, now.Add(time.Minute)))
+			require.ErrorIs(t, store.RevokeAPIKey(second.ID, now.Add(time.Minute)), sql.ErrNoRows)
+			require.ErrorIs(t, store.RevokeAPIKey("missing", now), sql.ErrNoRows)
+
+			keys, err := store.ListAPIKeys(user.ID)
+			require.NoError(t, err)
+			require.Len(t, keys, 2)
+			require.Equal(t, "deploy", keys[0].Name)
+			require.Equal(t, now.Add(time.Minute), keys[0].LastUsedAt)
+			require.True(t, keys[0].RevokedAt.IsZero())
+			require.Equal(t, "backup", keys[1].Name)
+			require.Equal(t, "blobs:read blobs:write", keys[1].Scope)
+			require.Equal(t, now.Add(time.Hour), keys[1].ExpiresAt)
+			require.Equal(t, now.Add(time.Minute), keys[1].RevokedAt)
+
+			keys, err = store.ListAPIKeys("someone else")
+			require.NoError(t, err)
+			require.Empty(t, keys)
+		})
+	}
+}
+
+func TestAuth_APIKeys(t *testing.T) {
+	router, store := newAuthRouter(t)
+	adminToken, _ := loginAs(t, router, "admin", "admin password")
+	rec := serve(router, "POST", "/v1/admin/users", []byte(`{"username":"ci","password":"long enough"}`), bearer(adminToken))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	ciToken, _ := loginAs(t, router, "ci", "long enough")
+
+	type keyResp struct {
+		ID string `json:"id"`
+		Key string `json:"key"`
+		Prefix string `json:"prefix"`
+		Scopes []string `json:"scopes"`
+		ExpiresAt string `json:"expires_at"`
+		LastUsedAt string `json:"last_used_at"`
+		RevokedAt string `json:"revoked_at"`
+	}
+	create := func(token, body string) (keyResp, int) {
+		rec := serve(router, "POST", "/v1/keys", []byte(body), bearer(token))
+		var k keyResp
+		json.Unmarshal(rec.Body.Bytes(), &k)
+		return k, rec.Code
+	}
+	list := func(token, query string) []keyResp {
+		rec := serve(router, "GET", "/v1/keys"+query, nil, bearer(token))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp struct {
+			Items []keyResp `json:"items"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Items
+	}
+
+	// a writer can't hand out admin scopes, nor unknown ones
+	_, code := create(ciToken, `{"name":"deploy","scopes":["admin:users"]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	_, code = create(ciToken, `{"name":"deploy","scopes":["blobs:everything"]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	_, code = create(ciToken, `{"name":"","scopes":["blobs:read"]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	_, code = create(ciToken, `{"name":"deploy","ttl":"0d"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	readOnly, code := create(ciToken, `{"name":"deploy","scopes":["blobs:read"],"ttl":"90d"}`)
+	require.Equal(t, http.StatusCreated, code)
+	require.True(t, strings.HasPrefix(readOnly.Key, auth.APIKeyPrefix))
+	require.True(t, strings.HasPrefix(readOnly.Key, readOnly.Prefix))
+	require.Equal(t, []string{"blobs:read"}, readOnly.Scopes)
+	require.NotEmpty(t, readOnly.ExpiresAt)
+	full, code := create(ciToken, `{"name":"backup"}`)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, []string{"blobs:read", "blobs:write"}, full.Scopes)
+	require.Empty(t, full.ExpiresAt)
+
+	// the key works as a bearer token or as X-API-Key, within its scopes
+	rec = serve(router, "PUT", "/v1/blobs/build.txt", []byte("artifact"), bearer(full.Key))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = serve(router, "GET", "/v1/blobs/build.txt", nil, map[string]string{"X-API-Key": readOnly.Key})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = serve(router, "PUT", "/v1/blobs/build.txt", []byte("other"), map[string]string{"X-API-Key": readOnly.Key})
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(readOnly.Key))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"username":"ci"`)
+	rec = serve(router, "GET", "/v1/whoami", nil, map[string]string{"X-API-Key": "rkz_made_up"})
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// keys can't make keys, and the secret is never listed
+	_, code = create(full.Key, `{"name":"sneaky"}`)
+	require.Equal(t, http.StatusForbidden, code)
+	keys := list(ciToken, "")
+	require.Len(t, keys, 2)
+	require.Empty(t, keys[0].Key)
+	require.NotEmpty(t, keys[0].LastUsedAt)
+	require.Len(t, list(adminToken, ""), 0)
+	rec = serve(router, "GET", "/v1/keys?user_id=someone", nil, bearer(ciToken))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// revoked or with its user disabled, the key stops working
+	rec = serve(router, "DELETE", "/v1/keys/"+readOnly.ID, nil, bearer(full.Key))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Contains(t, rec.Body.String(), `"revoked_at"`)
+	rec = serve(router, "DELETE", "/v1/keys/"+readOnly.ID, nil, bearer(ciToken))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(readOnly.Key))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	ci, err := store.GetUserByName("ci")
+	require.NoError(t, err)
+	require.Len(t, list(adminToken, "?user_id="+ci.ID), 2)
+
+	rec = serve(router, "POST", "/v1/admin/users/"+ci.ID+"/disable", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(full.Key))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// an admin revokes anyone's key
+	rec = serve(router, "DELETE", "/v1/keys/"+full.ID, nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAuth_APIKeyExpiry(t *testing.T) {
+	router, store := newAuthRouter(t)
+	admin, err := store.GetUserByName("admin")
+	require.NoError(t, err)
+	key, expired, err := auth.NewAPIKey(admin.ID, "old", []string{auth.ScopeBlobsRead}, time.Now().Add(-time.Minute), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAPIKey(expired))
+	rec := serve(router, "GET", "/v1/whoami", nil, bearer(key))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// an API key can't log out, it is revoked instead
+	key, live, err := auth.NewAPIKey(admin.ID, "live", []string{auth.ScopeBlobsRead}, time.Time{}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAPIKey(live))
+	rec = serve(router, "POST", "/v1/auth/logout", nil, bearer(key))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
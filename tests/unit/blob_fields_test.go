@@ -0,0 +1,47 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rekazdrive/internal/handlers"
+	"rekazdrive/internal/storage"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// every case is rejected before the metadata DB is touched, so none is needed
+func TestPostBlob_RejectsInvalidFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := handlers.NewBlobHandler(storage.NewLocalBackend(t.TempDir()), nil)
+	router := gin.New()
+	router.POST("/blobs", h.PostBlob)
+
+	cases := map[string]map[string]any{
+		"content type":   {"content_type": "not a type"},
+		"filename path":  {"filename": "../etc/passwd"},
+		"sha256 length":  {"sha256": "abc"},
+		"md5 not hex":    {"md5": strings.Repeat("z", 32)},
+		"metadata key":   {"metadata": map[string]string{"bad key": "v"}},
+		"metadata value": {"metadata": map[string]string{"k": strings.Repeat("v", 2000)}},
+		"empty tag":      {"tags": []string{""}},
+		"sha256 wrong":   {"sha256": strings.Repeat("0", 64)},
+	}
+	for name, fields := range cases {
+		t.Run(name, func(t *testing.T) {
+			body := map[string]any{"id": "a", "data": "aGVsbG8="}
+			for k, v := range fields {
+				body[k] = v
+			}
+			jsonBody, _ := json.Marshal(body)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("POST", "/blobs", bytes.NewReader(jsonBody)))
+			require.Equal(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/handlers"
+	"rekazdrive/internal/middleware"
+	"rekazdrive/internal/storage"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// the blob routes end to end on local storage and the in-memory metadata store,
+// every request comes from an admin so access control never gets in the way
+func newBlobRouter(t *testing.T) (*gin.Engine, *handlers.BlobHandler) {
+	return newBlobRouterOn(storage.NewLocalBackend(t.TempDir()))
+}
+
+func newBlobRouterOn(backend storage.StorageBackend) (*gin.Engine, *handlers.BlobHandler) {
+	gin.SetMode(gin.TestMode)
+	h := handlers.NewBlobHandler(backend, db.NewMemoryStore())
+	router := gin.New()
+	router.UseRawPath = true
+	router.UnescapePathValues = true
+	router.Use(func(c *gin.Context) {
+		middleware.SetCaller(c, middleware.Caller{UserID: "admin", Username: "admin", Admin: true})
+	})
+	blobs := router.Group("/v1/blobs")
+	blobs.POST("", h.PostBlob)
+	blobs.GET("", h.ListBlobs)
+	blobs.GET("/:id", h.GetBlob)
+	blobs.HEAD("/:id", h.HeadBlob)
+	blobs.DELETE("/:id", h.DeleteBlob)
+	blobs.PATCH("/:id", h.PatchBlob)
+	blobs.PUT("/:id", h.PutBlobContent)
+	blobs.GET("/:id/content", h.GetBlobContent)
+	blobs.GET("/:id/versions", h.ListVersions)
+	blobs.GET("/:id/versions/:version", h.GetVersionContent)
+	blobs.POST("/:id/versions/:version/restore", h.RestoreVersion)
+	blobs.DELETE("/:id/versions/:version", h.DeleteVersion)
+	trash := router.Group("/v1/trash")
+	trash.GET("", h.ListTrash)
+	trash.POST("/:id/restore", h.RestoreFromTrash)
+	trash.DELETE("/:id", h.PurgeFromTrash)
+	return router, h
+}
+
+func serve(router *gin.Engine, method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBlobHandler_MemoryStore(t *testing.T) {
+	router, _ := newBlobRouter(t)
+
+	rec := serve(router, "PUT", "/v1/blobs/docs%2Fa.txt", []byte("hello world"), map[string]string{"Content-Type": "text/plain"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = serve(router, "GET", "/v1/blobs/docs%2Fa.txt/content", nil, map[string]string{"Range": "bytes=6-"})
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "world", rec.Body.String())
+	require.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+
+	rec = serve(router, "HEAD", "/v1/blobs/docs%2Fa.txt", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "11", rec.Header().Get("Content-Length"))
+
+	rec = serve(router, "PATCH", "/v1/blobs/docs%2Fa.txt", []byte(`{"tags":["draft"]}`), nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = serve(router, "GET", "/v1/blobs?prefix=docs/", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Items []struct {
+			ID string `json:"id"`
+			SHA256 string `json:"sha256"`
+			Tags []string `json:"tags"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Items, 1)
+	require.Equal(t, "docs/a.txt", list.Items[0].ID)
+	require.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", list.Items[0].SHA256)
+	require.Equal(t, []string{"draft"}, list.Items[0].Tags)
+
+	rec = serve(router, "DELETE", "/v1/blobs/docs%2Fa.txt", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "GET", "/v1/blobs/docs%2Fa.txt", nil, nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// countingBackend counts how often the content is opened
+type countingBackend struct {
+	*storage.LocalBackend
+	opens atomic.Int32
+}
+
+func (b *countingBackend) Get(ctx context.Context, id string) (io.ReadCloser, storage.Info, error) {
+	b.opens.Add(1)
+	return b.LocalBackend.Get(ctx, id)
+}
+
+func (b *countingBackend) GetRange(ctx context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	b.opens.Add(1)
+	return b.LocalBackend.GetRange(ctx, id, offset, length)
+}
+
+func TestBlobHandler_OpensContentOnce(t *testing.T) {
+	backend := &countingBackend{LocalBackend: storage.NewLocalBackend(t.TempDir())}
+	router, _ := newBlobRouterOn(backend)
+
+	rec := serve(router, "PUT", "/v1/blobs/a.txt", []byte("hello world"), map[string]string{"Content-Type": "text/plain"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	backend.opens.Store(0)
+	rec = serve(router, "GET", "/v1/blobs/a.txt/content", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "hello world", rec.Body.String())
+	require.Equal(t, int32(1), backend.opens.Load())
+
+	backend.opens.Store(0)
+	rec = serve(router, "GET", "/v1/blobs/a.txt/content", nil, map[string]string{"Range": "bytes=6-"})
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "world", rec.Body.String())
+	require.Equal(t, int32(1), backend.opens.Load())
+}
@@ -0,0 +1,228 @@
+package unit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"io"
+	"rekazdrive/internal/storage"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// memCodecIndex is a map based stand-in for the blob_codecs table
+type memCodecIndex struct {
+	mu sync.Mutex
+	rows map[string]storage.StoredCodec
+}
+
+func newMemCodecIndex() *memCodecIndex {
+	return &memCodecIndex{rows: map[string]storage.StoredCodec{}}
+}
+
+func (m *memCodecIndex) PutCodec(ctx context.Context, c storage.StoredCodec) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.rows[c.ID].Object
+	m.rows[c.ID] = c
+	return prev, nil
+}
+
+func (m *memCodecIndex) GetCodec(ctx context.Context, id string) (storage.StoredCodec, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.rows[id]
+	if !ok {
+		return c, storage.ErrNotFound
+	}
+	return c, nil
+}
+
+func (m *memCodecIndex) DeleteCodec(ctx context.Context, id string) (storage.StoredCodec, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.rows[id]
+	if !ok {
+		return c, storage.ErrNotFound
+	}
+	delete(m.rows, id)
+	return c, nil
+}
+
+func (m *memCodecIndex) ListCodecs(ctx context.Context, prefix, cursor string, limit int) ([]storage.StoredCodec, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []storage.StoredCodec
+	for id, c := range m.rows {
+		if strings.HasPrefix(id, prefix) && id > cursor {
+			entries = append(entries, c)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	if len(entries) > limit {
+		entries = entries[:limit]
+		return entries, entries[limit-1].ID, nil
+	}
+	return entries, "", nil
+}
+
+func newCompressed(t *testing.T, codec string) (*storage.CompressedBackend, *storage.LocalBackend) {
+	base := storage.NewLocalBackend(t.TempDir())
+	backend, err := storage.NewCompressedBackend(base, newMemCodecIndex(), storage.CompressionPolicy{Codec: codec, MinSize: 64})
+	require.NoError(t, err)
+	return backend, base
+}
+
+// storedBytes reads what the backend keeps for id, without decoding it
+func storedBytes(t *testing.T, backend *storage.CompressedBackend, id string) []byte {
+	rc, err := backend.GetEncodedRange(context.Background(), id, 0, -1)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return data
+}
+
+func TestCompressedBackend_RoundTrip(t *testing.T) {
+	logs := []byte(strings.Repeat(`{"level":"info","msg":"request served","status":200}`+"\n", 2000))
+
+	for _, codec := range []string{storage.CodecGzip, storage.CodecZstd} {
+		t.Run(codec, func(t *testing.T) {
+			backend, base := newCompressed(t, codec)
+			ctx := storage.WithContentType(context.Background(), "application/x-ndjson")
+			require.NoError(t, backend.Put(ctx, "logs/app.ndjson", bytes.NewReader(logs), int64(len(logs))))
+
+			stored := storedBytes(t, backend, "logs/app.ndjson")
+			require.Less(t, len(stored)*5, len(logs))
+			_, err := base.Load("logs/app.ndjson")
+			require.ErrorIs(t, err, storage.ErrNotFound) // under a fresh name, not the id
+
+			rc, info, err := backend.Get(context.Background(), "logs/app.ndjson")
+			require.NoError(t, err)
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			require.NoError(t, err)
+			require.Equal(t, logs, data)
+			require.Equal(t, int64(len(logs)), info.Size)
+
+			rc, err = backend.GetRange(context.Background(), "logs/app.ndjson", 1000, 50)
+			require.NoError(t, err)
+			part, err := io.ReadAll(rc)
+			rc.Close()
+			require.NoError(t, err)
+			require.Equal(t, logs[1000:1050], part)
+
+			codecName, size, err := backend.Encoding(context.Background(), "logs/app.ndjson")
+			require.NoError(t, err)
+			require.Equal(t, codec, codecName)
+			require.Equal(t, int64(len(stored)), size)
+		})
+	}
+}
+
+func TestCompressedBackend_EncodedFormIsStandard(t *testing.T) {
+	text := []byte(strings.Repeat("plain old text, compresses well. ", 500))
+
+	for _, codec := range []string{storage.CodecGzip, storage.CodecZstd} {
+		t.Run(codec, func(t *testing.T) {
+			backend, _ := newCompressed(t, codec)
+			require.NoError(t, backend.Save("notes.txt", text)) // sniffed as text/plain
+
+			rc, err := backend.GetEncodedRange(context.Background(), "notes.txt", 0, -1)
+			require.NoError(t, err)
+			defer rc.Close()
+
+			// what a client gets with Accept-Encoding must decode with any standard decoder
+			var dec io.Reader
+			if codec == storage.CodecGzip {
+				dec, err = gzip.NewReader(rc)
+			} else {
+				var zr *zstd.Decoder
+				zr, err = zstd.NewReader(rc)
+				defer zr.Close()
+				dec = zr
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(dec)
+			require.NoError(t, err)
+			require.Equal(t, text, data)
+		})
+	}
+}
+
+func TestCompressedBackend_SkipsSmallAndBinary(t *testing.T) {
+	backend, _ := newCompressed(t, storage.CodecZstd)
+
+	require.NoError(t, backend.Save("small.txt", []byte("tiny")))
+	binary := make([]byte, 4096)
+	_, err := rand.Read(binary)
+	require.NoError(t, err)
+	require.NoError(t, backend.Save("random.bin", binary))
+
+	for id, want := range map[string][]byte{"small.txt": []byte("tiny"), "random.bin": binary} {
+		codec, _, err := backend.Encoding(context.Background(), id)
+		require.NoError(t, err)
+		require.Empty(t, codec, id)
+
+		require.Equal(t, want, storedBytes(t, backend, id))
+	}
+}
+
+func TestCompressedBackend_SizeMismatch(t *testing.T) {
+	backend, base := newCompressed(t, storage.CodecGzip)
+	text := strings.Repeat("abc ", 100)
+
+	err := backend.Put(context.Background(), "short.txt", strings.NewReader(text), int64(len(text))+10)
+	require.Error(t, err)
+
+	_, err = base.Load("short.txt")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+// an overwrite only replaces the old data once the index points at the new
+// one, a failed one leaves the old blob as it was
+func TestCompressedBackend_Overwrite(t *testing.T) {
+	backend, base := newCompressed(t, storage.CodecGzip)
+	ctx := context.Background()
+	text := strings.Repeat("first version of the text. ", 100)
+	require.NoError(t, backend.Save("doc.txt", []byte(text)))
+
+	// a legacy copy stored under the id goes away with the first write
+	require.NoError(t, base.Save("old.txt", []byte("plain")))
+	require.NoError(t, backend.Save("old.txt", []byte(text)))
+	_, err := base.Load("old.txt")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = backend.Put(ctx, "doc.txt", strings.NewReader("short"), 100)
+	require.Error(t, err)
+	data, err := backend.Load("doc.txt")
+	require.NoError(t, err)
+	require.Equal(t, text, string(data))
+
+	require.NoError(t, backend.Save("doc.txt", []byte("tiny")))
+	data, err = backend.Load("doc.txt")
+	require.NoError(t, err)
+	require.Equal(t, "tiny", string(data))
+
+	// only the current objects are left in the wrapped backend
+	page, _, err := base.List(ctx, "", "", 100)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	page, _, err = backend.List(ctx, "", "", 100)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.Equal(t, "doc.txt", page[0].ID)
+	require.Equal(t, int64(4), page[0].Size)
+
+	require.NoError(t, backend.Delete("doc.txt"))
+	require.NoError(t, backend.Delete("old.txt"))
+	page, _, err = base.List(ctx, "", "", 100)
+	require.NoError(t, err)
+	require.Empty(t, page)
+}
@@ -0,0 +1,174 @@
+package unit
+
+import (
+	"context"
+	"rekazdrive/internal/storage"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memRefIndex is a map based stand-in for the blobs_metadata digest columns
+type memRefIndex struct {
+	mu sync.Mutex
+	digests map[string]string
+	refs map[string]int
+}
+
+func newMemRefIndex() *memRefIndex {
+	return &memRefIndex{digests: map[string]string{}, refs: map[string]int{}}
+}
+
+func (m *memRefIndex) Ref(ctx context.Context, id, digest string, size int64, upload func() error, release func(string) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, had := m.digests[id]
+	if had && old == digest {
+		return nil
+	}
+	if m.refs[digest] == 0 {
+		if err := upload(); err != nil {
+			return err
+		}
+	}
+	m.refs[digest]++
+	m.digests[id] = digest
+	if had {
+		return m.unref(old, release)
+	}
+	return nil
+}
+
+func (m *memRefIndex) Unref(ctx context.Context, id string, release func(string) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	digest, ok := m.digests[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	delete(m.digests, id)
+	return m.unref(digest, release)
+}
+
+func (m *memRefIndex) unref(digest string, release func(string) error) error {
+	m.refs[digest]--
+	if m.refs[digest] > 0 {
+		return nil
+	}
+	delete(m.refs, digest)
+	return release(digest)
+}
+
+func (m *memRefIndex) Digest(ctx context.Context, id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	digest, ok := m.digests[id]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return digest, nil
+}
+
+func (m *memRefIndex) ListRefs(ctx context.Context, prefix, cursor string, limit int) ([]storage.Info, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var page []storage.Info
+	for id := range m.digests {
+		if strings.HasPrefix(id, prefix) && id > cursor {
+			page = append(page, storage.Info{ID: id})
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].ID < page[j].ID })
+	return page, "", nil
+}
+
+func casObjects(t *testing.T, base storage.StorageBackend) int {
+	page, _, err := base.List(context.Background(), ".cas/", "", 100)
+	require.NoError(t, err)
+	return len(page)
+}
+
+func TestDedupBackend_StoresContentOnce(t *testing.T) {
+	base := storage.NewLocalBackend(t.TempDir())
+	backend := storage.NewDedupBackend(base, newMemRefIndex())
+
+	require.NoError(t, backend.Save("builds/a.tar", []byte("same bytes")))
+	require.NoError(t, backend.Save("builds/b.tar", []byte("same bytes")))
+	require.NoError(t, backend.Save("builds/c.tar", []byte("other bytes")))
+	require.Equal(t, 2, casObjects(t, base))
+
+	data, err := backend.Load("builds/b.tar")
+	require.NoError(t, err)
+	require.Equal(t, "same bytes", string(data))
+
+	rc, err := backend.GetRange(context.Background(), "builds/a.tar", 5, 5)
+	require.NoError(t, err)
+	defer rc.Close()
+	part := make([]byte, 5)
+	_, err = rc.Read(part)
+	require.NoError(t, err)
+	require.Equal(t, "bytes", string(part))
+
+	page, _, err := backend.List(context.Background(), "builds/", "", 10)
+	require.NoError(t, err)
+	require.Len(t, page, 3)
+}
+
+func TestDedupBackend_DeleteKeepsSharedContent(t *testing.T) {
+	base := storage.NewLocalBackend(t.TempDir())
+	backend := storage.NewDedupBackend(base, newMemRefIndex())
+
+	require.NoError(t, backend.Save("a", []byte("shared")))
+	require.NoError(t, backend.Save("b", []byte("shared")))
+
+	require.NoError(t, backend.Delete("a"))
+	require.Equal(t, 1, casObjects(t, base))
+	data, err := backend.Load("b")
+	require.NoError(t, err)
+	require.Equal(t, "shared", string(data))
+
+	// last reference gone, so is the object
+	require.NoError(t, backend.Delete("b"))
+	require.Equal(t, 0, casObjects(t, base))
+
+	_, err = backend.Load("b")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestDedupBackend_OverwriteReleasesOldContent(t *testing.T) {
+	base := storage.NewLocalBackend(t.TempDir())
+	backend := storage.NewDedupBackend(base, newMemRefIndex())
+
+	require.NoError(t, backend.Save("a", []byte("v1")))
+	require.NoError(t, backend.Save("a", []byte("v2")))
+	require.Equal(t, 1, casObjects(t, base))
+
+	data, err := backend.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(data))
+}
+
+func TestDedupBackend_ReadsPreDedupBlobs(t *testing.T) {
+	base := storage.NewLocalBackend(t.TempDir())
+	require.NoError(t, base.Save("old", []byte("written before dedup")))
+
+	backend := storage.NewDedupBackend(base, newMemRefIndex())
+	data, err := backend.Load("old")
+	require.NoError(t, err)
+	require.Equal(t, "written before dedup", string(data))
+
+	// rewriting it moves it under its digest and drops the plain copy
+	require.NoError(t, backend.Save("old", []byte("written before dedup")))
+	_, err = base.Load("old")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	require.NoError(t, backend.Delete("old"))
+	require.Equal(t, 0, casObjects(t, base))
+}
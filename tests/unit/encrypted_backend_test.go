@@ -0,0 +1,244 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"rekazdrive/internal/storage"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memKeyStore is a map based stand-in for the blob_keys table
+type memKeyStore struct {
+	mu sync.Mutex
+	keys map[string]storage.ObjectKey
+}
+
+func newMemKeyStore() *memKeyStore {
+	return &memKeyStore{keys: map[string]storage.ObjectKey{}}
+}
+
+func (m *memKeyStore) PutKey(ctx context.Context, k storage.ObjectKey) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.keys[k.ID].Object
+	m.keys[k.ID] = k
+	return prev, nil
+}
+
+func (m *memKeyStore) GetKey(ctx context.Context, id string) (storage.ObjectKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[id]
+	if !ok {
+		return k, storage.ErrNotFound
+	}
+	return k, nil
+}
+
+func (m *memKeyStore) DeleteKey(ctx context.Context, id string) (storage.ObjectKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[id]
+	if !ok {
+		return k, storage.ErrNotFound
+	}
+	delete(m.keys, id)
+	return k, nil
+}
+
+func (m *memKeyStore) sorted(keep func(storage.ObjectKey) bool) []storage.ObjectKey {
+	var keys []storage.ObjectKey
+	for _, k := range m.keys {
+		if keep(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+func (m *memKeyStore) ListKeys(ctx context.Context, prefix, cursor string, limit int) ([]storage.ObjectKey, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sorted(func(k storage.ObjectKey) bool { return strings.HasPrefix(k.ID, prefix) && k.ID > cursor }), "", nil
+}
+
+func (m *memKeyStore) StaleKeys(ctx context.Context, masterKeyID, cursor string, limit int) ([]storage.ObjectKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.sorted(func(k storage.ObjectKey) bool { return k.MasterKeyID != masterKeyID && k.ID > cursor })
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (m *memKeyStore) RewrapKey(ctx context.Context, k storage.ObjectKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.keys[k.ID]; ok && cur.Object == k.Object {
+		m.keys[k.ID] = k
+	}
+	return nil
+}
+
+func masterKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+// every regular file under dir, which for a flat LocalBackend is every object
+func storedFiles(t *testing.T, dir string) [][]byte {
+	var files [][]byte
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		require.NoError(t, err)
+		files = append(files, data)
+	}
+	return files
+}
+
+func TestEncryptedBackend_RoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend, err := storage.NewEncryptedBackend(storage.NewLocalBackend(tmpDir), newMemKeyStore(),
+		map[string][]byte{"k1": masterKey(t)}, "k1")
+	require.NoError(t, err)
+
+	// several segments with a partial one at the end
+	data := bytes.Repeat([]byte("secret payload "), 20000)
+	require.NoError(t, backend.Save("docs/report.txt", data))
+
+	loaded, err := backend.Load("docs/report.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, loaded)
+
+	// only ciphertext reaches the disk
+	files := storedFiles(t, tmpDir)
+	require.Len(t, files, 1)
+	require.False(t, bytes.Contains(files[0], []byte("secret payload")))
+
+	for _, r := range [][2]int64{{0, 10}, {65530, 20}, {70000, -1}, {131072, 65536}, {int64(len(data)) - 1, 1}} {
+		rc, err := backend.GetRange(context.Background(), "docs/report.txt", r[0], r[1])
+		require.NoError(t, err)
+		part, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+
+		end := int64(len(data))
+		if r[1] >= 0 {
+			end = r[0] + r[1]
+		}
+		require.Equal(t, data[r[0]:end], part, "range %v", r)
+	}
+
+	require.NoError(t, backend.Save("empty", nil))
+	loaded, err = backend.Load("empty")
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+
+	page, _, err := backend.List(context.Background(), "docs/", "", 10)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, int64(len(data)), page[0].Size)
+}
+
+func TestEncryptedBackend_DetectsTampering(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend, err := storage.NewEncryptedBackend(storage.NewLocalBackend(tmpDir), newMemKeyStore(),
+		map[string][]byte{"k1": masterKey(t)}, "k1")
+	require.NoError(t, err)
+	require.NoError(t, backend.Save("a", []byte("do not touch")))
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	p := filepath.Join(tmpDir, entries[0].Name())
+	stored, err := os.ReadFile(p)
+	require.NoError(t, err)
+	stored[0] ^= 1
+	require.NoError(t, os.WriteFile(p, stored, 0644))
+
+	_, err = backend.Load("a")
+	require.Error(t, err)
+}
+
+func TestEncryptedBackend_OverwriteAndDelete(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend, err := storage.NewEncryptedBackend(storage.NewLocalBackend(tmpDir), newMemKeyStore(),
+		map[string][]byte{"k1": masterKey(t)}, "k1")
+	require.NoError(t, err)
+
+	require.NoError(t, backend.Save("a", []byte("v1")))
+	require.NoError(t, backend.Save("a", []byte("v2")))
+	require.Len(t, storedFiles(t, tmpDir), 1)
+
+	data, err := backend.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(data))
+
+	require.NoError(t, backend.Delete("a"))
+	require.Empty(t, storedFiles(t, tmpDir))
+}
+
+func TestEncryptedBackend_RotateMasterKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	keys := newMemKeyStore()
+	oldKey, newKey := masterKey(t), masterKey(t)
+
+	before, err := storage.NewEncryptedBackend(storage.NewLocalBackend(tmpDir), keys, map[string][]byte{"k1": oldKey}, "k1")
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, before.Save(id, []byte("data "+id)))
+	}
+
+	after, err := storage.NewEncryptedBackend(storage.NewLocalBackend(tmpDir), keys,
+		map[string][]byte{"k2": newKey, "k1": oldKey}, "k2")
+	require.NoError(t, err)
+
+	// readable with the old key until the re-wrap ran
+	data, err := after.Load("b")
+	require.NoError(t, err)
+	require.Equal(t, "data b", string(data))
+
+	n, err := after.Rewrap(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	// the old master key is no longer needed
+	onlyNew, err := storage.NewEncryptedBackend(storage.NewLocalBackend(tmpDir), keys, map[string][]byte{"k2": newKey}, "k2")
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b", "c"} {
+		data, err := onlyNew.Load(id)
+		require.NoError(t, err)
+		require.Equal(t, "data "+id, string(data))
+	}
+
+	n, err = onlyNew.Rewrap(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	masters, current, err := storage.ParseMasterKeys("new:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=, old:AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=")
+	require.NoError(t, err)
+	require.Equal(t, "new", current)
+	require.Len(t, masters, 2)
+	require.Len(t, masters["old"], 32)
+
+	_, _, err = storage.ParseMasterKeys("nocolon")
+	require.Error(t, err)
+	_, _, err = storage.ParseMasterKeys("")
+	require.Error(t, err)
+}
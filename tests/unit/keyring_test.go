@@ -0,0 +1,261 @@
+package unit
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataStore_SigningKeys(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			older := db.SigningKey{KID: "a", Algorithm: auth.AlgES256, PrivateKey: []byte{1, 2}, MasterKeyID: "m1", CreatedAt: now,
+				RetiresAt: now.Add(time.Hour), ExpiresAt: now.Add(2 * time.Hour)}
+			newer := db.SigningKey{KID: "b", Algorithm: auth.AlgEdDSA, PrivateKey: []byte{3}, CreatedAt: now.Add(time.Hour),
+				RetiresAt: now.Add(2 * time.Hour), ExpiresAt: now.Add(3 * time.Hour)}
+			require.NoError(t, store.CreateSigningKey(&older))
+			require.NoError(t, store.CreateSigningKey(&newer))
+
+			keys, err := store.ListSigningKeys(now)
+			require.NoError(t, err)
+			require.Equal(t, []db.SigningKey{newer, older}, keys)
+			keys, err = store.ListSigningKeys(now.Add(2 * time.Hour))
+			require.NoError(t, err)
+			require.Equal(t, []db.SigningKey{newer}, keys)
+
+			n, err := store.DeleteExpiredSigningKeys(now.Add(2 * time.Hour))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			keys, err = store.ListSigningKeys(now)
+			require.NoError(t, err)
+			require.Equal(t, []db.SigningKey{newer}, keys)
+
+			require.NoError(t, store.ResealSigningKey("b", "m2", []byte{4}))
+			keys, err = store.ListSigningKeys(now)
+			require.NoError(t, err)
+			require.Equal(t, "m2", keys[0].MasterKeyID)
+			require.Equal(t, []byte{4}, keys[0].PrivateKey)
+			require.ErrorIs(t, store.ResealSigningKey("a", "m2", []byte{4}), sql.ErrNoRows)
+		})
+	}
+}
+
+var testMasters = map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}
+
+func testClaims(now time.Time) *auth.Claims {
+	return &auth.Claims{
+		Username: "omar",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "omar",
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	for _, alg := range []string{auth.AlgRS256, auth.AlgES256, auth.AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			store := db.NewMemoryStore()
+			keyring, err := auth.NewKeyring(alg, store, testMasters, "k1", time.Hour, 10*time.Minute)
+			require.NoError(t, err)
+			verify := func(k *auth.Keyring, token string) error {
+				_, err := jwt.ParseWithClaims(token, &auth.Claims{}, k.Keyfunc)
+				return err
+			}
+			kid := func(token string) string {
+				parsed, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+				require.NoError(t, err)
+				return parsed.Header["kid"].(string)
+			}
+
+			// the first key is made on the first use
+			now := time.Now()
+			first, err := keyring.Sign(testClaims(now), now)
+			require.NoError(t, err)
+			require.NoError(t, verify(keyring, first))
+			jwks, err := keyring.JWKS()
+			require.NoError(t, err)
+			require.Len(t, jwks.Keys, 1)
+			require.Equal(t, kid(first), jwks.Keys[0].Kid)
+			require.Equal(t, alg, jwks.Keys[0].Alg)
+
+			// the published key verifies the token on its own
+			pub, err := jwks.Keys[0].PublicKey()
+			require.NoError(t, err)
+			_, err = jwt.ParseWithClaims(first, &auth.Claims{}, func(*jwt.Token) (interface{}, error) { return pub, nil })
+			require.NoError(t, err)
+
+			require.NoError(t, keyring.Rotate(now.Add(30*time.Minute)))
+			same, err := keyring.Sign(testClaims(now), now.Add(30*time.Minute))
+			require.NoError(t, err)
+			require.Equal(t, kid(first), kid(same))
+
+			// once it retired a new key signs, the old one still verifies
+			require.NoError(t, keyring.Rotate(now.Add(61*time.Minute)))
+			second, err := keyring.Sign(testClaims(now), now.Add(61*time.Minute))
+			require.NoError(t, err)
+			require.NotEqual(t, kid(first), kid(second))
+			require.NoError(t, verify(keyring, first))
+			require.NoError(t, verify(keyring, second))
+			jwks, err = keyring.JWKS()
+			require.NoError(t, err)
+			require.Len(t, jwks.Keys, 2)
+
+			// another replica on the same store verifies both
+			replica, err := auth.NewKeyring(alg, store, testMasters, "k1", time.Hour, 10*time.Minute)
+			require.NoError(t, err)
+			require.NoError(t, replica.Load(now.Add(61*time.Minute)))
+			require.NoError(t, verify(replica, first))
+			require.NoError(t, verify(replica, second))
+
+			// after the overlap the old key is gone
+			require.NoError(t, keyring.Load(now.Add(71*time.Minute)))
+			require.Error(t, verify(keyring, first))
+			require.NoError(t, verify(keyring, second))
+		})
+	}
+}
+
+func TestKeyring_RejectsForgedTokens(t *testing.T) {
+	store := db.NewMemoryStore()
+	keyring, err := auth.NewKeyring(auth.AlgES256, store, testMasters, "k1", time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	now := time.Now()
+	require.NoError(t, keyring.Rotate(now))
+	jwks, err := keyring.JWKS()
+	require.NoError(t, err)
+	parse := func(token string) error {
+		_, err := jwt.ParseWithClaims(token, &auth.Claims{}, keyring.Keyfunc)
+		return err
+	}
+
+	// HS256 with the public key as the secret, or with a kid nobody has
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(now))
+	forged.Header["kid"] = jwks.Keys[0].Kid
+	signed, err := forged.SignedString([]byte(jwks.Keys[0].X + jwks.Keys[0].Y))
+	require.NoError(t, err)
+	require.Error(t, parse(signed))
+
+	other, err := auth.NewKeyring(auth.AlgES256, db.NewMemoryStore(), testMasters, "k1", time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	signed, err = other.Sign(testClaims(now), now)
+	require.NoError(t, err)
+	require.Error(t, parse(signed))
+
+	_, err = auth.NewKeyring("none", store, testMasters, "k1", time.Hour, time.Minute)
+	require.Error(t, err)
+	_, err = auth.NewKeyring(auth.AlgHS256, store, testMasters, "k1", time.Hour, time.Minute)
+	require.Error(t, err)
+	_, err = auth.NewKeyring(auth.AlgES256, store, testMasters, "missing", time.Hour, time.Minute)
+	require.Error(t, err)
+	_, err = auth.NewKeyring(auth.AlgES256, store, map[string][]byte{"short": make([]byte, 16)}, "short", time.Hour, time.Minute)
+	require.Error(t, err)
+}
+
+// the store only ever sees sealed private keys, old ones are sealed again
+// with the current master key
+func TestKeyring_SealedAtRest(t *testing.T) {
+	store := db.NewMemoryStore()
+	now := time.Now()
+	notAKey := func() {
+		keys, err := store.ListSigningKeys(now)
+		require.NoError(t, err)
+		for _, k := range keys {
+			_, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+			require.Error(t, err)
+		}
+	}
+
+	keyring, err := auth.NewKeyring(auth.AlgES256, store, testMasters, "k1", time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	token, err := keyring.Sign(testClaims(now), now)
+	require.NoError(t, err)
+	keys, err := store.ListSigningKeys(now)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "k1", keys[0].MasterKeyID)
+	notAKey()
+
+	// without its master key the sealed key does not open and nothing else is left
+	other, err := auth.NewKeyring(auth.AlgES256, store, map[string][]byte{"k2": testMasters["k1"]}, "k2", time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	require.Error(t, other.Load(now))
+
+	// a key stored in plain before sealing still loads
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateSigningKey(&db.SigningKey{KID: "plain", Algorithm: auth.AlgES256, PrivateKey: der,
+		CreatedAt: now.Add(-time.Minute), RetiresAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	// next to a key that opens the sealed one is only skipped, its tokens stop verifying
+	require.NoError(t, other.Load(now))
+	_, err = jwt.ParseWithClaims(token, &auth.Claims{}, other.Keyfunc)
+	require.Error(t, err)
+
+	rotated, err := auth.NewKeyring(auth.AlgES256, store, map[string][]byte{"k2": bytes.Repeat([]byte{2}, 32), "k1": testMasters["k1"]}, "k2", time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, rotated.Rotate(now))
+	keys, err = store.ListSigningKeys(now)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	for _, k := range keys {
+		require.Equal(t, "k2", k.MasterKeyID)
+	}
+	notAKey()
+	_, err = jwt.ParseWithClaims(token, &auth.Claims{}, rotated.Keyfunc)
+	require.NoError(t, err)
+}
+
+func TestAuth_AsymmetricTokens(t *testing.T) {
+	store := db.NewMemoryStore()
+	keyring, err := auth.NewKeyring(auth.AlgEdDSA, store, testMasters, "k1", time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	router, _ := newAuthRouterWith(t, keyring, store, nil)
+
+	token, code := loginAs(t, router, "admin", "admin password")
+	require.Equal(t, http.StatusOK, code)
+	rec := serve(router, "GET", "/v1/whoami", nil, bearer(token))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	header, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+	require.NoError(t, err)
+	require.Equal(t, "EdDSA", header.Header["alg"])
+
+	rec = serve(router, "GET", "/.well-known/jwks.json", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var jwks auth.JWKS
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	require.Equal(t, header.Header["kid"], jwks.Keys[0].Kid)
+	require.Equal(t, "OKP", jwks.Keys[0].Kty)
+	require.NotContains(t, rec.Body.String(), `"d"`)
+
+	// an HS256 token with the old shared secret is refused
+	old := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(time.Now()))
+	signed, err := old.SignedString([]byte("test secret"))
+	require.NoError(t, err)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(signed))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAuth_HMACPublishesNoKeys(t *testing.T) {
+	router, _ := newAuthRouter(t)
+	rec := serve(router, "GET", "/.well-known/jwks.json", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"keys":[]}`, rec.Body.String())
+}
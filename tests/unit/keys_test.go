@@ -0,0 +1,95 @@
+package unit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"rekazdrive/internal/storage"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateID(t *testing.T) {
+	valid := []string{"a", "test-id", "builds/app-1.2/linux_amd64.tar.gz", "a.b/c_d", strings.Repeat("x", storage.MaxIDLength)}
+	for _, id := range valid {
+		require.NoError(t, storage.ValidateID(id), id)
+	}
+
+	invalid := []string{"", "/a", "a/", "a//b", "../x", "a/..", ".hidden", "a/.b", "a b", "a%2Fb", "a~b", "é", strings.Repeat("x", storage.MaxIDLength+1)}
+	for _, id := range invalid {
+		require.ErrorIs(t, storage.ValidateID(id), storage.ErrInvalidID, id)
+	}
+}
+
+func TestEncodeKey_RoundTrip(t *testing.T) {
+	ids := []string{"a", "a/b", "a_b", "a~b", "a%b", ".", "..", ".x/y", "with space", "ünïcode", "x:y"}
+	seen := map[string]string{}
+	for _, id := range ids {
+		key := storage.EncodeKey(id)
+		require.NotContains(t, key, "/")
+		require.False(t, strings.HasPrefix(key, "."), key)
+
+		other, dup := seen[key]
+		require.False(t, dup, "%q and %q share key %q", id, other, key)
+		seen[key] = id
+
+		decoded, err := storage.DecodeKey(key)
+		require.NoError(t, err)
+		require.Equal(t, id, decoded)
+	}
+
+	for _, key := range []string{"a/b", ".x", "%4", "%zz", "%41"} {
+		_, err := storage.DecodeKey(key)
+		require.Error(t, err, key)
+	}
+}
+
+func TestLocalBackend_NoCollisions(t *testing.T) {
+	backend := storage.NewLocalBackend(t.TempDir())
+
+	require.NoError(t, backend.Save("a/b", []byte("slash")))
+	require.NoError(t, backend.Save("a_b", []byte("underscore")))
+
+	data, err := backend.Load("a/b")
+	require.NoError(t, err)
+	require.Equal(t, "slash", string(data))
+
+	data, err = backend.Load("a_b")
+	require.NoError(t, err)
+	require.Equal(t, "underscore", string(data))
+
+	require.ErrorIs(t, backend.Save("", []byte("x")), storage.ErrInvalidID)
+}
+
+func TestMigrateLegacyKeys_Local(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend := storage.NewLocalBackend(tmpDir)
+
+	// what the old slash-flattening layout left on disk
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "dir_file"), []byte("nested"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "plain"), []byte("plain"), 0644))
+
+	ids := []string{"dir/file", "plain"}
+	copied, err := storage.MigrateLegacyKeys(context.Background(), backend, ids)
+	require.NoError(t, err)
+	require.Equal(t, 1, copied)
+
+	data, err := backend.Load("dir/file")
+	require.NoError(t, err)
+	require.Equal(t, "nested", string(data))
+
+	data, err = backend.Load("plain")
+	require.NoError(t, err)
+	require.Equal(t, "plain", string(data))
+
+	// the old name belonged to no current id and is gone
+	_, err = os.Stat(filepath.Join(tmpDir, "dir_file"))
+	require.True(t, os.IsNotExist(err))
+
+	// running again is a no-op
+	copied, err = storage.MigrateLegacyKeys(context.Background(), backend, ids)
+	require.NoError(t, err)
+	require.Equal(t, 0, copied)
+}
@@ -0,0 +1,142 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/lifecycle"
+	"rekazdrive/internal/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := lifecycle.ParseRules(" tmp/:7d, cache/a:b:12h ,")
+	require.NoError(t, err)
+	require.Equal(t, []lifecycle.Rule{
+		{Prefix: "tmp/", After: 7 * 24 * time.Hour},
+		{Prefix: "cache/a:b", After: 12 * time.Hour},
+	}, rules)
+
+	for _, bad := range []string{"tmp/", ":7d", "tmp/:soon", "tmp/:0d", "tmp/:-1h"} {
+		_, err := lifecycle.ParseRules(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+// saves a blob with data, updated at the given time
+func putLifecycleBlob(t *testing.T, store storage.StorageBackend, meta db.MetadataStore, id string, updated, expires time.Time) {
+	require.NoError(t, store.Put(context.Background(), id, bytes.NewReader([]byte(id)), int64(len(id))))
+	require.NoError(t, meta.SaveMetadata(&db.BlobMeta{ID: id, Size: int64(len(id)), UpdatedAt: updated, ExpiresAt: expires}))
+}
+
+func TestLifecycle_Sweep(t *testing.T) {
+	now := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	for name, meta := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store := storage.NewLocalBackend(t.TempDir())
+			putLifecycleBlob(t, store, meta, "a", now, now.Add(-time.Minute))
+			putLifecycleBlob(t, store, meta, "b", now, now)
+			putLifecycleBlob(t, store, meta, "c", now, now.Add(time.Minute))
+			putLifecycleBlob(t, store, meta, "d", now, time.Time{})
+			putLifecycleBlob(t, store, meta, "tmp/old", now.Add(-8*24*time.Hour), time.Time{})
+			putLifecycleBlob(t, store, meta, "tmp/new", now.Add(-6*24*time.Hour), time.Time{})
+			putLifecycleBlob(t, store, meta, "old", now.Add(-8*24*time.Hour), time.Time{})
+
+			worker := &lifecycle.Worker{
+				Store:     store,
+				Meta:      meta,
+				Rules:     []lifecycle.Rule{{Prefix: "tmp/", After: 7 * 24 * time.Hour}},
+				BatchSize: 1,
+			}
+			if coordinator, ok := meta.(lifecycle.Coordinator); ok {
+				worker.Coordinator, worker.Holder = coordinator, "test"
+			}
+			n, err := worker.Sweep(context.Background(), now)
+			require.NoError(t, err)
+			require.Equal(t, 3, n)
+
+			metas, err := meta.ListMetadata("", "", 10, nil, now)
+			require.NoError(t, err)
+			require.Equal(t, []string{"c", "d", "old", "tmp/new"}, metaIDs(metas))
+			for _, id := range []string{"a", "b", "tmp/old"} {
+				_, _, err := store.Get(context.Background(), id)
+				require.ErrorIs(t, err, storage.ErrNotFound, id)
+			}
+
+			n, err = worker.Sweep(context.Background(), now)
+			require.NoError(t, err)
+			require.Equal(t, 0, n)
+		})
+	}
+}
+
+func TestLifecycle_LeaseAndCheckpoint(t *testing.T) {
+	now := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	meta := newSQLiteStore(t)
+	store := storage.NewLocalBackend(t.TempDir())
+	for _, id := range []string{"a", "b", "c"} {
+		putLifecycleBlob(t, store, meta, id, now, now.Add(-time.Hour))
+	}
+	worker := &lifecycle.Worker{Store: store, Meta: meta, Coordinator: meta, Holder: "one"}
+
+	// another replica holds the lease, nothing happens until it runs out
+	ok, err := meta.AcquireLease("lifecycle", "two", time.Now(), time.Hour)
+	require.NoError(t, err)
+	require.True(t, ok)
+	n, err := worker.Sweep(context.Background(), now)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.NoError(t, meta.ReleaseLease("lifecycle", "two"))
+
+	// an interrupted sweep goes on after the last id it got to
+	require.NoError(t, meta.SaveCheckpoint("expired", "a"))
+	n, err = worker.Sweep(context.Background(), now)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	_, err = meta.GetMetadata("a")
+	require.NoError(t, err)
+
+	// the scan finished, the next one starts from the top again
+	cursor, err := meta.Checkpoint("expired")
+	require.NoError(t, err)
+	require.Empty(t, cursor)
+	n, err = worker.Sweep(context.Background(), now)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	_, err = meta.GetMetadata("a")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestBlobHandler_Expiry(t *testing.T) {
+	router, _ := newBlobRouter(t)
+
+	post := func(extra string) int {
+		body := `{"id":"tmp/x","data":"aGk="` + extra + `}`
+		return serve(router, "POST", "/v1/blobs", []byte(body), nil).Code
+	}
+	require.Equal(t, http.StatusBadRequest, post(`,"ttl":"soon"`))
+	require.Equal(t, http.StatusBadRequest, post(`,"expires_at":"2020-01-01T00:00:00Z"`))
+	require.Equal(t, http.StatusBadRequest, post(`,"ttl":"1h","expires_at":"2099-01-01T00:00:00Z"`))
+	require.Equal(t, http.StatusCreated, post(`,"ttl":"7d"`))
+
+	rec := serve(router, "GET", "/v1/blobs/tmp%2Fx", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		ExpiresAt string `json:"expires_at"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	expires, err := time.Parse(time.RFC3339, resp.ExpiresAt)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(7*24*time.Hour), expires, time.Minute)
+
+	// an upload without one replaces the expiry too
+	require.Equal(t, http.StatusCreated, post(""))
+	rec = serve(router, "GET", "/v1/blobs/tmp%2Fx", nil, nil)
+	require.NotContains(t, rec.Body.String(), "expires_at")
+}
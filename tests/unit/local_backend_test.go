@@ -1,8 +1,18 @@
 package unit
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"rekazdrive/internal/storage"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -20,4 +30,315 @@ func TestLocalBackend_SaveLoad(t *testing.T) {
 	loadedData, err := backend.Load(id)
 	require.NoError(t, err)
 	require.Equal(t, data, loadedData)
-}
\ No newline at end of file
+}
+
+func TestLocalBackend_PutGetStream(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend := storage.NewLocalBackend(tmpDir)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	id := "stream-id"
+
+	err := backend.Put(ctx, id, bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	rc, info, err := backend.Get(ctx, id)
+	require.NoError(t, err)
+	defer rc.Close()
+	require.Equal(t, int64(len(data)), info.Size)
+
+	loadedData, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, data, loadedData)
+
+	// announced size that doesn't match the stream is rejected
+	err = backend.Put(ctx, "short-id", bytes.NewReader(data), int64(len(data)+1))
+	require.Error(t, err)
+
+	_, _, err = backend.Get(ctx, "missing-id")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestLocalBackend_GetRange(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend := storage.NewLocalBackend(tmpDir)
+	ctx := context.Background()
+
+	err := backend.Save("range-id", []byte("0123456789"))
+	require.NoError(t, err)
+
+	cases := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 4, "0123"},
+		{6, 2, "67"},
+		{7, -1, "789"},
+		{8, 100, "89"},
+	}
+	for _, tc := range cases {
+		rc, err := backend.GetRange(ctx, "range-id", tc.offset, tc.length)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, tc.want, string(got))
+	}
+
+	_, err = backend.GetRange(ctx, "missing-id", 0, 1)
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestLocalBackend_List(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend := storage.NewLocalBackend(tmpDir)
+	ctx := context.Background()
+
+	for _, id := range []string{"logs-3", "logs-1", "other", "logs-2"} {
+		require.NoError(t, backend.Save(id, []byte(id)))
+	}
+
+	var ids []string
+	cursor := ""
+	for {
+		page, next, err := backend.List(ctx, "logs-", cursor, 2)
+		require.NoError(t, err)
+		for _, info := range page {
+			ids = append(ids, info.ID)
+			require.Equal(t, int64(len(info.ID)), info.Size)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	require.Equal(t, []string{"logs-1", "logs-2", "logs-3"}, ids)
+}
+
+func TestLocalBackend_AtomicWrites(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend := storage.NewLocalBackend(tmpDir)
+	ctx := context.Background()
+
+	// a failed upload leaves neither a partial blob nor a temp file behind
+	err := backend.Put(ctx, "atomic-id", bytes.NewReader([]byte("short")), 100)
+	require.Error(t, err)
+	_, _, err = backend.Get(ctx, "atomic-id")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// concurrent writers: the survivor is one of the payloads, never a mix
+	payloads := [][]byte{bytes.Repeat([]byte("a"), 1<<20), bytes.Repeat([]byte("b"), 1<<20)}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(data []byte) {
+			defer wg.Done()
+			require.NoError(t, backend.Save("atomic-id", data))
+		}(payloads[i%2])
+	}
+	wg.Wait()
+
+	data, err := backend.Load("atomic-id")
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, payloads[0]) || bytes.Equal(data, payloads[1]))
+}
+
+func TestLocalBackend_RemovesStaleTemps(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	stale := filepath.Join(tmpDir, ".tmp-crashed")
+	fresh := filepath.Join(tmpDir, ".tmp-inflight")
+	require.NoError(t, os.WriteFile(stale, []byte("half"), 0600))
+	require.NoError(t, os.WriteFile(fresh, []byte("half"), 0600))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	// the cleanup runs in the background
+	storage.NewLocalBackend(tmpDir)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(stale)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := os.Stat(fresh)
+	require.NoError(t, err) // may still belong to a live writer
+}
+
+func TestLocalBackend_ShardedLayout(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend, err := storage.NewShardedLocalBackend(tmpDir, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, backend.Save("logs/app.txt", []byte("hello")))
+
+	// nothing lands in the top level directory itself
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, entries[0].IsDir())
+
+	data, err := backend.Load("logs/app.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	page, _, err := backend.List(context.Background(), "logs/", "", 10)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, "logs/app.txt", page[0].ID)
+}
+
+func TestLocalBackend_Reshard(t *testing.T) {
+	tmpDir := t.TempDir()
+	flat := storage.NewLocalBackend(tmpDir)
+
+	// every two hex char name is also some shard directory, so these get in the way
+	var ids []string
+	for i := 0; i < 256; i++ {
+		ids = append(ids, fmt.Sprintf("%02x", i))
+	}
+	ids = append(ids, "a/b", "plain")
+	for _, id := range ids {
+		require.NoError(t, flat.Save(id, []byte("data "+id)))
+	}
+
+	sharded, err := storage.NewShardedLocalBackend(tmpDir, 2)
+	require.NoError(t, err)
+
+	// readable and listed before the reshard ran
+	data, err := sharded.Load("plain")
+	require.NoError(t, err)
+	require.Equal(t, "data plain", string(data))
+	require.ElementsMatch(t, ids, listAll(t, sharded, "", 7))
+
+	moved, err := sharded.Reshard(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(ids), moved)
+
+	for _, id := range ids {
+		data, err := sharded.Load(id)
+		require.NoError(t, err, id)
+		require.Equal(t, "data "+id, string(data))
+	}
+
+	require.ElementsMatch(t, ids, listAll(t, sharded, "", 7))
+
+	// second run has nothing left to do
+	moved, err = sharded.Reshard(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, moved)
+}
+
+// a depth 1 blob that sits where a depth 2 shard directory has to go is parked
+// inside its own shard and still found there before the reshard ran
+func TestLocalBackend_ReshardParkedInShard(t *testing.T) {
+	tmpDir := t.TempDir()
+	shallow, err := storage.NewShardedLocalBackend(tmpDir, 1)
+	require.NoError(t, err)
+
+	var ids []string
+	for i := 0; i < 256; i++ {
+		id := fmt.Sprintf("%02x", i)
+		ids = append(ids, id)
+		require.NoError(t, shallow.Save(id, []byte("data "+id)))
+	}
+
+	// a new key whose depth 2 path goes through one of those files
+	hash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	blocked := ""
+	for i := 0; blocked == "" && i < 100000; i++ {
+		key := fmt.Sprintf("new-%d", i)
+		h := hash(key)
+		if hash(h[2:4])[:2] == h[:2] {
+			blocked = key
+			ids = append(ids, key)
+		}
+	}
+	require.NotEmpty(t, blocked)
+	blocker := hash(blocked)[2:4]
+
+	deep, err := storage.NewShardedLocalBackend(tmpDir, 2)
+	require.NoError(t, err)
+	require.NoError(t, deep.Save(blocked, []byte("data "+blocked)))
+
+	data, err := deep.Load(blocker)
+	require.NoError(t, err)
+	require.Equal(t, "data "+blocker, string(data))
+	require.ElementsMatch(t, ids, listAll(t, deep, "", 7))
+
+	moved, err := deep.Reshard(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 256, moved)
+	for _, id := range ids {
+		data, err := deep.Load(id)
+		require.NoError(t, err, id)
+		require.Equal(t, "data "+id, string(data))
+	}
+}
+
+// listAll pages through List and returns the ids in the order they came
+func listAll(t *testing.T, backend storage.StorageBackend, prefix string, limit int) []string {
+	var ids []string
+	cursor := ""
+	for {
+		page, next, err := backend.List(context.Background(), prefix, cursor, limit)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page), limit)
+		for _, info := range page {
+			ids = append(ids, info.ID)
+		}
+		if next == "" {
+			return ids
+		}
+		cursor = next
+	}
+}
+
+func TestLocalBackend_ShardedList(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend, err := storage.NewShardedLocalBackend(tmpDir, 2)
+	require.NoError(t, err)
+
+	var ids, logs []string
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("docs/%d.txt", i)
+		if i%3 == 0 {
+			id = fmt.Sprintf("logs/%d.txt", i)
+			logs = append(logs, id)
+		}
+		ids = append(ids, id)
+		require.NoError(t, backend.Save(id, []byte(id)))
+	}
+
+	// every page picks up after the cursor, each id comes exactly once
+	for _, limit := range []int{1, 4, 50, 100} {
+		require.ElementsMatch(t, ids, listAll(t, backend, "", limit), "limit %d", limit)
+	}
+	require.ElementsMatch(t, logs, listAll(t, backend, "logs/", 3))
+	require.Empty(t, listAll(t, backend, "none/", 3))
+
+	// a deleted cursor still says where to go on
+	page, next, err := backend.List(context.Background(), "", "", 10)
+	require.NoError(t, err)
+	require.NoError(t, backend.Delete(page[9].ID))
+	rest, next, err := backend.List(context.Background(), "", next, 100)
+	require.NoError(t, err)
+	require.Empty(t, next)
+	var seen []string
+	for _, info := range append(page, rest...) {
+		seen = append(seen, info.ID)
+	}
+	require.ElementsMatch(t, ids, seen)
+}
+
+func TestLocalBackend_ShardDepthOutOfRange(t *testing.T) {
+	_, err := storage.NewShardedLocalBackend(t.TempDir(), 4)
+	require.Error(t, err)
+	_, err = storage.NewShardedLocalBackend(t.TempDir(), -1)
+	require.Error(t, err)
+}
@@ -0,0 +1,226 @@
+package unit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataStore_LoginThrottle(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			_, err := store.GetLoginFailures("user:omar")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			for i := 1; i <= 3; i++ {
+				n, err := store.AddLoginFailure("user:omar", now, now.Add(-time.Hour))
+				require.NoError(t, err)
+				require.Equal(t, i, n)
+			}
+			// the last failure is older than since, the count starts over
+			n, err := store.AddLoginFailure("user:omar", now.Add(2*time.Hour), now.Add(time.Hour))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			_, err = store.AddLoginFailure("ip:192.0.2.1", now, now.Add(-time.Hour))
+			require.NoError(t, err)
+
+			require.NoError(t, store.LockLogin(&db.Lockout{
+				ID: "l1", Key: "user:omar", Failures: 5, CreatedAt: now, LockedUntil: now.Add(3 * time.Hour),
+			}))
+			require.NoError(t, store.LockLogin(&db.Lockout{
+				ID: "l2", Key: "ip:192.0.2.1", Failures: 20, CreatedAt: now.Add(time.Minute), LockedUntil: now.Add(2 * time.Minute),
+			}))
+			f, err := store.GetLoginFailures("user:omar")
+			require.NoError(t, err)
+			require.Equal(t, db.LoginFailures{Key: "user:omar", Failures: 1, LastFailureAt: now.Add(2 * time.Hour), LockedUntil: now.Add(3 * time.Hour)}, *f)
+
+			lockouts, err := store.ListLockouts(10)
+			require.NoError(t, err)
+			require.Equal(t, []db.Lockout{
+				{ID: "l2", Key: "ip:192.0.2.1", Failures: 20, CreatedAt: now.Add(time.Minute), LockedUntil: now.Add(2 * time.Minute)},
+				{ID: "l1", Key: "user:omar", Failures: 5, CreatedAt: now, LockedUntil: now.Add(3 * time.Hour)},
+			}, lockouts)
+			lockouts, err = store.ListLockouts(1)
+			require.NoError(t, err)
+			require.Len(t, lockouts, 1)
+
+			// omar is still locked, the address isn't any more
+			n, err = store.DeleteStaleLoginFailures(now.Add(150*time.Minute), now.Add(150*time.Minute))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			_, err = store.GetLoginFailures("ip:192.0.2.1")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			require.NoError(t, store.ClearLoginFailures("user:omar"))
+			require.NoError(t, store.ClearLoginFailures("user:omar"))
+			_, err = store.GetLoginFailures("user:omar")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+			// the record of the lock stays
+			lockouts, err = store.ListLockouts(10)
+			require.NoError(t, err)
+			require.Len(t, lockouts, 2)
+		})
+	}
+}
+
+func TestLoginGuard_Backoff(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := db.NewMemoryStore()
+	guard := auth.NewLoginGuard(store, auth.LoginPolicy{
+		UserAttempts: 3, IPAttempts: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Second, Window: time.Hour,
+	})
+
+	fail := func(username, ip string) time.Duration {
+		wait, err := guard.Failed(username, ip, now)
+		require.NoError(t, err)
+		return wait
+	}
+	check := func(username, ip string) time.Duration {
+		wait, err := guard.Check(username, ip, now)
+		require.NoError(t, err)
+		return wait
+	}
+
+	require.Zero(t, fail("omar", "192.0.2.1"))
+	require.Zero(t, fail("omar", "192.0.2.1"))
+	require.Zero(t, check("omar", "192.0.2.1"))
+	// every failure past the limit doubles the lock, up to MaxDelay
+	require.Equal(t, time.Second, fail("omar", "192.0.2.1"))
+	require.Equal(t, time.Second, check("omar", "198.51.100.7"))
+	require.Zero(t, check("sara", "192.0.2.1"))
+	now = now.Add(time.Second)
+	require.Zero(t, check("omar", "192.0.2.1"))
+	require.Equal(t, 2*time.Second, fail("omar", "192.0.2.2"))
+	now = now.Add(2 * time.Second)
+	require.Equal(t, 4*time.Second, fail("omar", "192.0.2.2"))
+	now = now.Add(4 * time.Second)
+	require.Equal(t, 5*time.Second, fail("omar", "192.0.2.2"))
+
+	// an address is locked for every username once it is past its own limit
+	now = now.Add(time.Second)
+	require.Zero(t, fail("a", "203.0.113.9"))
+	require.Zero(t, fail("b", "203.0.113.9"))
+	require.Zero(t, fail("c", "203.0.113.9"))
+	require.Zero(t, fail("d", "203.0.113.9"))
+	require.Equal(t, time.Second, fail("e", "203.0.113.9"))
+	require.Equal(t, time.Second, check("sara", "203.0.113.9"))
+
+	lockouts, err := store.ListLockouts(100)
+	require.NoError(t, err)
+	require.Len(t, lockouts, 5)
+	require.Equal(t, "ip:203.0.113.9", lockouts[0].Key)
+	require.Equal(t, 5, lockouts[0].Failures)
+
+	// a successful login starts omar over, the address keeps its count
+	require.NoError(t, guard.Reset("omar"))
+	require.Zero(t, check("omar", "192.0.2.2"))
+	require.Zero(t, fail("omar", "192.0.2.2"))
+	f, err := store.GetLoginFailures(auth.IPThrottleKey("192.0.2.2"))
+	require.NoError(t, err)
+	require.Equal(t, 4, f.Failures)
+
+	// once the window has passed without failures they are forgotten
+	now = now.Add(2 * time.Hour)
+	n, err := guard.Cleanup(now)
+	require.NoError(t, err)
+	require.Equal(t, 9, n)
+	require.Zero(t, fail("omar", "192.0.2.2"))
+	require.Zero(t, fail("omar", "192.0.2.2"))
+}
+
+func TestAuth_LoginLockout(t *testing.T) {
+	router, store := newAuthRouter(t)
+	adminToken, code := loginAs(t, router, "admin", "admin password")
+	require.Equal(t, http.StatusOK, code)
+	user, err := auth.NewUser("omar", "long enough", auth.RoleWriter, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, store.CreateUser(user))
+
+	login := func(password string) (int, string) {
+		body, _ := json.Marshal(map[string]string{"username": "omar", "password": password})
+		rec := serve(router, "POST", "/v1/auth/login", body, nil)
+		return rec.Code, rec.Header().Get("Retry-After")
+	}
+	for i := 0; i < auth.DefaultLoginPolicy.UserAttempts-1; i++ {
+		code, retry := login("wrong")
+		require.Equal(t, http.StatusUnauthorized, code)
+		require.Empty(t, retry)
+	}
+	// the failure that locks says so already, then even the right password waits
+	code, retry := login("wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, "1", retry)
+	code, retry = login("long enough")
+	require.Equal(t, http.StatusTooManyRequests, code)
+	require.Equal(t, "1", retry)
+
+	rec := serve(router, "GET", "/v1/admin/lockouts", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var lockouts struct {
+		Items []struct {
+			Key string `json:"key"`
+			Failures int `json:"failures"`
+			LockedUntil string `json:"locked_until"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lockouts))
+	require.Len(t, lockouts.Items, 1)
+	require.Equal(t, "user:omar", lockouts.Items[0].Key)
+	require.Equal(t, auth.DefaultLoginPolicy.UserAttempts, lockouts.Items[0].Failures)
+	rec = serve(router, "GET", "/v1/admin/lockouts?limit=0", nil, bearer(adminToken))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// an admin lets omar in again
+	rec = serve(router, "POST", "/v1/admin/users/"+user.ID+"/unlock", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "POST", "/v1/admin/users/missing/unlock", nil, bearer(adminToken))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	code, retry = login("long enough")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, retry)
+	_, err = store.GetLoginFailures(auth.UserThrottleKey("omar"))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestAuth_LoginLockoutUnknownUser(t *testing.T) {
+	router, _ := newAuthRouter(t)
+
+	// unknown usernames lock the same way, so the lock doesn't tell who exists
+	var retry string
+	for i := 0; i < auth.DefaultLoginPolicy.UserAttempts; i++ {
+		body, _ := json.Marshal(map[string]string{"username": "Nobody", "password": "wrong"})
+		rec := serve(router, "POST", "/v1/auth/login", body, map[string]string{"X-Forwarded-For": "198.51.100.7"})
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		retry = rec.Header().Get("Retry-After")
+	}
+	require.Equal(t, "1", retry)
+	body, _ := json.Marshal(map[string]string{"username": "nobody", "password": "wrong"})
+	rec := serve(router, "POST", "/v1/auth/login", body, nil)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.True(t, strings.Contains(rec.Body.String(), "too many failed logins"))
+
+	// other usernames from the same address are only counted
+	_, code := loginAs(t, router, "admin", "admin password")
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestWeakCredentials(t *testing.T) {
+	require.True(t, auth.WeakPassword("admin", "admin"))
+	require.True(t, auth.WeakPassword("omar", "Password"))
+	require.True(t, auth.WeakPassword("omar", "short"))
+	require.True(t, auth.WeakPassword("Omar.Khaled", "omar.khaled"))
+	require.False(t, auth.WeakPassword("admin", "admin password"))
+
+	require.Error(t, auth.CheckSecret(""))
+	require.Error(t, auth.CheckSecret("change_me_pls"))
+	require.Error(t, auth.CheckSecret("too short for HS256"))
+	require.NoError(t, auth.CheckSecret(strings.Repeat("x", auth.MinSecretLen)))
+}
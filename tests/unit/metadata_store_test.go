@@ -0,0 +1,317 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"path/filepath"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newSQLiteStore(t *testing.T) *db.SQLiteStore {
+	store, err := db.NewSQLite(filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.DB.Close() })
+	require.NoError(t, store.InitSchema())
+	return store
+}
+
+// every MetadataStore has to behave the same, the Postgres one is covered by
+// the integration tests
+func metadataStores(t *testing.T) map[string]db.MetadataStore {
+	return map[string]db.MetadataStore{
+		"memory": db.NewMemoryStore(),
+		"sqlite": newSQLiteStore(t),
+	}
+}
+
+func TestMetadataStore_SaveGetUpdate(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			first := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			meta := &db.BlobMeta{
+				ID:           "docs/a.txt",
+				Size:         5,
+				UpdatedAt:    first,
+				ContentType:  "text/plain",
+				Filename:     "a.txt",
+				SHA256:       "ab",
+				MD5:          "cd",
+				UserMetadata: map[string]string{"owner": "omar"},
+				Tags:         []string{"x", "y"},
+			}
+			require.NoError(t, store.SaveMetadata(meta))
+			meta.Tags[0] = "changed by caller" // must not leak into the store
+
+			got, err := store.GetMetadata("docs/a.txt")
+			require.NoError(t, err)
+			require.Equal(t, int64(5), got.Size)
+			require.True(t, got.CreatedAt.Equal(first))
+			require.Equal(t, "text/plain", got.ContentType)
+			require.Equal(t, map[string]string{"owner": "omar"}, got.UserMetadata)
+			require.Equal(t, []string{"x", "y"}, got.Tags)
+
+			// overwrite keeps the first created_at
+			second := first.Add(time.Hour)
+			require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: "docs/a.txt", Size: 7, UpdatedAt: second}))
+			got, err = store.GetMetadata("docs/a.txt")
+			require.NoError(t, err)
+			require.Equal(t, int64(7), got.Size)
+			require.True(t, got.CreatedAt.Equal(first))
+			require.True(t, got.UpdatedAt.Equal(second))
+			require.Empty(t, got.UserMetadata)
+			require.Empty(t, got.Tags)
+
+			// nil leaves a part alone
+			third := second.Add(time.Hour)
+			got, err = store.UpdateUserMetadata("docs/a.txt", map[string]string{"k": "v"}, nil, third)
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"k": "v"}, got.UserMetadata)
+			require.Empty(t, got.Tags)
+			got, err = store.UpdateUserMetadata("docs/a.txt", nil, []string{"t"}, third)
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"k": "v"}, got.UserMetadata)
+			require.Equal(t, []string{"t"}, got.Tags)
+			require.True(t, got.UpdatedAt.Equal(third))
+
+			_, err = store.UpdateUserMetadata("missing", nil, nil, third)
+			require.ErrorIs(t, err, sql.ErrNoRows)
+			_, err = store.GetMetadata("missing")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+		})
+	}
+}
+
+func TestMetadataStore_ListDelete(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now().UTC()
+			for _, id := range []string{"a/1", "a/2", "a/3", "A/4", "a_5", "b/1"} {
+				require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: id, Size: 1, UpdatedAt: now}))
+			}
+
+			metas, err := store.ListMetadata("a/", "", 2, nil, now)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a/1", "a/2"}, metaIDs(metas))
+			metas, err = store.ListMetadata("a/", "a/2", 2, nil, now)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a/3"}, metaIDs(metas))
+
+			// "_" is not a wildcard and the match is case sensitive
+			metas, err = store.ListMetadata("a_", "", 10, nil, now)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a_5"}, metaIDs(metas))
+
+			require.NoError(t, store.DeleteMetadata("a/2"))
+			require.ErrorIs(t, store.DeleteMetadata("a/2"), sql.ErrNoRows)
+			metas, err = store.ListMetadata("", "", 10, nil, now)
+			require.NoError(t, err)
+			require.Equal(t, []string{"A/4", "a/1", "a/3", "a_5", "b/1"}, metaIDs(metas))
+		})
+	}
+}
+
+// expired blobs the lifecycle worker has not deleted yet are skipped in the
+// query, so a page still fills up with the ones after them
+func TestMetadataStore_ListSkipsExpired(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+			expires := map[string]time.Time{"a": {}, "b": now.Add(-time.Minute), "c": now, "d": now.Add(time.Minute), "e": {}}
+			for id, at := range expires {
+				require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: id, Size: 1, UpdatedAt: now, ExpiresAt: at}))
+			}
+
+			metas, err := store.ListMetadata("", "", 2, nil, now)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", "d"}, metaIDs(metas))
+			metas, err = store.ListMetadata("", "d", 2, nil, now)
+			require.NoError(t, err)
+			require.Equal(t, []string{"e"}, metaIDs(metas))
+
+			metas, err = store.ListMetadata("", "", 10, nil, time.Time{})
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", "b", "c", "d", "e"}, metaIDs(metas))
+		})
+	}
+}
+
+func metaIDs(metas []db.BlobMeta) []string {
+	ids := []string{}
+	for _, m := range metas {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// the whole storage stack on one SQLite file: dedup on top of encryption
+// writes blob_keys rows while a dedup reference is being taken
+func TestSQLiteStore_StorageIndexes(t *testing.T) {
+	store := newSQLiteStore(t)
+	base := storage.NewLocalBackend(t.TempDir())
+	encrypted, err := storage.NewEncryptedBackend(base, store, map[string][]byte{"k1": masterKey(t)}, "k1")
+	require.NoError(t, err)
+	dedup := storage.NewDedupBackend(encrypted, store)
+	backend, err := storage.NewCompressedBackend(dedup, store, storage.CompressionPolicy{Codec: storage.CodecGzip, MinSize: 1})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	text := bytes.Repeat([]byte("same text in two blobs. "), 200)
+	require.NoError(t, backend.Put(ctx, "one.txt", bytes.NewReader(text), int64(len(text))))
+	require.NoError(t, backend.Put(ctx, "two.txt", bytes.NewReader(text), int64(len(text))))
+	require.Equal(t, 1, casObjects(t, encrypted))
+
+	rc, _, err := backend.Get(ctx, "two.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	require.Equal(t, text, data)
+
+	codec, _, err := backend.Encoding(ctx, "two.txt")
+	require.NoError(t, err)
+	require.Equal(t, storage.CodecGzip, codec)
+	entries, _, err := store.ListCodecs(ctx, "", "", 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	refs, _, err := store.ListRefs(ctx, "", "", 10)
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+
+	// the storage indexes never create blob rows, only the handler's SaveMetadata does
+	_, err = store.GetMetadata("one.txt")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	require.NoError(t, backend.Delete("one.txt"))
+	require.Equal(t, 1, casObjects(t, encrypted))
+	require.NoError(t, backend.Delete("two.txt"))
+	require.Equal(t, 0, casObjects(t, encrypted))
+
+	keys, _, err := store.ListKeys(ctx, "", "", 10)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	entries, _, err = store.ListCodecs(ctx, "", "", 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestMetadataStore_Versions(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+			for i, vid := range []string{"v1", "v2", "v3"} {
+				meta := &db.BlobMeta{ID: "doc", Size: int64(i + 1), UpdatedAt: start.Add(time.Duration(i) * time.Minute), VersionID: vid, Tags: []string{vid}}
+				require.NoError(t, store.SaveMetadata(meta))
+			}
+
+			versions, err := store.ListVersions("doc", "", 2)
+			require.NoError(t, err)
+			require.Equal(t, []string{"v3", "v2"}, versionIDs(versions))
+			versions, err = store.ListVersions("doc", "v2", 2)
+			require.NoError(t, err)
+			require.Equal(t, []string{"v1"}, versionIDs(versions))
+
+			v, err := store.GetVersion("doc", "v1")
+			require.NoError(t, err)
+			require.Equal(t, []string{"v1"}, v.Tags)
+			require.True(t, v.CreatedAt.Equal(start))
+
+			require.ErrorIs(t, store.DeleteVersion("doc", "v3"), db.ErrCurrentVersion)
+			_, err = store.GetVersion("doc", "v3")
+			require.NoError(t, err)
+
+			later := start.Add(time.Hour)
+			meta, err := store.RestoreVersion("doc", "v1", later)
+			require.NoError(t, err)
+			require.Equal(t, "v1", meta.VersionID)
+			require.Equal(t, int64(1), meta.Size)
+			require.True(t, meta.CreatedAt.Equal(start))
+			require.True(t, meta.UpdatedAt.Equal(later))
+
+			require.NoError(t, store.DeleteVersion("doc", "v3"))
+			require.ErrorIs(t, store.DeleteVersion("doc", "v3"), sql.ErrNoRows)
+			_, err = store.RestoreVersion("doc", "v3", later)
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			// the history outlives the blob
+			require.NoError(t, store.DeleteMetadata("doc"))
+			require.NoError(t, store.DeleteVersion("doc", "v1"))
+			versions, err = store.ListVersions("doc", "", 10)
+			require.NoError(t, err)
+			require.Equal(t, []string{"v2"}, versionIDs(versions))
+		})
+	}
+}
+
+func versionIDs(versions []db.BlobMeta) []string {
+	ids := []string{}
+	for _, v := range versions {
+		ids = append(ids, v.VersionID)
+	}
+	return ids
+}
+
+func TestMetadataStore_Trash(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			start := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+			for _, id := range []string{"a", "b", "c"} {
+				require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: id, Size: 1, UpdatedAt: start, Tags: []string{id}}))
+			}
+			require.NoError(t, store.TrashMetadata("a", start.Add(time.Hour)))
+			require.NoError(t, store.TrashMetadata("b", start.Add(2*time.Hour)))
+			require.ErrorIs(t, store.TrashMetadata("a", start), sql.ErrNoRows)
+
+			// gone for everything but the trash queries
+			_, err := store.GetMetadata("a")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+			_, err = store.UpdateUserMetadata("a", nil, []string{"x"}, start)
+			require.ErrorIs(t, err, sql.ErrNoRows)
+			metas, err := store.ListMetadata("", "", 10, nil, time.Now())
+			require.NoError(t, err)
+			require.Equal(t, []string{"c"}, metaIDs(metas))
+
+			trashed, err := store.ListTrash("", "", 10, nil)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", "b"}, metaIDs(trashed))
+			require.True(t, trashed[0].DeletedAt.Equal(start.Add(time.Hour)))
+			trashed, err = store.ListTrash("", "a", 10, nil)
+			require.NoError(t, err)
+			require.Equal(t, []string{"b"}, metaIDs(trashed))
+
+			expired, err := store.ExpiredTrash(start.Add(90*time.Minute), 10)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a"}, metaIDs(expired))
+
+			restored, err := store.RestoreTrashed("a")
+			require.NoError(t, err)
+			require.Equal(t, []string{"a"}, restored.Tags)
+			_, err = store.RestoreTrashed("a")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			// only the trashing that was read gets purged
+			got, err := store.GetTrashed("b")
+			require.NoError(t, err)
+			require.ErrorIs(t, store.PurgeTrashed("b", start), sql.ErrNoRows)
+			require.NoError(t, store.PurgeTrashed("b", got.DeletedAt))
+			_, err = store.GetTrashed("b")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			// an upload takes a blob out of the trash
+			require.NoError(t, store.TrashMetadata("c", start))
+			require.NoError(t, store.SaveMetadata(&db.BlobMeta{ID: "c", Size: 2, UpdatedAt: start}))
+			metas, err = store.ListMetadata("", "", 10, nil, time.Now())
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", "c"}, metaIDs(metas))
+			trashed, err = store.ListTrash("", "", 10, nil)
+			require.NoError(t, err)
+			require.Empty(t, trashed)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package unit
+
+import (
+	"rekazdrive/internal/db"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_add_col.up.sql":   {Data: []byte("ALTER TABLE t ADD COLUMN c TEXT;")},
+		"m/0002_add_col.down.sql": {Data: []byte("ALTER TABLE t DROP COLUMN c;")},
+		"m/0001_init.up.sql":      {Data: []byte("CREATE TABLE t (id TEXT);")},
+		"m/0001_init.down.sql":    {Data: []byte("DROP TABLE t;")},
+	}
+
+	migrations, err := db.LoadMigrations(fsys, "m")
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	require.Equal(t, 1, migrations[0].Version)
+	require.Equal(t, "init", migrations[0].Name)
+	require.Equal(t, "DROP TABLE t;", migrations[0].Down)
+	require.Equal(t, 2, migrations[1].Version)
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {
+			"m/0001_init.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"bad version": {
+			"m/init.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/init.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"two names": {
+			"m/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/0001_a.down.sql": {Data: []byte("SELECT 1;")},
+			"m/0001_b.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/0001_b.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"stray file": {
+			"m/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/0001_a.down.sql": {Data: []byte("SELECT 1;")},
+			"m/notes.txt":       {Data: []byte("todo")},
+		},
+	}
+	for name, fsys := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := db.LoadMigrations(fsys, "m")
+			require.Error(t, err)
+		})
+	}
+}
+
+// the shipped migrations must always load, versions without gaps
+func TestEmbeddedMigrations(t *testing.T) {
+	for _, scope := range []string{db.ScopeMetadata, db.ScopeBlob} {
+		m, err := db.NewMigrator(nil, scope)
+		require.NoError(t, err, scope)
+		require.NotEmpty(t, m.Migrations, scope)
+		for i, mig := range m.Migrations {
+			require.Equal(t, i+1, mig.Version, scope)
+		}
+	}
+}
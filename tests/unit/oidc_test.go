@@ -0,0 +1,287 @@
+package unit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// testIssuer is a stand-in OIDC provider with ES256 keys it can rotate
+type testIssuer struct {
+	*httptest.Server
+	jwksHits atomic.Int32
+
+	mu sync.Mutex
+	keys map[string]*ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	iss := &testIssuer{keys: map[string]*ecdsa.PrivateKey{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		iss.jwksHits.Add(1)
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		jwks := auth.JWKS{Keys: []auth.JWK{}}
+		for kid, key := range iss.keys {
+			jwk, err := auth.NewJWK(kid, "ES256", &key.PublicKey)
+			require.NoError(t, err)
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+		json.NewEncoder(w).Encode(jwks)
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	iss.addKey(t, "k1")
+	return iss
+}
+
+func (iss *testIssuer) addKey(t *testing.T, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	iss.mu.Lock()
+	iss.keys[kid] = key
+	iss.mu.Unlock()
+}
+
+// token signs claims with kid, iss, aud "drive", sub and a 5 minute exp are filled in
+func (iss *testIssuer) token(t *testing.T, kid string, claims jwt.MapClaims) string {
+	now := time.Now()
+	full := jwt.MapClaims{"iss": iss.URL, "aud": "drive", "sub": "u-1", "iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix()}
+	for k, v := range claims {
+		full[k] = v
+	}
+	iss.mu.Lock()
+	key := iss.keys[kid]
+	iss.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, full)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func newOIDCRouter(t *testing.T, iss *testIssuer, defaultRole string) (*testIssuer, *gin.Engine, db.MetadataStore) {
+	provider, err := auth.NewOIDCProvider(auth.OIDCConfig{
+		Issuer:          iss.URL,
+		Audience:        "drive",
+		RoleGroups:      map[string]string{"drive-admins": auth.RoleAdmin, "engineering": auth.RoleWriter},
+		DefaultRole:     defaultRole,
+		ClockSkew:       time.Minute,
+		RefreshInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	router, store := newAuthRouterWith(t, auth.NewHMACKeyring("test secret"), db.NewMemoryStore(), provider)
+	return iss, router, store
+}
+
+func TestOIDC_ProviderTokens(t *testing.T) {
+	iss, router, store := newOIDCRouter(t, newTestIssuer(t), auth.RoleReader)
+	whoami := func(token string) (int, map[string]any) {
+		rec := serve(router, "GET", "/v1/whoami", nil, bearer(token))
+		var resp map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	// the first token makes the account, with the role and groups of the provider
+	code, resp := whoami(iss.token(t, "k1", jwt.MapClaims{"email": "Sara@Example.com", "email_verified": true, "groups": []string{"engineering", "lunch club"}}))
+	require.Equal(t, http.StatusOK, code, resp)
+	require.Equal(t, "sara@example.com", resp["username"])
+	require.Equal(t, []any{"blobs:read", "blobs:write"}, resp["scopes"])
+	user, err := store.GetUserByName("sara@example.com")
+	require.NoError(t, err)
+	require.Equal(t, auth.RoleWriter, user.Role)
+	groups, err := store.UserGroups(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"engineering"}, groups) // "lunch club" isn't a valid group name
+
+	// the provider decides the role, on every request
+	code, resp = whoami(iss.token(t, "k1", jwt.MapClaims{"email": "sara@example.com", "groups": []string{"drive-admins", "engineering"}}))
+	require.Equal(t, http.StatusOK, code, resp)
+	require.Equal(t, []any{"blobs:read", "blobs:write", "admin:*"}, resp["scopes"])
+	code, resp = whoami(iss.token(t, "k1", jwt.MapClaims{"email": "sara@example.com"}))
+	require.Equal(t, http.StatusOK, code, resp)
+	require.Equal(t, []any{"blobs:read"}, resp["scopes"])
+	user, err = store.GetUser(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, auth.RoleReader, user.Role)
+
+	// the JWKS is fetched once, then again for a kid it doesn't know
+	require.Equal(t, int32(1), iss.jwksHits.Load())
+	iss.addKey(t, "k2")
+	code, _ = whoami(iss.token(t, "k2", jwt.MapClaims{"email": "sara@example.com"}))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int32(2), iss.jwksHits.Load())
+
+	// a disabled account stays locked out
+	rec := serve(router, "POST", "/v1/admin/users/"+user.ID+"/disable", nil, bearer(iss.token(t, "k1", jwt.MapClaims{"sub": "u-2", "email": "boss@example.com", "groups": []string{"drive-admins"}})))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	code, _ = whoami(iss.token(t, "k1", jwt.MapClaims{"email": "sara@example.com"}))
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// local logins still work next to the provider
+	_, code = loginAs(t, router, "admin", "admin password")
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestOIDC_RejectsBadTokens(t *testing.T) {
+	iss, router, _ := newOIDCRouter(t, newTestIssuer(t), "")
+	whoami := func(token string) int {
+		return serve(router, "GET", "/v1/whoami", nil, bearer(token)).Code
+	}
+	now := time.Now()
+	ok := jwt.MapClaims{"email": "sara@example.com", "groups": []string{"engineering"}}
+	with := func(extra jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for k, v := range ok {
+			claims[k] = v
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+	require.Equal(t, http.StatusOK, whoami(iss.token(t, "k1", ok)))
+
+	// exp and nbf get a minute of leeway, no more
+	require.Equal(t, http.StatusOK, whoami(iss.token(t, "k1", with(jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()}))))
+	require.Equal(t, http.StatusUnauthorized, whoami(iss.token(t, "k1", with(jwt.MapClaims{"exp": now.Add(-2 * time.Minute).Unix()}))))
+	require.Equal(t, http.StatusOK, whoami(iss.token(t, "k1", with(jwt.MapClaims{"nbf": now.Add(30 * time.Second).Unix()}))))
+	require.Equal(t, http.StatusUnauthorized, whoami(iss.token(t, "k1", with(jwt.MapClaims{"nbf": now.Add(2 * time.Minute).Unix()}))))
+	require.Equal(t, http.StatusUnauthorized, whoami(iss.token(t, "k1", with(jwt.MapClaims{"exp": nil}))))
+
+	require.Equal(t, http.StatusUnauthorized, whoami(iss.token(t, "k1", with(jwt.MapClaims{"aud": "someone else"}))))
+	require.Equal(t, http.StatusUnauthorized, whoami(iss.token(t, "k1", with(jwt.MapClaims{"iss": "https://evil.example.com"}))))
+	require.Equal(t, http.StatusUnauthorized, whoami(iss.token(t, "k1", with(jwt.MapClaims{"email_verified": false}))))
+	require.Equal(t, http.StatusUnauthorized, whoami(iss.token(t, "k1", with(jwt.MapClaims{"email": "not an email"}))))
+
+	// a key the provider doesn't publish
+	other := newTestIssuer(t)
+	forged := other.token(t, "k1", with(jwt.MapClaims{"iss": iss.URL}))
+	require.Equal(t, http.StatusUnauthorized, whoami(forged))
+
+	// no group with a role and no default role
+	rec := serve(router, "GET", "/v1/whoami", nil, bearer(iss.token(t, "k1", with(jwt.MapClaims{"groups": []string{"sales"}}))))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), "no role")
+}
+
+func TestParseRoleGroups(t *testing.T) {
+	groups, err := auth.ParseRoleGroups("drive-admins:admin, org:team:writer,")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"drive-admins": "admin", "org:team": "writer"}, groups)
+	_, err = auth.ParseRoleGroups("staff:owner")
+	require.Error(t, err)
+	_, err = auth.ParseRoleGroups("staff")
+	require.Error(t, err)
+}
+
+func TestMetadataStore_Identities(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			local, err := auth.NewUser("sara@example.com", "long enough", auth.RoleWriter, now)
+			require.NoError(t, err)
+			require.NoError(t, store.CreateUser(local))
+			_, err = store.GetUserByIdentity("https://idp", "u-1")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			// the username is taken, nothing is created or linked
+			other, err := auth.NewUser("sara@example.com", "x", auth.RoleReader, now)
+			require.NoError(t, err)
+			require.ErrorIs(t, store.CreateLinkedUser(other, &db.UserIdentity{Issuer: "https://idp", Subject: "u-1", CreatedAt: now}), db.ErrUserExists)
+			_, err = store.GetUserByIdentity("https://idp", "u-1")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			linked, err := auth.NewUser("omar@example.com", "x", auth.RoleReader, now)
+			require.NoError(t, err)
+			require.NoError(t, store.CreateLinkedUser(linked, &db.UserIdentity{Issuer: "https://idp", Subject: "u-2", CreatedAt: now}))
+			got, err := store.GetUserByIdentity("https://idp", "u-2")
+			require.NoError(t, err)
+			require.Equal(t, linked.ID, got.ID)
+			_, err = store.GetUserByIdentity("https://other", "u-2")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			require.NoError(t, store.LinkIdentity(&db.UserIdentity{Issuer: "https://idp", Subject: "u-1", UserID: local.ID, CreatedAt: now}))
+			require.ErrorIs(t, store.LinkIdentity(&db.UserIdentity{Issuer: "https://idp", Subject: "u-1", UserID: linked.ID, CreatedAt: now}), db.ErrIdentityLinked)
+			require.ErrorIs(t, store.LinkIdentity(&db.UserIdentity{Issuer: "https://idp", Subject: "u-3", UserID: "missing", CreatedAt: now}), sql.ErrNoRows)
+			got, err = store.GetUserByIdentity("https://idp", "u-1")
+			require.NoError(t, err)
+			require.Equal(t, local.ID, got.ID)
+			identities, err := store.ListIdentities(local.ID)
+			require.NoError(t, err)
+			require.Equal(t, []db.UserIdentity{{Issuer: "https://idp", Subject: "u-1", UserID: local.ID, CreatedAt: now}}, identities)
+
+			// only the account it is linked to can unlink it
+			require.ErrorIs(t, store.UnlinkIdentity(linked.ID, "https://idp", "u-1"), sql.ErrNoRows)
+			require.NoError(t, store.UnlinkIdentity(local.ID, "https://idp", "u-1"))
+			identities, err = store.ListIdentities(local.ID)
+			require.NoError(t, err)
+			require.Empty(t, identities)
+		})
+	}
+}
+
+func TestOIDC_SharedUsername(t *testing.T) {
+	iss, router, store := newOIDCRouter(t, newTestIssuer(t), auth.RoleReader)
+	adminToken, code := loginAs(t, router, "admin", "admin password")
+	require.Equal(t, http.StatusOK, code)
+	local, err := auth.NewUser("sara@example.com", "long enough", auth.RoleReader, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, store.CreateUser(local))
+
+	// a provider user named like a local account doesn't get it, nor can they change it
+	token := iss.token(t, "k1", jwt.MapClaims{"sub": "u-9", "email": "sara@example.com", "groups": []string{"drive-admins"}})
+	rec := serve(router, "GET", "/v1/whoami", nil, bearer(token))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	var refused map[string]string
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &refused))
+	require.Equal(t, iss.URL, refused["issuer"])
+	require.Equal(t, "u-9", refused["subject"])
+	user, err := store.GetUser(local.ID)
+	require.NoError(t, err)
+	require.Equal(t, auth.RoleReader, user.Role)
+
+	// neither does the bootstrap admin's name
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(iss.token(t, "k1", jwt.MapClaims{"sub": "u-8", "email": "admin", "groups": []string{"drive-admins"}})))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// once an admin links them, the provider user is that account
+	body, _ := json.Marshal(map[string]string{"issuer": iss.URL, "subject": "u-9"})
+	rec = serve(router, "POST", "/v1/admin/users/"+local.ID+"/identities", body, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = serve(router, "POST", "/v1/admin/users/"+local.ID+"/identities", body, bearer(adminToken))
+	require.Equal(t, http.StatusConflict, rec.Code)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), local.ID)
+	user, err = store.GetUser(local.ID)
+	require.NoError(t, err)
+	require.Equal(t, auth.RoleAdmin, user.Role)
+
+	// and isn't any more once unlinked
+	rec = serve(router, "DELETE", "/v1/admin/users/"+local.ID+"/identities?issuer="+url.QueryEscape(iss.URL)+"&subject=u-9", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.JSONEq(t, `{"items":[]}`, rec.Body.String())
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(token))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
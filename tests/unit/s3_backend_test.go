@@ -1,6 +1,10 @@
 package unit
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"rekazdrive/internal/storage"
 	"testing"
@@ -35,3 +39,41 @@ func TestS3Backend_SaveLoad(t *testing.T) {
 	err = backend.Delete(id)
 	require.NoError(t, err)
 }
+
+func TestS3Backend_ListContinuation(t *testing.T) {
+	// stand-in for the bucket, serves two pages of ListObjectsV2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/bucket", r.URL.Path)
+		require.Equal(t, "2", r.URL.Query().Get("list-type"))
+		require.Equal(t, "logs~", r.URL.Query().Get("prefix"))
+		require.Contains(t, r.Header.Get("Authorization"), "AWS4-HMAC-SHA256")
+
+		if r.URL.Query().Get("continuation-token") == "" {
+			fmt.Fprint(w, `<ListBucketResult><IsTruncated>true</IsTruncated><NextContinuationToken>tok+1/=</NextContinuationToken>
+				<Contents><Key>logs~a</Key><Size>3</Size><LastModified>2024-01-02T03:04:05.000Z</LastModified><ETag>"e1"</ETag></Contents>
+			</ListBucketResult>`)
+			return
+		}
+		require.Equal(t, "tok+1/=", r.URL.Query().Get("continuation-token"))
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>
+			<Contents><Key>logs~b</Key><Size>5</Size><LastModified>2024-01-02T03:04:05.000Z</LastModified><ETag>"e2"</ETag></Contents>
+		</ListBucketResult>`)
+	}))
+	defer srv.Close()
+
+	backend := storage.NewS3Backend(srv.URL, "bucket", "key", "secret", "us-east-1")
+	ctx := context.Background()
+
+	page, next, err := backend.List(ctx, "logs/", "", 1)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, "logs/a", page[0].ID)
+	require.Equal(t, int64(3), page[0].Size)
+	require.Equal(t, "tok+1/=", next)
+
+	page, next, err = backend.List(ctx, "logs/", next, 1)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, "logs/b", page[0].ID)
+	require.Empty(t, next)
+}
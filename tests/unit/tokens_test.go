@@ -0,0 +1,241 @@
+package unit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataStore_Tokens(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			user, err := auth.NewUser("omar", "long enough", auth.RoleWriter, now)
+			require.NoError(t, err)
+			require.NoError(t, store.CreateUser(user))
+
+			newToken := func(hash, family string, ttl time.Duration) {
+				require.NoError(t, store.CreateRefreshToken(&db.RefreshToken{
+					Hash: hash, UserID: user.ID, FamilyID: family, CreatedAt: now, ExpiresAt: now.Add(ttl),
+				}))
+			}
+			newToken("h1", "f1", time.Hour)
+			newToken("h2", "f1", time.Hour)
+			newToken("h3", "f2", time.Minute)
+
+			got, err := store.GetRefreshToken("h1")
+			require.NoError(t, err)
+			require.Equal(t, db.RefreshToken{Hash: "h1", UserID: user.ID, FamilyID: "f1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}, *got)
+			_, err = store.GetRefreshToken("missing")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			// each token is used once, never after it expired or was revoked
+			require.NoError(t, store.UseRefreshToken("h1", now))
+			require.ErrorIs(t, store.UseRefreshToken("h1", now), sql.ErrNoRows)
+			got, err = store.GetRefreshToken("h1")
+			require.NoError(t, err)
+			require.Equal(t, now, got.UsedAt)
+			require.ErrorIs(t, store.UseRefreshToken("h3", now.Add(time.Hour)), sql.ErrNoRows)
+			require.ErrorIs(t, store.UseRefreshToken("missing", now), sql.ErrNoRows)
+
+			require.NoError(t, store.RevokeRefreshFamily("f1", now))
+			require.ErrorIs(t, store.UseRefreshToken("h2", now), sql.ErrNoRows)
+			got, err = store.GetRefreshToken("h2")
+			require.NoError(t, err)
+			require.Equal(t, now, got.RevokedAt)
+			require.NoError(t, store.UseRefreshToken("h3", now))
+
+			require.NoError(t, store.RevokeToken("j1", now.Add(time.Minute)))
+			require.NoError(t, store.RevokeToken("j1", now.Add(time.Minute)))
+			require.NoError(t, store.RevokeToken("j2", now.Add(time.Hour)))
+			revoked, err := store.RevokedTokens(now)
+			require.NoError(t, err)
+			require.Equal(t, map[string]time.Time{"j1": now.Add(time.Minute), "j2": now.Add(time.Hour)}, revoked)
+			revoked, err = store.RevokedTokens(now.Add(time.Minute))
+			require.NoError(t, err)
+			require.Equal(t, map[string]time.Time{"j2": now.Add(time.Hour)}, revoked)
+
+			// h3 and j1 are expired by then
+			n, err := store.DeleteExpiredTokens(now.Add(30 * time.Minute))
+			require.NoError(t, err)
+			require.Equal(t, 2, n)
+			_, err = store.GetRefreshToken("h3")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+			_, err = store.GetRefreshToken("h1")
+			require.NoError(t, err)
+
+			// every family of the user at once
+			newToken("h4", "f3", time.Hour)
+			newToken("h5", "f4", time.Hour)
+			require.NoError(t, store.RevokeUserRefreshTokens(user.ID, now))
+			require.ErrorIs(t, store.UseRefreshToken("h4", now), sql.ErrNoRows)
+			require.ErrorIs(t, store.UseRefreshToken("h5", now), sql.ErrNoRows)
+			got, err = store.GetRefreshToken("h1")
+			require.NoError(t, err)
+			require.Equal(t, now, got.RevokedAt)
+		})
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	now := time.Now().UTC()
+	store := db.NewMemoryStore()
+	revoked := auth.NewRevocations(store)
+	require.NoError(t, revoked.Revoke("mine", now.Add(time.Hour)))
+	require.True(t, revoked.Revoked("mine"))
+
+	// another replica's revocation shows up on the next sync
+	require.NoError(t, store.RevokeToken("theirs", now.Add(time.Hour)))
+	require.False(t, revoked.Revoked("theirs"))
+	require.NoError(t, revoked.Sync(now))
+	require.True(t, revoked.Revoked("theirs"))
+	require.True(t, revoked.Revoked("mine"))
+
+	require.NoError(t, revoked.Sync(now.Add(2*time.Hour)))
+	require.False(t, revoked.Revoked("mine"))
+}
+
+func TestAuth_RefreshAndLogout(t *testing.T) {
+	router, _ := newAuthRouter(t)
+	type pair struct {
+		Token string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn int `json:"expires_in"`
+	}
+	login := func() pair {
+		rec := serve(router, "POST", "/v1/auth/login", []byte(`{"username":"admin","password":"admin password"}`), nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var p pair
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+		require.Equal(t, 300, p.ExpiresIn)
+		return p
+	}
+	refresh := func(token string) (pair, int) {
+		body, _ := json.Marshal(map[string]string{"refresh_token": token})
+		rec := serve(router, "POST", "/v1/auth/refresh", body, nil)
+		var p pair
+		json.Unmarshal(rec.Body.Bytes(), &p)
+		return p, rec.Code
+	}
+	whoami := func(token string) int {
+		return serve(router, "GET", "/v1/whoami", nil, bearer(token)).Code
+	}
+
+	first := login()
+	require.Equal(t, http.StatusOK, whoami(first.Token))
+	_, code := refresh("not a token")
+	require.Equal(t, http.StatusUnauthorized, code)
+	rec := serve(router, "POST", "/v1/auth/refresh", []byte(`{}`), nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// rotation, the new pair works and the old refresh token is spent
+	second, code := refresh(first.RefreshToken)
+	require.Equal(t, http.StatusOK, code)
+	require.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	require.Equal(t, http.StatusOK, whoami(second.Token))
+
+	// reusing the spent one revokes the family, the newer token too
+	_, code = refresh(first.RefreshToken)
+	require.Equal(t, http.StatusUnauthorized, code)
+	_, code = refresh(second.RefreshToken)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// logout ends the access token and the given refresh token's family
+	session := login()
+	other := login()
+	body, _ := json.Marshal(map[string]string{"refresh_token": session.RefreshToken})
+	rec = serve(router, "POST", "/v1/auth/logout", body, bearer(session.Token))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, http.StatusUnauthorized, whoami(session.Token))
+	_, code = refresh(session.RefreshToken)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// other sessions go on, logout without a body only revokes the access token
+	require.Equal(t, http.StatusOK, whoami(other.Token))
+	rec = serve(router, "POST", "/v1/auth/logout", nil, bearer(other.Token))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, http.StatusUnauthorized, whoami(other.Token))
+	next, code := refresh(other.RefreshToken)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, http.StatusOK, whoami(next.Token))
+
+	// tokens from before sessions have no jti
+	old := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{
+		Scope: auth.ScopeBlobsRead,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "admin",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	signed, err := old.SignedString([]byte("test secret"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, whoami(signed))
+}
+
+func TestAuth_RefreshDisabledUser(t *testing.T) {
+	router, store := newAuthRouter(t)
+	adminToken, _ := loginAs(t, router, "admin", "admin password")
+	rec := serve(router, "POST", "/v1/admin/users", []byte(`{"username":"omar","password":"long enough"}`), bearer(adminToken))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = serve(router, "POST", "/v1/auth/login", []byte(`{"username":"omar","password":"long enough"}`), nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	user, err := store.GetUserByName("omar")
+	require.NoError(t, err)
+	rec = serve(router, "POST", "/v1/admin/users/"+user.ID+"/disable", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body, _ := json.Marshal(map[string]string{"refresh_token": resp.RefreshToken})
+	rec = serve(router, "POST", "/v1/auth/refresh", body, nil)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// enabling the account again doesn't bring its refresh tokens back
+	rec = serve(router, "POST", "/v1/admin/users/"+user.ID+"/enable", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "POST", "/v1/auth/refresh", body, nil)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAuth_RefreshAfterPasswordReset(t *testing.T) {
+	router, store := newAuthRouter(t)
+	adminToken, _ := loginAs(t, router, "admin", "admin password")
+	rec := serve(router, "POST", "/v1/admin/users", []byte(`{"username":"omar","password":"long enough"}`), bearer(adminToken))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// two sessions, say a laptop and a leaked token
+	refresh := func() string {
+		rec := serve(router, "POST", "/v1/auth/login", []byte(`{"username":"omar","password":"long enough"}`), nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		body, _ := json.Marshal(map[string]string{"refresh_token": resp.RefreshToken})
+		return string(body)
+	}
+	first, second := refresh(), refresh()
+
+	user, err := store.GetUserByName("omar")
+	require.NoError(t, err)
+	rec = serve(router, "POST", "/v1/admin/users/"+user.ID+"/password", []byte(`{"password":"a new password"}`), bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	for _, body := range []string{first, second} {
+		rec = serve(router, "POST", "/v1/auth/refresh", []byte(body), nil)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// a login with the new password starts a session that works
+	rec = serve(router, "POST", "/v1/auth/login", []byte(`{"username":"omar","password":"a new password"}`), nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,92 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/handlers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type trashList struct {
+	Items []struct {
+		ID string `json:"id"`
+		DeletedAt string `json:"deleted_at"`
+		PurgeAt string `json:"purge_at"`
+	} `json:"items"`
+}
+
+func TestTrash_RestoreAndPurge(t *testing.T) {
+	router, h := newBlobRouter(t)
+	h.TrashRetention = 24 * time.Hour
+
+	for _, id := range []string{"a.txt", "b.txt"} {
+		rec := serve(router, "PUT", "/v1/blobs/"+id, []byte("content of "+id), nil)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		rec = serve(router, "DELETE", "/v1/blobs/"+id, nil, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		rec = serve(router, "GET", "/v1/blobs/"+id+"/content", nil, nil)
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	}
+	rec := serve(router, "DELETE", "/v1/blobs/a.txt", nil, nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serve(router, "GET", "/v1/trash", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list trashList
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Items, 2)
+	require.Equal(t, "a.txt", list.Items[0].ID)
+	deleted, err := time.Parse(time.RFC3339, list.Items[0].DeletedAt)
+	require.NoError(t, err)
+	purge, err := time.Parse(time.RFC3339, list.Items[0].PurgeAt)
+	require.NoError(t, err)
+	require.Equal(t, 24*time.Hour, purge.Sub(deleted))
+
+	rec = serve(router, "POST", "/v1/trash/a.txt/restore", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = serve(router, "GET", "/v1/blobs/a.txt/content", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "content of a.txt", rec.Body.String())
+
+	rec = serve(router, "DELETE", "/v1/trash/b.txt", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = serve(router, "POST", "/v1/trash/b.txt/restore", nil, nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	_, _, err = h.Store.Get(context.Background(), "b.txt")
+	require.Error(t, err)
+}
+
+func TestTrash_PurgeExpired(t *testing.T) {
+	router, h := newBlobRouter(t)
+	h.TrashRetention = time.Hour
+	h.Versioning = handlers.VersioningPolicy{Enabled: true, Prefixes: []string{"docs/"}}
+
+	for _, id := range []string{"a.txt", "docs%2Fb.txt"} {
+		rec := serve(router, "PUT", "/v1/blobs/"+id, []byte("data"), nil)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		rec = serve(router, "DELETE", "/v1/blobs/"+id, nil, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	n, err := h.PurgeExpiredTrash(context.Background(), time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = h.PurgeExpiredTrash(context.Background(), time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	trashed, err := h.Meta.ListTrash("", "", 10, nil)
+	require.NoError(t, err)
+	require.Empty(t, trashed)
+	_, _, err = h.Store.Get(context.Background(), "a.txt")
+	require.Error(t, err)
+
+	// a versioned blob's history outlives it, like on a delete without trash
+	list := listVersions(t, router, "/v1/blobs/docs%2Fb.txt/versions")
+	require.Len(t, list.Items, 1)
+	require.False(t, list.Items[0].Current)
+}
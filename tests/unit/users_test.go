@@ -0,0 +1,292 @@
+package unit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/auth"
+	"rekazdrive/internal/db"
+	"rekazdrive/internal/handlers"
+	"rekazdrive/internal/middleware"
+	"rekazdrive/internal/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassword_HashVerify(t *testing.T) {
+	hash, err := auth.HashPassword("correct horse")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$"))
+
+	require.True(t, auth.VerifyPassword(hash, "correct horse"))
+	require.False(t, auth.VerifyPassword(hash, "correct horse "))
+	require.False(t, auth.VerifyPassword("correct horse", "correct horse"))
+	require.False(t, auth.VerifyPassword("$argon2id$v=19$m=1,t=0,p=1$AAAA$AAAA", ""))
+
+	// same password, different salt
+	other, err := auth.HashPassword("correct horse")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+}
+
+func TestMetadataStore_Users(t *testing.T) {
+	for name, store := range metadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 8, 1, 0, 0, 0, 0, time.UTC)
+			n, err := store.CountUsers()
+			require.NoError(t, err)
+			require.Equal(t, 0, n)
+
+			alice := &db.User{ID: "u1", Username: "alice", PasswordHash: "h1", Role: auth.RoleAdmin, CreatedAt: now}
+			require.NoError(t, store.CreateUser(alice))
+			require.NoError(t, store.CreateUser(&db.User{ID: "u2", Username: "bob", PasswordHash: "h2", Role: auth.RoleReader, CreatedAt: now}))
+			require.ErrorIs(t, store.CreateUser(&db.User{ID: "u3", Username: "alice", Role: auth.RoleWriter, CreatedAt: now}), db.ErrUserExists)
+
+			u, err := store.GetUserByName("alice")
+			require.NoError(t, err)
+			require.Equal(t, "u1", u.ID)
+			require.Equal(t, auth.RoleAdmin, u.Role)
+			require.False(t, u.Disabled)
+			_, err = store.GetUserByName("carol")
+			require.ErrorIs(t, err, sql.ErrNoRows)
+
+			later := now.Add(time.Hour)
+			require.NoError(t, store.SetUserDisabled("u2", true, later))
+			require.NoError(t, store.SetUserPassword("u2", "h2b", later))
+			require.ErrorIs(t, store.SetUserPassword("nobody", "h", later), sql.ErrNoRows)
+			require.NoError(t, store.SetUserRole("u2", auth.RoleWriter, later))
+			require.ErrorIs(t, store.SetUserRole("nobody", auth.RoleWriter, later), sql.ErrNoRows)
+			u, err = store.GetUser("u2")
+			require.NoError(t, err)
+			require.Equal(t, auth.RoleWriter, u.Role)
+			require.True(t, u.Disabled)
+			require.Equal(t, "h2b", u.PasswordHash)
+			require.True(t, u.UpdatedAt.Equal(later))
+			require.True(t, u.CreatedAt.Equal(now))
+
+			users, err := store.ListUsers()
+			require.NoError(t, err)
+			require.Len(t, users, 2)
+			require.Equal(t, "alice", users[0].Username)
+		})
+	}
+}
+
+// login, the blob and trash routes and the admin user API on the memory store
+func newAuthRouter(t *testing.T) (*gin.Engine, db.MetadataStore) {
+	return newAuthRouterWith(t, auth.NewHMACKeyring("test secret"), db.NewMemoryStore(), nil)
+}
+
+// newAuthRouterWith signs tokens with the keyring, which must use the store if
+// it needs one, and accepts the provider's tokens if oidc isn't nil
+func newAuthRouterWith(t *testing.T, signing *auth.Keyring, store db.MetadataStore, oidc *auth.OIDCProvider) (*gin.Engine, db.MetadataStore) {
+	gin.SetMode(gin.TestMode)
+	admin, err := auth.NewUser("Admin", "admin password", auth.RoleAdmin, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, store.CreateUser(admin))
+
+	revoked := auth.NewRevocations(store)
+	sessions := handlers.NewAuthHandler(signing, store, revoked)
+	sessions.AccessTTL = 5 * time.Minute
+	router := gin.New()
+	router.GET("/.well-known/jwks.json", sessions.JWKS)
+	v1 := router.Group("/v1")
+	v1.POST("/auth/login", sessions.Login)
+	v1.POST("/auth/refresh", sessions.Refresh)
+	protected := v1.Group("")
+	protected.Use(middleware.AuthMiddleware(signing, store, revoked, oidc))
+	protected.POST("/auth/logout", sessions.Logout)
+	protected.POST("/keys", sessions.CreateAPIKey)
+	protected.GET("/keys", sessions.ListAPIKeys)
+	protected.DELETE("/keys/:id", sessions.RevokeAPIKey)
+	protected.GET("/whoami", func(c *gin.Context) {
+		caller, _ := middleware.CallerFrom(c)
+		role := caller.Role // the token's role, the user's for API keys
+		if claims, ok := middleware.ClaimsFrom(c); ok {
+			role = claims.Role
+		}
+		c.JSON(http.StatusOK, gin.H{"id": caller.UserID, "username": caller.Username, "role": role, "scopes": caller.Scopes})
+	})
+	users := handlers.NewUserHandler(store, store)
+	admins := protected.Group("/admin")
+	admins.Use(middleware.RequireScope(auth.ScopeAdminUsers))
+	admins.POST("/users", users.CreateUser)
+	admins.GET("/users", users.ListUsers)
+	admins.POST("/users/:id/disable", users.DisableUser)
+	admins.POST("/users/:id/enable", users.EnableUser)
+	admins.POST("/users/:id/password", users.ResetPassword)
+	admins.PUT("/users/:id/role", users.SetRole)
+	admins.GET("/roles", users.ListRoles)
+	admins.GET("/users/:id/groups", users.GetGroups)
+	admins.PUT("/users/:id/groups", users.SetGroups)
+	admins.GET("/users/:id/identities", users.ListIdentities)
+	admins.POST("/users/:id/identities", users.LinkIdentity)
+	admins.DELETE("/users/:id/identities", users.UnlinkIdentity)
+	admins.POST("/users/:id/unlock", sessions.UnlockUser)
+	admins.GET("/lockouts", sessions.ListLockouts)
+
+	h := handlers.NewBlobHandler(storage.NewLocalBackend(t.TempDir()), store)
+	h.TrashRetention = time.Hour
+	read, write := middleware.RequireScope(auth.ScopeBlobsRead), middleware.RequireScope(auth.ScopeBlobsWrite)
+	blobs := protected.Group("/blobs")
+	blobs.GET("", read, h.ListBlobs)
+	blobs.GET("/:id", read, h.GetBlob)
+	blobs.PUT("/:id", write, h.PutBlobContent)
+	blobs.PATCH("/:id", write, h.PatchBlob)
+	blobs.DELETE("/:id", write, h.DeleteBlob)
+	blobs.GET("/:id/acl", read, h.GetACL)
+	blobs.PUT("/:id/acl", write, h.PutACL)
+	trash := protected.Group("/trash")
+	trash.GET("", read, h.ListTrash)
+	trash.POST("/:id/restore", write, h.RestoreFromTrash)
+	return router, store
+}
+
+func loginAs(t *testing.T, router *gin.Engine, username, password string) (string, int) {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	rec := serve(router, "POST", "/v1/auth/login", body, nil)
+	var resp struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return resp.Token, rec.Code
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestAuth_UsersAndAdminAPI(t *testing.T) {
+	router, _ := newAuthRouter(t)
+
+	_, code := loginAs(t, router, "admin", "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+	_, code = loginAs(t, router, "nobody", "admin password")
+	require.Equal(t, http.StatusUnauthorized, code)
+	adminToken, code := loginAs(t, router, " ADMIN ", "admin password")
+	require.Equal(t, http.StatusOK, code)
+
+	rec := serve(router, "POST", "/v1/admin/users", []byte(`{"username":"omar","password":"short"}`), bearer(adminToken))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(router, "POST", "/v1/admin/users", []byte(`{"username":"omar","password":"long enough"}`), bearer(adminToken))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	require.NotContains(t, rec.Body.String(), "argon2")
+	var created struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	rec = serve(router, "POST", "/v1/admin/users", []byte(`{"username":"Omar","password":"long enough"}`), bearer(adminToken))
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	// the token carries the user id
+	token, code := loginAs(t, router, "omar", "long enough")
+	require.Equal(t, http.StatusOK, code)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"id":"`+created.ID+`","username":"omar","role":"writer","scopes":["blobs:read","blobs:write"]}`, rec.Body.String())
+	rec = serve(router, "GET", "/v1/admin/users", nil, bearer(token))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// disabling locks out existing tokens too
+	rec = serve(router, "POST", "/v1/admin/users/"+created.ID+"/disable", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(token))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	_, code = loginAs(t, router, "omar", "long enough")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	rec = serve(router, "POST", "/v1/admin/users/"+created.ID+"/enable", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "POST", "/v1/admin/users/"+created.ID+"/password", []byte(`{"password":"a new password"}`), bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	_, code = loginAs(t, router, "omar", "long enough")
+	require.Equal(t, http.StatusUnauthorized, code)
+	_, code = loginAs(t, router, "omar", "a new password")
+	require.Equal(t, http.StatusOK, code)
+
+	rec = serve(router, "POST", "/v1/admin/users/nobody/disable", nil, bearer(adminToken))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(adminToken))
+	var me struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &me))
+	rec = serve(router, "POST", "/v1/admin/users/"+me.ID+"/disable", nil, bearer(adminToken))
+	require.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestScopes(t *testing.T) {
+	admin := auth.RoleScopes(auth.RoleAdmin)
+	require.True(t, auth.HasScope(admin, auth.ScopeAdminUsers))
+	require.True(t, auth.HasScope(admin, auth.ScopeAdmin))
+	require.False(t, auth.HasScope([]string{auth.ScopeAdminUsers}, auth.ScopeAdmin))
+	require.False(t, auth.HasScope([]string{"admin*"}, "admin:users"))
+	require.False(t, auth.HasScope(auth.RoleScopes(auth.RoleReader), auth.ScopeBlobsWrite))
+	require.Empty(t, auth.RoleScopes("root"))
+
+	require.Equal(t, []string{auth.ScopeBlobsRead}, auth.Narrow(admin, auth.RoleScopes(auth.RoleReader)))
+	require.Equal(t, []string{auth.ScopeBlobsRead, auth.ScopeAdminUsers}, auth.Narrow([]string{auth.ScopeBlobsRead, auth.ScopeAdminUsers}, admin))
+}
+
+func TestAuth_Roles(t *testing.T) {
+	router, _ := newAuthRouter(t)
+	adminToken, _ := loginAs(t, router, "admin", "admin password")
+
+	rec := serve(router, "POST", "/v1/admin/users", []byte(`{"username":"rana","password":"long enough","role":"root"}`), bearer(adminToken))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(router, "POST", "/v1/admin/users", []byte(`{"username":"rana","password":"long enough","role":"reader"}`), bearer(adminToken))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created struct {
+		ID string `json:"id"`
+		Role string `json:"role"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	require.Equal(t, auth.RoleReader, created.Role)
+
+	reader, _ := loginAs(t, router, "rana", "long enough")
+	rec = serve(router, "GET", "/v1/blobs", nil, bearer(reader))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "PUT", "/v1/blobs/a.txt", []byte("a"), bearer(reader))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), auth.ScopeBlobsWrite)
+	rec = serve(router, "GET", "/v1/admin/roles", nil, bearer(reader))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = serve(router, "GET", "/v1/admin/roles", nil, bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `{"role":"reader","scopes":["blobs:read"]}`)
+
+	// a promotion needs a new token, the old one keeps the scopes it was issued with
+	rec = serve(router, "PUT", "/v1/admin/users/"+created.ID+"/role", []byte(`{"role":"writer"}`), bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = serve(router, "PUT", "/v1/blobs/a.txt", []byte("a"), bearer(reader))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	writer, _ := loginAs(t, router, "rana", "long enough")
+	rec = serve(router, "PUT", "/v1/blobs/a.txt", []byte("a"), bearer(writer))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// a demotion applies to tokens already out there
+	rec = serve(router, "PUT", "/v1/admin/users/"+created.ID+"/role", []byte(`{"role":"reader"}`), bearer(adminToken))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "PUT", "/v1/blobs/a.txt", []byte("b"), bearer(writer))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(writer))
+	require.JSONEq(t, `{"id":"`+created.ID+`","username":"rana","role":"writer","scopes":["blobs:read"]}`, rec.Body.String())
+
+	rec = serve(router, "PUT", "/v1/admin/users/"+created.ID+"/role", []byte(`{"role":"root"}`), bearer(adminToken))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(router, "PUT", "/v1/admin/users/nobody/role", []byte(`{"role":"reader"}`), bearer(adminToken))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serve(router, "GET", "/v1/whoami", nil, bearer(adminToken))
+	var me struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &me))
+	rec = serve(router, "PUT", "/v1/admin/users/"+me.ID+"/role", []byte(`{"role":"reader"}`), bearer(adminToken))
+	require.Equal(t, http.StatusConflict, rec.Code)
+}
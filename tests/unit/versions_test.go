@@ -0,0 +1,112 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"rekazdrive/internal/handlers"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+type versionList struct {
+	Items []struct {
+		VersionID string `json:"version_id"`
+		Size int64 `json:"size"`
+		Current bool `json:"current"`
+	} `json:"items"`
+	NextCursor string `json:"next_cursor"`
+}
+
+func listVersions(t *testing.T, router *gin.Engine, path string) versionList {
+	rec := serve(router, "GET", path, nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var list versionList
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	return list
+}
+
+func TestVersioning_OverwriteKeepsHistory(t *testing.T) {
+	router, h := newBlobRouter(t)
+	h.Versioning = handlers.VersioningPolicy{Enabled: true, Prefixes: []string{"docs/"}}
+
+	for _, body := range []string{"one", "two!", "three"} {
+		rec := serve(router, "PUT", "/v1/blobs/docs%2Fa.txt", []byte(body), nil)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	list := listVersions(t, router, "/v1/blobs/docs%2Fa.txt/versions")
+	require.Len(t, list.Items, 3)
+	require.True(t, list.Items[0].Current)
+	require.Equal(t, int64(5), list.Items[0].Size)
+	oldest := list.Items[2].VersionID
+
+	rec := serve(router, "GET", "/v1/blobs/docs%2Fa.txt/versions/"+oldest, nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "one", rec.Body.String())
+	require.Equal(t, `"`+oldest+`"`, rec.Header().Get("ETag"))
+
+	// restore moves the pointer, nothing is copied or dropped
+	rec = serve(router, "POST", "/v1/blobs/docs%2Fa.txt/versions/"+oldest+"/restore", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = serve(router, "GET", "/v1/blobs/docs%2Fa.txt/content", nil, nil)
+	require.Equal(t, "one", rec.Body.String())
+	require.Equal(t, oldest, rec.Header().Get("X-Version-Id"))
+
+	rec = serve(router, "DELETE", "/v1/blobs/docs%2Fa.txt/versions/"+oldest, nil, nil)
+	require.Equal(t, http.StatusConflict, rec.Code)
+	newest := list.Items[0].VersionID
+	rec = serve(router, "DELETE", "/v1/blobs/docs%2Fa.txt/versions/"+newest, nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "GET", "/v1/blobs/docs%2Fa.txt/versions/"+newest, nil, nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// deleting the blob keeps the history, a restore brings it back
+	rec = serve(router, "DELETE", "/v1/blobs/docs%2Fa.txt", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, listVersions(t, router, "/v1/blobs/docs%2Fa.txt/versions").Items, 2)
+	rec = serve(router, "POST", "/v1/blobs/docs%2Fa.txt/versions/"+list.Items[1].VersionID+"/restore", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "GET", "/v1/blobs/docs%2Fa.txt/content", nil, nil)
+	require.Equal(t, "two!", rec.Body.String())
+
+	// internal names never show up as blobs
+	rec = serve(router, "GET", "/v1/blobs", nil, nil)
+	require.NotContains(t, rec.Body.String(), ".versions")
+}
+
+func TestVersioning_OnlyUnderPrefixes(t *testing.T) {
+	router, h := newBlobRouter(t)
+	h.Versioning = handlers.VersioningPolicy{Enabled: true, Prefixes: []string{"docs/"}}
+
+	serve(router, "PUT", "/v1/blobs/tmp%2Fx", []byte("a"), nil)
+	serve(router, "PUT", "/v1/blobs/tmp%2Fx", []byte("b"), nil)
+	require.Empty(t, listVersions(t, router, "/v1/blobs/tmp%2Fx/versions").Items)
+
+	rec := serve(router, "GET", "/v1/blobs/nothing/versions", nil, nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// data uploaded before versioning was turned on becomes the first version
+func TestVersioning_KeepsUnversionedData(t *testing.T) {
+	router, h := newBlobRouter(t)
+	serve(router, "PUT", "/v1/blobs/report", []byte("before"), nil)
+	etag := serve(router, "HEAD", "/v1/blobs/report", nil, nil).Header().Get("ETag")
+
+	h.Versioning = handlers.VersioningPolicy{Enabled: true}
+	list := listVersions(t, router, "/v1/blobs/report/versions")
+	require.Empty(t, list.Items)
+
+	serve(router, "PUT", "/v1/blobs/report", []byte("after"), nil)
+	list = listVersions(t, router, "/v1/blobs/report/versions")
+	require.Len(t, list.Items, 2)
+	rec := serve(router, "GET", "/v1/blobs/report/versions/"+list.Items[1].VersionID, nil, nil)
+	require.Equal(t, "before", rec.Body.String())
+
+	rec = serve(router, "POST", "/v1/blobs/report/versions/"+list.Items[1].VersionID+"/restore", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(router, "GET", "/v1/blobs/report/content", nil, nil)
+	require.Equal(t, "before", rec.Body.String())
+	require.NotEqual(t, etag, rec.Header().Get("ETag")) // restoring is a change of its own
+}